@@ -0,0 +1,104 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+var validCacheArgs = []string{"serve"}
+
+func NewCacheCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"cache serve",
+		abroot.Trans("cache.long"),
+		abroot.Trans("cache.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := cache(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"address",
+			"a",
+			abroot.Trans("cache.addressFlag"),
+			"",
+		))
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"advertise",
+			"",
+			abroot.Trans("cache.advertiseFlag"),
+			false,
+		))
+
+	cmd.Args = cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs)
+	cmd.ValidArgs = validCacheArgs
+	cmd.Example = "abroot cache serve --address 192.168.1.10:5000 --advertise"
+
+	return cmd
+}
+
+func cache(cmd *cobra.Command, args []string) error {
+	switch args[0] {
+	case "serve":
+		address, err := cmd.Flags().GetString("address")
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+
+		advertise, err := cmd.Flags().GetBool("advertise")
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+
+		if address == "" {
+			err = errors.New(abroot.Trans("cache.addressRequired"))
+			cmdr.Error.Println(err)
+			return err
+		}
+
+		if !settings.Cnf.CacheBlobs {
+			err = errors.New(abroot.Trans("cache.blobsNotKept"))
+			cmdr.Error.Println(err)
+			return err
+		}
+
+		cmdr.Info.Printf(abroot.Trans("cache.serving"), address)
+		err = core.ServeCache(address, advertise)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+	default:
+		return errors.New(abroot.Trans("cache.unknownCommand", args[0]))
+	}
+
+	return nil
+}
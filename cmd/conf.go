@@ -45,6 +45,7 @@ func cnf(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	startCommandLog(cmd)
 	result, err := core.ConfEdit()
 	switch result {
 	case core.CONF_CHANGED:
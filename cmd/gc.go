@@ -0,0 +1,106 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"os"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+func NewGCCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"gc",
+		abroot.Trans("gc.long"),
+		abroot.Trans("gc.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := gc(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"dry-run",
+			"d",
+			abroot.Trans("gc.dryRunFlag"),
+			false))
+
+	cmd.Example = "abroot gc"
+
+	return cmd
+}
+
+func gc(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(false) {
+		cmdr.Error.Println(abroot.Trans("gc.rootRequired"))
+		return nil
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	aBsys, err := core.NewABSystem()
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	report, err := aBsys.GarbageCollect(dryRun)
+	if err != nil {
+		if err == core.ErrOperationLocked {
+			cmdr.Error.Println(abroot.Trans("gc.locked"))
+			return err
+		}
+
+		cmdr.Error.Printf(abroot.Trans("gc.failed"), err)
+		return err
+	}
+
+	items := []cmdr.BulletListItem{}
+	for _, category := range report.Categories {
+		items = append(items, cmdr.BulletListItem{
+			Level: 1,
+			Text:  abroot.Trans("gc.category", abroot.Trans("gc.categories."+category.Name), len(category.Items), humanize.Bytes(category.Bytes)),
+		})
+		for _, item := range category.Items {
+			items = append(items, cmdr.BulletListItem{Level: 2, Text: item})
+		}
+	}
+
+	if dryRun {
+		cmdr.Bold.Println(abroot.Trans("gc.dryRunTitle"))
+	} else {
+		cmdr.Bold.Println(abroot.Trans("gc.title"))
+	}
+	cmdr.BulletList.WithItems(items).Render()
+
+	if dryRun {
+		cmdr.Info.Println(abroot.Trans("gc.dryRunTotal", humanize.Bytes(report.TotalBytes())))
+	} else {
+		cmdr.Info.Println(abroot.Trans("gc.total", humanize.Bytes(report.TotalBytes())))
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+func NewHistoryCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"history",
+		abroot.Trans("history.long"),
+		abroot.Trans("history.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := history(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"json",
+			"j",
+			abroot.Trans("history.jsonFlag"),
+			false))
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"operation",
+			"o",
+			abroot.Trans("history.operationFlag"),
+			""))
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"result",
+			"r",
+			abroot.Trans("history.resultFlag"),
+			""))
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"since",
+			"s",
+			abroot.Trans("history.sinceFlag"),
+			""))
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"limit",
+			"n",
+			abroot.Trans("history.limitFlag"),
+			""))
+
+	cmd.Example = "abroot history --operation upgrade --result failed"
+
+	return cmd
+}
+
+func history(cmd *cobra.Command, args []string) error {
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	filter := core.HistoryFilter{}
+
+	filter.Operation, err = cmd.Flags().GetString("operation")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	filter.Result, err = cmd.Flags().GetString("result")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	since, err := cmd.Flags().GetString("since")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	if since != "" {
+		filter.Since, err = time.ParseInLocation(time.DateOnly, since, time.Local)
+		if err != nil {
+			err = fmt.Errorf(abroot.Trans("history.invalidSince"), since)
+			cmdr.Error.Println(err)
+			return err
+		}
+	}
+
+	limit, err := cmd.Flags().GetString("limit")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	if limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 0 {
+			err = fmt.Errorf(abroot.Trans("history.invalidLimit"), limit)
+			cmdr.Error.Println(err)
+			return err
+		}
+	}
+
+	entries, err := core.ReadHistory(filter)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	if jsonFlag {
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if len(entries) == 0 {
+		cmdr.Info.Println(abroot.Trans("history.empty"))
+		return nil
+	}
+
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s  %-14s %-13s", entry.Started.Local().Format(time.DateTime), entry.Operation, entry.Result)
+		if entry.DryRun {
+			line += " " + abroot.Trans("history.dryRun")
+		}
+		fmt.Println(line)
+
+		if entry.ID != "" {
+			fmt.Printf("    %s %s\n", abroot.Trans("history.operationID"), entry.ID)
+		}
+		if entry.Image != "" {
+			fmt.Printf("    %s %s\n", abroot.Trans("history.image"), entry.Image)
+		}
+		if entry.NewDigest != "" && entry.NewDigest != entry.OldDigest {
+			fmt.Printf("    %s %s -> %s\n", abroot.Trans("history.digest"), shortDigest(entry.OldDigest), shortDigest(entry.NewDigest))
+		}
+		if len(entry.PackagesAdded) > 0 {
+			fmt.Printf("    %s %s\n", abroot.Trans("history.packagesAdded"), strings.Join(entry.PackagesAdded, ", "))
+		}
+		if len(entry.PackagesRemoved) > 0 {
+			fmt.Printf("    %s %s\n", abroot.Trans("history.packagesRemoved"), strings.Join(entry.PackagesRemoved, ", "))
+		}
+		if entry.Error != "" {
+			fmt.Printf("    %s %s\n", abroot.Trans("history.error"), entry.Error)
+		}
+	}
+
+	return nil
+}
+
+// shortDigest shortens an image digest to the first 12 characters of its
+// hash, as done by most container tools
+func shortDigest(digest string) string {
+	_, hash, found := strings.Cut(digest, ":")
+	if !found {
+		hash = digest
+	}
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return hash
+}
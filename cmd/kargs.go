@@ -54,6 +54,7 @@ func kargs(cmd *cobra.Command, args []string) error {
 
 	switch args[0] {
 	case "edit":
+		startCommandLog(cmd)
 		changed, err := core.KargsEdit()
 		if err != nil {
 			cmdr.Error.Println(err)
@@ -70,8 +71,10 @@ func kargs(cmd *cobra.Command, args []string) error {
 			cmdr.Error.Println(err)
 			return err
 		}
+		aBsys.Trigger = core.HISTORY_KARGS
 		err = aBsys.RunOperation(core.APPLY, false, false)
 		if err != nil {
+			printOperationReport(err)
 			cmdr.Error.Println(abroot.Trans("pkg.applyFailed"))
 			return err
 		}
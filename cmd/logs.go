@@ -0,0 +1,96 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+func NewLogsCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"logs",
+		abroot.Trans("logs.long"),
+		abroot.Trans("logs.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := logs(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"operation",
+			"o",
+			abroot.Trans("logs.operationFlag"),
+			""))
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"follow",
+			"f",
+			abroot.Trans("logs.followFlag"),
+			false))
+
+	cmd.Example = "abroot logs --follow"
+
+	return cmd
+}
+
+func logs(cmd *cobra.Command, args []string) error {
+	operationID, err := cmd.Flags().GetString("operation")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	follow, err := cmd.Flags().GetBool("follow")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	opLog, err := core.GetOperationLog(operationID)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	cmdr.Info.Printf(abroot.Trans("logs.header"), opLog.ID, opLog.Started.Format(time.DateTime))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = core.ReadOperationLog(ctx, opLog, follow, func(record core.LogRecord) {
+		fmt.Println(record.String())
+	})
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+func NewMetricsCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"metrics",
+		abroot.Trans("metrics.long"),
+		abroot.Trans("metrics.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := metrics(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"output",
+			"o",
+			abroot.Trans("metrics.outputFlag"),
+			""))
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"listen",
+			"l",
+			abroot.Trans("metrics.listenFlag"),
+			""))
+
+	cmd.Example = "abroot metrics --output /var/lib/prometheus/node-exporter/abroot.prom"
+
+	return cmd
+}
+
+func metrics(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(false) {
+		cmdr.Error.Println(abroot.Trans("metrics.rootRequired"))
+		return nil
+	}
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	listen, err := cmd.Flags().GetString("listen")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	if output != "" && listen != "" {
+		err = errors.New(abroot.Trans("metrics.outputAndListen"))
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	aBsys, err := core.NewABSystem()
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	collector := core.NewMetricsCollector(aBsys)
+
+	switch {
+	case listen != "":
+		cmdr.Info.Printf(abroot.Trans("metrics.serving"), listen)
+		err = core.ServeMetrics(listen, collector)
+	case output != "":
+		err = collector.WriteMetricsFile(output)
+	default:
+		err = core.WriteMetrics(os.Stdout, collector.Collect())
+	}
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	return nil
+}
@@ -14,11 +14,9 @@ package cmd
 */
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"slices"
-	"strings"
-	"syscall"
 
 	"github.com/spf13/cobra"
 
@@ -60,6 +58,24 @@ func NewMountSysCommand() *cmdr.Command {
 		),
 	)
 
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"generator",
+			"g",
+			"write systemd mount units to the given directory instead of mounting",
+			"",
+		),
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"init",
+			"",
+			"run as the init of the system, starting systemd with the given arguments once done",
+			false,
+		),
+	)
+
 	cmd.Example = "abroot mount-sys"
 
 	cmd.Hidden = true
@@ -77,7 +93,7 @@ func mountSysCmd(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func mountSys(cmd *cobra.Command, _ []string) error {
+func mountSys(cmd *cobra.Command, args []string) error {
 	if !core.RootCheck(false) {
 		cmdr.Error.Println("This operation requires root.")
 		return nil
@@ -88,50 +104,46 @@ func mountSys(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
-	manager := core.NewABRootManager()
-	present, err := manager.GetPresent()
+	generatorDir, err := cmd.Flags().GetString("generator")
 	if err != nil {
 		return err
 	}
 
-	// remount as writeable
-	if !dryRun {
-		err := syscall.Mount("/", "/", "", syscall.MS_REMOUNT, "")
+	asInit, err := cmd.Flags().GetBool("init")
+	if err != nil {
+		return err
+	}
+
+	if generatorDir != "" {
+		manager := core.NewABRootManager()
+		present, err := manager.GetPresent()
 		if err != nil {
-			cmdr.Error.Println("failed to remount root", err)
+			return err
 		}
+		return generateMountUnits(present, manager.VarPartition, generatorDir, dryRun)
 	}
 
-	err = mountVar(manager.VarPartition, dryRun)
-	if err != nil {
-		cmdr.Error.Println(err)
-		os.Exit(5)
-	}
+	log := core.NewBootLogger(os.Stdout)
+	defer log.Close()
 
-	if !dryRun {
-		err = core.RepairRootIntegrity("/")
+	err = earlyBoot(log, dryRun)
+	if asInit {
 		if err != nil {
-			cmdr.Error.Println(err)
-			os.Exit(4)
+			core.EmergencyShell(log, err)
 		}
-	}
 
-	if present.Label == "" {
-		return &PartNotFoundError{"current root"}
-	}
-	err = mountOverlayMounts(present.Label, dryRun)
-	if err != nil {
-		cmdr.Error.Println(err)
-		os.Exit(7)
+		log.Info("starting systemd")
+		err = core.ExecInit(args)
+		core.EmergencyShell(log, fmt.Errorf("could not start %s: %w", core.SystemdPath, err))
 	}
 
-	if present.Uuid == "" {
-		return &PartNotFoundError{"current root"}
+	var bootErr *core.EarlyBootError
+	if errors.As(err, &bootErr) {
+		log.Error("%v", err)
+		os.Exit(bootErr.ExitCode)
 	}
-	err = adjustFstab(present.Uuid, dryRun)
 	if err != nil {
-		cmdr.Error.Println(err)
-		os.Exit(8)
+		return err
 	}
 
 	if dryRun {
@@ -143,126 +155,57 @@ func mountSys(cmd *cobra.Command, _ []string) error {
 	return nil
 }
 
-func mountVar(varPart core.Partition, dryRun bool) error {
-	cmdr.FgDefault.Println("mounting " + varPart.Device + " in /var")
-
-	if varPart.Device == "" {
-		return &PartNotFoundError{settings.Cnf.PartLabelVar}
-	}
-
-	if !dryRun {
-		err := varPart.Mount("/var")
-		if err != nil {
-			return err
+// earlyBoot finds the booted root and the /var partition, then performs the
+// early boot mounts. Since lsblk may not work this early, the partitions are
+// looked up natively if ABRootManager can't find them.
+func earlyBoot(log *core.BootLogger, dryRun bool) error {
+	manager := core.NewABRootManager()
+	present, err := manager.GetPresent()
+	varPart := manager.VarPartition
+	if err != nil || present.Partition.Uuid == "" || varPart.Device == "" {
+		log.Warn("could not list the partitions, looking them up in /dev/disk")
+
+		foundRoot, foundVar, findErr := core.FindBootPartitions("/", "/proc/self/mountinfo")
+		if findErr == nil {
+			present, varPart = foundRoot, foundVar
+		} else if err != nil {
+			return &PartNotFoundError{"current root"}
 		}
 	}
 
-	return nil
-}
+	b := core.NewEarlyBoot(present, varPart, log)
+	b.DryRun = dryRun
 
-func mountOverlayMounts(rootLabel string, dryRun bool) error {
-	type overlayMount struct {
-		destination       string
-		lowerdirs         []string
-		upperdir, workdir string
-	}
+	return b.Run()
+}
 
-	overlays := []overlayMount{
-		{"/etc", []string{"/etc"}, "/var/lib/abroot/etc/" + rootLabel, "/var/lib/abroot/etc/" + rootLabel + "-work"},
+// generateMountUnits works as a systemd generator, writing mount units for
+// the root, /var, the overlays and the bind mounts, so that the fstab of the
+// root never needs to be modified at runtime
+func generateMountUnits(present core.ABRootPartition, varPart core.Partition, dir string, dryRun bool) error {
+	if present.Label == "" {
+		return &PartNotFoundError{"current root"}
 	}
-
-	for _, overlay := range overlays {
-		if _, err := os.Lstat(overlay.workdir); os.IsNotExist(err) {
-			err := os.MkdirAll(overlay.workdir, 0o755)
-			cmdr.Warning.Println(err)
-			// failing the boot here won't help so ingore any error
-		}
-
-		lowerCombined := strings.Join(overlay.lowerdirs, ":")
-		options := "lowerdir=" + lowerCombined + ",upperdir=" + overlay.upperdir + ",workdir=" + overlay.workdir
-
-		cmdr.FgDefault.Println("mounting overlay mount " + overlay.destination + " with options " + options)
-
-		if !dryRun {
-			err := syscall.Mount("overlay", overlay.destination, "overlay", 0, options)
-			if err != nil {
-				return err
-			}
-		}
+	if varPart.Device == "" {
+		return &PartNotFoundError{settings.Cnf.PartLabelVar}
 	}
 
-	return nil
-}
-
-func adjustFstab(uuid string, dryRun bool) error {
-	cmdr.FgDefault.Println("switching the root in fstab")
-
-	const fstabFile = "/etc/fstab"
-	systemMounts := []string{"/", "/var", "/usr", "/etc"}
-	varBindMounts := []string{"/home", "/media", "/mnt", "/root"}
-
-	fstabContentsRaw, err := os.ReadFile(fstabFile)
+	units, err := core.GenerateMountUnits(present, varPart)
 	if err != nil {
 		return err
 	}
 
-	fstabContents := string(fstabContentsRaw)
-
-	lines := strings.Split(fstabContents, "\n")
-
-	linesNew := make([]string, 0, len(lines))
-
-	for _, line := range lines {
-
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") {
-			linesNew = append(linesNew, line)
-			continue
+	for _, unit := range units {
+		cmdr.FgDefault.Println("generating " + unit.Name() + " for " + unit.Where)
+		if dryRun {
+			cmdr.FgDefault.Println(unit.Contents())
 		}
-
-		words := strings.Fields(line)
-		if len(words) < 2 {
-			linesNew = append(linesNew, line)
-			continue
-		}
-
-		mountpoint := words[1]
-		varBindMountLine := fmt.Sprintf("/var%s %s none defaults,bind 0 0", mountpoint, mountpoint)
-
-		if slices.Contains(systemMounts, mountpoint) || (slices.Contains(varBindMounts, mountpoint) && line == varBindMountLine) {
-			cmdr.FgDefault.Println("Deleting line: ", line)
-			continue
-		}
-
-		linesNew = append(linesNew, line)
 	}
 
-	currentRootLine := "UUID=" + uuid + " / btrfs ro,defaults 0 0"
-
-	cmdr.FgDefault.Println("Adding line: ", currentRootLine)
-
-	linesNew = append([]string{currentRootLine}, linesNew...)
-
-	newFstabContents := strings.Join(linesNew, "\n")
-
-	newFstabFile := fstabFile + ".new"
-
-	if !dryRun {
-		cmdr.FgDefault.Println("writing new fstab file")
-		err := os.WriteFile(newFstabFile, []byte(newFstabContents), 0o644)
-		if err != nil {
-			return err
-		}
-		err = core.AtomicSwap(fstabFile, newFstabFile)
-		if err != nil {
-			return err
-		}
-		err = os.Rename(newFstabFile, fstabFile+".old")
-		if err != nil {
-			cmdr.Warning.Println("Old Fstab file will keep .new suffix")
-			// ignore, backup is not neccessary to boot
-		}
+	if dryRun {
+		cmdr.Info.Println("Dry run complete.")
+		return nil
 	}
 
-	return nil
+	return core.WriteMountUnits(units, dir)
 }
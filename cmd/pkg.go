@@ -69,6 +69,13 @@ func NewPkgCommand() *cmdr.Command {
 			abroot.Trans("upgrade.deleteOld"),
 			false))
 
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"limit-rate",
+			"",
+			abroot.Trans("pkg.limitRateFlag"),
+			""))
+
 	cmd.Args = cobra.MinimumNArgs(1)
 	cmd.ValidArgs = validPkgArgs
 	cmd.Example = "abroot pkg add <pkg>"
@@ -106,6 +113,17 @@ func pkg(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	limitRate, err := cmd.Flags().GetString("limit-rate")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	_, err = core.ParseRateLimit(limitRate)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
 	pkgM, err := core.NewPackageManager(false)
 	if err != nil {
 		cmdr.Error.Println(abroot.Trans("pkg.failedGettingPkgManagerInstance", err))
@@ -151,6 +169,7 @@ func pkg(cmd *cobra.Command, args []string) error {
 		if len(args) < 2 {
 			return errors.New(abroot.Trans("pkg.noPackageNameProvided"))
 		}
+		startCommandLog(cmd)
 		for _, pkg := range args[1:] {
 			err := pkgM.Add(pkg)
 			if err != nil {
@@ -163,6 +182,7 @@ func pkg(cmd *cobra.Command, args []string) error {
 		if len(args) < 2 {
 			return errors.New(abroot.Trans("pkg.noPackageNameProvided"))
 		}
+		startCommandLog(cmd)
 		for _, pkg := range args[1:] {
 			err := pkgM.Remove(pkg)
 			if err != nil {
@@ -203,10 +223,13 @@ func pkg(cmd *cobra.Command, args []string) error {
 			cmdr.Error.Println(err)
 			return err
 		}
+		aBsys.DownloadRateLimit = limitRate
 
 		err = aBsys.RunOperation(core.APPLY, deleteOldSystem, dryRun)
 		if err != nil {
-			cmdr.Error.Printf(abroot.Trans("pkg.applyFailed"), err)
+			if !printOperationReport(err) {
+				cmdr.Error.Printf(abroot.Trans("pkg.applyFailed"), err)
+			}
 			return err
 		}
 		cmdr.Info.Println(abroot.Trans("pkg.applySuccess"))
@@ -50,13 +50,21 @@ func NewRebaseCommand() *cmdr.Command {
 			false,
 		))
 
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"limit-rate",
+			"",
+			abroot.Trans("rebase.limitRateFlag"),
+			"",
+		))
+
 	cmd.Args = cobra.ExactArgs(1)
 	cmd.Example = "abroot rebase ghcr.io/vanilla-os/desktop:main"
 
 	return cmd
 }
 
-func rebase(cmd *cobra.Command, args []string) error {
+func rebase(cmd *cobra.Command, args []string) (err error) {
 
 	if !core.RootCheck(false) {
 		cmdr.Error.Println(abroot.Trans("rebase.rootRequired"))
@@ -69,11 +77,6 @@ func rebase(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	if err != nil {
-		cmdr.Error.Println(err)
-		return err
-	}
-
 	removePackages, err := cmd.Flags().GetBool("remove-packages")
 	if err != nil {
 		cmdr.Error.Println(err)
@@ -92,14 +95,78 @@ func rebase(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	rebaseOnly, err := cmd.Flags().GetBool("rebase-only")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	limitRate, err := cmd.Flags().GetString("limit-rate")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	_, err = core.ParseRateLimit(limitRate)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
 	name := args[0]
 	abSys, err := core.NewABSystem()
 	if err != nil {
 		cmdr.Error.Println(err)
 		return err
 	}
+	abSys.DownloadRateLimit = limitRate
+	abSys.Trigger = core.HISTORY_REBASE
+
+	if !dryRun {
+		startCommandLog(cmd)
+	}
+
+	cmdr.Info.Printf(abroot.Trans("rebase.checkingImage"), name)
+	target, err := abSys.Rebase(name)
+	if err != nil {
+		var incompatibleErr *core.ImageIncompatibleError
+		if errors.As(err, &incompatibleErr) {
+			cmdr.Error.Printf(abroot.Trans("rebase.incompatibleImage"), incompatibleErr.Reason)
+			return err
+		}
+
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	// recorded once everything else succeeded or failed
+	defer func() {
+		abSys.FinishRebase(dryRun, err)
+	}()
+
+	cmdr.Info.Printf(
+		abroot.Trans("rebase.imageInfo"),
+		target.FullName(), target.Image.Digest, target.Image.OS, target.Image.Architecture,
+	)
+
+	added, upgraded, downgraded, removed, err := core.BaseImagePackageDiff(abSys.CurImage.Image, abSys.CurImage.Digest, target.FullName(), target.Image.Digest)
+	if err != nil {
+		cmdr.Warning.Println(abroot.Trans("rebase.packageDiffUnavailable"))
+	} else if len(added)+len(upgraded)+len(downgraded)+len(removed) > 0 {
+		cmdr.Info.Println(abroot.Trans("rebase.packageDiff"))
+		err = renderPackageDiff(added, upgraded, downgraded, removed)
+		if err != nil {
+			return err
+		}
+	}
+
+	// set once the rebase is complete, see the removal of packages below
+	rebased := false
 
 	pkgM, err := core.NewPackageManager(dryRun)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
 	if pkgM.Status == core.PKG_MNG_ENABLED {
 		var removePackagesPrompt string
 		if !keepPackages && !removePackages {
@@ -118,27 +185,57 @@ func rebase(cmd *cobra.Command, args []string) error {
 				for _, v := range addedPackages {
 					pkgM.Remove(v)
 				}
+
+				// the packages are kept if the rebase fails, so that the
+				// system is left as it was
+				defer func() {
+					if !rebased {
+						restoreErr := pkgM.RestoreAddPackages(addedPackages)
+						if restoreErr != nil {
+							cmdr.Warning.Println(restoreErr)
+						}
+					}
+				}()
 			}
 			cmdr.Info.Println(abroot.Trans("rebase.pkgRemoveSuccess"))
 		}
 	}
 
-	err = abSys.Rebase(name, dryRun)
-	if err != nil {
-		cmdr.Error.Println(err)
+	if rebaseOnly {
+		err = abSys.CommitRebase(dryRun)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+
+		rebased = true
+		cmdr.Info.Println(abroot.Trans("rebase.success"))
+		return nil
+	}
+
+	// the configuration is only committed by the operation, right before
+	// syncing /etc, so that a failed rebase leaves the system on the old image
+	cmdr.Info.Println(abroot.Trans("rebase.deploying"))
+	err = abSys.RunOperation(core.UPGRADE, false, dryRun)
+	if err != nil && err != core.ErrNoUpdate {
+		if !printOperationReport(err) {
+			cmdr.Error.Println(err)
+		}
+		cmdr.Error.Println(abroot.Trans("rebase.deployFailed"))
 		return err
 	}
 
-	rebaseOnly, err := cmd.Flags().GetBool("rebase-only")
+	err = abSys.CommitRebase(dryRun)
 	if err != nil {
 		cmdr.Error.Println(err)
 		return err
 	}
-	if rebaseOnly {
-		cmdr.Info.Println(abroot.Trans("rebase.success"))
-		return nil
-	}
 
+	rebased = true
+
+	if dryRun {
+		cmdr.Info.Println(abroot.Trans("rebase.dryRunSuccess"))
+	}
 	cmdr.Info.Println(abroot.Trans("rebase.successUpdate"))
-	return abSys.RunOperation("UPGRADE", false, dryRun)
+	return nil
 }
@@ -15,7 +15,11 @@ package cmd
 
 import (
 	"embed"
+	"os"
 
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
 	"github.com/vanilla-os/orchid/cmdr"
 )
 
@@ -46,3 +50,18 @@ func NewRootCommand(version string) *cmdr.Command {
 
 	return root
 }
+
+// startCommandLog starts the operation log of a command about to change
+// the system, so that everything it does is logged, even if it fails before
+// starting an operation. Commands only reading the system don't call it,
+// and operations start their own log.
+func startCommandLog(cmd *cobra.Command) {
+	if os.Geteuid() != 0 {
+		return
+	}
+
+	_, err := core.StartOperationLog(cmd.CommandPath())
+	if err != nil {
+		core.PrintVerboseWarn("startCommandLog", 0, "could not start the log:", err)
+	}
+}
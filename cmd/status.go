@@ -14,13 +14,9 @@ package cmd
 */
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -59,6 +55,20 @@ func NewStatusCommand() *cmdr.Command {
 			abroot.Trans("status.dumpFlag"),
 			false))
 
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"no-redact",
+			"",
+			abroot.Trans("status.noRedactFlag"),
+			false))
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"check-update",
+			"",
+			abroot.Trans("status.checkUpdateFlag"),
+			false))
+
 	cmd.Example = "abroot status"
 
 	return cmd
@@ -80,22 +90,33 @@ func status(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	a := core.NewABRootManager()
-	present, err := a.GetPresent()
+	noRedactFlag, err := cmd.Flags().GetBool("no-redact")
 	if err != nil {
 		return err
 	}
 
-	future, err := a.GetFuture()
+	checkUpdateFlag, err := cmd.Flags().GetBool("check-update")
 	if err != nil {
 		return err
 	}
 
-	specs := core.GetPCSpecs()
-	abImage, err := core.NewABImageFromRoot()
+	aBsys, err := core.NewABSystem()
 	if err != nil {
 		return err
 	}
+	a := aBsys.RootM
+	present, err := a.GetPresent()
+	if err != nil {
+		return err
+	}
+
+	future, err := a.GetFuture()
+	if err != nil {
+		return err
+	}
+
+	specs := core.GetPCSpecs()
+	abImage := aBsys.CurImage
 
 	kargs, err := core.KargsRead()
 	if err != nil {
@@ -125,25 +146,102 @@ func status(cmd *cobra.Command, args []string) error {
 	}
 	pkgsUnstg := append(unstagedAdded, unstagedRemoved...)
 
+	var thinPool *core.ThinPoolUsage
+	if settings.Cnf.StorageBackend == core.STORAGE_LVM_THIN {
+		usage, err := core.GetThinPoolUsage()
+		if err != nil {
+			return err
+		}
+		thinPool = &usage
+	}
+
 	if jsonFlag || dumpFlag {
+		type updateStatus struct {
+			// Available is only set when the registry was checked
+			Available *bool `json:"available,omitempty"`
+
+			// Staged is true once an update was deployed to the future
+			// root, until the next boot
+			Staged bool `json:"staged"`
+
+			PendingPackages bool `json:"pendingPackages"`
+		}
+
 		type status struct {
-			Present         string       `json:"present"`
-			Future          string       `json:"future"`
-			CPU             string       `json:"cpu"`
-			GPU             []string     `json:"gpu"`
-			Memory          string       `json:"memory"`
-			ABImage         core.ABImage `json:"abimage"`
-			Kargs           string       `json:"kargs"`
-			PkgsAdd         []string     `json:"pkgsAdd"`
-			PkgsRm          []string     `json:"pkgsRm"`
-			PkgsUnstg       []string     `json:"pkgsUnstg"`
-			PkgMngStatus    int          `json:"pkgMngStatus"`
-			PkgMngAgreement bool         `json:"pkgMngAg"`
+			SchemaVersion   int                     `json:"schemaVersion"`
+			Present         string                  `json:"present"`
+			Future          string                  `json:"future"`
+			Booted          string                  `json:"booted"`
+			NextBoot        string                  `json:"nextBoot"`
+			CPU             string                  `json:"cpu"`
+			GPU             []string                `json:"gpu"`
+			Memory          string                  `json:"memory"`
+			ABImage         core.ABImage            `json:"abimage"`
+			Kargs           string                  `json:"kargs"`
+			PkgsAdd         []string                `json:"pkgsAdd"`
+			PkgsRm          []string                `json:"pkgsRm"`
+			PkgsUnstg       []string                `json:"pkgsUnstg"`
+			PkgMngStatus    int                     `json:"pkgMngStatus"`
+			PkgMngAgreement bool                    `json:"pkgMngAg"`
+			ThinPool        *core.ThinPoolUsage     `json:"thinPool,omitempty"`
+			Operation       core.OperationState     `json:"operation"`
+			Update          updateStatus            `json:"update"`
+			Partitions      []core.PartitionUsage   `json:"partitions"`
+			EtcOverlay      core.EtcOverlayState    `json:"etcOverlay"`
+			VarEncryption   core.VarEncryptionState `json:"varEncryption"`
+			LastOperation   *core.HistoryEntry      `json:"lastOperation"`
+		}
+
+		nextBoot, err := a.GetNextBoot()
+		if err != nil {
+			return err
+		}
+
+		operationState := aBsys.GetOperationState()
+
+		update := updateStatus{
+			Staged:          operationState.Finished,
+			PendingPackages: len(pkgsUnstg) > 0,
+		}
+		if checkUpdateFlag {
+			_, available, err := aBsys.CheckUpdate()
+			if err != nil {
+				return err
+			}
+			update.Available = &available
+		}
+
+		partitions := []core.PartitionUsage{}
+		partBoot, err := a.GetBoot()
+		if err != nil {
+			return err
+		}
+		for _, part := range []core.Partition{present.Partition, future.Partition, partBoot, a.VarPartition} {
+			if part.Device == "" {
+				continue
+			}
+			// the size is always reported, the used and free space of a
+			// filesystem which is not mounted may be unknown
+			usage, _ := part.Usage()
+			partitions = append(partitions, usage)
+		}
+
+		etcOverlay, err := core.GetEtcOverlayState()
+		if err != nil {
+			return err
+		}
+
+		lastOperation, err := core.GetLastOperation()
+		if err != nil {
+			return err
 		}
 
 		s := status{
+			SchemaVersion:   core.StatusSchemaVersion,
 			Present:         present.Label,
 			Future:          future.Label,
+			Booted:          present.Label,
+			NextBoot:        nextBoot.Label,
 			CPU:             specs.CPU,
 			GPU:             specs.GPU,
 			Memory:          specs.Memory,
@@ -154,6 +252,13 @@ func status(cmd *cobra.Command, args []string) error {
 			PkgsUnstg:       pkgsUnstg,
 			PkgMngStatus:    settings.Cnf.IPkgMngStatus,
 			PkgMngAgreement: pkgMngAgreementStatus,
+			ThinPool:        thinPool,
+			Operation:       operationState,
+			Update:          update,
+			Partitions:      partitions,
+			EtcOverlay:      etcOverlay,
+			VarEncryption:   core.GetVarEncryptionState(a.VarPartition),
+			LastOperation:   lastOperation,
 		}
 
 		b, err := json.Marshal(s)
@@ -166,60 +271,32 @@ func status(cmd *cobra.Command, args []string) error {
 			return nil
 		}
 
+		var redactor *core.Redactor
+		if !noRedactFlag {
+			redactor, err = core.NewSystemRedactor(settings.Cnf.DumpRedact)
+			if err != nil {
+				return err
+			}
+		}
+
 		tarballPath := fmt.Sprintf("/tmp/abroot-status-%s.tar.gz", uuid.New().String())
-		tarballFile, err := os.Create(tarballPath)
+		bundle, err := core.NewDiagnosticBundle(tarballPath, redactor)
 		if err != nil {
 			return err
 		}
-		defer tarballFile.Close()
-
-		gzipWriter := gzip.NewWriter(tarballFile)
-		defer gzipWriter.Close()
-
-		tarWriter := tar.NewWriter(gzipWriter)
-		defer tarWriter.Close()
+		defer bundle.Close()
 
-		tarHeader := &tar.Header{
-			Name: "status.json",
-			Mode: 0o644,
-			Size: int64(len(b)),
-		}
-		err = tarWriter.WriteHeader(tarHeader)
+		err = bundle.AddData("status.json", "abroot status --json", b)
 		if err != nil {
 			return err
 		}
-		_, err = tarWriter.Write(b)
+
+		err = aBsys.CollectDiagnostics(bundle)
 		if err != nil {
 			return err
 		}
 
-		err = filepath.Walk("/var/log/", func(path string, info os.FileInfo, err error) error {
-			if strings.Contains(path, "abroot.log") {
-				relPath, err := filepath.Rel("/var/log/", path)
-				if err != nil {
-					return err
-				}
-				tarHeader := &tar.Header{
-					Name: filepath.Join("logs", relPath),
-					Mode: 0o644,
-					Size: info.Size(),
-				}
-				err = tarWriter.WriteHeader(tarHeader)
-				if err != nil {
-					return err
-				}
-				logFile, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer logFile.Close()
-				_, err = io.Copy(tarWriter, logFile)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
+		err = bundle.Close()
 		if err != nil {
 			return err
 		}
@@ -250,6 +327,16 @@ func status(cmd *cobra.Command, args []string) error {
 		{Level: 1, Text: abroot.Trans("status.partitions.future", future.Label, futureMark)},
 	}).Render()
 
+	// Thin Pool:
+	if thinPool != nil {
+		cmdr.Bold.Println(abroot.Trans("status.thinPool.title"))
+		cmdr.BulletList.WithItems([]cmdr.BulletListItem{
+			{Level: 1, Text: abroot.Trans("status.thinPool.name", thinPool.VgName+"/"+thinPool.PoolName)},
+			{Level: 1, Text: abroot.Trans("status.thinPool.data", thinPool.DataPercent)},
+			{Level: 1, Text: abroot.Trans("status.thinPool.metadata", thinPool.MetadataPercent)},
+		}).Render()
+	}
+
 	// Device Specification:
 	cmdr.Bold.Println(abroot.Trans("status.specs.title"))
 	cmdr.BulletList.WithItems([]cmdr.BulletListItem{
@@ -260,11 +347,18 @@ func status(cmd *cobra.Command, args []string) error {
 
 	// ABImage:
 	cmdr.Bold.Println(abroot.Trans("status.abimage.title"))
-	cmdr.BulletList.WithItems([]cmdr.BulletListItem{
+	abImageItems := []cmdr.BulletListItem{
 		{Level: 1, Text: abroot.Trans("status.abimage.digest", abImage.Digest)},
 		{Level: 1, Text: abroot.Trans("status.abimage.timestamp", abImage.Timestamp.Format("2006-01-02 15:04:05"))},
 		{Level: 1, Text: abroot.Trans("status.abimage.image", abImage.Image)},
-	}).Render()
+	}
+	if abImage.IndexDigest != "" {
+		abImageItems = append(abImageItems,
+			cmdr.BulletListItem{Level: 1, Text: abroot.Trans("status.abimage.indexDigest", abImage.IndexDigest)},
+			cmdr.BulletListItem{Level: 1, Text: abroot.Trans("status.abimage.platform", abImage.Platform)},
+		)
+	}
+	cmdr.BulletList.WithItems(abImageItems).Render()
 
 	// Kernel Arguments: ...
 	cmdr.Bold.Printf(abroot.Trans("status.kargs") + " ")
@@ -287,33 +381,14 @@ func status(cmd *cobra.Command, args []string) error {
 }
 
 func getCurrentlyBootedPartition(a *core.ABRootManager) (string, string, error) {
-	bootPart, err := a.GetBoot()
-	if err != nil {
-		return "", "", err
-	}
-	tmpBootMount := "/run/abroot/tmp-boot-mount-status/"
-	err = os.MkdirAll(tmpBootMount, 0o755)
-	if err != nil {
-		return "", "", err
-	}
-	err = bootPart.Mount(tmpBootMount)
-	if err != nil {
-		return "", "", err
-	}
-	defer bootPart.Unmount()
-
-	g, err := core.NewGrub(bootPart)
-	if err != nil {
-		return "", "", err
-	}
-	isPresent, err := g.IsBootedIntoPresentRoot()
+	nextBoot, err := a.GetNextBoot()
 	if err != nil {
 		return "", "", err
 	}
 
 	presentMark := ""
 	futureMark := ""
-	if isPresent {
+	if nextBoot.IdentifiedAs == "present" {
 		presentMark = " ✓"
 	} else {
 		futureMark = " ✓"
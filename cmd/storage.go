@@ -0,0 +1,172 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+var validStorageArgs = []string{"plan", "resize"}
+
+func NewStorageCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"storage plan|resize",
+		abroot.Trans("storage.long"),
+		abroot.Trans("storage.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := storage(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"json",
+			"j",
+			abroot.Trans("storage.jsonFlag"),
+			false,
+		),
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"dry-run",
+			"d",
+			abroot.Trans("storage.dryRunFlag"),
+			false,
+		),
+	)
+
+	cmd.Args = cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs)
+	cmd.ValidArgs = validStorageArgs
+	cmd.Example = "abroot storage plan"
+
+	return cmd
+}
+
+func storage(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(false) {
+		cmdr.Error.Println(abroot.Trans("storage.rootRequired"))
+		return nil
+	}
+
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	aBsys, err := core.NewABSystem()
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	plan, err := core.PlanStorage(aBsys.RootM, settings.GetFullImageNameWithTag())
+	if err != nil {
+		cmdr.Error.Printf(abroot.Trans("storage.planFailed"), err)
+		return err
+	}
+
+	if jsonFlag {
+		out, err := core.MarshalStoragePlan(plan)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	cmdr.Info.Printf(abroot.Trans("storage.imageSize"), plan.Image, humanize.IBytes(plan.ImageSize), humanize.IBytes(plan.RootSize))
+	cmdr.FgDefault.Println(plan.String())
+
+	switch args[0] {
+	case "plan":
+		if !plan.NeedsResize() {
+			cmdr.Info.Println(abroot.Trans("storage.noResizeNeeded"))
+			return nil
+		}
+		if !plan.Feasible {
+			cmdr.Warning.Println(abroot.Trans("storage.notFeasible"))
+			return nil
+		}
+		cmdr.Info.Println(abroot.Trans("storage.runResize"))
+	case "resize":
+		if !dryRun {
+			startCommandLog(cmd)
+		}
+		return resizeStorage(aBsys, plan, dryRun)
+	default:
+		return errors.New(abroot.Trans("storage.unknownCommand", args[0]))
+	}
+
+	return nil
+}
+
+// resizeStorage grows the future root as proposed by the plan, then tells
+// whether the present root has to be grown after rebooting
+func resizeStorage(aBsys *core.ABSystem, plan *core.StoragePlan, dryRun bool) error {
+	future := plan.Volume("future")
+	present := plan.Volume("present")
+
+	if future != nil && future.Proposed > future.Size {
+		cmdr.Info.Printf(abroot.Trans("storage.resizing"), future.Label, humanize.IBytes(future.Proposed))
+		err := aBsys.ResizeFutureRoot(plan, dryRun)
+		if err != nil {
+			if err == core.ErrOperationLocked {
+				cmdr.Error.Println(abroot.Trans("storage.locked"))
+				return err
+			}
+			if errors.Is(err, core.ErrVarShrinkScheduled) {
+				cmdr.Info.Println(abroot.Trans("storage.varShrinkScheduled"))
+				return nil
+			}
+
+			cmdr.Error.Printf(abroot.Trans("storage.resizeFailed"), err)
+			return err
+		}
+		if dryRun {
+			cmdr.Info.Println(abroot.Trans("storage.dryRunComplete"))
+			return nil
+		}
+		cmdr.Info.Println(abroot.Trans("storage.resized"))
+	} else {
+		cmdr.Info.Println(abroot.Trans("storage.futureLargeEnough"))
+	}
+
+	if present != nil && present.Proposed > present.Size {
+		cmdr.Info.Printf(abroot.Trans("storage.rebootAndRepeat"), present.Label)
+	}
+
+	return nil
+}
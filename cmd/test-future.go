@@ -0,0 +1,150 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+func NewTestFutureCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"test-future",
+		abroot.Trans("testFuture.long"),
+		abroot.Trans("testFuture.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := testFuture(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"shell",
+			"s",
+			abroot.Trans("testFuture.shellFlag"),
+			false))
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"run",
+			"r",
+			abroot.Trans("testFuture.runFlag"),
+			""))
+
+	cmd.Example = "abroot test-future --run 'apt list --installed'"
+
+	return cmd
+}
+
+func testFuture(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(false) {
+		cmdr.Error.Println(abroot.Trans("testFuture.rootRequired"))
+		return nil
+	}
+
+	shell, err := cmd.Flags().GetBool("shell")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	runCmd, err := cmd.Flags().GetString("run")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	if shell && runCmd != "" {
+		err = errors.New(abroot.Trans("testFuture.shellAndRun"))
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	aBsys, err := core.NewABSystem()
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	env, err := aBsys.NewFutureTestEnv()
+	if err != nil {
+		if err == core.ErrOperationLocked {
+			cmdr.Error.Println(abroot.Trans("testFuture.locked"))
+			return err
+		}
+
+		cmdr.Error.Println(err)
+		return err
+	}
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			cmdr.Warning.Println(err)
+			return
+		}
+		cmdr.Info.Println(abroot.Trans("testFuture.discarded"))
+	}()
+
+	switch {
+	case shell:
+		return env.Shell()
+	case runCmd != "":
+		return env.Run(runCmd)
+	}
+
+	cmdr.Info.Println(abroot.Trans("testFuture.booting"))
+	report, err := env.Boot()
+	if err != nil {
+		if err == core.ErrNspawnUnavailable {
+			cmdr.Error.Println(abroot.Trans("testFuture.nspawnRequired"))
+			return err
+		}
+
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	cmdr.Info.Printf(abroot.Trans("testFuture.state"), report.State)
+	if report.DefaultTargetReached {
+		cmdr.Info.Println(abroot.Trans("testFuture.targetReached"))
+	} else {
+		cmdr.Error.Println(abroot.Trans("testFuture.targetNotReached"))
+	}
+
+	if len(report.FailedUnits) == 0 {
+		cmdr.Info.Println(abroot.Trans("testFuture.noFailedUnits"))
+	} else {
+		cmdr.Warning.Println(abroot.Trans("testFuture.failedUnits"))
+		items := []cmdr.BulletListItem{}
+		for _, unit := range report.FailedUnits {
+			items = append(items, cmdr.BulletListItem{Level: 1, Text: unit})
+		}
+		cmdr.BulletList.WithItems(items).Render()
+	}
+
+	if !report.DefaultTargetReached || len(report.FailedUnits) > 0 {
+		return errors.New(abroot.Trans("testFuture.failed"))
+	}
+
+	return nil
+}
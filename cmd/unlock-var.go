@@ -76,6 +76,15 @@ func NewUnlockVarCommand() *cmdr.Command {
 		),
 	)
 
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"tpm2",
+			"t",
+			"unlock with the key sealed in the TPM2, falling back to a FIDO2 security key and the passphrase",
+			false,
+		),
+	)
+
 	cmd.Example = "abroot unlock-var"
 
 	cmd.Hidden = true
@@ -135,6 +144,11 @@ func unlockVar(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
+	tpm2, err := cmd.Flags().GetBool("tpm2")
+	if err != nil {
+		return err
+	}
+
 	partitions, err := core.NewDiskManager().GetPartitions("")
 	if err != nil {
 		return err
@@ -165,17 +179,57 @@ func unlockVar(cmd *cobra.Command, _ []string) error {
 
 	if dryRun {
 		cmdr.Info.Println("Dry run complete.")
-	} else {
-		cryptsetupCmd := exec.Command("/usr/sbin/cryptsetup", "luksOpen", varDisk, "luks-"+uuid)
-		cryptsetupCmd.Stdin = os.Stdin
-		cryptsetupCmd.Stderr = os.Stderr
-		cryptsetupCmd.Stdout = os.Stdout
-		err := cryptsetupCmd.Run()
-		if err != nil {
-			return err
+		return nil
+	}
+
+	if tpm2 {
+		err := core.UnlockVarTPM2(varDisk, "luks-"+uuid)
+		if err == nil {
+			warnVarEncryptionInProgress(varDisk)
+			cmdr.Info.Println("The var partition has been unlocked with the TPM2.")
+			return nil
 		}
-		cmdr.Info.Println("The system mounts have been performed successfully.")
+		cmdr.Warning.Println(err)
 	}
 
+	hasFido2, err := core.HasVarKeyslot(varDisk, core.KEYSLOT_FIDO2)
+	if err != nil {
+		cmdr.Warning.Println(err)
+	}
+	if hasFido2 {
+		cmdr.FgDefault.Println("touch the FIDO2 security key to unlock", varDisk)
+		err := core.UnlockVarFIDO2(varDisk, "luks-"+uuid)
+		if err == nil {
+			warnVarEncryptionInProgress(varDisk)
+			cmdr.Info.Println("The var partition has been unlocked with the FIDO2 security key.")
+			return nil
+		}
+		cmdr.Warning.Println(err)
+	}
+
+	if tpm2 || hasFido2 {
+		cmdr.FgDefault.Println("falling back to the passphrase")
+	}
+
+	cryptsetupCmd := exec.Command("/usr/sbin/cryptsetup", "luksOpen", varDisk, "luks-"+uuid)
+	cryptsetupCmd.Stdin = os.Stdin
+	cryptsetupCmd.Stderr = os.Stderr
+	cryptsetupCmd.Stdout = os.Stdout
+	err = cryptsetupCmd.Run()
+	if err != nil {
+		return err
+	}
+	warnVarEncryptionInProgress(varDisk)
+	cmdr.Info.Println("The system mounts have been performed successfully.")
+
 	return nil
 }
+
+// warnVarEncryptionInProgress reminds to resume an interrupted encryption
+// of the var partition
+func warnVarEncryptionInProgress(varDisk string) {
+	inProgress, err := core.VarReencryptionInProgress(varDisk)
+	if err == nil && inProgress {
+		cmdr.Warning.Println("The encryption of the var partition was interrupted, run 'abroot var-encryption enable' to resume it.")
+	}
+}
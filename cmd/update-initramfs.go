@@ -81,7 +81,9 @@ func updateInitramfs(cmd *cobra.Command, args []string) error {
 
 	err = aBsys.RunOperation(core.INITRAMFS, deleteOldSystem, dryRun)
 	if err != nil {
-		cmdr.Error.Printf(abroot.Trans("updateInitramfs.updateFailed"), err)
+		if !printOperationReport(err) {
+			cmdr.Error.Printf(abroot.Trans("updateInitramfs.updateFailed"), err)
+		}
 		return err
 	}
 
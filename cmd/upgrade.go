@@ -15,6 +15,7 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -23,6 +24,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
 	"github.com/vanilla-os/differ/diff"
 	"github.com/vanilla-os/orchid/cmdr"
 )
@@ -83,6 +85,13 @@ func NewUpgradeCommand() *cmdr.Command {
 			abroot.Trans("upgrade.unblock"),
 			false))
 
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"limit-rate",
+			"",
+			abroot.Trans("upgrade.limitRateFlag"),
+			""))
+
 	cmd.Example = "abroot upgrade"
 
 	return cmd
@@ -157,7 +166,7 @@ func upgrade(cmd *cobra.Command, args []string) error {
 		}
 
 		// Check for image updates
-		newDigest, res, err := aBsys.CheckUpdate()
+		newImage, res, err := aBsys.CheckUpdate()
 		if err != nil {
 			cmdr.Error.Println(err)
 			return err
@@ -168,7 +177,7 @@ func upgrade(cmd *cobra.Command, args []string) error {
 				cmdr.Info.Println(abroot.Trans("upgrade.systemUpdateAvailable"))
 			}
 
-			sysAdded, sysUpgraded, sysDowngraded, sysRemoved, err = core.BaseImagePackageDiff(aBsys.CurImage.Digest, newDigest)
+			sysAdded, sysUpgraded, sysDowngraded, sysRemoved, err = core.BaseImagePackageDiff(aBsys.CurImage.Image, aBsys.CurImage.Digest, settings.GetFullImageNameWithTag(), newImage.Digest)
 			if err != nil {
 				return err
 			}
@@ -206,7 +215,7 @@ func upgrade(cmd *cobra.Command, args []string) error {
 		if raw {
 			var newDigestIfHasUpdate digest.Digest = ""
 			if res {
-				newDigestIfHasUpdate = newDigest
+				newDigestIfHasUpdate = newImage.Digest
 			}
 
 			out, err := json.Marshal(map[string]any{
@@ -244,6 +253,17 @@ func upgrade(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	aBsys.DownloadRateLimit, err = cmd.Flags().GetString("limit-rate")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	_, err = core.ParseRateLimit(aBsys.DownloadRateLimit)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
 	force, err := cmd.Flags().GetBool("force")
 	if err != nil {
 		cmdr.Error.Println(err)
@@ -265,6 +285,16 @@ func upgrade(cmd *cobra.Command, args []string) error {
 			return err
 		}
 
+		if printOperationReport(err) {
+			return err
+		}
+
+		var vetoErr *core.HookVetoError
+		if errors.As(err, &vetoErr) {
+			cmdr.Error.Printf(abroot.Trans("upgrade.hookVeto"), vetoErr.Stage, vetoErr.Hook, vetoErr.ExitCode)
+			return err
+		}
+
 		cmdr.Error.Println(err)
 		return err
 	}
@@ -317,3 +347,23 @@ func renderPackageDiff(added, upgraded, downgraded, removed []diff.PackageDiff)
 
 	return nil
 }
+
+// printOperationReport prints the report of the space or health checks
+// which made an operation fail, if any, and tells whether it did
+func printOperationReport(err error) bool {
+	var spaceErr *core.NotEnoughSpaceError
+	if errors.As(err, &spaceErr) && spaceErr.Report != nil {
+		cmdr.Error.Println(abroot.Trans("upgrade.notEnoughSpace"))
+		cmdr.FgDefault.Println(spaceErr.Report.String())
+		return true
+	}
+
+	var healthErr *core.HealthCheckFailedError
+	if errors.As(err, &healthErr) {
+		cmdr.Error.Println(abroot.Trans("upgrade.healthCheckFailed"))
+		cmdr.FgDefault.Println(healthErr.Report.String())
+		return true
+	}
+
+	return false
+}
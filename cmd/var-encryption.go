@@ -0,0 +1,207 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+var validVarEncryptionArgs = []string{"enable", "enroll-tpm2", "enroll-fido2", "list-keyslots"}
+
+func NewVarEncryptionCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"var-encryption enable|enroll-tpm2|enroll-fido2|list-keyslots",
+		abroot.Trans("varEncryption.long"),
+		abroot.Trans("varEncryption.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := varEncryption(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithStringFlag(
+		cmdr.NewStringFlag(
+			"pcrs",
+			"p",
+			abroot.Trans("varEncryption.pcrsFlag"),
+			"",
+		),
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"dry-run",
+			"d",
+			abroot.Trans("varEncryption.dryRunFlag"),
+			false,
+		),
+	)
+
+	cmd.Args = cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs)
+	cmd.ValidArgs = validVarEncryptionArgs
+	cmd.Example = "abroot var-encryption enroll-tpm2 --pcrs 7+9"
+
+	return cmd
+}
+
+func varEncryption(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(false) {
+		cmdr.Error.Println(abroot.Trans("varEncryption.rootRequired"))
+		return nil
+	}
+
+	pcrsFlag, err := cmd.Flags().GetString("pcrs")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	manager := core.NewABRootManager()
+	state := core.GetVarEncryptionState(manager.VarPartition)
+	if args[0] == "enable" {
+		if !dryRun {
+			startCommandLog(cmd)
+		}
+		return enableVarEncryption(manager.VarPartition, state, dryRun)
+	}
+	if !state.Encrypted {
+		err := &NotEncryptedError{}
+		cmdr.Error.Println(abroot.Trans("varEncryption.notEncrypted"))
+		return err
+	}
+
+	switch args[0] {
+	case "enroll-tpm2":
+		startCommandLog(cmd)
+		pcrs := settings.Cnf.VarTpm2Pcrs
+		if pcrsFlag != "" {
+			pcrs, err = core.ParsePcrs(pcrsFlag)
+			if err != nil {
+				cmdr.Error.Println(err)
+				return err
+			}
+		}
+		if len(core.StablePcrs(pcrs)) == 0 {
+			cmdr.Warning.Println(abroot.Trans("varEncryption.noStablePcrs"))
+		}
+
+		cmdr.Info.Printf(abroot.Trans("varEncryption.enrollingTpm2"), state.Device, core.FormatPcrs(pcrs))
+		err = core.EnrollVarTPM2(state.Device, pcrs)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+		cmdr.Info.Println(abroot.Trans("varEncryption.enrolled"))
+	case "enroll-fido2":
+		startCommandLog(cmd)
+		cmdr.Info.Printf(abroot.Trans("varEncryption.enrollingFido2"), state.Device)
+		err = core.EnrollVarFIDO2(state.Device)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+		cmdr.Info.Println(abroot.Trans("varEncryption.enrolled"))
+	case "list-keyslots":
+		keyslots, err := core.ListVarKeyslots(state.Device)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+
+		cmdr.Info.Printf(abroot.Trans("varEncryption.keyslots"), state.Device)
+		for _, keyslot := range keyslots {
+			if keyslot.Type == core.KEYSLOT_TPM2 {
+				cmdr.FgDefault.Printf(abroot.Trans("varEncryption.tpm2Keyslot"), keyslot.Slot, core.FormatPcrs(keyslot.Pcrs))
+				continue
+			}
+			cmdr.FgDefault.Printf(abroot.Trans("varEncryption.keyslot"), keyslot.Slot, keyslot.Type)
+		}
+	default:
+		return errors.New(abroot.Trans("varEncryption.unknownCommand", args[0]))
+	}
+
+	return nil
+}
+
+// enableVarEncryption schedules the encryption of /var for the next boot,
+// or resumes it if it was interrupted
+func enableVarEncryption(varPart core.Partition, state core.VarEncryptionState, dryRun bool) error {
+	if state.Encrypted {
+		inProgress, err := core.VarReencryptionInProgress(state.Device)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+		if !inProgress {
+			cmdr.Info.Println(abroot.Trans("varEncryption.alreadyEncrypted"))
+			return nil
+		}
+
+		cmdr.Info.Printf(abroot.Trans("varEncryption.resuming"), state.Device)
+		if dryRun {
+			cmdr.Info.Println(abroot.Trans("varEncryption.dryRunComplete"))
+			return nil
+		}
+		err = core.ResumeVarEncryption(state.Device)
+		if err != nil {
+			cmdr.Error.Println(err)
+			return err
+		}
+		cmdr.Info.Println(abroot.Trans("varEncryption.encrypted"))
+		return nil
+	}
+
+	if _, err := os.Stat(core.VarEncryptionScheduleFile); err == nil {
+		cmdr.Info.Println(abroot.Trans("varEncryption.alreadyScheduled"))
+		return nil
+	}
+
+	plan, err := core.PlanVarEncryption(varPart)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	cmdr.Info.Printf(abroot.Trans("varEncryption.plan"),
+		plan.Device, plan.FsType, plan.FsSize/1024/1024, plan.DeviceSize/1024/1024, plan.MapperName)
+	if dryRun {
+		cmdr.Info.Println(abroot.Trans("varEncryption.dryRunComplete"))
+		return nil
+	}
+
+	err = core.ScheduleVarEncryption(plan)
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+	cmdr.Info.Println(abroot.Trans("varEncryption.scheduled"))
+
+	return nil
+}
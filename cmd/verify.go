@@ -0,0 +1,205 @@
+package cmd
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/orchid/cmdr"
+)
+
+// errRootModified is returned when the verified root differs from what was
+// deployed in it
+var errRootModified = errors.New("the root differs from what was deployed")
+
+func NewVerifyCommand() *cmdr.Command {
+	cmd := cmdr.NewCommand(
+		"verify",
+		abroot.Trans("verify.long"),
+		abroot.Trans("verify.short"),
+		func(cmd *cobra.Command, args []string) error {
+			err := verify(cmd, args)
+			if err != nil {
+				os.Exit(1)
+			}
+			return nil
+		},
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"present",
+			"p",
+			abroot.Trans("verify.presentFlag"),
+			false,
+		),
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"future",
+			"f",
+			abroot.Trans("verify.futureFlag"),
+			false,
+		),
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"repair",
+			"r",
+			abroot.Trans("verify.repairFlag"),
+			false,
+		),
+	)
+
+	cmd.WithBoolFlag(
+		cmdr.NewBoolFlag(
+			"remove-extra",
+			"",
+			abroot.Trans("verify.removeExtraFlag"),
+			false,
+		),
+	)
+
+	cmd.Example = "abroot verify --future --repair"
+
+	return cmd
+}
+
+func verify(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(false) {
+		cmdr.Error.Println(abroot.Trans("verify.rootRequired"))
+		return nil
+	}
+
+	presentFlag, err := cmd.Flags().GetBool("present")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	futureFlag, err := cmd.Flags().GetBool("future")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	repairFlag, err := cmd.Flags().GetBool("repair")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	removeExtraFlag, err := cmd.Flags().GetBool("remove-extra")
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	if presentFlag && futureFlag {
+		err := errors.New(abroot.Trans("verify.presentAndFuture"))
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	identifier := "present"
+	if futureFlag {
+		identifier = "future"
+	}
+
+	if repairFlag {
+		startCommandLog(cmd)
+	}
+
+	aBsys, err := core.NewABSystem()
+	if err != nil {
+		cmdr.Error.Println(err)
+		return err
+	}
+
+	cmdr.Info.Printf(abroot.Trans("verify.verifying"), abroot.Trans("verify.roots."+identifier))
+	report, err := aBsys.VerifyRoot(identifier, repairFlag, removeExtraFlag)
+	if err != nil {
+		if err == core.ErrOperationLocked {
+			cmdr.Error.Println(abroot.Trans("verify.locked"))
+			return err
+		}
+
+		cmdr.Error.Printf(abroot.Trans("verify.failed"), err)
+		return err
+	}
+
+	if report.Source == "image" {
+		cmdr.Warning.Println(abroot.Trans("verify.noManifest"))
+	}
+
+	if report.Clean() {
+		cmdr.Info.Println(abroot.Trans("verify.clean"))
+		return nil
+	}
+
+	items := []cmdr.BulletListItem{}
+	for _, category := range []struct {
+		name  string
+		paths []string
+	}{
+		{"modified", report.Modified},
+		{"missing", report.Missing},
+		{"extra", report.Extra},
+	} {
+		if len(category.paths) == 0 {
+			continue
+		}
+		items = append(items, cmdr.BulletListItem{
+			Level: 1,
+			Text:  abroot.Trans("verify.category", abroot.Trans("verify.categories."+category.name), len(category.paths)),
+		})
+		for _, path := range category.paths {
+			items = append(items, cmdr.BulletListItem{Level: 2, Text: "/" + path})
+		}
+	}
+	cmdr.BulletList.WithItems(items).Render()
+
+	if !repairFlag {
+		cmdr.Warning.Println(abroot.Trans("verify.runRepair"))
+		return errRootModified
+	}
+
+	if len(report.KeptExtra) > 0 {
+		cmdr.Warning.Println(abroot.Trans("verify.keptExtra"))
+		for _, path := range report.KeptExtra {
+			cmdr.FgDefault.Println("  /" + path)
+		}
+	}
+
+	if len(report.Unrepairable) > 0 {
+		cmdr.Warning.Println(abroot.Trans("verify.unrepairable"))
+		for _, path := range report.Unrepairable {
+			cmdr.FgDefault.Println("  /" + path)
+		}
+		return errRootModified
+	}
+
+	if len(report.KeptExtra) > 0 {
+		return errRootModified
+	}
+
+	cmdr.Info.Println(abroot.Trans("verify.repaired"))
+	return nil
+}
@@ -0,0 +1,373 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/abroot/settings"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheServiceName is the DNS-SD service advertised by the peer caches
+const cacheServiceName = "_abroot-cache._tcp.local."
+
+// mdnsAddr is the multicast address and port of mDNS
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// peerDiscoveryTimeout is how long responses to an mDNS query are awaited
+const peerDiscoveryTimeout = 2 * time.Second
+
+// blobPathRegex matches the path of the blob endpoint of the registry API
+var blobPathRegex = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+
+// NewCacheHandler returns a handler serving the blobs kept in the
+// downloads directory through a read-only subset of the OCI distribution
+// API. Blobs are looked up by digest only, whatever the repository they
+// are requested for, and clients must verify them, as peers do. If allowed
+// is not empty, only the clients in one of its networks are served.
+func NewCacheHandler(allowed []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+		if !isClientAllowed(r.RemoteAddr, allowed) {
+			PrintVerboseWarn("CacheHandler", 0, "refusing", r.RemoteAddr, "which is not in cacheAllowedNetworks")
+			writeRegistryError(w, http.StatusForbidden, "DENIED", "client not allowed by this cache")
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		match := blobPathRegex.FindStringSubmatch(r.URL.Path)
+		if match == nil {
+			writeRegistryError(w, http.StatusNotFound, "UNSUPPORTED", "only blobs are served by this cache")
+			return
+		}
+
+		blobDigest, err := digest.Parse(match[2])
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+
+		// blobs are kept as they were pulled, compressed layers included,
+		// so they are found by the digest the manifest of peers refers to
+		file, err := os.Open(filepath.Join(downloadsDir, blobDigest.Encoded()))
+		if err != nil {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to the cache")
+			return
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", blobDigest.String())
+		PrintVerboseInfo("CacheHandler", "serving", blobDigest, "to", r.RemoteAddr)
+		http.ServeContent(w, r, "", info.ModTime(), file)
+	})
+}
+
+// isClientAllowed reports whether the client at remoteAddr is in one of
+// the allowed networks, any client being allowed if there are none
+func isClientAllowed(remoteAddr string, allowed []netip.Prefix) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	return slices.ContainsFunc(allowed, func(network netip.Prefix) bool {
+		return network.Contains(addr)
+	})
+}
+
+// ParseAllowedNetworks parses the networks of cacheAllowedNetworks, given
+// in CIDR notation or as single addresses
+func ParseAllowedNetworks(networks []string) ([]netip.Prefix, error) {
+	allowed := []netip.Prefix{}
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed network %q: %w", network, err)
+			}
+			allowed = append(allowed, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %q: %w", network, err)
+		}
+		allowed = append(allowed, prefix.Masked())
+	}
+	return allowed, nil
+}
+
+// writeRegistryError writes an error in the format of the registry API
+func writeRegistryError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
+
+// ServeCache serves the kept blobs on the given address until an error
+// occurs. The address must name the interface to listen on, so that the
+// cache is only exposed where it is meant to be. The cache has no
+// authentication: anyone who can reach the address can fetch the blobs,
+// unless cacheAllowedNetworks restricts the clients. Since the blobs are
+// those of a public image this only exposes which image the system runs,
+// but the address should not be on an untrusted network. If advertise is
+// true, the cache is also announced on the local network through mDNS, so
+// that peers with discovery enabled can find it.
+func ServeCache(address string, advertise bool) error {
+	PrintVerboseInfo("ServeCache", "running...")
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		err = fmt.Errorf("invalid address %q: the interface to listen on must be given, e.g. 192.168.1.10:5000", address)
+		PrintVerboseErr("ServeCache", 0, err)
+		return err
+	}
+
+	// the compressed layers peers ask for can't be reproduced from the
+	// store, so only the kept blobs can be served
+	if !settings.Cnf.CacheBlobs {
+		err = errors.New("cacheBlobs must be enabled to serve the cache")
+		PrintVerboseErr("ServeCache", 0.1, err)
+		return err
+	}
+
+	allowed, err := ParseAllowedNetworks(settings.Cnf.CacheAllowedNetworks)
+	if err != nil {
+		PrintVerboseErr("ServeCache", 0.2, err)
+		return err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		PrintVerboseErr("ServeCache", 0, err)
+		return err
+	}
+
+	if advertise {
+		port := listener.Addr().(*net.TCPAddr).Port
+		go func() {
+			err := advertiseCache(uint16(port))
+			if err != nil {
+				PrintVerboseWarn("ServeCache", 1, "could not advertise the cache:", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Handler:           NewCacheHandler(allowed),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err = server.Serve(listener)
+	if err != nil {
+		PrintVerboseErr("ServeCache", 2, err)
+		return err
+	}
+
+	return nil
+}
+
+// advertiseCache answers the mDNS queries for cacheServiceName with the
+// port the cache is served on
+func advertiseCache(port uint16) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	serviceName := dnsmessage.MustNewName(cacheServiceName)
+	instanceName, err := dnsmessage.NewName(hostname + "." + cacheServiceName)
+	if err != nil {
+		return err
+	}
+	targetName, err := dnsmessage.NewName(hostname + ".local.")
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		var query dnsmessage.Message
+		err = query.Unpack(buf[:n])
+		if err != nil || query.Header.Response {
+			continue
+		}
+
+		asked := false
+		for _, q := range query.Questions {
+			if q.Type == dnsmessage.TypePTR && strings.EqualFold(q.Name.String(), cacheServiceName) {
+				asked = true
+			}
+		}
+		if !asked {
+			continue
+		}
+
+		response := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: query.Header.ID, Response: true, Authoritative: true},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: serviceName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.PTRResource{PTR: instanceName},
+			}},
+			Additionals: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.SRVResource{Port: port, Target: targetName},
+			}},
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			return err
+		}
+
+		// queries are answered directly, peers query from an ephemeral port
+		_, err = conn.WriteToUDP(packed, src)
+		if err != nil {
+			PrintVerboseWarn("advertiseCache", 0, "could not answer", src, err)
+		}
+	}
+}
+
+// DiscoverPeerCaches queries the local network through mDNS for the caches
+// served by other ABRoot systems and returns their addresses
+func DiscoverPeerCaches() ([]string, error) {
+	PrintVerboseInfo("DiscoverPeerCaches", "running...")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		PrintVerboseErr("DiscoverPeerCaches", 0, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(cacheServiceName),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		PrintVerboseErr("DiscoverPeerCaches", 1, err)
+		return nil, err
+	}
+
+	_, err = conn.WriteToUDP(packed, mdnsAddr)
+	if err != nil {
+		PrintVerboseErr("DiscoverPeerCaches", 2, err)
+		return nil, err
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(peerDiscoveryTimeout))
+	if err != nil {
+		PrintVerboseErr("DiscoverPeerCaches", 3, err)
+		return nil, err
+	}
+
+	peers := []string{}
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// the deadline ends the discovery
+			break
+		}
+
+		var response dnsmessage.Message
+		err = response.Unpack(buf[:n])
+		if err != nil || !response.Header.Response {
+			continue
+		}
+
+		resources := append(response.Answers, response.Additionals...)
+		for _, resource := range resources {
+			srv, ok := resource.Body.(*dnsmessage.SRVResource)
+			if !ok || !strings.HasSuffix(strings.ToLower(resource.Header.Name.String()), cacheServiceName) {
+				continue
+			}
+
+			peer := net.JoinHostPort(src.IP.String(), strconv.Itoa(int(srv.Port)))
+			PrintVerboseInfo("DiscoverPeerCaches", "found peer cache", peer)
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers, nil
+}
+
+// GetPeerCaches returns the peer caches to try before the registry, the
+// configured ones first, then the discovered ones if discovery is enabled
+func GetPeerCaches() []string {
+	peers := append([]string{}, settings.Cnf.PeerCaches...)
+
+	if settings.Cnf.PeerCacheDiscovery {
+		discovered, err := DiscoverPeerCaches()
+		if err != nil {
+			PrintVerboseWarn("GetPeerCaches", 0, "peer cache discovery failed:", err)
+		}
+		for _, peer := range discovered {
+			if !slices.Contains(peers, peer) {
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	return peers
+}
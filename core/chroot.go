@@ -67,20 +67,24 @@ func NewChroot(root string, rootUuid string, rootDevice string, mountUserEtc boo
 		PrintVerboseErr("NewChroot", 1, err)
 		return nil, err
 	}
+	mounted := []string{root}
 
 	for _, mount := range ReservedMounts {
 		PrintVerboseInfo("NewChroot", "mounting", mount)
 		err := syscall.Mount(mount, filepath.Join(root, mount), "", syscall.MS_BIND, "")
 		if err != nil {
 			PrintVerboseErr("NewChroot", 2, err)
+			unmountAll(mounted)
 			return nil, err
 		}
+		mounted = append(mounted, filepath.Join(root, mount))
 	}
 
 	if mountUserEtc {
 		err = syscall.Mount("overlay", filepath.Join(root, "etc"), "overlay", syscall.MS_RDONLY, "lowerdir="+userEtcPath+":"+filepath.Join(root, "/etc"))
 		if err != nil {
 			PrintVerboseErr("NewChroot", 3, "failed to mount user etc:", err)
+			unmountAll(mounted)
 			return nil, err
 		}
 	}
@@ -89,14 +93,28 @@ func NewChroot(root string, rootUuid string, rootDevice string, mountUserEtc boo
 	return chroot, nil
 }
 
-// Close unmounts all the bind mounts and closes the chroot environment
+// unmountAll unmounts the given mount points in reverse order, detaching
+// the busy ones, so that a partially set up chroot leaves nothing mounted
+func unmountAll(mountPoints []string) {
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		err := syscall.Unmount(mountPoints[i], syscall.MNT_DETACH)
+		if err != nil {
+			PrintVerboseWarn("unmountAll", 0, "could not unmount", mountPoints[i], err)
+		}
+	}
+}
+
+// Close unmounts all the bind mounts and closes the chroot environment.
+// Every mount is attempted even if one fails, and the first error is
+// returned.
 func (c *Chroot) Close() error {
 	PrintVerboseInfo("Chroot.Close", "running...")
 
+	var firstErr error
 	err := syscall.Unmount(filepath.Join(c.root, "/dev/pts"), 0)
 	if err != nil {
 		PrintVerboseErr("Chroot.Close", 0, err)
-		return err
+		firstErr = err
 	}
 
 	mountList := ReservedMounts
@@ -115,9 +133,14 @@ func (c *Chroot) Close() error {
 		err := syscall.Unmount(mountDir, 0)
 		if err != nil {
 			PrintVerboseErr("Chroot.Close", 1, err)
-			return err
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
+	if firstErr != nil {
+		return firstErr
+	}
 
 	PrintVerboseInfo("Chroot.Close", "successfully closed.")
 	return nil
@@ -144,6 +167,19 @@ func (c *Chroot) Execute(cmd string) error {
 	return nil
 }
 
+// ExecuteOutput runs a command in the chroot environment like Execute, but
+// returns its combined output instead of printing it
+func (c *Chroot) ExecuteOutput(cmd string) (string, error) {
+	PrintVerboseInfo("Chroot.ExecuteOutput", "running command:", cmd)
+	out, err := exec.Command("chroot", c.root, "/bin/sh", "-c", cmd).CombinedOutput()
+	if err != nil {
+		PrintVerboseErr("Chroot.ExecuteOutput", 0, err)
+		return string(out), err
+	}
+
+	return string(out), nil
+}
+
 // ExecuteCmds runs a list of commands in the chroot environment,
 // stops at the first error
 func (c *Chroot) ExecuteCmds(cmds []string) error {
@@ -0,0 +1,594 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// Kinds of data which can be redacted from a diagnostic bundle
+const (
+	REDACT_UUIDS     = "uuids"
+	REDACT_HOSTNAMES = "hostnames"
+	REDACT_USERNAMES = "usernames"
+)
+
+// DiagnosticManifestName is the name of the manifest in a diagnostic bundle
+const DiagnosticManifestName = "manifest.json"
+
+// diagnosticsJournalLines is how many lines of the journal of the current
+// boot are collected
+const diagnosticsJournalLines = 2000
+
+// diagnosticsMountDir is where the partitions read by CollectDiagnostics are
+// mounted
+const diagnosticsMountDir = "/run/abroot/diagnostics"
+
+// uuidRegex matches the UUIDs of filesystems and devices, including the
+// short ones of FAT filesystems
+var uuidRegex = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b|\b[0-9A-F]{4}-[0-9A-F]{4}\b`)
+
+// Redactor replaces UUIDs, hostnames and usernames with placeholders. The
+// same value is always replaced with the same placeholder, e.g. <uuid-1>, so
+// that the redacted files can still be related to each other.
+type Redactor struct {
+	kinds        []string
+	words        []redactedWord
+	replacements map[string]string
+	counters     map[string]int
+}
+
+// redactedWord is a literal value to redact, such as a hostname
+type redactedWord struct {
+	regex *regexp.Regexp
+	kind  string
+}
+
+// NewRedactor returns a Redactor for the given kinds of data, see the
+// REDACT_* constants, using the given hostnames and usernames
+func NewRedactor(kinds []string, hostnames []string, usernames []string) (*Redactor, error) {
+	r := &Redactor{
+		kinds:        []string{},
+		replacements: map[string]string{},
+		counters:     map[string]int{},
+	}
+
+	words := map[string]string{}
+	for _, kind := range kinds {
+		switch kind {
+		case REDACT_UUIDS:
+		case REDACT_HOSTNAMES:
+			for _, hostname := range hostnames {
+				words[hostname] = "hostname"
+			}
+		case REDACT_USERNAMES:
+			for _, username := range usernames {
+				words[username] = "user"
+			}
+		default:
+			return nil, fmt.Errorf("unknown kind of data to redact: %s", kind)
+		}
+		if !slices.Contains(r.kinds, kind) {
+			r.kinds = append(r.kinds, kind)
+		}
+	}
+
+	// longer values first, so that a value containing another one is
+	// replaced as a whole
+	values := []string{}
+	for value := range words {
+		if value != "" && value != "localhost" {
+			values = append(values, value)
+		}
+	}
+	slices.SortFunc(values, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	for _, value := range values {
+		r.words = append(r.words, redactedWord{
+			regex: regexp.MustCompile(`\b` + regexp.QuoteMeta(value) + `\b`),
+			kind:  words[value],
+		})
+	}
+
+	return r, nil
+}
+
+// NewSystemRedactor returns a Redactor for the given kinds of data, using
+// the hostname of the system and the usernames of its regular users
+func NewSystemRedactor(kinds []string) (*Redactor, error) {
+	PrintVerboseInfo("NewSystemRedactor", "running...")
+
+	hostnames := []string{}
+	hostname, err := os.Hostname()
+	if err == nil {
+		hostnames = append(hostnames, hostname)
+	}
+	etcHostname, err := os.ReadFile("/etc/hostname")
+	if err == nil {
+		hostnames = append(hostnames, strings.TrimSpace(string(etcHostname)))
+	}
+
+	usernames, err := regularUsers("/etc/passwd")
+	if err != nil {
+		PrintVerboseWarn("NewSystemRedactor", 0, "could not read the users:", err)
+	}
+
+	return NewRedactor(kinds, hostnames, usernames)
+}
+
+// regularUsers returns the names of the users with an UID in the range of
+// regular users in a passwd file
+func regularUsers(passwdPath string) ([]string, error) {
+	file, err := os.Open(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil || uid < 1000 || uid >= 65534 {
+			continue
+		}
+		users = append(users, fields[0])
+	}
+
+	return users, scanner.Err()
+}
+
+// Kinds returns the kinds of data redacted
+func (r *Redactor) Kinds() []string {
+	return r.kinds
+}
+
+// Redact returns data with the values to redact replaced by placeholders
+func (r *Redactor) Redact(data []byte) []byte {
+	if slices.Contains(r.kinds, REDACT_UUIDS) {
+		data = uuidRegex.ReplaceAllFunc(data, func(value []byte) []byte {
+			return []byte(r.placeholder(strings.ToLower(string(value)), "uuid"))
+		})
+	}
+
+	for _, word := range r.words {
+		data = word.regex.ReplaceAllFunc(data, func(value []byte) []byte {
+			return []byte(r.placeholder(string(value), word.kind))
+		})
+	}
+
+	return data
+}
+
+// placeholder returns the placeholder of a value, numbering the values of
+// each kind in the order they are found
+func (r *Redactor) placeholder(value string, kind string) string {
+	key := kind + ":" + value
+	if replacement, ok := r.replacements[key]; ok {
+		return replacement
+	}
+
+	r.counters[kind]++
+	replacement := fmt.Sprintf("<%s-%d>", kind, r.counters[kind])
+	r.replacements[key] = replacement
+	return replacement
+}
+
+// DiagnosticItem is an entry of the manifest of a diagnostic bundle
+type DiagnosticItem struct {
+	// Name is the path of the file in the bundle
+	Name string `json:"name"`
+
+	// Source is the file or the command the content comes from
+	Source string `json:"source"`
+
+	Size int64 `json:"size"`
+
+	// Error is set if the content could not be collected, in which case
+	// the file is not in the bundle
+	Error string `json:"error,omitempty"`
+}
+
+// DiagnosticManifest lists what was collected in a diagnostic bundle
+type DiagnosticManifest struct {
+	Created  time.Time        `json:"created"`
+	Redacted []string         `json:"redacted"`
+	Items    []DiagnosticItem `json:"items"`
+}
+
+// DiagnosticBundle is a tar.gz archive of files useful to diagnose issues,
+// redacted as they are added. A manifest listing what was collected, and
+// what could not be, is added by Close.
+type DiagnosticBundle struct {
+	Manifest DiagnosticManifest
+
+	redactor   *Redactor
+	file       *os.File
+	gzipWriter *gzip.Writer
+	tarWriter  *tar.Writer
+	closed     bool
+}
+
+// NewDiagnosticBundle creates a diagnostic bundle at the given path. The
+// redactor can be nil, in which case nothing is redacted.
+func NewDiagnosticBundle(path string, redactor *Redactor) (*DiagnosticBundle, error) {
+	PrintVerboseInfo("NewDiagnosticBundle", "running...")
+
+	// the bundle may contain private data, even when redacted
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		PrintVerboseErr("NewDiagnosticBundle", 0, err)
+		return nil, err
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	b := &DiagnosticBundle{
+		Manifest: DiagnosticManifest{
+			Created:  time.Now(),
+			Redacted: []string{},
+			Items:    []DiagnosticItem{},
+		},
+		redactor:   redactor,
+		file:       file,
+		gzipWriter: gzipWriter,
+		tarWriter:  tar.NewWriter(gzipWriter),
+	}
+	if redactor != nil {
+		b.Manifest.Redacted = redactor.Kinds()
+	}
+
+	return b, nil
+}
+
+// AddData adds a file with the given content to the bundle
+func (b *DiagnosticBundle) AddData(name string, source string, data []byte) error {
+	if b.redactor != nil {
+		data = b.redactor.Redact(data)
+	}
+
+	err := b.write(name, data)
+	if err != nil {
+		PrintVerboseErr("DiagnosticBundle.AddData", 0, err)
+		return err
+	}
+
+	b.Manifest.Items = append(b.Manifest.Items, DiagnosticItem{
+		Name:   name,
+		Source: source,
+		Size:   int64(len(data)),
+	})
+	return nil
+}
+
+// AddError records in the manifest that a file could not be collected
+func (b *DiagnosticBundle) AddError(name string, source string, err error) {
+	PrintVerboseWarn("DiagnosticBundle.AddError", 0, "could not collect", source+":", err)
+
+	message := err.Error()
+	if b.redactor != nil {
+		message = string(b.redactor.Redact([]byte(message)))
+	}
+
+	b.Manifest.Items = append(b.Manifest.Items, DiagnosticItem{
+		Name:   name,
+		Source: source,
+		Error:  message,
+	})
+}
+
+// AddFile adds the content of a file to the bundle, recording in the
+// manifest if it can't be read
+func (b *DiagnosticBundle) AddFile(name string, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		b.AddError(name, path, err)
+		return nil
+	}
+
+	return b.AddData(name, path, data)
+}
+
+// AddCommand adds the output of a command to the bundle, recording in the
+// manifest if it fails
+func (b *DiagnosticBundle) AddCommand(name string, command string, args ...string) error {
+	source := strings.Join(append([]string{command}, args...), " ")
+
+	out, err := exec.Command(command, args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		b.AddError(name, source, err)
+		return nil
+	}
+
+	return b.AddData(name, source, out)
+}
+
+// write writes a file to the archive
+func (b *DiagnosticBundle) write(name string, data []byte) error {
+	err := b.tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.tarWriter.Write(data)
+	return err
+}
+
+// Close adds the manifest to the bundle and closes it. The file is closed
+// even if the manifest can't be written, and closing the bundle again does
+// nothing, so that it can be deferred.
+func (b *DiagnosticBundle) Close() error {
+	PrintVerboseInfo("DiagnosticBundle.Close", "running...")
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	manifest, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		PrintVerboseErr("DiagnosticBundle.Close", 0, err)
+	} else {
+		err = b.write(DiagnosticManifestName, manifest)
+		if err != nil {
+			PrintVerboseErr("DiagnosticBundle.Close", 1, err)
+		}
+	}
+
+	for _, closer := range []interface{ Close() error }{b.tarWriter, b.gzipWriter, b.file} {
+		closeErr := closer.Close()
+		if closeErr != nil {
+			PrintVerboseErr("DiagnosticBundle.Close", 2, closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
+	}
+
+	return err
+}
+
+// CollectDiagnostics adds to the bundle the files and command outputs
+// needed to diagnose boot and transaction issues: the boot configuration,
+// the partitions and mounts, the configuration of ABRoot, the operation
+// logs and the journal of the current boot. What can't be collected is
+// recorded in the manifest, so that a partial bundle is still produced.
+func (s *ABSystem) CollectDiagnostics(b *DiagnosticBundle) error {
+	PrintVerboseInfo("ABSystem.CollectDiagnostics", "running...")
+
+	// Boot configuration
+	err := s.collectBootConfig(b)
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 0, err)
+		return err
+	}
+
+	err = b.AddFile("etc/abroot/kargs", KargsPath)
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 1, err)
+		return err
+	}
+	err = b.AddFile("etc/abroot/kargs.bak", KargsPath+".bak")
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 1.1, err)
+		return err
+	}
+
+	// Partitions and mounts
+	err = b.AddCommand("disks/lsblk.json", "lsblk", "--json", "--output", "NAME,TYPE,SIZE,FSTYPE,LABEL,PARTLABEL,UUID,MOUNTPOINTS")
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 3, err)
+		return err
+	}
+
+	partitions, err := json.MarshalIndent(map[string]interface{}{
+		"partitions":   s.RootM.Partitions,
+		"varPartition": s.RootM.VarPartition,
+	}, "", "  ")
+	if err != nil {
+		b.AddError("disks/abroot-partitions.json", "ABRootManager", err)
+	} else {
+		err = b.AddData("disks/abroot-partitions.json", "ABRootManager", partitions)
+		if err != nil {
+			PrintVerboseErr("ABSystem.CollectDiagnostics", 3.1, err)
+			return err
+		}
+	}
+
+	err = b.AddFile("etc/fstab", "/etc/fstab")
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 3.2, err)
+		return err
+	}
+	err = b.AddFile("disks/mountinfo", "/proc/self/mountinfo")
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 3.3, err)
+		return err
+	}
+
+	// ABRoot configuration and packages
+	for _, file := range [][2]string{
+		{"config/abroot.system.json", settings.CnfPathSystem},
+		{"config/abroot.admin.json", settings.CnfPathAdmin},
+		{"etc/abroot/" + PackagesAddFile, filepath.Join(PackagesBaseDir, PackagesAddFile)},
+		{"etc/abroot/" + PackagesRemoveFile, filepath.Join(PackagesBaseDir, PackagesRemoveFile)},
+	} {
+		err = b.AddFile(file[0], file[1])
+		if err != nil {
+			PrintVerboseErr("ABSystem.CollectDiagnostics", 4, err)
+			return err
+		}
+	}
+
+	// Logs and history
+	logFiles, err := filepath.Glob(filepath.Join(LogDir, "*"))
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 5, err)
+		return err
+	}
+	legacyLogFiles, _ := filepath.Glob(legacyLogGlob)
+	for _, path := range append(logFiles, legacyLogFiles...) {
+		err = b.AddFile(filepath.Join("logs", filepath.Base(path)), path)
+		if err != nil {
+			PrintVerboseErr("ABSystem.CollectDiagnostics", 5.1, err)
+			return err
+		}
+	}
+
+	err = b.AddFile("history.jsonl", HistoryFile)
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 5.2, err)
+		return err
+	}
+
+	err = b.AddCommand("journal.txt", "journalctl", "--boot", "--no-pager", "--lines", strconv.Itoa(diagnosticsJournalLines))
+	if err != nil {
+		PrintVerboseErr("ABSystem.CollectDiagnostics", 6, err)
+		return err
+	}
+
+	return nil
+}
+
+// collectBootConfig adds the GRUB configuration of the boot partition and
+// of each root to the bundle. The partitions are read while the operation
+// lock is held, so that they are not read while an operation changes them:
+// if one is running, they are recorded as missing.
+func (s *ABSystem) collectBootConfig(b *DiagnosticBundle) error {
+	names := []string{"boot/grub/grub.cfg", "boot/grub/grub.cfg.future"}
+	labels := []string{settings.Cnf.PartLabelA, settings.Cnf.PartLabelB}
+
+	err := s.LockOperation()
+	if err == ErrOperationLocked {
+		for _, name := range names {
+			b.AddError(name, "boot partition", err)
+		}
+		for _, label := range labels {
+			b.AddError(filepath.Join("roots", label, "abroot.cfg"), label, err)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer s.UnlockOperation()
+
+	partBoot, err := s.RootM.GetBoot()
+	if err != nil {
+		for _, name := range names {
+			b.AddError(name, "boot partition", err)
+		}
+	} else {
+		err = collectFromPartition(partBoot, filepath.Join(diagnosticsMountDir, "boot"), func(mountPoint string) error {
+			for _, name := range names {
+				err := b.AddFile(name, filepath.Join(mountPoint, "grub", filepath.Base(name)))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, label := range labels {
+		err = s.collectRootBootConfig(b, label)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectRootBootConfig adds the abroot.cfg generated for a root to the
+// bundle, which is in the init volume when using thin provisioning. The
+// present root is read through a bind mount of /, only the future root is
+// mounted.
+func (s *ABSystem) collectRootBootConfig(b *DiagnosticBundle, label string) error {
+	name := filepath.Join("roots", label, "abroot.cfg")
+
+	if settings.Cnf.ThinProvisioning {
+		partInit, err := s.RootM.GetInit()
+		if err != nil {
+			b.AddError(name, "init volume", err)
+			return nil
+		}
+		return collectFromPartition(partInit, filepath.Join(diagnosticsMountDir, "init"), func(mountPoint string) error {
+			return b.AddFile(name, filepath.Join(mountPoint, label, "abroot.cfg"))
+		})
+	}
+
+	root, err := s.RootM.GetPartition(label)
+	if err != nil {
+		b.AddError(name, label, err)
+		return nil
+	}
+
+	mountPoint, unmount, err := s.mountRoot(root.IdentifiedAs, diagnosticsMountDir)
+	if err != nil {
+		b.AddError(name, label, err)
+		return nil
+	}
+	defer unmount()
+
+	return b.AddFile(name, filepath.Join(mountPoint, "boot", "grub", "abroot.cfg"))
+}
+
+// collectFromPartition reads a partition while collect runs, through its
+// mount point if it is already mounted, since mounting its device again
+// would fail, or mounted read-only otherwise. If it can't be mounted, the
+// error is only logged, since the files it holds are then recorded as
+// missing by collect.
+func collectFromPartition(part Partition, mountPoint string, collect func(mountPoint string) error) error {
+	if part.MountPoint != "" {
+		return collect(part.MountPoint)
+	}
+
+	err := part.MountReadOnly(mountPoint)
+	if err != nil {
+		PrintVerboseWarn("collectFromPartition", 0, "could not mount", part.Label+":", err)
+	} else {
+		defer part.Unmount()
+	}
+
+	return collect(mountPoint)
+}
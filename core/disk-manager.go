@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -164,9 +166,21 @@ func (d *DiskManager) GetPartitions(device string) ([]Partition, error) {
 	return result, nil
 }
 
-// Mount mounts a partition to a directory, returning an error if any occurs
+// Mount mounts a partition to a directory, using its MountOptions (e.g. to
+// select a btrfs subvolume), returning an error if any occurs
 func (p *Partition) Mount(destination string) error {
 	PrintVerboseInfo("Partition.Mount", "running...")
+	return p.mount(destination, 0)
+}
+
+// MountReadOnly mounts a partition to a directory like Mount, read-only so
+// that it can be inspected while it may be in use
+func (p *Partition) MountReadOnly(destination string) error {
+	PrintVerboseInfo("Partition.MountReadOnly", "running...")
+	return p.mount(destination, syscall.MS_RDONLY)
+}
+
+func (p *Partition) mount(destination string, flags uintptr) error {
 
 	if _, err := os.Stat(destination); os.IsNotExist(err) {
 		if err := os.MkdirAll(destination, 0755); err != nil {
@@ -181,7 +195,7 @@ func (p *Partition) Mount(destination string) error {
 	}
 	devicePath += p.Device
 
-	err := syscall.Mount(devicePath, destination, p.FsType, 0, "")
+	err := syscall.Mount(devicePath, destination, p.FsType, flags, p.MountOptions)
 	if err != nil {
 		PrintVerboseErr("Partition.Mount", 1, err)
 		return err
@@ -213,6 +227,93 @@ func (p *Partition) Unmount() error {
 	return nil
 }
 
+// ErrUsageUnknown is returned when the used and free space of a filesystem
+// can't be read without mounting it
+var ErrUsageUnknown = errors.New("the filesystem is not mounted, its usage is unknown")
+
+// PartitionUsage is the size of a partition and the used and free space of
+// its filesystem, in bytes. Known reports whether the latter could be read.
+type PartitionUsage struct {
+	Label  string `json:"label"`
+	Device string `json:"device"`
+	FsType string `json:"fsType"`
+	Known  bool   `json:"known"`
+	Size   uint64 `json:"size"`
+	Used   uint64 `json:"used"`
+	Free   uint64 `json:"free"`
+}
+
+// Usage returns the size of a partition, read from sysfs, and the used and
+// free space of its filesystem. Partitions are never mounted to be
+// measured, since it could race with a running operation: the usage of a
+// filesystem which is not mounted is read from lsblk, and ErrUsageUnknown
+// is returned, along with the size, when it doesn't report it.
+func (p *Partition) Usage() (PartitionUsage, error) {
+	PrintVerboseInfo("Partition.Usage", "running...")
+
+	usage := PartitionUsage{
+		Label:  p.Label,
+		Device: p.Device,
+		FsType: p.FsType,
+	}
+
+	device := "/dev/" + p.Device
+	if p.IsDevMapper() {
+		device = "/dev/mapper/" + p.Device
+	}
+
+	// mappings are named dm-N in sysfs
+	devicePath, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		PrintVerboseErr("Partition.Usage", 0, err)
+		return usage, err
+	}
+	usage.Size, err = getSysfsSize("/sys/class/block", filepath.Base(devicePath))
+	if err != nil {
+		PrintVerboseErr("Partition.Usage", 0.1, err)
+		return usage, err
+	}
+
+	if p.MountPoint == "" {
+		output, err := exec.Command("lsblk", "-b", "-n", "-d", "-o", "FSAVAIL,FSUSED", device).Output()
+		if err != nil {
+			PrintVerboseErr("Partition.Usage", 0.2, err)
+			return usage, err
+		}
+
+		fields := strings.Fields(string(output))
+		if len(fields) != 2 {
+			PrintVerboseInfo("Partition.Usage", "no usage reported for", device)
+			return usage, ErrUsageUnknown
+		}
+		values := make([]uint64, len(fields))
+		for i, field := range fields {
+			values[i], err = strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				PrintVerboseErr("Partition.Usage", 1, err)
+				return usage, err
+			}
+		}
+
+		usage.Free, usage.Used = values[0], values[1]
+		usage.Known = true
+		return usage, nil
+	}
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(p.MountPoint, &stat)
+	if err != nil {
+		PrintVerboseErr("Partition.Usage", 2, err)
+		return usage, err
+	}
+
+	usage.Free = stat.Bavail * uint64(stat.Bsize)
+	usage.Used = (stat.Blocks - stat.Bfree) * uint64(stat.Bsize)
+	usage.Known = true
+
+	return usage, nil
+}
+
 // Returns whether the partition is a device-mapper virtual partition
 func (p *Partition) IsDevMapper() bool {
 	return p.Parent != nil
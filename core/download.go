@@ -0,0 +1,703 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/abroot/settings"
+	"go.podman.io/image/v5/directory"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/docker/config"
+	"go.podman.io/image/v5/pkg/tlsclientconfig"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+	"go.podman.io/storage"
+)
+
+// downloadsDir holds the blobs of the image being pulled, in the layout of
+// the dir transport. Partially downloaded blobs are kept there, so that an
+// interrupted pull can be resumed by the next operation.
+var downloadsDir = filepath.Join(abrootStorageDir, "downloads")
+
+// partialSuffix marks blobs which are still being downloaded
+const partialSuffix = ".partial"
+
+// peerPartialSuffix marks blobs which are still being downloaded from a
+// peer, kept apart so that a failing peer never touches the partial file
+// of the registry
+const peerPartialSuffix = ".peer-partial"
+
+// dirTransportVersion is the content of the version file of the dir
+// transport layout
+const dirTransportVersion = "Directory Transport Version: 1.1\n"
+
+// peerDialTimeout and peerResponseTimeout bound how long an unresponsive
+// peer cache delays a download
+const (
+	peerDialTimeout     = 3 * time.Second
+	peerResponseTimeout = 10 * time.Second
+)
+
+// challengeParamRegex matches the parameters of a WWW-Authenticate header
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// ParseRateLimit parses a download rate limit, in bytes per second, such as
+// 2MB or 500KiB. An empty string or 0 means no limit.
+func ParseRateLimit(limit string) (uint64, error) {
+	if limit == "" {
+		return 0, nil
+	}
+
+	rate, err := humanize.ParseBytes(limit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid download rate limit %q: %w", limit, err)
+	}
+
+	return rate, nil
+}
+
+// GetDownloadRateLimit returns the download rate limit in bytes per second,
+// using override instead of downloadRateLimit if it is not empty
+func GetDownloadRateLimit(override string) (uint64, error) {
+	if override != "" {
+		return ParseRateLimit(override)
+	}
+
+	return ParseRateLimit(settings.Cnf.DownloadRateLimit)
+}
+
+// rateLimiter spreads reads over time so that their total rate, across all
+// the readers sharing it, doesn't exceed the configured one
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate uint64
+	next time.Time
+}
+
+// newRateLimiter returns a limiter for the given rate in bytes per second,
+// or nil if rate is 0
+func newRateLimiter(rate uint64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes can be read
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// blobClient downloads blobs straight from a registry, since the containers
+// libraries can't resume a download from an offset
+type blobClient struct {
+	client     *http.Client
+	baseURL    string
+	repository string
+	auth       types.DockerAuthConfig
+
+	// authorization is the value of the Authorization header, once known
+	authorization string
+
+	// peer is true for the cache of a peer, whose partial downloads are
+	// kept apart and not resumed from another source
+	peer bool
+}
+
+// newBlobClient returns a client for the repository of the given source,
+// using its credentials and TLS configuration
+func newBlobClient(ctx context.Context, source ImageSource) (*blobClient, error) {
+	named, err := reference.ParseNormalizedNamed(source.ImageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	domain := reference.Domain(named)
+	host := domain
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	sys := source.SystemContext
+	insecure := sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	certDirs := []string{sys.DockerCertPath}
+	if sys.DockerCertPath == "" {
+		certDirs = []string{
+			filepath.Join("/etc/containers/certs.d", host),
+			filepath.Join("/etc/docker/certs.d", host),
+		}
+	}
+	for _, certDir := range certDirs {
+		err = tlsclientconfig.SetupCertificates(certDir, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transport := tlsclientconfig.NewTransport()
+	transport.TLSClientConfig = tlsConfig
+
+	auth := types.DockerAuthConfig{}
+	if sys.DockerAuthConfig != nil {
+		auth = *sys.DockerAuthConfig
+	} else {
+		auth, err = config.GetCredentials(sys, domain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials for %s: %w", domain, err)
+		}
+	}
+
+	c := &blobClient{
+		client:     &http.Client{Transport: transport},
+		repository: reference.Path(named),
+		auth:       auth,
+	}
+
+	// insecure registries may not serve TLS at all
+	schemes := []string{"https"}
+	if insecure {
+		schemes = append(schemes, "http")
+	}
+
+	errs := []error{}
+	for _, scheme := range schemes {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+host+"/v2/", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Body.Close()
+
+		c.baseURL = scheme + "://" + host
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("could not reach %s: %w", host, errors.Join(errs...))
+}
+
+// newPeerBlobClient returns a client for the cache served by a peer. Peers
+// serve plain HTTP without authentication, blobs are trusted only once
+// their digest is verified.
+func newPeerBlobClient(peer string, repository string) *blobClient {
+	transport := tlsclientconfig.NewTransport()
+	transport.DialContext = (&net.Dialer{Timeout: peerDialTimeout}).DialContext
+	transport.ResponseHeaderTimeout = peerResponseTimeout
+
+	return &blobClient{
+		client:     &http.Client{Transport: transport},
+		baseURL:    "http://" + peer,
+		repository: repository,
+		peer:       true,
+	}
+}
+
+// getBlob requests a blob from the given offset, authorizing the client
+// if the registry asks to
+func (c *blobClient) getBlob(ctx context.Context, blobDigest digest.Digest, offset int64) (*http.Response, error) {
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", c.baseURL, c.repository, blobDigest)
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		err = c.authorize(ctx, challenge)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authorize sets the Authorization header answering the given challenge
+func (c *blobClient) authorize(ctx context.Context, challenge string) error {
+	scheme, rawParams, _ := strings.Cut(challenge, " ")
+	params := map[string]string{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(rawParams, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		credentials := c.auth.Username + ":" + c.auth.Password
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid authentication realm %q", params["realm"])
+	}
+
+	scope := "repository:" + c.repository + ":pull"
+	var req *http.Request
+	if c.auth.IdentityToken != "" {
+		// identity tokens are OAuth2 refresh tokens
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {c.auth.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"abroot"},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if c.auth.Username != "" {
+			req.SetBasicAuth(c.auth.Username, c.auth.Password)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get a token from %s: %s", realm.Host, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// downloadImage downloads the blobs of an image from the given source into
+// downloadsDir, resuming the ones partially downloaded by a previous pull.
+// Each blob is first requested from the given peer caches, the manifest is
+// always fetched from the source so that the blobs can be verified against
+// it. Layers already in the store are skipped, since they get reused when
+// the image is copied into it. It returns a reference to the downloaded
+// image.
+func downloadImage(ctx context.Context, store storage.Store, source ImageSource, peers []string, progressCh chan types.ProgressProperties, limiter *rateLimiter) (types.ImageReference, error) {
+	PrintVerboseInfo("downloadImage", "running...")
+
+	srcRef, err := alltransports.ParseImageName("docker://" + source.ImageName)
+	if err != nil {
+		PrintVerboseErr("downloadImage", 0, err)
+		return nil, err
+	}
+
+	imgSource, err := srcRef.NewImageSource(ctx, source.SystemContext)
+	if err != nil {
+		PrintVerboseErr("downloadImage", 1, err)
+		return nil, err
+	}
+	defer imgSource.Close()
+
+	manRaw, manMime, err := imgSource.GetManifest(ctx, nil)
+	if err != nil {
+		PrintVerboseErr("downloadImage", 2, err)
+		return nil, err
+	}
+
+	if manifest.MIMETypeIsMultiImage(manMime) {
+		list, err := manifest.ListFromBlob(manRaw, manMime)
+		if err != nil {
+			PrintVerboseErr("downloadImage", 3, err)
+			return nil, err
+		}
+
+		instanceDigest, err := list.ChooseInstance(source.SystemContext)
+		if err != nil {
+			PrintVerboseErr("downloadImage", 4, err)
+			return nil, err
+		}
+
+		manRaw, manMime, err = imgSource.GetManifest(ctx, &instanceDigest)
+		if err != nil {
+			PrintVerboseErr("downloadImage", 5, err)
+			return nil, err
+		}
+	}
+
+	man, err := manifest.FromBlob(manRaw, manMime)
+	if err != nil {
+		PrintVerboseErr("downloadImage", 6, err)
+		return nil, err
+	}
+
+	// blobs of the image kept by previous pulls are reused, even for layers
+	// which are already in the store, so that they can still be served
+	allBlobs := []types.BlobInfo{man.ConfigInfo()}
+	for _, layer := range man.LayerInfos() {
+		allBlobs = append(allBlobs, layer.BlobInfo)
+	}
+
+	blobs := []types.BlobInfo{man.ConfigInfo()}
+	for _, layer := range man.LayerInfos() {
+		layers, err := store.LayersByCompressedDigest(layer.Digest)
+		if err == nil && len(layers) > 0 {
+			PrintVerboseInfo("downloadImage", "layer", layer.Digest, "already in storage")
+			continue
+		}
+		blobs = append(blobs, layer.BlobInfo)
+	}
+
+	err = prepareDownloadsDir(manRaw, allBlobs)
+	if err != nil {
+		PrintVerboseErr("downloadImage", 7, err)
+		return nil, err
+	}
+
+	client, err := newBlobClient(ctx, source)
+	if err != nil {
+		PrintVerboseErr("downloadImage", 8, err)
+		return nil, err
+	}
+
+	clients := []*blobClient{}
+	for _, peer := range peers {
+		clients = append(clients, newPeerBlobClient(peer, client.repository))
+	}
+	clients = append(clients, client)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallel := max(int(settings.Cnf.MaxParallelDownloads), 1)
+	sem := make(chan struct{}, parallel)
+	errCh := make(chan error, len(blobs))
+	var wg sync.WaitGroup
+	for _, blob := range blobs {
+		wg.Add(1)
+		go func(blob types.BlobInfo) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := downloadBlob(ctx, clients, downloadsDir, blob, progressCh, limiter)
+			if err != nil {
+				errCh <- fmt.Errorf("%s: %w", blob.Digest, err)
+				cancel()
+			}
+		}(blob)
+	}
+	wg.Wait()
+	close(errCh)
+
+	errs := []error{}
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		err = errors.Join(errs...)
+		PrintVerboseErr("downloadImage", 9, err)
+		return nil, err
+	}
+
+	return directory.NewReference(downloadsDir)
+}
+
+// prepareDownloadsDir writes the manifest of the image being pulled to
+// downloadsDir and removes anything left there by previous pulls which is
+// not one of the given blobs
+func prepareDownloadsDir(manRaw []byte, blobs []types.BlobInfo) error {
+	err := os.MkdirAll(downloadsDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{"version": true, "manifest.json": true}
+	for _, blob := range blobs {
+		keep[blob.Digest.Encoded()] = true
+		keep[blob.Digest.Encoded()+partialSuffix] = true
+	}
+
+	entries, err := os.ReadDir(downloadsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+
+		PrintVerboseInfo("prepareDownloadsDir", "removing stale download", entry.Name())
+		err = os.RemoveAll(filepath.Join(downloadsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(downloadsDir, "version"), []byte(dirTransportVersion), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(downloadsDir, "manifest.json"), manRaw, 0o644)
+}
+
+// clearDownloadsDir removes the blobs of a pulled image
+func clearDownloadsDir() error {
+	return os.RemoveAll(downloadsDir)
+}
+
+// downloadBlob downloads a blob into dir from the first of the given
+// clients able to provide it
+func downloadBlob(ctx context.Context, clients []*blobClient, dir string, blob types.BlobInfo, progressCh chan types.ProgressProperties, limiter *rateLimiter) error {
+	errs := []error{}
+	for _, client := range clients {
+		err := downloadBlobFrom(ctx, client, dir, blob, progressCh, limiter)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		PrintVerboseWarn("downloadBlob", 0, "could not download", blob.Digest, "from", client.baseURL, err)
+		errs = append(errs, fmt.Errorf("%s: %w", client.baseURL, err))
+
+		// what a peer sent before failing is only verified once complete,
+		// so it is not resumed from the next source
+		if client.peer {
+			err = os.Remove(filepath.Join(dir, blob.Digest.Encoded()+peerPartialSuffix))
+			if err != nil && !os.IsNotExist(err) {
+				PrintVerboseWarn("downloadBlob", 1, "could not discard the partial download from", client.baseURL, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// downloadBlobFrom downloads a blob into dir, resuming from its partial
+// file if any, and verifies its digest once complete. The first progress
+// report of the blob carries the offset it was resumed from. Peers write
+// to their own partial file.
+func downloadBlobFrom(ctx context.Context, client *blobClient, dir string, blob types.BlobInfo, progressCh chan types.ProgressProperties, limiter *rateLimiter) error {
+	finalPath := filepath.Join(dir, blob.Digest.Encoded())
+	partialPath := finalPath + partialSuffix
+	if client.peer {
+		partialPath = finalPath + peerPartialSuffix
+	}
+
+	if _, err := os.Stat(finalPath); err == nil {
+		progressCh <- types.ProgressProperties{Event: types.ProgressEventNewArtifact, Artifact: blob, Offset: uint64(max(blob.Size, 0))}
+		progressCh <- types.ProgressProperties{Event: types.ProgressEventDone, Artifact: blob, Offset: uint64(max(blob.Size, 0))}
+		return nil
+	}
+
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := info.Size()
+	if blob.Size > 0 && offset > blob.Size {
+		offset = 0
+	}
+
+	resp, err := client.getBlob(ctx, blob.Digest, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		PrintVerboseInfo("downloadBlob", "resuming", blob.Digest, "from", offset)
+	case http.StatusOK:
+		// the registry ignored the range, start over
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is already complete, it only needs verifying
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	err = file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	progressCh <- types.ProgressProperties{Event: types.ProgressEventNewArtifact, Artifact: blob, Offset: uint64(offset)}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		buf := make([]byte, 32*1024)
+		lastReport := time.Now()
+		for {
+			n, readErr := resp.Body.Read(buf)
+			if n > 0 {
+				_, err = file.Write(buf[:n])
+				if err != nil {
+					return err
+				}
+				offset += int64(n)
+
+				if time.Since(lastReport) > 100*time.Millisecond {
+					progressCh <- types.ProgressProperties{Event: types.ProgressEventRead, Artifact: blob, Offset: uint64(offset)}
+					lastReport = time.Now()
+				}
+
+				err = limiter.wait(ctx, n)
+				if err != nil {
+					return err
+				}
+			}
+
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = verifyBlob(partialPath, blob.Digest)
+	if err != nil {
+		// a corrupted partial file can't be resumed
+		os.Remove(partialPath)
+		return err
+	}
+
+	err = os.Rename(partialPath, finalPath)
+	if err != nil {
+		return err
+	}
+
+	progressCh <- types.ProgressProperties{Event: types.ProgressEventDone, Artifact: blob, Offset: uint64(offset)}
+	return nil
+}
+
+// verifyBlob checks that the content of a file matches the given digest
+func verifyBlob(path string, expected digest.Digest) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	actual, err := expected.Algorithm().FromReader(file)
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/types"
+)
+
+// The blob client is internal to the pull, so it is tested from inside the
+// package.
+
+// testBlob is the content of the blob served by the test registries
+var testBlob = []byte(strings.Repeat("vanilla", 10000))
+
+// testRegistry serves testBlob at /v2/vanilla-os/desktop/blobs/<digest>
+// with the given handler, after answering the /v2/ ping. It returns the
+// source to download from.
+func testRegistry(t *testing.T, serveBlob http.HandlerFunc) (ImageSource, *httptest.Server) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v2/vanilla-os/desktop/blobs/"+digest.FromBytes(testBlob).String(), serveBlob)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	source := ImageSource{
+		ImageName: strings.TrimPrefix(server.URL, "http://") + "/vanilla-os/desktop",
+		SystemContext: &types.SystemContext{
+			// the registry only serves plain HTTP
+			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+			DockerCertPath:              t.TempDir(),
+			DockerAuthConfig:            &types.DockerAuthConfig{Username: "vanilla", Password: "secret"},
+		},
+	}
+	return source, server
+}
+
+// downloadTestBlob downloads testBlob into dir, starting from the given
+// partial file, and returns the downloaded content
+func downloadTestBlob(t *testing.T, source ImageSource, dir string, partial []byte) ([]byte, error) {
+	t.Helper()
+
+	blob := types.BlobInfo{Digest: digest.FromBytes(testBlob), Size: int64(len(testBlob))}
+	if partial != nil {
+		err := os.WriteFile(filepath.Join(dir, blob.Digest.Encoded()+".partial"), partial, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	client, err := newBlobClient(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	progressCh := make(chan types.ProgressProperties)
+	go func() {
+		for range progressCh {
+		}
+	}()
+	defer close(progressCh)
+
+	err = downloadBlob(ctx, []*blobClient{client}, dir, blob, progressCh, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, blob.Digest.Encoded()+".partial")); err == nil {
+		t.Fatal("expected the partial file to be renamed")
+	}
+	return os.ReadFile(filepath.Join(dir, blob.Digest.Encoded()))
+}
+
+// TestDownloadBlobResume tests resuming a blob from its partial file, from
+// a registry honouring the range or not.
+func TestDownloadBlobResume(t *testing.T) {
+	half := len(testBlob) / 2
+
+	ranges := []string{}
+	source, _ := testRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(testBlob))
+	})
+
+	data, err := downloadTestBlob(t, source, t.TempDir(), testBlob[:half])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBlob) {
+		t.Fatal("expected the resumed blob to be complete")
+	}
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%d-", half) {
+		t.Fatal("expected the rest of the blob to be requested, got", ranges)
+	}
+
+	// the partial file is not trusted if the whole blob is sent
+	source, _ = testRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(testBlob)
+	})
+	data, err = downloadTestBlob(t, source, t.TempDir(), bytes.Repeat([]byte{0}, half))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBlob) {
+		t.Fatal("expected the partial file to be replaced when the range is ignored")
+	}
+
+	t.Log("TestDownloadBlobResume: done")
+}
+
+// TestDownloadBlobComplete tests that a partial file which is already
+// complete is only verified when the registry can't serve its range.
+func TestDownloadBlobComplete(t *testing.T) {
+	source, _ := testRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != fmt.Sprintf("bytes=%d-", len(testBlob)) {
+			t.Error("unexpected range:", r.Header.Get("Range"))
+		}
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	})
+
+	data, err := downloadTestBlob(t, source, t.TempDir(), testBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBlob) {
+		t.Fatal("expected the complete partial file to be kept")
+	}
+
+	t.Log("TestDownloadBlobComplete: done")
+}
+
+// TestDownloadBlobDigestMismatch tests that a blob which doesn't match its
+// digest is rejected and its partial file removed.
+func TestDownloadBlobDigestMismatch(t *testing.T) {
+	source, _ := testRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.ToUpper(testBlob))
+	})
+
+	dir := t.TempDir()
+	_, err := downloadTestBlob(t, source, dir, nil)
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatal("expected a corrupted blob to be rejected, got", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Fatal("expected the corrupted blob to be removed, found", entries[0].Name())
+	}
+
+	t.Log("TestDownloadBlobDigestMismatch: done")
+}
+
+// TestDownloadBlobToken tests getting a token from the realm of a bearer
+// challenge, with the credentials of the registry.
+func TestDownloadBlobToken(t *testing.T) {
+	var server *httptest.Server
+	source, server := testRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abroot-token" {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="registry.test",scope="repository:vanilla-os/desktop:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(testBlob)
+	})
+	server.Config.Handler.(*http.ServeMux).HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "vanilla" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("service") != "registry.test" || r.URL.Query().Get("scope") != "repository:vanilla-os/desktop:pull" {
+			t.Error("unexpected token request:", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"token": "abroot-token"}`))
+	})
+
+	data, err := downloadTestBlob(t, source, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBlob) {
+		t.Fatal("expected the blob to be downloaded once authorized")
+	}
+
+	// wrong credentials can't get a token
+	source.SystemContext.DockerAuthConfig.Password = "wrong"
+	_, err = downloadTestBlob(t, source, t.TempDir(), nil)
+	if err == nil {
+		t.Fatal("expected the download to fail without a token")
+	}
+
+	t.Log("TestDownloadBlobToken: done")
+}
+
+// TestDownloadBlobPeerFailure tests that a peer failing mid-download leaves
+// the partial file of the registry alone, so it is still resumed.
+func TestDownloadBlobPeerFailure(t *testing.T) {
+	half := len(testBlob) / 2
+	blob := types.BlobInfo{Digest: digest.FromBytes(testBlob), Size: int64(len(testBlob))}
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a truncated blob, as sent by a peer going away
+		w.Header().Set("Content-Length", fmt.Sprint(len(testBlob)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(testBlob[:half/2])
+	}))
+	t.Cleanup(peer.Close)
+
+	ranges := []string{}
+	source, _ := testRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(testBlob))
+	})
+
+	dir := t.TempDir()
+	partialPath := filepath.Join(dir, blob.Digest.Encoded()+partialSuffix)
+	err := os.WriteFile(partialPath, testBlob[:half], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := newBlobClient(ctx, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerClient := newPeerBlobClient(strings.TrimPrefix(peer.URL, "http://"), client.repository)
+
+	progressCh := make(chan types.ProgressProperties)
+	go func() {
+		for range progressCh {
+		}
+	}()
+	defer close(progressCh)
+
+	err = downloadBlob(ctx, []*blobClient{peerClient, client}, dir, blob, progressCh, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, blob.Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBlob) {
+		t.Fatal("expected the blob to be complete")
+	}
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%d-", half) {
+		t.Fatal("expected the registry download to be resumed, got", ranges)
+	}
+	if _, err := os.Stat(filepath.Join(dir, blob.Digest.Encoded()+peerPartialSuffix)); err == nil {
+		t.Fatal("expected the partial file of the peer to be discarded")
+	}
+
+	t.Log("TestDownloadBlobPeerFailure: done")
+}
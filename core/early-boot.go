@@ -0,0 +1,571 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// SystemdPath is the init started once the early boot is done
+const SystemdPath = "/lib/systemd/systemd"
+
+// emergencyShells are tried in order when the early boot fails
+var emergencyShells = []string{"/usr/bin/bash", "/bin/bash", "/usr/bin/sh", "/bin/sh", "/usr/bin/busybox"}
+
+// BootLogger reports the progress of the early boot on the console and in
+// the kernel log, since the journal is not running yet
+type BootLogger struct {
+	Console io.Writer
+
+	// Kmsg is the kernel log, nil if it could not be opened
+	Kmsg io.WriteCloser
+}
+
+// NewBootLogger returns a BootLogger writing to console and, if it can be
+// opened, to /dev/kmsg
+func NewBootLogger(console io.Writer) *BootLogger {
+	l := &BootLogger{Console: console}
+
+	kmsg, err := os.OpenFile("/dev/kmsg", os.O_WRONLY, 0)
+	if err == nil {
+		l.Kmsg = kmsg
+	}
+
+	return l
+}
+
+// log writes a message with the given syslog priority
+func (l *BootLogger) log(priority int, prefix string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintln(l.Console, "ABRoot: "+prefix+msg)
+
+	if l.Kmsg != nil {
+		// every write is a record of the kernel log
+		fmt.Fprintf(l.Kmsg, "<%d>abroot: %s\n", priority, msg)
+	}
+}
+
+// Info reports the progress of the early boot
+func (l *BootLogger) Info(format string, args ...any) {
+	l.log(6, "", format, args...)
+}
+
+// Warn reports an error which does not stop the early boot
+func (l *BootLogger) Warn(format string, args ...any) {
+	l.log(4, "warning: ", format, args...)
+}
+
+// Error reports an error which stops the early boot
+func (l *BootLogger) Error(format string, args ...any) {
+	l.log(3, "error: ", format, args...)
+}
+
+// Close closes the kernel log
+func (l *BootLogger) Close() error {
+	if l.Kmsg != nil {
+		return l.Kmsg.Close()
+	}
+	return nil
+}
+
+// EarlyBootError is returned when a step of the early boot fails
+type EarlyBootError struct {
+	Step string
+	Err  error
+
+	// ExitCode identifies the step which failed, for the callers exiting
+	// with it
+	ExitCode int
+}
+
+func (e *EarlyBootError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Step, e.Err)
+}
+
+func (e *EarlyBootError) Unwrap() error {
+	return e.Err
+}
+
+// EarlyBoot performs the mounts the system needs before systemd starts:
+// the root is remounted writable, /var is mounted, the overlays and the
+// bind mounts are set up, /usr is made read-only, the fstab is adjusted and
+// the TPM2 key of an encrypted /var is sealed against the new boot chain.
+// All the paths are relative to Root, so that the sequence can be run
+// against a fake root in a mount namespace.
+type EarlyBoot struct {
+	// Root is where the root is mounted, / at boot
+	Root string
+
+	// RootPartition is the root being booted
+	RootPartition ABRootPartition
+
+	// VarDevice is mounted on /var, with VarFsType and VarOptions. The
+	// filesystem type is detected if VarFsType is empty.
+	VarDevice  string
+	VarFsType  string
+	VarOptions string
+
+	DryRun bool
+
+	Log *BootLogger
+
+	// encryptedVar is the plan of the encryption of /var performed during
+	// this boot, if any
+	encryptedVar *VarEncryptionPlan
+}
+
+// NewEarlyBoot returns an EarlyBoot mounting the given /var partition for
+// the given root. A device-mapper /var, e.g. an unlocked LUKS device or an
+// LVM volume, is mounted from /dev/mapper.
+func NewEarlyBoot(root ABRootPartition, varPart Partition, log *BootLogger) *EarlyBoot {
+	varDevice := ""
+	if varPart.Device != "" {
+		varDevice = "/dev/" + varPart.Device
+		if varPart.IsDevMapper() {
+			varDevice = "/dev/mapper/" + varPart.Device
+		}
+	}
+
+	return &EarlyBoot{
+		Root:          "/",
+		RootPartition: root,
+		VarDevice:     varDevice,
+		VarFsType:     varPart.FsType,
+		VarOptions:    varPart.MountOptions,
+		Log:           log,
+	}
+}
+
+// path returns the given absolute path in the root
+func (b *EarlyBoot) path(path string) string {
+	return filepath.Join(b.Root, path)
+}
+
+// mount performs a mount, or only logs it on a dry run
+func (b *EarlyBoot) mount(source string, target string, fstype string, flags uintptr, options string) error {
+	if b.DryRun {
+		return nil
+	}
+
+	err := syscall.Mount(source, target, fstype, flags, options)
+	if err != nil {
+		return fmt.Errorf("could not mount %s on %s: %w", source, target, err)
+	}
+	return nil
+}
+
+// Run performs the whole early boot sequence, stopping at the first step
+// which fails
+func (b *EarlyBoot) Run() error {
+	PrintVerboseInfo("EarlyBoot.Run", "running...")
+
+	steps := []struct {
+		name     string
+		run      func() error
+		exitCode int
+	}{
+		{"remounting the root as writable", b.remountRoot, 3},
+		{"mounting /var", b.mountVar, 5},
+		{"repairing the root structure", b.repairRoot, 4},
+		{"mounting the overlays", b.mountOverlays, 7},
+		{"mounting the bind mounts", b.mountBinds, 9},
+		{"making /usr read-only", b.bindUsrReadOnly, 10},
+		{"adjusting the fstab", b.adjustFstab, 8},
+		{"recording the encrypted /var", b.recordEncryptedVar, 8},
+		{"sealing the /var key in the TPM2", b.resealVarTPM2, 5},
+	}
+
+	for _, step := range steps {
+		b.Log.Info("%s", step.name)
+
+		err := step.run()
+		if err != nil {
+			err = &EarlyBootError{step.name, err, step.exitCode}
+			PrintVerboseErr("EarlyBoot.Run", 0, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remountRoot remounts the root as writable. A failure is only reported,
+// since the system can still boot, with a read-only root.
+func (b *EarlyBoot) remountRoot() error {
+	err := b.mount(b.Root, b.Root, "", syscall.MS_REMOUNT, "")
+	if err != nil {
+		b.Log.Warn("%v", err)
+	}
+	return nil
+}
+
+// mountVar mounts the /var partition, shrinking or encrypting it first if
+// this was scheduled
+func (b *EarlyBoot) mountVar() error {
+	err := b.mountVarDevice()
+	if err != nil {
+		return err
+	}
+
+	err = b.shrinkVarIfScheduled()
+	if err != nil {
+		return err
+	}
+
+	return b.encryptVarIfScheduled()
+}
+
+// mountVarDevice mounts VarDevice on /var
+func (b *EarlyBoot) mountVarDevice() error {
+	if b.VarDevice == "" {
+		if settings.Cnf.PartCryptVar != "" {
+			return fmt.Errorf("partition %s not found, the encrypted device %s may still be locked", settings.Cnf.PartLabelVar, settings.Cnf.PartCryptVar)
+		}
+		return fmt.Errorf("partition %s not found", settings.Cnf.PartLabelVar)
+	}
+
+	b.Log.Info("mounting %s on /var", b.VarDevice)
+	target := b.path("/var")
+
+	if b.VarFsType != "" {
+		return b.mount(b.VarDevice, target, b.VarFsType, 0, b.VarOptions)
+	}
+
+	// like mount(8), try the filesystems supported by the kernel
+	fsTypes, err := blockFilesystems("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	var mountErr error
+	for _, fsType := range fsTypes {
+		mountErr = b.mount(b.VarDevice, target, fsType, 0, b.VarOptions)
+		if mountErr == nil {
+			b.VarFsType = fsType
+			return nil
+		}
+	}
+	return fmt.Errorf("could not detect the filesystem of %s: %w", b.VarDevice, mountErr)
+}
+
+// blockFilesystems returns the filesystems backed by a device listed in a
+// /proc/filesystems file
+func blockFilesystems(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fsTypes := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 1 {
+			fsTypes = append(fsTypes, fields[0])
+		}
+	}
+
+	return fsTypes, scanner.Err()
+}
+
+// repairRoot restores the links and directories the root needs
+func (b *EarlyBoot) repairRoot() error {
+	if b.DryRun {
+		return nil
+	}
+	return RepairRootIntegrity(b.Root)
+}
+
+// mountOverlays mounts the /etc overlay and the ones in the configuration
+func (b *EarlyBoot) mountOverlays() error {
+	if b.RootPartition.Label == "" {
+		return errors.New("the current root could not be found")
+	}
+
+	overlays, err := GetOverlayMounts(b.RootPartition.Label)
+	if err != nil {
+		return err
+	}
+
+	for _, overlay := range overlays {
+		rooted := OverlayMount{
+			Destination: b.path(overlay.Destination),
+			UpperDir:    b.path(overlay.UpperDir),
+			WorkDir:     b.path(overlay.WorkDir),
+		}
+		for _, lowerDir := range overlay.LowerDirs {
+			rooted.LowerDirs = append(rooted.LowerDirs, b.path(lowerDir))
+		}
+
+		for _, dir := range []string{rooted.UpperDir, rooted.WorkDir} {
+			if _, err := os.Lstat(dir); os.IsNotExist(err) && !b.DryRun {
+				err := os.MkdirAll(dir, 0o755)
+				if err != nil {
+					// the mount below will report the actual problem
+					b.Log.Warn("%v", err)
+				}
+			}
+		}
+
+		b.Log.Info("mounting overlay on %s", overlay.Destination)
+		err := b.mount("overlay", rooted.Destination, "overlay", 0, rooted.Options())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mountBinds performs the bind mounts in the configuration
+func (b *EarlyBoot) mountBinds() error {
+	binds, err := GetBindMounts()
+	if err != nil {
+		return err
+	}
+
+	for _, bind := range binds {
+		b.Log.Info("bind mounting %s on %s with options %s", bind.Source, bind.Destination, bind.Options())
+
+		err := b.bindMount(b.path(bind.Source), b.path(bind.Destination), bind.ReadOnly)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindUsrReadOnly bind mounts /usr on itself, read-only, so that it stays
+// immutable while the rest of the root is writable
+func (b *EarlyBoot) bindUsrReadOnly() error {
+	usr := b.path("/usr")
+	return b.bindMount(usr, usr, true)
+}
+
+// bindMount bind mounts source on destination, creating both if needed
+func (b *EarlyBoot) bindMount(source string, destination string, readOnly bool) error {
+	if b.DryRun {
+		return nil
+	}
+
+	for _, dir := range []string{source, destination} {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			// the mount below will report the actual problem
+			b.Log.Warn("%v", err)
+		}
+	}
+
+	err := b.mount(source, destination, "", syscall.MS_BIND, "")
+	if err != nil {
+		return err
+	}
+
+	if readOnly {
+		return b.mount("", destination, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "")
+	}
+
+	return nil
+}
+
+// adjustFstab makes the fstab point to the current root, see AdjustFstab.
+// Nothing is done when the mount units are generated instead, so that the
+// fstab is not rewritten on every boot.
+func (b *EarlyBoot) adjustFstab() error {
+	if MountGeneratorInstalled(b.Root) {
+		b.Log.Info("the mount units are generated by %s, leaving the fstab as is", mountGeneratorName)
+		return nil
+	}
+
+	if b.RootPartition.Partition.Uuid == "" {
+		return errors.New("the UUID of the current root could not be found")
+	}
+
+	fstabFile := b.path("/etc/fstab")
+	fstabContents, err := os.ReadFile(fstabFile)
+	if err != nil {
+		return err
+	}
+
+	newFstabContents, err := AdjustFstab(string(fstabContents), b.RootPartition)
+	if err != nil {
+		return err
+	}
+
+	if b.DryRun {
+		b.Log.Info("new fstab contents:\n%s", newFstabContents)
+		return nil
+	}
+
+	newFstabFile := fstabFile + ".new"
+	err = os.WriteFile(newFstabFile, []byte(newFstabContents), 0o644)
+	if err != nil {
+		return err
+	}
+	err = AtomicSwap(fstabFile, newFstabFile)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(newFstabFile, fstabFile+".old")
+	if err != nil {
+		// the backup is not necessary to boot
+		b.Log.Warn("the old fstab file keeps the .new suffix")
+	}
+
+	return nil
+}
+
+// FindBootPartitions finds the root mounted at root and the /var partition
+// from the links in dev/disk of the root and the mounts listed in
+// mountinfoPath, without relying on any external tool. It is meant as a
+// fallback for ABRootManager during the early boot.
+func FindBootPartitions(root string, mountinfoPath string) (ABRootPartition, Partition, error) {
+	PrintVerboseInfo("FindBootPartitions", "running...")
+
+	fsType, options, err := getMountOptions(mountinfoPath, root)
+	if err != nil {
+		PrintVerboseErr("FindBootPartitions", 0, err)
+		return ABRootPartition{}, Partition{}, err
+	}
+	source, err := getMountSource(mountinfoPath, root)
+	if err != nil || source == "" {
+		err = fmt.Errorf("could not find the device mounted on %s: %v", root, err)
+		PrintVerboseErr("FindBootPartitions", 1, err)
+		return ABRootPartition{}, Partition{}, err
+	}
+
+	resolve := func(link string) string {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(root, link))
+		if err != nil {
+			return ""
+		}
+		return resolved
+	}
+	rootDevice := resolve(source)
+	if rootDevice == "" {
+		rootDevice = filepath.Join(root, source)
+	}
+
+	rootPart := ABRootPartition{IdentifiedAs: "present", Current: true}
+	for _, label := range []string{settings.Cnf.PartLabelA, settings.Cnf.PartLabelB} {
+		if label != "" && resolve(filepath.Join("/dev/disk/by-label", label)) == rootDevice {
+			rootPart.Label = label
+		}
+	}
+	if rootPart.Label == "" {
+		err := fmt.Errorf("%s is not labelled as an ABRoot root", source)
+		PrintVerboseErr("FindBootPartitions", 2, err)
+		return ABRootPartition{}, Partition{}, err
+	}
+
+	uuids, _ := os.ReadDir(filepath.Join(root, "/dev/disk/by-uuid"))
+	for _, uuid := range uuids {
+		if resolve(filepath.Join("/dev/disk/by-uuid", uuid.Name())) == rootDevice {
+			rootPart.Uuid = uuid.Name()
+		}
+	}
+
+	rootPart.FsType = fsType
+	rootPart.MountPoint = root
+	rootPart.Partition = Partition{
+		Label:      rootPart.Label,
+		MountPoint: root,
+		Uuid:       rootPart.Uuid,
+		FsType:     fsType,
+		Device:     strings.TrimPrefix(source, "/dev/"),
+	}
+	// btrfs roots are subvolumes, which must be selected when mounting
+	for _, option := range strings.Split(options, ",") {
+		if strings.HasPrefix(option, "subvol=") {
+			rootPart.Partition.MountOptions = option
+		}
+	}
+
+	varPart := Partition{Label: settings.Cnf.PartLabelVar}
+	varDevice := resolve(filepath.Join("/dev/disk/by-label", settings.Cnf.PartLabelVar))
+	if varDevice != "" {
+		varPart.Device = strings.TrimPrefix(strings.TrimPrefix(varDevice, root), "/dev/")
+	}
+
+	return rootPart, varPart, nil
+}
+
+// getMountSource returns the source of the topmost mount at the given path,
+// as listed in a mountinfo file
+func getMountSource(mountinfoPath string, mountPoint string) (string, error) {
+	mountinfo, err := os.Open(mountinfoPath)
+	if err != nil {
+		return "", err
+	}
+	defer mountinfo.Close()
+
+	source := ""
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != mountPoint {
+			continue
+		}
+		for i := 6; i < len(fields)-2; i++ {
+			if fields[i] == "-" {
+				source = fields[i+2]
+				break
+			}
+		}
+	}
+
+	return source, scanner.Err()
+}
+
+// ExecInit replaces the current process with systemd, passing it the given
+// arguments
+func ExecInit(args []string) error {
+	return syscall.Exec(SystemdPath, append([]string{SystemdPath}, args...), os.Environ())
+}
+
+// EmergencyShell reports an early boot failure and replaces the current
+// process with a shell on the console, so that the system can be repaired.
+// Since the init must never exit, it waits forever if no shell can be run.
+func EmergencyShell(log *BootLogger, bootErr error) {
+	log.Error("%v", bootErr)
+	log.Error("the system can't boot, starting an emergency shell")
+
+	for _, shell := range emergencyShells {
+		args := []string{shell}
+		if filepath.Base(shell) == "busybox" {
+			args = append(args, "sh")
+		}
+
+		err := syscall.Exec(shell, args, os.Environ())
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOENT) {
+			log.Warn("could not run %s: %v", shell, err)
+		}
+	}
+
+	log.Error("no shell could be run, the system needs to be restarted")
+	for {
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,416 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/containers/buildah"
+	"github.com/vanilla-os/abroot/settings"
+	"github.com/vanilla-os/prometheus"
+	"go.podman.io/storage"
+)
+
+// Categories of the items reclaimed by the garbage collection
+const (
+	GC_CONTAINERS   = "containers"
+	GC_IMAGES       = "images"
+	GC_LAYERS       = "layers"
+	GC_TRANSITIONAL = "transitional"
+	GC_LOGS         = "logs"
+)
+
+// GCCategory represents the items of a category reclaimed by the garbage
+// collection, along with their total size
+type GCCategory struct {
+	Name  string   `json:"name"`
+	Items []string `json:"items"`
+	Bytes uint64   `json:"bytes"`
+}
+
+// GCReport is the result of a garbage collection
+type GCReport struct {
+	DryRun     bool         `json:"dryRun"`
+	Categories []GCCategory `json:"categories"`
+}
+
+// TotalBytes returns the space reclaimed across all the categories
+func (r *GCReport) TotalBytes() uint64 {
+	var total uint64
+	for _, c := range r.Categories {
+		total += c.Bytes
+	}
+	return total
+}
+
+// GarbageCollect reclaims the space used by stale build containers, images
+// not used by any root, layers not referenced by any image, transitional
+// directories left in the future root by interrupted operations and old log
+// files. If dryRun is true, nothing is deleted but the report still lists
+// what would be reclaimed, and the operation lock is only checked, not
+// taken, so that a stale lock never blocks a report.
+// It returns ErrOperationLocked if another operation is running.
+func (s *ABSystem) GarbageCollect(dryRun bool) (*GCReport, error) {
+	PrintVerboseInfo("ABSystem.GarbageCollect", "running...")
+
+	if dryRun {
+		if s.isLockfilePidActive() {
+			PrintVerboseErr("ABSystem.GarbageCollect", 0, ErrOperationLocked)
+			return nil, ErrOperationLocked
+		}
+	} else {
+		_, err := StartOperationLog("gc")
+		if err != nil {
+			PrintVerboseWarn("ABSystem.GarbageCollect", 0.1, "could not start the operation log:", err)
+		}
+
+		err = s.LockOperation()
+		if err != nil {
+			PrintVerboseErr("ABSystem.GarbageCollect", 0, err)
+			return nil, err
+		}
+		defer s.UnlockOperation()
+	}
+
+	pt, err := prometheus.NewPrometheus(
+		abrootStorageDir,
+		"overlay",
+		settings.Cnf.MaxParallelDownloads,
+	)
+	if err != nil {
+		PrintVerboseErr("ABSystem.GarbageCollect", 1, err)
+		return nil, err
+	}
+
+	report := &GCReport{DryRun: dryRun}
+
+	storageCategories, err := s.gcStorage(pt.Store, dryRun)
+	if err != nil {
+		PrintVerboseErr("ABSystem.GarbageCollect", 2, err)
+		return nil, err
+	}
+	report.Categories = append(report.Categories, storageCategories...)
+
+	transitional, err := s.gcTransitional(dryRun)
+	if err != nil {
+		PrintVerboseErr("ABSystem.GarbageCollect", 3, err)
+		return nil, err
+	}
+	report.Categories = append(report.Categories, transitional)
+
+	logs, err := gcLogs(dryRun)
+	if err != nil {
+		PrintVerboseErr("ABSystem.GarbageCollect", 4, err)
+		return nil, err
+	}
+	report.Categories = append(report.Categories, logs)
+
+	return report, nil
+}
+
+// gcStorage reclaims the containers, images and layers of the ABRoot
+// storage which are not needed anymore. The latest image built for each
+// root is kept, since it is used to regenerate the initramfs.
+func (s *ABSystem) gcStorage(store storage.Store, dryRun bool) ([]GCCategory, error) {
+	PrintVerboseInfo("ABSystem.gcStorage", "running...")
+
+	containersCat := GCCategory{Name: GC_CONTAINERS, Items: []string{}}
+	imagesCat := GCCategory{Name: GC_IMAGES, Items: []string{}}
+	layersCat := GCCategory{Name: GC_LAYERS, Items: []string{}}
+
+	// ABRoot never keeps containers around, any of them is a leftover of an
+	// interrupted build
+	containers, err := store.Containers()
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcStorage", 0, err)
+		return nil, err
+	}
+
+	keptImages, err := s.getRootImages(store)
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcStorage", 1, err)
+		return nil, err
+	}
+
+	images, err := store.Images()
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcStorage", 2, err)
+		return nil, err
+	}
+
+	layers, err := store.Layers()
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcStorage", 3, err)
+		return nil, err
+	}
+
+	layersByID := map[string]storage.Layer{}
+	for _, layer := range layers {
+		layersByID[layer.ID] = layer
+	}
+
+	// collects the layers of a chain, from the top one
+	chain := func(topLayer string) []string {
+		ids := []string{}
+		for id := topLayer; id != ""; id = layersByID[id].Parent {
+			if _, ok := layersByID[id]; !ok {
+				break
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	keptLayers := map[string]bool{}
+	removedImageLayers := map[string]bool{}
+	for _, image := range images {
+		topLayers := append([]string{image.TopLayer}, image.MappedTopLayers...)
+		for _, top := range topLayers {
+			for _, id := range chain(top) {
+				if slices.Contains(keptImages, image.ID) {
+					keptLayers[id] = true
+				} else {
+					removedImageLayers[id] = true
+				}
+			}
+		}
+	}
+
+	for _, container := range containers {
+		containersCat.Items = append(containersCat.Items, container.ID)
+		if layer, ok := layersByID[container.LayerID]; ok {
+			containersCat.Bytes += layerDiskSize(store, layer)
+		}
+	}
+
+	for _, image := range images {
+		if slices.Contains(keptImages, image.ID) {
+			continue
+		}
+
+		name := image.ID
+		if len(image.Names) > 0 {
+			name = image.Names[0]
+		}
+		imagesCat.Items = append(imagesCat.Items, name)
+	}
+
+	// layers only used by removed images are accounted to them, the others
+	// are dangling
+	removedLayers := []storage.Layer{}
+	for _, layer := range layers {
+		if keptLayers[layer.ID] {
+			continue
+		}
+
+		// container layers are removed with their container
+		if slices.ContainsFunc(containers, func(c storage.Container) bool { return c.LayerID == layer.ID }) {
+			continue
+		}
+
+		size := layerDiskSize(store, layer)
+		if removedImageLayers[layer.ID] {
+			imagesCat.Bytes += size
+		} else {
+			layersCat.Items = append(layersCat.Items, layer.ID)
+			layersCat.Bytes += size
+		}
+		removedLayers = append(removedLayers, layer)
+	}
+
+	if dryRun {
+		return []GCCategory{containersCat, imagesCat, layersCat}, nil
+	}
+
+	for _, container := range containers {
+		PrintVerboseInfo("ABSystem.gcStorage", "deleting container", container.ID)
+		err := store.DeleteContainer(container.ID)
+		if err != nil {
+			PrintVerboseErr("ABSystem.gcStorage", 4, err)
+			return nil, err
+		}
+	}
+
+	for _, image := range images {
+		if slices.Contains(keptImages, image.ID) {
+			continue
+		}
+
+		PrintVerboseInfo("ABSystem.gcStorage", "deleting image", image.ID)
+		_, err := store.DeleteImage(image.ID, true)
+		if err != nil && !errors.Is(err, storage.ErrImageUnknown) {
+			PrintVerboseErr("ABSystem.gcStorage", 5, err)
+			return nil, err
+		}
+	}
+
+	// children must be deleted before their parents
+	sort.Slice(removedLayers, func(i, j int) bool {
+		return len(chain(removedLayers[i].ID)) > len(chain(removedLayers[j].ID))
+	})
+	for _, layer := range removedLayers {
+		PrintVerboseInfo("ABSystem.gcStorage", "deleting layer", layer.ID)
+		err := store.DeleteLayer(layer.ID)
+		if err != nil && !errors.Is(err, storage.ErrLayerUnknown) {
+			PrintVerboseErr("ABSystem.gcStorage", 6, err)
+			return nil, err
+		}
+	}
+
+	return []GCCategory{containersCat, imagesCat, layersCat}, nil
+}
+
+// getRootImages returns the IDs of the latest images built for the present
+// and future roots
+func (s *ABSystem) getRootImages(store storage.Store) ([]string, error) {
+	images, err := store.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]storage.Image{}
+	for _, image := range images {
+		builder, err := buildah.ImportBuilderFromImage(context.Background(), store, buildah.ImportFromImageOptions{Image: image.ID})
+		if err != nil {
+			PrintVerboseWarn("ABSystem.getRootImages", 0, "could not read labels of image", image.ID, err)
+			continue
+		}
+
+		root, ok := builder.Labels()["ABRoot.root"]
+		if !ok {
+			continue
+		}
+
+		if cur, ok := latest[root]; !ok || image.Created.After(cur.Created) {
+			latest[root] = image
+		}
+	}
+
+	ids := []string{}
+	for _, root := range s.RootM.Partitions {
+		if image, ok := latest[root.Label]; ok {
+			ids = append(ids, image.ID)
+		}
+	}
+
+	return ids, nil
+}
+
+// layerDiskSize returns the space used by a layer in the overlay storage
+func layerDiskSize(store storage.Store, layer storage.Layer) uint64 {
+	size, err := getDirSize(filepath.Join(store.GraphRoot(), "overlay", layer.ID))
+	if err == nil {
+		return uint64(size)
+	}
+
+	return uint64(max(layer.UncompressedSize, 0))
+}
+
+// gcTransitional removes the transitional directory left in the future root
+// by an interrupted operation. The future root is mounted where operations
+// mount it, so that an operation started meanwhile unmounts it like any
+// leftover mount instead of being blocked by it.
+func (s *ABSystem) gcTransitional(dryRun bool) (GCCategory, error) {
+	PrintVerboseInfo("ABSystem.gcTransitional", "running...")
+
+	category := GCCategory{Name: GC_TRANSITIONAL, Items: []string{}}
+
+	partFuture, err := s.RootM.GetFuture()
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcTransitional", 0, err)
+		return category, err
+	}
+
+	futureRoot := "/part-future"
+	partFuture.Partition.Unmount() // just in case
+	err = partFuture.Partition.Mount(futureRoot)
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcTransitional", 1, err)
+		return category, err
+	}
+	defer partFuture.Partition.Unmount()
+
+	path := filepath.Join(futureRoot, "abroot-trans")
+	size, err := getDirSize(path)
+	if os.IsNotExist(err) {
+		return category, nil
+	}
+	if err != nil {
+		PrintVerboseErr("ABSystem.gcTransitional", 2, err)
+		return category, err
+	}
+
+	category.Items = append(category.Items, path)
+	category.Bytes += uint64(size)
+
+	if !dryRun {
+		err = os.RemoveAll(path)
+		if err != nil {
+			PrintVerboseErr("ABSystem.gcTransitional", 3, err)
+			return category, err
+		}
+	}
+
+	return category, nil
+}
+
+// gcLogs removes the log files exceeding logMaxFiles or logRetentionDays,
+// along with the ones written by older versions, one per invocation
+func gcLogs(dryRun bool) (GCCategory, error) {
+	PrintVerboseInfo("gcLogs", "running...")
+
+	category := GCCategory{Name: GC_LOGS, Items: []string{}}
+
+	keep := -1
+	if settings.Cnf.LogMaxFiles > 0 {
+		keep = int(settings.Cnf.LogMaxFiles)
+	}
+	logFiles, err := expiredLogFiles(keep)
+	if err != nil {
+		PrintVerboseErr("gcLogs", 0, err)
+		return category, err
+	}
+
+	legacyLogFiles, err := filepath.Glob(legacyLogGlob)
+	if err != nil {
+		PrintVerboseErr("gcLogs", 1, err)
+		return category, err
+	}
+	logFiles = append(logFiles, legacyLogFiles...)
+
+	for _, path := range logFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		category.Items = append(category.Items, path)
+		category.Bytes += uint64(info.Size())
+
+		if !dryRun {
+			err = os.Remove(path)
+			if err != nil {
+				PrintVerboseErr("gcLogs", 2, err)
+				return category, err
+			}
+		}
+	}
+
+	return category, nil
+}
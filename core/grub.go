@@ -59,6 +59,12 @@ func generateABGrubConf(kernelVersion string, rootPath string, rootUuid string,
 		systemRoot = "UUID=" + rootUuid
 	}
 
+	if settings.Cnf.StorageBackend == STORAGE_BTRFS_SUBVOLUMES {
+		// grub resolves paths from the top level of the btrfs pool
+		bootPrefix = "/" + rootLabel + bootPrefix
+		systemRoot += " rootflags=subvol=" + rootLabel
+	}
+
 	confPath := filepath.Join(grubPath, "abroot.cfg")
 	template := `  search --no-floppy --fs-uuid --set=root %s
   linux   %s/vmlinuz-%s root=%s %s
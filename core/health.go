@@ -0,0 +1,350 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HealthChecksDir contains the user supplied check scripts, which are run
+// inside the future root along with the built-in checks
+const HealthChecksDir = "/etc/abroot/health-checks.d"
+
+// healthScriptsRunDir is where the user check scripts are copied to, inside
+// the root being checked, to execute them. The chroot shares /run with the
+// host, so nothing is left in the root itself.
+const healthScriptsRunDir = "/run/abroot/health-checks"
+
+// maxSymlinkHops is the maximum number of symlinks followed while resolving
+// a path inside a root, as in the kernel
+const maxSymlinkHops = 40
+
+// HealthCheckCommands are executed inside the future root to make sure its
+// key binaries work
+var HealthCheckCommands = []string{
+	"/bin/sh -c true",
+	"/usr/bin/env true",
+	"/usr/bin/mount --version",
+	"/usr/lib/systemd/systemd --version",
+}
+
+// HealthCheckRunner runs a command inside the root being checked and returns
+// its combined output
+type HealthCheckRunner func(cmd string) (string, error)
+
+// chrootSetupFailed returns a HealthCheckRunner failing every command, for
+// when the chroot of the root being checked could not be set up
+func chrootSetupFailed(err error) HealthCheckRunner {
+	err = fmt.Errorf("could not set up the chroot: %w", err)
+	return func(cmd string) (string, error) {
+		return "", err
+	}
+}
+
+// HealthCheckResult is the result of a single health check
+type HealthCheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+// HealthReport is the result of the health checks performed on a root
+// before switching the bootloader to it
+type HealthReport struct {
+	Root    string              `json:"root"`
+	Results []HealthCheckResult `json:"results"`
+}
+
+// Passed reports whether all the checks passed
+func (r *HealthReport) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns a human readable version of the report, with a line for
+// each check
+func (r *HealthReport) String() string {
+	lines := []string{}
+	for _, result := range r.Results {
+		mark := "ok"
+		if !result.Passed {
+			mark = "FAILED"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %s, %s", result.Name, mark, result.Message))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// add records the result of a check, which failed if err is not nil
+func (r *HealthReport) add(name string, message string, err error) {
+	result := HealthCheckResult{Name: name, Passed: err == nil, Message: message}
+	if err != nil {
+		result.Message = err.Error()
+		PrintVerboseWarn("HealthReport", 0, "check", name, "failed:", err)
+	}
+
+	r.Results = append(r.Results, result)
+}
+
+// HealthCheckFailedError is returned when a root fails its health checks
+type HealthCheckFailedError struct {
+	Report *HealthReport
+}
+
+func (e *HealthCheckFailedError) Error() string {
+	return "the future root failed its health checks:\n" + e.Report.String()
+}
+
+// CheckRootHealth checks that the root mounted at root can boot: its kernel,
+// found in bootDir, must have an initrd and modules, /sbin/init must resolve
+// to an executable, its fstab must parse, its key binaries must execute and
+// its dpkg database must be consistent. The user check scripts found in
+// scriptsDir are run too, and must exit with 0. Commands are executed inside
+// the root through run.
+// It returns a HealthCheckFailedError, along with the report, if any check
+// fails.
+func CheckRootHealth(root string, bootDir string, scriptsDir string, run HealthCheckRunner) (*HealthReport, error) {
+	PrintVerboseInfo("CheckRootHealth", "running...")
+
+	report := &HealthReport{Root: root}
+
+	message, err := checkKernel(root, bootDir)
+	report.add("kernel", message, err)
+
+	message, err = checkInit(root)
+	report.add("init", message, err)
+
+	message, err = checkFstab(root)
+	report.add("fstab", message, err)
+
+	for _, cmd := range HealthCheckCommands {
+		out, err := run(cmd)
+		if err != nil {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
+		}
+		report.add("exec "+strings.Fields(cmd)[0], "executed", err)
+	}
+
+	message, err = checkDpkg(root, run)
+	report.add("dpkg", message, err)
+
+	scripts, err := os.ReadDir(scriptsDir)
+	if err != nil && !os.IsNotExist(err) {
+		PrintVerboseErr("CheckRootHealth", 0, err)
+		return nil, err
+	}
+	for _, script := range scripts {
+		info, err := os.Stat(filepath.Join(scriptsDir, script.Name()))
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			PrintVerboseWarn("CheckRootHealth", 1, "skipping", script.Name(), "as it is not an executable file")
+			continue
+		}
+
+		message, err := runCheckScript(root, filepath.Join(scriptsDir, script.Name()), run)
+		report.add("script "+script.Name(), message, err)
+	}
+
+	if !report.Passed() {
+		err := &HealthCheckFailedError{Report: report}
+		PrintVerboseErr("CheckRootHealth", 2, err)
+		return report, err
+	}
+
+	PrintVerboseInfo("CheckRootHealth", "all checks passed")
+	return report, nil
+}
+
+// checkKernel checks that the latest kernel in bootDir has a matching initrd
+// and modules directory
+func checkKernel(root string, bootDir string) (string, error) {
+	kernelVer := getKernelVersion(bootDir)
+	if kernelVer == "" {
+		return "", fmt.Errorf("no kernel found in %s", bootDir)
+	}
+
+	initrd := filepath.Join(bootDir, "initrd.img-"+kernelVer)
+	info, err := os.Stat(initrd)
+	if err != nil {
+		return "", fmt.Errorf("no initrd for kernel %s: %w", kernelVer, err)
+	}
+	if info.Size() == 0 {
+		return "", fmt.Errorf("the initrd of kernel %s is empty", kernelVer)
+	}
+
+	modulesDir, err := resolveInRoot(root, "/usr/lib/modules/"+kernelVer)
+	if err != nil {
+		return "", fmt.Errorf("no modules for kernel %s: %w", kernelVer, err)
+	}
+	info, err = os.Stat(filepath.Join(root, modulesDir))
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("no modules for kernel %s", kernelVer)
+	}
+
+	return "kernel " + kernelVer + " has an initrd and modules", nil
+}
+
+// checkInit checks that /sbin/init resolves to an executable inside root
+func checkInit(root string) (string, error) {
+	initPath, err := resolveInRoot(root, "/sbin/init")
+	if err != nil {
+		return "", fmt.Errorf("/sbin/init does not resolve: %w", err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, initPath))
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+		return "", fmt.Errorf("/sbin/init resolves to %s, which is not an executable file", initPath)
+	}
+
+	return "/sbin/init resolves to " + initPath, nil
+}
+
+// checkFstab checks that every entry of the fstab of root is well formed
+func checkFstab(root string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(root, "etc", "fstab"))
+	if err != nil {
+		return "", err
+	}
+
+	entries := 0
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields) > 6 {
+			return "", fmt.Errorf("line %d: expected 4 to 6 fields, found %d", i+1, len(fields))
+		}
+		for _, field := range fields[4:] {
+			_, err := strconv.Atoi(field)
+			if err != nil {
+				return "", fmt.Errorf("line %d: %q is not a number", i+1, field)
+			}
+		}
+		entries++
+	}
+
+	return fmt.Sprintf("%d entries", entries), nil
+}
+
+// checkDpkg checks that the dpkg database of root is consistent, if any
+func checkDpkg(root string, run HealthCheckRunner) (string, error) {
+	_, err := os.Stat(filepath.Join(root, "var", "lib", "dpkg", "status"))
+	if os.IsNotExist(err) {
+		return "no dpkg database", nil
+	}
+
+	out, err := run("dpkg --audit")
+	out = strings.TrimSpace(out)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, out)
+	}
+	if out != "" {
+		return "", errors.New(out)
+	}
+
+	return "database consistent", nil
+}
+
+// runCheckScript copies a user check script into the root and runs it there
+func runCheckScript(root string, script string, run HealthCheckRunner) (string, error) {
+	content, err := os.ReadFile(script)
+	if err != nil {
+		return "", err
+	}
+
+	runDir := filepath.Join(root, healthScriptsRunDir)
+	err = os.MkdirAll(runDir, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(script)
+	err = os.WriteFile(filepath.Join(runDir, name), content, 0o755)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(filepath.Join(runDir, name))
+
+	out, err := run(filepath.Join(healthScriptsRunDir, name))
+	out = strings.TrimSpace(out)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, out)
+	}
+
+	return "passed", nil
+}
+
+// resolveInRoot resolves the symlinks of path as if root was the root of
+// the filesystem, and returns the resulting path relative to root
+func resolveInRoot(root string, path string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(path, "/")
+	hops := 0
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,210 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// HistoryFile is where the history of the operations is kept, one JSON
+// entry per line
+var HistoryFile = filepath.Join(AbrootVarDir, "history.jsonl")
+
+// Results of the operations recorded in the history
+const (
+	HISTORY_SUCCESS       = "success"
+	HISTORY_FAILED        = "failed"
+	HISTORY_NOTHING_TO_DO = "nothing-to-do"
+)
+
+// Operation types recorded in the history besides the ABSystemOperation ones
+const (
+	HISTORY_ROLLBACK = "rollback"
+	HISTORY_REBASE   = "rebase"
+	HISTORY_KARGS    = "kargs"
+)
+
+// errNothingToDo is given to HistoryEntry.Finish by the operations which
+// ended without changing anything for another reason than ErrNoUpdate
+var errNothingToDo = errors.New("nothing to do")
+
+// HistoryEntry is the record of an operation in the history
+type HistoryEntry struct {
+	// ID is the ID of the operation log, see StartOperationLog
+	ID              string    `json:"id,omitempty"`
+	Operation       string    `json:"operation"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DryRun          bool      `json:"dryRun,omitempty"`
+	Image           string    `json:"image,omitempty"`
+	OldDigest       string    `json:"oldDigest,omitempty"`
+	NewDigest       string    `json:"newDigest,omitempty"`
+	PackagesAdded   []string  `json:"packagesAdded,omitempty"`
+	PackagesRemoved []string  `json:"packagesRemoved,omitempty"`
+	Result          string    `json:"result"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// NewHistoryEntry starts the record of an operation of the given type
+func NewHistoryEntry(operation string) *HistoryEntry {
+	return &HistoryEntry{
+		ID:        CurrentOperationID(),
+		Operation: operation,
+		Started:   time.Now(),
+	}
+}
+
+// Finish sets the result of the operation from the error it returned, then
+// appends the entry to the history. Errors are only logged, since failing to
+// record an operation must not make it fail.
+func (e *HistoryEntry) Finish(err error) {
+	e.Finished = time.Now()
+	if e.ID == "" {
+		e.ID = CurrentOperationID()
+	}
+
+	switch {
+	case err == nil:
+		e.Result = HISTORY_SUCCESS
+	case errors.Is(err, ErrNoUpdate), errors.Is(err, errNothingToDo):
+		e.Result = HISTORY_NOTHING_TO_DO
+	default:
+		e.Result = HISTORY_FAILED
+		e.Error = err.Error()
+	}
+
+	writeErr := AppendHistory(e)
+	if writeErr != nil {
+		PrintVerboseWarn("HistoryEntry.Finish", 0, "could not record the operation in the history:", writeErr)
+	}
+}
+
+// AppendHistory appends an entry to the history
+func AppendHistory(entry *HistoryEntry) error {
+	PrintVerboseInfo("AppendHistory", "running...")
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		PrintVerboseErr("AppendHistory", 0, err)
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(HistoryFile), 0o755)
+	if err != nil {
+		PrintVerboseErr("AppendHistory", 1, err)
+		return err
+	}
+
+	file, err := os.OpenFile(HistoryFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		PrintVerboseErr("AppendHistory", 2, err)
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		PrintVerboseErr("AppendHistory", 3, err)
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		PrintVerboseErr("AppendHistory", 4, err)
+		return err
+	}
+
+	return nil
+}
+
+// HistoryFilter selects entries of the history, empty fields match any
+// entry
+type HistoryFilter struct {
+	Operation string
+	Result    string
+	Since     time.Time
+
+	// Limit is the maximum number of entries returned, the most recent
+	// ones, 0 for no limit
+	Limit int
+}
+
+// matches reports whether an entry is selected by the filter
+func (f *HistoryFilter) matches(entry *HistoryEntry) bool {
+	if f.Operation != "" && entry.Operation != f.Operation {
+		return false
+	}
+	if f.Result != "" && entry.Result != f.Result {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Started.Before(f.Since) {
+		return false
+	}
+
+	return true
+}
+
+// ReadHistory returns the entries of the history selected by filter, from
+// the most recent to the oldest. Lines which can't be parsed, e.g. one cut
+// by a power loss, are skipped.
+func ReadHistory(filter HistoryFilter) ([]HistoryEntry, error) {
+	PrintVerboseInfo("ReadHistory", "running...")
+
+	entries := []HistoryEntry{}
+
+	file, err := os.Open(HistoryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		PrintVerboseErr("ReadHistory", 0, err)
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			PrintVerboseWarn("ReadHistory", 1, "skipping invalid entry:", err)
+			continue
+		}
+
+		if filter.matches(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		PrintVerboseErr("ReadHistory", 2, err)
+		return nil, err
+	}
+
+	// most recent first
+	slices.Reverse(entries)
+
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,172 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// HooksDir is the directory containing a <stage>.d directory of hooks for
+// each HookStage
+const HooksDir = "/etc/abroot/hooks"
+
+// HookStage represents a point of an operation at which hooks are executed
+type HookStage string
+
+// Supported HookStage types
+const (
+	// Before anything is deployed to the future root, can veto the operation
+	HOOK_PRE_UPGRADE HookStage = "pre-upgrade"
+	// After the future root has been deployed, while it is still mounted
+	HOOK_POST_DEPLOY HookStage = "post-deploy"
+	// Before the bootloader is switched to the future root, can veto the
+	// operation
+	HOOK_PRE_REBOOT HookStage = "pre-reboot"
+	// After a successful rollback
+	HOOK_POST_ROLLBACK HookStage = "post-rollback"
+)
+
+// CanVeto returns true if a failing hook of the stage stops the operation
+func (h HookStage) CanVeto() bool {
+	return strings.HasPrefix(string(h), "pre-")
+}
+
+// HookEnv describes the operation hooks are executed for. It is passed to
+// the hooks as ABROOT_* environment variables.
+type HookEnv struct {
+	Operation    string
+	PresentLabel string
+	FutureLabel  string
+	OldDigest    string
+	NewDigest    string
+	FutureRoot   string
+	DryRun       bool
+}
+
+// Environ returns the environment of a hook of the given stage
+func (e *HookEnv) Environ(stage HookStage) []string {
+	dryRun := "0"
+	if e.DryRun {
+		dryRun = "1"
+	}
+
+	return append(os.Environ(),
+		"ABROOT_HOOK="+string(stage),
+		"ABROOT_OPERATION="+e.Operation,
+		"ABROOT_PRESENT_LABEL="+e.PresentLabel,
+		"ABROOT_FUTURE_LABEL="+e.FutureLabel,
+		"ABROOT_OLD_DIGEST="+e.OldDigest,
+		"ABROOT_NEW_DIGEST="+e.NewDigest,
+		"ABROOT_FUTURE_ROOT="+e.FutureRoot,
+		"ABROOT_DRY_RUN="+dryRun,
+	)
+}
+
+// HookVetoError is returned when a hook of a stage which can veto the
+// operation fails
+type HookVetoError struct {
+	Hook     string
+	Stage    HookStage
+	ExitCode int
+}
+
+func (e *HookVetoError) Error() string {
+	return fmt.Sprintf("%s hook %s vetoed the operation with exit code %d", e.Stage, e.Hook, e.ExitCode)
+}
+
+// RunHooks executes the hooks of the given stage found in HooksDir
+func RunHooks(stage HookStage, env *HookEnv) error {
+	return RunHooksFrom(HooksDir, stage, env)
+}
+
+// RunHooksFrom executes, in lexical order, the executable files found in the
+// <stage>.d directory of hooksDir. The output of each hook is logged. If the
+// stage can veto the operation, the first failing hook stops the execution
+// and a HookVetoError is returned, otherwise failures are only logged.
+func RunHooksFrom(hooksDir string, stage HookStage, env *HookEnv) error {
+	PrintVerboseInfo("RunHooks", "running", stage, "hooks...")
+
+	stageDir := filepath.Join(hooksDir, string(stage)+".d")
+	entries, err := os.ReadDir(stageDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			PrintVerboseInfo("RunHooks", "no", stage, "hooks")
+			return nil
+		}
+		PrintVerboseErr("RunHooks", 0, err)
+		return err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		// follow symlinks, so that hooks can be linked from elsewhere
+		info, err := os.Stat(filepath.Join(stageDir, entry.Name()))
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			PrintVerboseWarn("RunHooks", 1, "skipping", entry.Name(), "as it is not an executable file")
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hookPath := filepath.Join(stageDir, name)
+		PrintVerboseInfo("RunHooks", "executing", stage, "hook", hookPath)
+
+		var output bytes.Buffer
+		cmd := exec.Command(hookPath)
+		cmd.Env = env.Environ(stage)
+		cmd.Dir = stageDir
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := cmd.Run()
+
+		for _, line := range strings.Split(strings.TrimRight(output.String(), "\n"), "\n") {
+			if line != "" {
+				PrintVerboseInfo("RunHooks", name+":", line)
+			}
+		}
+
+		if err == nil {
+			PrintVerboseInfo("RunHooks", "hook", name, "succeeded")
+			continue
+		}
+
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+
+		if stage.CanVeto() {
+			vetoErr := &HookVetoError{Hook: name, Stage: stage, ExitCode: exitCode}
+			PrintVerboseErr("RunHooks", 2, vetoErr, err)
+			return vetoErr
+		}
+		PrintVerboseWarn("RunHooks", 3, "hook", name, "failed:", err)
+	}
+
+	return nil
+}
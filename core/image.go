@@ -28,25 +28,64 @@ import (
 // investigate the current ABImage on an ABRoot system, you can find it
 // at /abimage.abr
 type ABImage struct {
+	// Digest is the digest of the manifest for this platform
 	Digest    digest.Digest `json:"digest"`
 	Timestamp time.Time     `json:"timestamp"`
 	Image     string        `json:"image"`
+
+	// IndexDigest is the digest of the manifest list Digest was selected
+	// from, empty for single-platform images and older records
+	IndexDigest digest.Digest `json:"indexDigest,omitempty"`
+
+	// Platform is the platform Digest was selected for, e.g. linux/amd64
+	Platform string `json:"platform,omitempty"`
+}
+
+// PlatformImage identifies the manifest of an image for this platform,
+// along with the manifest list it was selected from, if any
+type PlatformImage struct {
+	Digest      digest.Digest
+	IndexDigest digest.Digest
+	Platform    string
 }
 
 // NewABImage creates a new ABImage instance and returns a pointer to it,
 // if the digest is empty, it returns an error
-func NewABImage(digest digest.Digest, image string) (*ABImage, error) {
-	if digest == "" {
+func NewABImage(platformImage PlatformImage, image string) (*ABImage, error) {
+	if platformImage.Digest == "" {
 		return nil, fmt.Errorf("NewABImage: digest is empty")
 	}
 
 	return &ABImage{
-		Digest:    digest,
-		Timestamp: time.Now(),
-		Image:     image,
+		Digest:      platformImage.Digest,
+		Timestamp:   time.Now(),
+		Image:       image,
+		IndexDigest: platformImage.IndexDigest,
+		Platform:    platformImage.Platform,
 	}, nil
 }
 
+// PlatformImage returns the platform manifest the ABImage was deployed from
+func (a *ABImage) PlatformImage() PlatformImage {
+	return PlatformImage{
+		Digest:      a.Digest,
+		IndexDigest: a.IndexDigest,
+		Platform:    a.Platform,
+	}
+}
+
+// IsSameImage reports whether the given platform manifest is the one the
+// ABImage was deployed from. Records written before platform digests were
+// tracked may hold the digest of the manifest list instead, which is
+// accepted too.
+func (a *ABImage) IsSameImage(platformImage PlatformImage) bool {
+	if a.Digest == platformImage.Digest {
+		return true
+	}
+
+	return a.IndexDigest == "" && platformImage.IndexDigest != "" && a.Digest == platformImage.IndexDigest
+}
+
 // NewABImageFromRoot returns the current ABImage by parsing /abimage.abr, if
 // it fails, it returns an error (e.g. if the file doesn't exist).
 // Note for distro maintainers: if the /abimage.abr is not present, it could
@@ -0,0 +1,279 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"go.podman.io/storage"
+	"golang.org/x/sys/unix"
+)
+
+// layersRecordFile is the file, relative to a root, listing the image layers
+// materialized in it
+const layersRecordFile = "abroot-layers.abr"
+
+// incrementalSyncsFile is the file, relative to a root, counting the
+// incremental syncs since its last full sync
+const incrementalSyncsFile = "abroot-incremental-syncs.abr"
+
+// Markers used by the OCI layer format when the overlay driver stores
+// whiteouts as regular files
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// RootLayer represents an image layer materialized in a root, with the paths
+// it adds, changes or removes
+type RootLayer struct {
+	Digest digest.Digest `json:"digest"`
+	Paths  []string      `json:"paths"`
+
+	// OpaqueDirs are the directories whose lower contents the layer hides
+	OpaqueDirs []string `json:"opaqueDirs,omitempty"`
+}
+
+// ReadRootLayers returns the layers recorded in the given root. A nil slice
+// is returned if the root has no record, e.g. if it was never deployed by a
+// layer aware ABRoot.
+func ReadRootLayers(root string) ([]RootLayer, error) {
+	PrintVerboseInfo("ReadRootLayers", "running...")
+
+	data, err := os.ReadFile(filepath.Join(root, layersRecordFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		PrintVerboseErr("ReadRootLayers", 0, err)
+		return nil, err
+	}
+
+	var layers []RootLayer
+	err = json.Unmarshal(data, &layers)
+	if err != nil {
+		PrintVerboseErr("ReadRootLayers", 1, err)
+		return nil, err
+	}
+
+	return layers, nil
+}
+
+// WriteRootLayers records the layers materialized in the given root
+func WriteRootLayers(root string, layers []RootLayer) error {
+	PrintVerboseInfo("WriteRootLayers", "running...")
+
+	data, err := json.Marshal(layers)
+	if err != nil {
+		PrintVerboseErr("WriteRootLayers", 0, err)
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(root, layersRecordFile), data, 0o644)
+	if err != nil {
+		PrintVerboseErr("WriteRootLayers", 1, err)
+		return err
+	}
+
+	return nil
+}
+
+// ReadIncrementalSyncs returns how many incremental syncs the given root got
+// since its last full sync, 0 if it has no count
+func ReadIncrementalSyncs(root string) int {
+	data, err := os.ReadFile(filepath.Join(root, incrementalSyncsFile))
+	if err != nil {
+		return 0
+	}
+
+	syncs, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		PrintVerboseWarn("ReadIncrementalSyncs", 0, "ignoring invalid count:", err)
+		return 0
+	}
+	return syncs
+}
+
+// WriteIncrementalSyncs records how many incremental syncs the given root
+// got since its last full sync
+func WriteIncrementalSyncs(root string, syncs int) error {
+	return os.WriteFile(filepath.Join(root, incrementalSyncsFile), []byte(strconv.Itoa(syncs)+"\n"), 0o644)
+}
+
+// DiffRootLayers compares the layers recorded in a root with the ones of a
+// new image. It returns how many bottom layers the two share and the paths
+// and opaque directories touched by the layers above those, which are the
+// only ones that can differ between the root and the new image, as long as
+// nothing else changed the root: files belonging to no layer are not
+// listed, only a full sync removes them.
+func DiffRootLayers(oldLayers []RootLayer, newLayers []RootLayer) (int, []string, []string) {
+	common := 0
+	for common < len(oldLayers) && common < len(newLayers) {
+		if oldLayers[common].Digest == "" || oldLayers[common].Digest != newLayers[common].Digest {
+			break
+		}
+		common++
+	}
+
+	paths := []string{}
+	opaqueDirs := []string{}
+	for _, layer := range append(slices.Clone(oldLayers[common:]), newLayers[common:]...) {
+		paths = append(paths, layer.Paths...)
+		opaqueDirs = append(opaqueDirs, layer.OpaqueDirs...)
+	}
+
+	slices.Sort(paths)
+	slices.Sort(opaqueDirs)
+
+	return common, slices.Compact(paths), slices.Compact(opaqueDirs)
+}
+
+// getImageLayers returns the layers of the image with the given top layer,
+// from the bottom one, along with the paths each of them touches
+func getImageLayers(store storage.Store, topLayer string) ([]RootLayer, error) {
+	PrintVerboseInfo("getImageLayers", "running...")
+
+	if store.GraphDriverName() != "overlay" {
+		err := fmt.Errorf("unsupported storage driver %s", store.GraphDriverName())
+		PrintVerboseErr("getImageLayers", 0, err)
+		return nil, err
+	}
+
+	layers := []RootLayer{}
+	for id := topLayer; id != ""; {
+		layer, err := store.Layer(id)
+		if err != nil {
+			PrintVerboseErr("getImageLayers", 1, err)
+			return nil, err
+		}
+
+		diffDir := filepath.Join(store.GraphRoot(), "overlay", layer.ID, "diff")
+		paths, opaqueDirs, err := readLayerDiff(diffDir)
+		if err != nil {
+			PrintVerboseErr("getImageLayers", 2, err)
+			return nil, err
+		}
+
+		layers = append(layers, RootLayer{
+			Digest:     layer.UncompressedDigest,
+			Paths:      paths,
+			OpaqueDirs: opaqueDirs,
+		})
+		id = layer.Parent
+	}
+
+	slices.Reverse(layers)
+	return layers, nil
+}
+
+// readLayerDiff returns the paths, relative to the root, touched by the
+// overlay diff directory of a layer, whiteouts included, and the
+// directories it makes opaque
+func readLayerDiff(diffDir string) ([]string, []string, error) {
+	paths := []string{}
+	opaqueDirs := []string{}
+
+	err := filepath.WalkDir(diffDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(diffDir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		name := d.Name()
+		switch {
+		case name == whiteoutOpaque:
+			opaqueDirs = append(opaqueDirs, filepath.Dir(relPath))
+		case strings.HasPrefix(name, whiteoutPrefix):
+			paths = append(paths, filepath.Join(filepath.Dir(relPath), strings.TrimPrefix(name, whiteoutPrefix)))
+		default:
+			paths = append(paths, relPath)
+			if d.IsDir() && isOpaqueDir(path) {
+				opaqueDirs = append(opaqueDirs, relPath)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return paths, opaqueDirs, nil
+}
+
+// isOpaqueDir reports whether an overlay directory hides the contents of the
+// lower ones
+func isOpaqueDir(path string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		n, err := unix.Lgetxattr(path, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// syncChangedPaths syncs only the given paths and opaque directories from
+// the image mounted at src into the root at dest. Paths missing from the
+// image are deleted from the root, while the paths which are not given are
+// left alone, even if they don't belong to the image.
+func syncChangedPaths(src string, dest string, paths []string, opaqueDirs []string, listFile string) error {
+	PrintVerboseInfo("syncChangedPaths", "syncing", len(paths), "paths and", len(opaqueDirs), "opaque directories")
+
+	err := os.WriteFile(listFile, []byte(strings.Join(paths, "\n")+"\n"), 0o644)
+	if err != nil {
+		PrintVerboseErr("syncChangedPaths", 0, err)
+		return err
+	}
+
+	err = rsyncCmd(src+"/", dest, []string{"--files-from=" + listFile, "--delete-missing-args", "--force", "--checksum"}, false)
+	if err != nil {
+		PrintVerboseErr("syncChangedPaths", 1, err)
+		return err
+	}
+
+	for _, dir := range opaqueDirs {
+		srcDir := filepath.Join(src, dir)
+		if _, err := os.Stat(srcDir); err != nil {
+			// the directory was removed and its deletion already synced
+			continue
+		}
+
+		err = rsyncCmd(srcDir+"/", filepath.Join(dest, dir), []string{"--delete", "--checksum"}, true)
+		if err != nil {
+			PrintVerboseErr("syncChangedPaths", 2, err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -13,60 +13,241 @@ package core
 		consistent state.
 */
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	humanize "github.com/dustin/go-humanize"
+	"github.com/vanilla-os/abroot/settings"
 	"github.com/vanilla-os/orchid/cmdr"
 )
 
-// logFile is a file handle for the log file
-var logFile *os.File
+// LogDir is where the logs of the operations are kept
+const LogDir = "/var/log/abroot"
+
+// logBufferLimit is the maximum size of the records kept in memory until
+// the log of an operation is started
+const logBufferLimit = 1 << 20
+
+// logFollowInterval is how often a followed log is checked for new records
+const logFollowInterval = 500 * time.Millisecond
+
+// logFileRegex matches the name of the log files, capturing the start time
+// and ID of the operation and the number of the rotated part, if any
+var logFileRegex = regexp.MustCompile(`^abroot-(\d{8}-\d{6})-([0-9a-f]+)(?:\.(\d+))?\.json$`)
+
+// logTimeFormat is the format of the start time in the log file names
+const logTimeFormat = "20060102-150405"
+
+// legacyLogGlob matches the log files written by older versions, one per
+// invocation
+const legacyLogGlob = "/var/log/abroot.log.*"
+
+// operationLogWriter writes the records to the log file of the current
+// operation, rotating it once it exceeds maxSize. Until an operation is
+// started, records are kept in memory, so that nothing is written by
+// commands which don't change the system.
+type operationLogWriter struct {
+	mu      sync.Mutex
+	buffer  bytes.Buffer
+	id      string
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	parts   int
+}
+
+func (w *operationLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if w.buffer.Len()+len(p) <= logBufferLimit {
+			w.buffer.Write(p)
+		}
+		return len(p), nil
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// start directs the records to the given file, starting with the ones
+// kept in memory so far
+func (w *operationLogWriter) start(id string, path string, file *os.File, maxSize int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.id = id
+	w.path = path
+	w.file = file
+	w.maxSize = maxSize
+
+	n, err := w.buffer.WriteTo(file)
+	w.size = n
+	w.buffer.Reset()
+	return err
+}
+
+// rotate moves the current log file to the next numbered part and opens a
+// new one in its place
+func (w *operationLogWriter) rotate() error {
+	w.parts++
+
+	err := w.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(w.path, rotatedLogPath(w.path, w.parts))
+	if err != nil {
+		return err
+	}
+
+	w.file, err = os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	w.size = 0
+	return err
+}
+
+// Close closes the log file, the records written afterwards being kept in
+// memory again
+func (w *operationLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// NewOperationLogWriter returns a writer to the log file at path, rotated
+// once it exceeds maxSize bytes like the logs of the operations
+func NewOperationLogWriter(path string, maxSize int64) (io.WriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &operationLogWriter{}
+	err = w.start("", path, file, maxSize)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// rotatedLogPath returns the path the given part of a log is rotated to
+func rotatedLogPath(path string, part int) string {
+	return strings.TrimSuffix(path, ".json") + "." + strconv.Itoa(part) + ".json"
+}
+
+// logWriter receives the records of all the PrintVerbose* functions
+var logWriter = &operationLogWriter{}
+
+// logHandler formats the records as JSON objects, one per line
+var logHandler = slog.NewJSONHandler(logWriter, &slog.HandlerOptions{Level: slog.LevelDebug})
 
 // printLog is a logger to Stdout for verbose information
 var printLog = log.New(os.Stdout, "(Verbose) ", 0)
 
-// init initializes the log file and sets up logging
-func init() {
-	PrintVerboseInfo("NewLogFile", "running...")
+// StartOperationLog starts the log of an operation: the records logged so
+// far, and all the following ones, are written to a new file in LogDir
+// named after the start time and a new operation ID, which is returned.
+// Old log files are removed according to logMaxFiles and logRetentionDays.
+// If a log was already started by this process, its ID is returned.
+func StartOperationLog(operation string) (string, error) {
+	if id := CurrentOperationID(); id != "" {
+		return id, nil
+	}
 
-	// Incremental value to append to log file name
-	incremental := 0
+	PrintVerboseInfo("StartOperationLog", "running...")
 
-	// Check for existing log files
-	logFiles, err := filepath.Glob("/var/log/abroot.log.*")
+	err := os.MkdirAll(LogDir, 0o755)
 	if err != nil {
-		// If there are no log files, start with incremental 1
-		incremental = 1
-	} else {
-		allIncrementals := []int{}
-		// Extract incremental values from existing log file names
-		for _, logFile := range logFiles {
-			_, err := fmt.Sscanf(logFile, "/var/log/abroot.log.%d", &incremental)
-			if err != nil {
-				continue
-			}
-			allIncrementals = append(allIncrementals, incremental)
-		}
-		// Set incremental to the next available value
-		if len(allIncrementals) == 0 {
-			incremental = 1
-		} else {
-			incremental = allIncrementals[len(allIncrementals)-1] + 1
+		PrintVerboseErr("StartOperationLog", 0, err)
+		return "", err
+	}
+
+	keep := -1
+	if settings.Cnf.LogMaxFiles > 0 {
+		// leave room for the new log
+		keep = int(settings.Cnf.LogMaxFiles) - 1
+	}
+	err = RemoveExpiredLogs(keep)
+	if err != nil {
+		PrintVerboseWarn("StartOperationLog", 1, "could not remove old log files:", err)
+	}
+
+	var maxSize uint64
+	if settings.Cnf.LogMaxSize != "" {
+		maxSize, err = humanize.ParseBytes(settings.Cnf.LogMaxSize)
+		if err != nil {
+			PrintVerboseWarn("StartOperationLog", 3, "invalid logMaxSize, logs won't be rotated:", err)
+			maxSize = 0
 		}
 	}
 
-	// Open or create the log file
-	logFile, err = os.OpenFile(
-		fmt.Sprintf("/var/log/abroot.log.%d", incremental),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0666,
-	)
+	idBytes := make([]byte, 4)
+	_, err = rand.Read(idBytes)
 	if err != nil {
-		PrintVerboseErrNoLog("NewLogFile", 0, "failed to open log file", err)
+		PrintVerboseErr("StartOperationLog", 4, err)
+		return "", err
 	}
+	id := hex.EncodeToString(idBytes)
+
+	path := filepath.Join(LogDir, fmt.Sprintf("abroot-%s-%s.json", time.Now().Format(logTimeFormat), id))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		PrintVerboseErr("StartOperationLog", 5, err)
+		return "", err
+	}
+
+	err = logWriter.start(id, path, file, int64(maxSize))
+	if err != nil {
+		PrintVerboseErr("StartOperationLog", 6, err)
+		return "", err
+	}
+
+	PrintVerboseInfo("StartOperationLog", "logging operation", operation, "to", path)
+	return id, nil
+}
+
+// CurrentOperationID returns the ID of the operation being logged, or an
+// empty string if no operation log was started
+func CurrentOperationID() string {
+	logWriter.mu.Lock()
+	defer logWriter.mu.Unlock()
+
+	return logWriter.id
 }
 
 // IsVerbose checks if verbose mode is enabled
@@ -93,11 +274,25 @@ func printFormattedMessage(formattedMsg string) {
 	printLog.Printf("%s\n", formattedMsg)
 }
 
-// logToFileIfEnabled logs messages to the file if logging is enabled
-func logToFileIfEnabled(formattedMsg string) {
-	if logFile != nil {
-		LogToFile(formattedMsg)
+// logRecord writes a structured record to the log
+func logRecord(prefix, level string, depth float32, msg string) error {
+	slogLevel := slog.LevelInfo
+	switch level {
+	case "warn":
+		slogLevel = slog.LevelWarn
+	case "err":
+		slogLevel = slog.LevelError
 	}
+
+	record := slog.NewRecord(time.Now(), slogLevel, msg, 0)
+	if prefix != "" {
+		record.AddAttrs(slog.String("prefix", prefix))
+	}
+	if depth > -1 {
+		record.AddAttrs(slog.String("depth", strconv.FormatFloat(float64(depth), 'f', -1, 32)))
+	}
+
+	return logHandler.Handle(context.Background(), record)
 }
 
 // PrintVerboseNoLog prints verbose messages without logging to the file
@@ -112,7 +307,7 @@ func PrintVerboseNoLog(prefix, level string, depth float32, args ...interface{})
 func PrintVerbose(prefix, level string, depth float32, args ...interface{}) {
 	PrintVerboseNoLog(prefix, level, depth, args...)
 
-	logToFileIfEnabled(formatMessage(prefix, level, depth, args...))
+	logRecord(prefix, level, depth, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 }
 
 // PrintVerboseSimpleNoLog prints simple verbose messages without logging to the file
@@ -157,19 +352,318 @@ func PrintVerboseInfo(prefix string, args ...interface{}) {
 
 // LogToFile writes messages to the log file
 func LogToFile(msg string, args ...interface{}) error {
-	if logFile != nil {
-		_, err := fmt.Fprintf(
-			logFile,
-			"%s: %s\n",
-			time.Now().Format("2006-01-02 1 15:04:05"),
-			fmt.Sprintf(msg, args...),
-		)
+	return logRecord("", "info", -1, fmt.Sprintf(msg, args...))
+}
+
+// GetLogFile returns the log file handle of the current operation, nil if
+// no operation log was started
+func GetLogFile() *os.File {
+	logWriter.mu.Lock()
+	defer logWriter.mu.Unlock()
+
+	return logWriter.file
+}
+
+// LogRecord is a record read back from an operation log
+type LogRecord struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	Msg    string    `json:"msg"`
+	Prefix string    `json:"prefix,omitempty"`
+	Depth  string    `json:"depth,omitempty"`
+}
+
+// String returns a human readable version of the record
+func (r LogRecord) String() string {
+	if r.Time.IsZero() {
+		return r.Msg
+	}
+
+	source := r.Prefix
+	if r.Depth != "" {
+		source += "(" + r.Depth + ")"
+	}
+	if source != "" {
+		source += ": "
+	}
+
+	return fmt.Sprintf("%s %-5s %s%s", r.Time.Format(time.DateTime), r.Level, source, r.Msg)
+}
+
+// parseLogLine parses a line of an operation log, lines which are not JSON
+// records are returned as the message of an empty record
+func parseLogLine(line string) LogRecord {
+	var record LogRecord
+	err := json.Unmarshal([]byte(line), &record)
+	if err != nil {
+		return LogRecord{Msg: line}
+	}
+
+	return record
+}
+
+// OperationLog represents the log files of an operation
+type OperationLog struct {
+	ID      string
+	Started time.Time
+
+	// Files are the parts of the log, from the oldest to the current one
+	Files []string
+}
+
+// ListOperationLogs returns the logs found in LogDir, from the oldest to
+// the most recent
+func ListOperationLogs() ([]OperationLog, error) {
+	PrintVerboseInfo("ListOperationLogs", "running...")
+
+	entries, err := os.ReadDir(LogDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []OperationLog{}, nil
+		}
+		PrintVerboseErr("ListOperationLogs", 0, err)
+		return nil, err
+	}
+
+	type logPart struct {
+		path string
+		num  int
+	}
+	parts := map[string][]logPart{}
+	logs := map[string]*OperationLog{}
+	for _, entry := range entries {
+		match := logFileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		started, err := time.ParseInLocation(logTimeFormat, match[1], time.Local)
+		if err != nil {
+			continue
+		}
+
+		id := match[2]
+		if _, ok := logs[id]; !ok {
+			logs[id] = &OperationLog{ID: id, Started: started}
+		}
+
+		// the current part has no number and always comes last
+		num := int(^uint(0) >> 1)
+		if match[3] != "" {
+			num, _ = strconv.Atoi(match[3])
+		}
+		parts[id] = append(parts[id], logPart{filepath.Join(LogDir, entry.Name()), num})
+	}
+
+	result := []OperationLog{}
+	for id, opLog := range logs {
+		sort.Slice(parts[id], func(i, j int) bool { return parts[id][i].num < parts[id][j].num })
+		for _, part := range parts[id] {
+			opLog.Files = append(opLog.Files, part.path)
+		}
+		result = append(result, *opLog)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Started.Equal(result[j].Started) {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Started.Before(result[j].Started)
+	})
+
+	return result, nil
+}
+
+// GetOperationLog returns the log of the operation with the given ID, or
+// the most recent one if id is empty
+func GetOperationLog(id string) (*OperationLog, error) {
+	PrintVerboseInfo("GetOperationLog", "running...")
+
+	logs, err := ListOperationLogs()
+	if err != nil {
+		PrintVerboseErr("GetOperationLog", 0, err)
+		return nil, err
+	}
+
+	if id == "" {
+		if len(logs) == 0 {
+			return nil, fmt.Errorf("no operation log found in %s", LogDir)
+		}
+		return &logs[len(logs)-1], nil
+	}
+
+	for _, opLog := range logs {
+		if opLog.ID == id {
+			return &opLog, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no log found for operation %s", id)
+}
+
+// ReadOperationLog calls handle for each record of the given log. If follow
+// is true, it then waits for new records, following the rotations of the
+// log, until ctx is done.
+func ReadOperationLog(ctx context.Context, opLog *OperationLog, follow bool, handle func(LogRecord)) error {
+	PrintVerboseInfoNoLog("ReadOperationLog", "running...")
+
+	for _, path := range opLog.Files[:len(opLog.Files)-1] {
+		err := readLogFile(path, handle)
+		if err != nil {
+			PrintVerboseErrNoLog("ReadOperationLog", 0, err)
+			return err
+		}
+	}
+
+	current := opLog.Files[len(opLog.Files)-1]
+	if !follow {
+		return readLogFile(current, handle)
+	}
+
+	file, err := os.Open(current)
+	if err != nil {
+		PrintVerboseErrNoLog("ReadOperationLog", 1, err)
 		return err
 	}
-	return nil
+	defer func() { file.Close() }()
+
+	// the number the open file has, or will have once rotated
+	part := len(opLog.Files)
+	isCurrent := true
+	done := false
+
+	reader := bufio.NewReader(file)
+	partial := ""
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			handle(parseLogLine(strings.TrimSuffix(partial, "\n")))
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			PrintVerboseErrNoLog("ReadOperationLog", 2, err)
+			return err
+		}
+
+		if done {
+			// the current file is opened before looking for the next part,
+			// so that a part rotated in the meantime is not skipped
+			next, err := os.Open(current)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					PrintVerboseErrNoLog("ReadOperationLog", 3, err)
+					return err
+				}
+			} else {
+				part++
+				isCurrent = true
+				nextPart, err := os.Open(rotatedLogPath(current, part))
+				if err == nil {
+					next.Close()
+					next = nextPart
+					isCurrent = false
+				}
+
+				file.Close()
+				file = next
+				reader.Reset(file)
+				done = false
+				continue
+			}
+		} else if !isCurrent {
+			done = true
+			continue
+		} else {
+			// a rotation renames the file, so once the path points to
+			// another file the open one only needs to be drained
+			pathInfo, err := os.Stat(current)
+			fileInfo, fileErr := file.Stat()
+			if (err != nil && os.IsNotExist(err)) || (err == nil && fileErr == nil && !os.SameFile(pathInfo, fileInfo)) {
+				done = true
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logFollowInterval):
+		}
+	}
 }
 
-// GetLogFile returns the log file handle
-func GetLogFile() *os.File {
-	return logFile
+// readLogFile calls handle for each record of a log file
+func readLogFile(path string, handle func(LogRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), logBufferLimit)
+	for scanner.Scan() {
+		handle(parseLogLine(scanner.Text()))
+	}
+
+	return scanner.Err()
+}
+
+// RemoveExpiredLogs removes the log files which exceed logRetentionDays,
+// and the oldest ones beyond the latest keep, a negative keep meaning no
+// limit. The files of the current operation are never removed.
+func RemoveExpiredLogs(keep int) error {
+	expired, err := expiredLogFiles(keep)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, path := range expired {
+		err := os.Remove(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expiredLogFiles returns the log files which exceed logRetentionDays, and
+// the oldest ones beyond the latest keep, a negative keep meaning no limit.
+// The files of the current operation are never returned.
+func expiredLogFiles(keep int) ([]string, error) {
+	logs, err := ListOperationLogs()
+	if err != nil {
+		return nil, err
+	}
+
+	currentID := CurrentOperationID()
+	files := []string{}
+	for i := len(logs) - 1; i >= 0; i-- {
+		if logs[i].ID == currentID {
+			continue
+		}
+		for j := len(logs[i].Files) - 1; j >= 0; j-- {
+			files = append(files, logs[i].Files[j])
+		}
+	}
+
+	expired := []string{}
+	retention := time.Duration(settings.Cnf.LogRetentionDays) * 24 * time.Hour
+	for i, path := range files {
+		if keep >= 0 && i >= keep {
+			expired = append(expired, path)
+			continue
+		}
+
+		if retention > 0 {
+			info, err := os.Stat(path)
+			if err == nil && time.Since(info.ModTime()) > retention {
+				expired = append(expired, path)
+			}
+		}
+	}
+
+	return expired, nil
 }
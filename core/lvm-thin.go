@@ -0,0 +1,329 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// thinSnapshotMount is where a new thin snapshot gets mounted to replay its
+// journal
+var thinSnapshotMount = filepath.Join("/run", "abroot", "thin-snapshot")
+
+// ThinPoolFullError is returned when the thin pool holding the roots has
+// less free data or metadata space than configured in thinPoolMinFreePercent
+type ThinPoolFullError struct {
+	Usage ThinPoolUsage
+}
+
+func (e *ThinPoolFullError) Error() string {
+	return fmt.Sprintf(
+		"thin pool %s/%s is too full to proceed (data %.2f%%, metadata %.2f%%, %d%% must be free)",
+		e.Usage.VgName, e.Usage.PoolName, e.Usage.DataPercent, e.Usage.MetadataPercent, settings.Cnf.ThinPoolMinFreePercent,
+	)
+}
+
+// LogicalVolume represents an LVM logical volume as reported by lvs
+type LogicalVolume struct {
+	VgName          string
+	LvName          string
+	DmPath          string
+	PoolLv          string
+	Size            uint64
+	DataPercent     float64
+	MetadataPercent float64
+}
+
+// ThinPoolUsage represents the usage of the thin pool holding the roots
+type ThinPoolUsage struct {
+	VgName          string  `json:"vgName"`
+	PoolName        string  `json:"poolName"`
+	Size            uint64  `json:"size"`
+	DataPercent     float64 `json:"dataPercent"`
+	MetadataPercent float64 `json:"metadataPercent"`
+}
+
+// Check returns a ThinPoolFullError if the free data or metadata space of
+// the pool is below the configured threshold
+func (u ThinPoolUsage) Check() error {
+	maxUsed := 100 - float64(settings.Cnf.ThinPoolMinFreePercent)
+	if u.DataPercent > maxUsed || u.MetadataPercent > maxUsed {
+		return &ThinPoolFullError{u}
+	}
+
+	return nil
+}
+
+// Free returns the data space still available in the pool
+func (u ThinPoolUsage) Free() uint64 {
+	return uint64(float64(u.Size) * (100 - u.DataPercent) / 100)
+}
+
+// LvmThinBackend is a fully managed LVM thin provisioning layout. Roots are
+// thin volumes labelled partLabelA and partLabelB, and the future one is
+// recreated as a thin snapshot of the present one on every operation, so
+// unchanged blocks are shared in the pool.
+type LvmThinBackend struct {
+	PartitionsBackend
+}
+
+// Name returns the name of the backend
+func (b *LvmThinBackend) Name() string {
+	return STORAGE_LVM_THIN
+}
+
+// PrepareFuture replaces the future volume with a thin snapshot of the
+// present one, then gives the snapshot's filesystem the future label and a
+// new UUID, so that both roots can still be told apart. The old future
+// volume is the rollback target, so this is only called once nothing but
+// the export can make the operation fail.
+func (b *LvmThinBackend) PrepareFuture(present ABRootPartition, future ABRootPartition) error {
+	PrintVerboseInfo("LvmThinBackend.PrepareFuture", "running...")
+
+	presentLv, err := getLogicalVolume(present.Partition)
+	if err != nil {
+		PrintVerboseErr("LvmThinBackend.PrepareFuture", 0, err)
+		return err
+	}
+
+	futureLv, err := getLogicalVolume(future.Partition)
+	if err != nil {
+		PrintVerboseErr("LvmThinBackend.PrepareFuture", 1, err)
+		return err
+	}
+
+	if presentLv.PoolLv == "" {
+		err := fmt.Errorf("%s/%s is not a thin volume", presentLv.VgName, presentLv.LvName)
+		PrintVerboseErr("LvmThinBackend.PrepareFuture", 2, err)
+		return err
+	}
+
+	err = runLvmCmds([][]string{
+		{"lvremove", "-y", futureLv.VgName + "/" + futureLv.LvName},
+		{"lvcreate", "-s", "-kn", "-n", futureLv.LvName, presentLv.VgName + "/" + presentLv.LvName},
+		{"udevadm", "settle"},
+	})
+	if err != nil {
+		PrintVerboseErr("LvmThinBackend.PrepareFuture", 3, err)
+		return err
+	}
+
+	// the snapshot was taken from a mounted filesystem, mount it once so
+	// that its journal gets replayed before its UUID can be changed
+	if present.FsType != "btrfs" {
+		snapshot := future.Partition
+		snapshot.MountOptions = ""
+		if snapshot.FsType == "xfs" {
+			snapshot.MountOptions = "nouuid"
+		}
+
+		err = snapshot.Mount(thinSnapshotMount)
+		if err != nil {
+			PrintVerboseErr("LvmThinBackend.PrepareFuture", 4, err)
+			return err
+		}
+
+		err = snapshot.Unmount()
+		if err != nil {
+			PrintVerboseErr("LvmThinBackend.PrepareFuture", 4.1, err)
+			return err
+		}
+	}
+
+	err = runLvmCmds(append(
+		RelabelCmds(present.FsType, futureLv.DmPath, future.Label),
+		[]string{"udevadm", "settle"},
+	))
+	if err != nil {
+		PrintVerboseErr("LvmThinBackend.PrepareFuture", 5, err)
+		return err
+	}
+
+	return nil
+}
+
+// AvailableSpace returns the free space of the root mounted at rootMount,
+// capped by what the pool can still provide. The space used in the root is
+// considered available, since its files get replaced by the new system.
+func (b *LvmThinBackend) AvailableSpace(rootMount string) (uint64, error) {
+	free, used, err := filesystemSpace(rootMount)
+	if err != nil {
+		PrintVerboseErr("LvmThinBackend.AvailableSpace", 0, err)
+		return 0, err
+	}
+
+	usage, err := GetThinPoolUsage()
+	if err != nil {
+		PrintVerboseErr("LvmThinBackend.AvailableSpace", 1, err)
+		return 0, err
+	}
+
+	return min(free, usage.Free()) + used, nil
+}
+
+// runLvmCmds runs the given commands in order, stopping at the first failure
+func runLvmCmds(cmds [][]string) error {
+	for _, args := range cmds {
+		PrintVerboseInfo("runLvmCmds", "running", strings.Join(args, " "))
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+
+		// e2fsck exits with 1 when it corrected the filesystem
+		var exitErr *exec.ExitError
+		if args[0] == "e2fsck" && errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s failed: %s: %w", args[0], strings.TrimSpace(string(out)), err)
+		}
+	}
+
+	return nil
+}
+
+// RelabelCmds returns the commands needed to set a new label and UUID on a
+// snapshotted filesystem. tune2fs refuses to change the UUID of an ext4
+// filesystem with metadata checksums unless it was just checked, which a
+// snapshot mounted to replay its journal never is.
+func RelabelCmds(fsType string, device string, label string) [][]string {
+	switch fsType {
+	case "ext4":
+		return [][]string{
+			{"e2fsck", "-f", "-y", device},
+			{"tune2fs", "-U", "random", "-L", label, device},
+		}
+	case "xfs":
+		return [][]string{{"xfs_admin", "-U", "generate", "-L", label, device}}
+	case "btrfs":
+		return [][]string{
+			{"btrfstune", "-f", "-u", device},
+			{"btrfs", "filesystem", "label", device, label},
+		}
+	}
+
+	return [][]string{{"e2label", device, label}}
+}
+
+// getLogicalVolume returns the logical volume backing the given partition
+func getLogicalVolume(partition Partition) (LogicalVolume, error) {
+	lvs, err := listLogicalVolumes()
+	if err != nil {
+		return LogicalVolume{}, err
+	}
+
+	dmPath := "/dev/mapper/" + partition.Device
+	for _, lv := range lvs {
+		if lv.DmPath == dmPath {
+			return lv, nil
+		}
+	}
+
+	return LogicalVolume{}, fmt.Errorf("%s is not an LVM logical volume", dmPath)
+}
+
+// GetThinPoolUsage returns the usage of the thin pool holding the present
+// root
+func GetThinPoolUsage() (ThinPoolUsage, error) {
+	PrintVerboseInfo("GetThinPoolUsage", "running...")
+
+	present, err := NewABRootManager().GetPresent()
+	if err != nil {
+		PrintVerboseErr("GetThinPoolUsage", 0, err)
+		return ThinPoolUsage{}, err
+	}
+
+	presentLv, err := getLogicalVolume(present.Partition)
+	if err != nil {
+		PrintVerboseErr("GetThinPoolUsage", 1, err)
+		return ThinPoolUsage{}, err
+	}
+
+	lvs, err := listLogicalVolumes()
+	if err != nil {
+		PrintVerboseErr("GetThinPoolUsage", 2, err)
+		return ThinPoolUsage{}, err
+	}
+
+	for _, lv := range lvs {
+		if lv.VgName == presentLv.VgName && lv.LvName == presentLv.PoolLv {
+			return ThinPoolUsage{
+				VgName:          lv.VgName,
+				PoolName:        lv.LvName,
+				Size:            lv.Size,
+				DataPercent:     lv.DataPercent,
+				MetadataPercent: lv.MetadataPercent,
+			}, nil
+		}
+	}
+
+	err = fmt.Errorf("could not find the thin pool of %s/%s", presentLv.VgName, presentLv.LvName)
+	PrintVerboseErr("GetThinPoolUsage", 3, err)
+	return ThinPoolUsage{}, err
+}
+
+// listLogicalVolumes returns all the logical volumes known to LVM
+func listLogicalVolumes() ([]LogicalVolume, error) {
+	out, err := exec.Command(
+		"lvs", "--reportformat", "json", "--units", "b", "--nosuffix",
+		"-o", "vg_name,lv_name,lv_dm_path,pool_lv,lv_size,data_percent,metadata_percent",
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list logical volumes: %w", err)
+	}
+
+	return ParseLvsReport(out)
+}
+
+// ParseLvsReport parses the JSON report of lvs. The usage of the volumes
+// which are not thin pools is reported empty, and read as 0.
+func ParseLvsReport(report []byte) ([]LogicalVolume, error) {
+	var lvsReport struct {
+		Report []struct {
+			Lv []map[string]string `json:"lv"`
+		} `json:"report"`
+	}
+
+	err := json.Unmarshal(report, &lvsReport)
+	if err != nil {
+		return nil, err
+	}
+
+	lvs := []LogicalVolume{}
+	for _, r := range lvsReport.Report {
+		for _, lv := range r.Lv {
+			size, _ := strconv.ParseUint(lv["lv_size"], 10, 64)
+			dataPercent, _ := strconv.ParseFloat(lv["data_percent"], 64)
+			metadataPercent, _ := strconv.ParseFloat(lv["metadata_percent"], 64)
+
+			lvs = append(lvs, LogicalVolume{
+				VgName:          lv["vg_name"],
+				LvName:          lv["lv_name"],
+				DmPath:          lv["lv_dm_path"],
+				PoolLv:          lv["pool_lv"],
+				Size:            size,
+				DataPercent:     dataPercent,
+				MetadataPercent: metadataPercent,
+			})
+		}
+	}
+
+	return lvs, nil
+}
@@ -0,0 +1,392 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsUpdateCheckInterval is how long the result of a check for updates
+// is reused, so that frequent scrapes don't query the registry every time
+const metricsUpdateCheckInterval = time.Hour
+
+// metricsStorageSizeInterval is how long the size of the image storage is
+// reused, since measuring it walks the whole directory
+const metricsStorageSizeInterval = 15 * time.Minute
+
+// upgradeOperations are the operations of the history deploying a new image
+var upgradeOperations = []string{UPGRADE, FORCE_UPGRADE, HISTORY_REBASE}
+
+// Metric is a gauge exported in the Prometheus text format
+type Metric struct {
+	Name    string
+	Help    string
+	Samples []MetricSample
+}
+
+// MetricSample is a value of a metric, identified by its labels
+type MetricSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format, which is
+// what the textfile collector of node_exporter reads
+func WriteMetrics(w io.Writer, metrics []Metric) error {
+	var b strings.Builder
+	for _, metric := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", metric.Name, escapeMetricHelp(metric.Help))
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", metric.Name)
+
+		for _, sample := range metric.Samples {
+			b.WriteString(metric.Name)
+
+			if len(sample.Labels) > 0 {
+				names := make([]string, 0, len(sample.Labels))
+				for name := range sample.Labels {
+					names = append(names, name)
+				}
+				slices.Sort(names)
+
+				labels := make([]string, 0, len(names))
+				for _, name := range names {
+					labels = append(labels, fmt.Sprintf(`%s="%s"`, name, escapeMetricLabel(sample.Labels[name])))
+				}
+				b.WriteString("{" + strings.Join(labels, ",") + "}")
+			}
+
+			b.WriteString(" " + strconv.FormatFloat(sample.Value, 'g', -1, 64) + "\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// escapeMetricHelp escapes the help text of a metric
+func escapeMetricHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// escapeMetricLabel escapes the value of a label
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// gauge returns a metric with a single sample
+func gauge(name string, help string, value float64, labels map[string]string) Metric {
+	return Metric{
+		Name:    name,
+		Help:    help,
+		Samples: []MetricSample{{Labels: labels, Value: value}},
+	}
+}
+
+// boolValue converts a boolean to the value of a metric
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// MetricsCollector collects the metrics of the system, from the same data
+// shown by `abroot status`
+type MetricsCollector struct {
+	system *ABSystem
+
+	mutex           sync.Mutex
+	lastUpdateCheck time.Time
+	updateAvailable bool
+	updateCheckErr  error
+
+	lastStorageSize  time.Time
+	storageSizeBytes int64
+	storageSizeErr   error
+}
+
+// NewMetricsCollector returns a MetricsCollector for the given system
+func NewMetricsCollector(s *ABSystem) *MetricsCollector {
+	return &MetricsCollector{system: s}
+}
+
+// Collect returns the metrics of the system. A metric which can't be
+// collected is left out, the error being logged, while abroot_up reports
+// whether all of them were collected.
+func (c *MetricsCollector) Collect() []Metric {
+	PrintVerboseInfo("MetricsCollector.Collect", "running...")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	metrics := []Metric{}
+	complete := true
+
+	image := c.system.CurImage
+	imageLabels := map[string]string{
+		"image":  image.Image,
+		"digest": image.Digest.String(),
+	}
+	if image.IndexDigest != "" {
+		imageLabels["index_digest"] = image.IndexDigest.String()
+	}
+	metrics = append(metrics, gauge("abroot_image_info", "The image deployed in the present root.", 1, imageLabels))
+
+	// Upgrades and last operation
+	lastUpgrade := image.Timestamp
+	upgrades, err := ReadHistory(HistoryFilter{Result: HISTORY_SUCCESS})
+	if err != nil {
+		PrintVerboseWarn("MetricsCollector.Collect", 0, "could not read the history:", err)
+		complete = false
+	}
+	for _, entry := range upgrades {
+		if !entry.DryRun && slices.Contains(upgradeOperations, entry.Operation) {
+			if entry.Finished.After(lastUpgrade) {
+				lastUpgrade = entry.Finished
+			}
+			break
+		}
+	}
+	metrics = append(metrics, gauge("abroot_last_upgrade_age_seconds",
+		"Seconds since the last successful upgrade.", time.Since(lastUpgrade).Seconds(), nil))
+
+	lastOperation, err := GetLastOperation()
+	if err != nil {
+		PrintVerboseWarn("MetricsCollector.Collect", 1, "could not read the history:", err)
+		complete = false
+	} else if lastOperation != nil {
+		labels := map[string]string{"operation": lastOperation.Operation}
+		metrics = append(metrics,
+			gauge("abroot_last_operation_duration_seconds", "Duration of the last operation.",
+				lastOperation.Finished.Sub(lastOperation.Started).Seconds(), labels),
+			gauge("abroot_last_operation_timestamp_seconds", "Time the last operation finished at.",
+				float64(lastOperation.Finished.Unix()), labels),
+		)
+
+		result := Metric{Name: "abroot_last_operation_result", Help: "Result of the last operation, 1 for the one it had."}
+		for _, value := range []string{HISTORY_SUCCESS, HISTORY_FAILED, HISTORY_NOTHING_TO_DO} {
+			result.Samples = append(result.Samples, MetricSample{
+				Labels: map[string]string{"operation": lastOperation.Operation, "result": value},
+				Value:  boolValue(lastOperation.Result == value),
+			})
+		}
+		metrics = append(metrics, result)
+	}
+
+	// Updates and packages
+	updateAvailable, err := c.checkUpdate()
+	if err != nil {
+		PrintVerboseWarn("MetricsCollector.Collect", 2, "could not check for updates:", err)
+		complete = false
+	} else {
+		metrics = append(metrics, gauge("abroot_update_available",
+			"Whether a newer image is available in the registry.", boolValue(updateAvailable), nil))
+	}
+
+	operationState := c.system.GetOperationState()
+	metrics = append(metrics,
+		gauge("abroot_update_staged", "Whether an update was deployed and waits for a reboot.",
+			boolValue(operationState.Finished), nil),
+		gauge("abroot_operation_running", "Whether an operation is running.",
+			boolValue(operationState.Locked), nil),
+	)
+
+	pkgM, err := NewPackageManager(false)
+	if err == nil {
+		var added, removed []string
+		added, removed, err = pkgM.GetUnstagedPackages("/")
+		if err == nil {
+			metrics = append(metrics, gauge("abroot_pending_packages",
+				"Number of package changes waiting to be applied.", float64(len(added)+len(removed)), nil))
+		}
+	}
+	if err != nil {
+		PrintVerboseWarn("MetricsCollector.Collect", 3, "could not list the pending packages:", err)
+		complete = false
+	}
+
+	// Storage
+	freeBytes := Metric{Name: "abroot_root_free_bytes", Help: "Free space of the filesystem of the present root."}
+	sizeBytes := Metric{Name: "abroot_root_size_bytes", Help: "Size of the device of each root."}
+	usages, err := c.measureRoots()
+	if err != nil {
+		PrintVerboseWarn("MetricsCollector.Collect", 4, "could not measure the roots:", err)
+		complete = false
+	}
+	for _, usage := range usages {
+		labels := map[string]string{"root": usage.Label, "role": usage.role}
+		if usage.Known {
+			freeBytes.Samples = append(freeBytes.Samples, MetricSample{Labels: labels, Value: float64(usage.Free)})
+		}
+		sizeBytes.Samples = append(sizeBytes.Samples, MetricSample{Labels: labels, Value: float64(usage.Size)})
+	}
+	metrics = append(metrics, freeBytes, sizeBytes)
+
+	storageSize, err := c.storageSize()
+	if err != nil && !os.IsNotExist(err) {
+		PrintVerboseWarn("MetricsCollector.Collect", 5, "could not measure the storage directory:", err)
+		complete = false
+	} else {
+		metrics = append(metrics, gauge("abroot_storage_size_bytes",
+			"Size of the image storage in "+abrootStorageDir+".", float64(storageSize), nil))
+	}
+
+	metrics = append(metrics, gauge("abroot_up", "Whether all the metrics could be collected.", boolValue(complete), nil))
+
+	return metrics
+}
+
+// checkUpdate checks the registry for an update, reusing the last result
+// for metricsUpdateCheckInterval
+func (c *MetricsCollector) checkUpdate() (bool, error) {
+	if time.Since(c.lastUpdateCheck) < metricsUpdateCheckInterval {
+		return c.updateAvailable, c.updateCheckErr
+	}
+
+	_, c.updateAvailable, c.updateCheckErr = c.system.CheckUpdate()
+	c.lastUpdateCheck = time.Now()
+	return c.updateAvailable, c.updateCheckErr
+}
+
+// rootUsage is the usage of a root along with its role
+type rootUsage struct {
+	PartitionUsage
+	role string
+}
+
+// measureRoots returns the usage of the roots without taking the operation
+// lock, so that scrapes never race an operation: the present root is
+// measured through the filesystem mounted at /, while only the size of the
+// device of the future root is reported, since it may be recreated at any
+// time.
+func (c *MetricsCollector) measureRoots() ([]rootUsage, error) {
+	usages := []rootUsage{}
+	for _, root := range c.system.RootM.Partitions {
+		part := root.Partition
+		if root.IdentifiedAs == "present" {
+			part.MountPoint = "/"
+		}
+
+		usage, err := part.Usage()
+		if err != nil && !errors.Is(err, ErrUsageUnknown) {
+			return usages, fmt.Errorf("could not measure root %s: %w", root.Label, err)
+		}
+		if root.IdentifiedAs == "future" {
+			usage.Known, usage.Free, usage.Used = false, 0, 0
+		}
+		usages = append(usages, rootUsage{PartitionUsage: usage, role: root.IdentifiedAs})
+	}
+
+	return usages, nil
+}
+
+// storageSize returns the size of the image storage, reusing the last
+// result for metricsStorageSizeInterval since the whole directory is walked
+func (c *MetricsCollector) storageSize() (int64, error) {
+	if time.Since(c.lastStorageSize) < metricsStorageSizeInterval {
+		return c.storageSizeBytes, c.storageSizeErr
+	}
+
+	c.storageSizeBytes, c.storageSizeErr = getDirSize(abrootStorageDir)
+	c.lastStorageSize = time.Now()
+	return c.storageSizeBytes, c.storageSizeErr
+}
+
+// WriteMetricsFile writes the metrics to a file atomically, so that the
+// textfile collector never reads a partial file
+func (c *MetricsCollector) WriteMetricsFile(path string) error {
+	PrintVerboseInfo("MetricsCollector.WriteMetricsFile", "running...")
+
+	var b bytes.Buffer
+	err := WriteMetrics(&b, c.Collect())
+	if err != nil {
+		PrintVerboseErr("MetricsCollector.WriteMetricsFile", 0, err)
+		return err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err = os.WriteFile(tmpPath, b.Bytes(), 0o644)
+	if err != nil {
+		PrintVerboseErr("MetricsCollector.WriteMetricsFile", 1, err)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		PrintVerboseErr("MetricsCollector.WriteMetricsFile", 2, err)
+		return err
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (c *MetricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b bytes.Buffer
+	err := WriteMetrics(&b, c.Collect())
+	if err != nil {
+		PrintVerboseErr("MetricsCollector.ServeHTTP", 0, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// ServeMetrics serves the metrics of the system over HTTP on the given
+// address, at /metrics
+func ServeMetrics(address string, c *MetricsCollector) error {
+	PrintVerboseInfo("ServeMetrics", "running...")
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		PrintVerboseErr("ServeMetrics", 0, err)
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c)
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err = server.Serve(listener)
+	if err != nil {
+		PrintVerboseErr("ServeMetrics", 1, err)
+		return err
+	}
+
+	return nil
+}
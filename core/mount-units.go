@@ -0,0 +1,237 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mountGeneratorDirs are the directories systemd loads generators from
+var mountGeneratorDirs = []string{
+	"/etc/systemd/system-generators",
+	"/usr/local/lib/systemd/system-generators",
+	"/usr/lib/systemd/system-generators",
+}
+
+// mountGeneratorName is the name the generator running
+// `abroot mount-sys --generator` is installed as
+const mountGeneratorName = "abroot-generator"
+
+// MountGeneratorInstalled returns whether the generator is installed in the
+// given root, in which case the mount units replace the fstab entries of the
+// root, and the fstab is left as is
+func MountGeneratorInstalled(root string) bool {
+	for _, dir := range mountGeneratorDirs {
+		if _, err := os.Stat(filepath.Join(root, dir, mountGeneratorName)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// MountUnit represents a systemd mount unit generated by ABRoot, to be used
+// in place of the root's fstab entries
+type MountUnit struct {
+	What    string
+	Where   string
+	Type    string
+	Options string
+
+	// RequiresMountsFor lists the paths which must be mounted before this
+	// unit, e.g. /var for the overlays which keep their data there
+	RequiresMountsFor []string
+}
+
+// Name returns the unit file name, derived from the mount point as done by
+// systemd-escape --path --suffix=mount
+func (u *MountUnit) Name() string {
+	return EscapeUnitPath(u.Where) + ".mount"
+}
+
+// Contents returns the contents of the unit file
+func (u *MountUnit) Contents() string {
+	var b strings.Builder
+
+	b.WriteString("# Automatically generated by abroot mount-sys --generator\n\n")
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=ABRoot mount for " + u.Where + "\n")
+	b.WriteString("Documentation=https://github.com/Vanilla-OS/ABRoot\n")
+	b.WriteString("DefaultDependencies=no\n")
+	b.WriteString("Before=local-fs.target umount.target\n")
+	b.WriteString("Conflicts=umount.target\n")
+	if len(u.RequiresMountsFor) > 0 {
+		b.WriteString("RequiresMountsFor=" + strings.Join(u.RequiresMountsFor, " ") + "\n")
+	}
+
+	b.WriteString("\n[Mount]\n")
+	b.WriteString("What=" + u.What + "\n")
+	b.WriteString("Where=" + u.Where + "\n")
+	b.WriteString("Type=" + u.Type + "\n")
+	if u.Options != "" {
+		b.WriteString("Options=" + u.Options + "\n")
+	}
+
+	return b.String()
+}
+
+// EscapeUnitPath escapes a path to be used as a systemd unit name, following
+// the rules of systemd-escape --path
+func EscapeUnitPath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && (i == 0 || path[i-1] == '/'):
+			fmt.Fprintf(&b, "\\x%02x", c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+
+	return b.String()
+}
+
+// partitionMountSource returns the device path used to mount a partition,
+// preferring stable identifiers over kernel names
+func partitionMountSource(part Partition) string {
+	if part.IsDevMapper() {
+		return "/dev/mapper/" + part.Device
+	}
+
+	if part.Uuid != "" {
+		return "/dev/disk/by-uuid/" + part.Uuid
+	}
+
+	return "/dev/" + part.Device
+}
+
+// GenerateMountUnits returns the mount units for the given root and /var
+// partitions, followed by the ones for the overlays and bind mounts
+func GenerateMountUnits(root ABRootPartition, varPart Partition) ([]MountUnit, error) {
+	PrintVerboseInfo("GenerateMountUnits", "running...")
+
+	if root.Partition.FsType == "" {
+		err := errors.New("could not determine the filesystem of the root partition")
+		PrintVerboseErr("GenerateMountUnits", 0, err)
+		return nil, err
+	}
+
+	if varPart.FsType == "" {
+		err := errors.New("could not determine the filesystem of the var partition")
+		PrintVerboseErr("GenerateMountUnits", 1, err)
+		return nil, err
+	}
+
+	rootOptions := "ro"
+	if root.Partition.MountOptions != "" {
+		rootOptions += "," + root.Partition.MountOptions
+	}
+
+	units := []MountUnit{
+		{
+			What:    partitionMountSource(root.Partition),
+			Where:   "/",
+			Type:    root.Partition.FsType,
+			Options: rootOptions,
+		},
+		{
+			What:    partitionMountSource(varPart),
+			Where:   "/var",
+			Type:    varPart.FsType,
+			Options: "defaults",
+		},
+	}
+
+	overlays, err := GetOverlayMounts(root.Label)
+	if err != nil {
+		PrintVerboseErr("GenerateMountUnits", 2, err)
+		return nil, err
+	}
+	for _, overlay := range overlays {
+		units = append(units, MountUnit{
+			What:              "overlay",
+			Where:             overlay.Destination,
+			Type:              "overlay",
+			Options:           overlay.Options(),
+			RequiresMountsFor: []string{"/var"},
+		})
+	}
+
+	binds, err := GetBindMounts()
+	if err != nil {
+		PrintVerboseErr("GenerateMountUnits", 3, err)
+		return nil, err
+	}
+	for _, bind := range binds {
+		units = append(units, MountUnit{
+			What:              bind.Source,
+			Where:             bind.Destination,
+			Type:              "none",
+			Options:           bind.Options(),
+			RequiresMountsFor: []string{bind.Source},
+		})
+	}
+
+	return units, nil
+}
+
+// WriteMountUnits writes the given units into a systemd generator output
+// directory and makes local-fs.target require them
+func WriteMountUnits(units []MountUnit, dir string) error {
+	PrintVerboseInfo("WriteMountUnits", "running...")
+
+	wantsDir := filepath.Join(dir, "local-fs.target.requires")
+	err := os.MkdirAll(wantsDir, 0o755)
+	if err != nil {
+		PrintVerboseErr("WriteMountUnits", 0, err)
+		return err
+	}
+
+	for _, unit := range units {
+		unitPath := filepath.Join(dir, unit.Name())
+		err := os.WriteFile(unitPath, []byte(unit.Contents()), 0o644)
+		if err != nil {
+			PrintVerboseErr("WriteMountUnits", 1, err)
+			return err
+		}
+
+		linkPath := filepath.Join(wantsDir, unit.Name())
+		err = os.Remove(linkPath)
+		if err != nil && !os.IsNotExist(err) {
+			PrintVerboseErr("WriteMountUnits", 2, err)
+			return err
+		}
+		err = os.Symlink(filepath.Join("..", unit.Name()), linkPath)
+		if err != nil {
+			PrintVerboseErr("WriteMountUnits", 3, err)
+			return err
+		}
+	}
+
+	PrintVerboseInfo("WriteMountUnits", "wrote", len(units), "units to", dir)
+	return nil
+}
@@ -0,0 +1,261 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// AbrootVarDir is the directory in /var where ABRoot keeps its state, such
+// as the upper directories of the overlay mounts
+const AbrootVarDir = "/var/lib/abroot"
+
+// systemMounts are the mount points which are always managed by ABRoot and
+// must never be defined in the root's fstab
+var systemMounts = []string{"/", "/var", "/usr", "/etc"}
+
+// varBindMounts are the legacy bind mounts from /var, they are now symlinks
+// (see integrity.go) so their old fstab entries must be removed
+var varBindMounts = []string{"/home", "/media", "/mnt", "/root"}
+
+// InvalidMountError is returned when a mount defined in the configuration
+// is not valid
+type InvalidMountError struct {
+	Mount  string
+	Reason string
+}
+
+func (e *InvalidMountError) Error() string {
+	return fmt.Sprintf("invalid mount %s: %s", e.Mount, e.Reason)
+}
+
+// OverlayMount represents an overlay mounted on top of a directory of the
+// root at boot time
+type OverlayMount struct {
+	Destination string
+	LowerDirs   []string
+	UpperDir    string
+	WorkDir     string
+}
+
+// Options returns the mount options of the overlay
+func (o *OverlayMount) Options() string {
+	return "lowerdir=" + strings.Join(o.LowerDirs, ":") + ",upperdir=" + o.UpperDir + ",workdir=" + o.WorkDir
+}
+
+// BindMount represents a bind mount performed at boot time
+type BindMount struct {
+	Source      string
+	Destination string
+	ReadOnly    bool
+}
+
+// Options returns the mount options of the bind mount
+func (b *BindMount) Options() string {
+	if b.ReadOnly {
+		return "bind,ro"
+	}
+	return "bind"
+}
+
+// GetOverlayMounts returns the overlay mounts for the given root, starting
+// with the /etc one, followed by the ones defined in the configuration
+func GetOverlayMounts(rootLabel string) ([]OverlayMount, error) {
+	PrintVerboseInfo("GetOverlayMounts", "running...")
+
+	etcDir := filepath.Join(AbrootVarDir, "etc")
+	overlays := []OverlayMount{
+		{
+			Destination: "/etc",
+			LowerDirs:   []string{"/etc"},
+			UpperDir:    filepath.Join(etcDir, rootLabel),
+			WorkDir:     filepath.Join(etcDir, rootLabel+"-work"),
+		},
+	}
+
+	for _, conf := range settings.Cnf.ExtraOverlayMounts {
+		err := validateMountDestination(conf.Destination)
+		if err != nil {
+			PrintVerboseErr("GetOverlayMounts", 0, err)
+			return nil, err
+		}
+
+		location := filepath.Clean(conf.Location)
+		if conf.Location == "" || filepath.IsAbs(location) || strings.HasPrefix(location, "..") {
+			err := &InvalidMountError{conf.Destination, "location must be a path relative to " + AbrootVarDir}
+			PrintVerboseErr("GetOverlayMounts", 1, err)
+			return nil, err
+		}
+
+		upperName := rootLabel
+		if conf.Shared {
+			upperName = "shared"
+		}
+
+		baseDir := filepath.Join(AbrootVarDir, location)
+		overlays = append(overlays, OverlayMount{
+			Destination: filepath.Clean(conf.Destination),
+			LowerDirs:   []string{filepath.Clean(conf.Destination)},
+			UpperDir:    filepath.Join(baseDir, upperName),
+			WorkDir:     filepath.Join(baseDir, upperName+"-work"),
+		})
+	}
+
+	return overlays, nil
+}
+
+// GetBindMounts returns the bind mounts defined in the configuration
+func GetBindMounts() ([]BindMount, error) {
+	PrintVerboseInfo("GetBindMounts", "running...")
+
+	binds := []BindMount{}
+	for _, conf := range settings.Cnf.ExtraBindMounts {
+		err := validateMountDestination(conf.Destination)
+		if err != nil {
+			PrintVerboseErr("GetBindMounts", 0, err)
+			return nil, err
+		}
+
+		if !filepath.IsAbs(conf.Source) {
+			err := &InvalidMountError{conf.Destination, "source must be an absolute path"}
+			PrintVerboseErr("GetBindMounts", 1, err)
+			return nil, err
+		}
+
+		binds = append(binds, BindMount{
+			Source:      filepath.Clean(conf.Source),
+			Destination: filepath.Clean(conf.Destination),
+			ReadOnly:    conf.ReadOnly,
+		})
+	}
+
+	return binds, nil
+}
+
+// createBindDirs creates the sources and the destinations of the configured
+// bind mounts in the given root, as the early boot would once booted, so
+// that they are recorded in its manifest. The ones in /var are left out,
+// since they belong to the /var partition.
+func createBindDirs(root string) error {
+	binds, err := GetBindMounts()
+	if err != nil {
+		return err
+	}
+
+	for _, bind := range binds {
+		for _, dir := range []string{bind.Source, bind.Destination} {
+			if dir == "/var" || strings.HasPrefix(dir, "/var/") {
+				continue
+			}
+
+			err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateMountDestination makes sure a configured mount does not shadow
+// one of the mounts ABRoot relies on
+func validateMountDestination(destination string) error {
+	if !filepath.IsAbs(destination) {
+		return &InvalidMountError{destination, "destination must be an absolute path"}
+	}
+
+	if slices.Contains(systemMounts, filepath.Clean(destination)) {
+		return &InvalidMountError{destination, "destination is managed by ABRoot"}
+	}
+
+	return nil
+}
+
+// AdjustFstab returns the given fstab contents with the root entry pointing
+// to the given root. Entries for the mounts managed by ABRoot are removed,
+// since those are performed by mount-sys.
+func AdjustFstab(fstabContents string, root ABRootPartition) (string, error) {
+	PrintVerboseInfo("AdjustFstab", "running...")
+
+	managedMounts := slices.Clone(systemMounts)
+
+	overlays, err := GetOverlayMounts("")
+	if err != nil {
+		PrintVerboseErr("AdjustFstab", 0, err)
+		return "", err
+	}
+	for _, overlay := range overlays {
+		managedMounts = append(managedMounts, overlay.Destination)
+	}
+
+	binds, err := GetBindMounts()
+	if err != nil {
+		PrintVerboseErr("AdjustFstab", 1, err)
+		return "", err
+	}
+	for _, bind := range binds {
+		managedMounts = append(managedMounts, bind.Destination)
+	}
+
+	lines := strings.Split(fstabContents, "\n")
+	linesNew := make([]string, 0, len(lines)+1)
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			linesNew = append(linesNew, line)
+			continue
+		}
+
+		words := strings.Fields(line)
+		if len(words) < 2 {
+			linesNew = append(linesNew, line)
+			continue
+		}
+
+		mountpoint := filepath.Clean(words[1])
+		varBindMountLine := fmt.Sprintf("/var%s %s none defaults,bind 0 0", mountpoint, mountpoint)
+
+		if slices.Contains(managedMounts, mountpoint) || (slices.Contains(varBindMounts, mountpoint) && line == varBindMountLine) {
+			PrintVerboseInfo("AdjustFstab", "deleting line:", line)
+			continue
+		}
+
+		linesNew = append(linesNew, line)
+	}
+
+	rootFsType := root.Partition.FsType
+	if rootFsType == "" {
+		rootFsType = "auto"
+	}
+
+	rootOptions := "ro,defaults"
+	if root.Partition.MountOptions != "" {
+		rootOptions += "," + root.Partition.MountOptions
+	}
+
+	currentRootLine := "UUID=" + root.Partition.Uuid + " / " + rootFsType + " " + rootOptions + " 0 0"
+	PrintVerboseInfo("AdjustFstab", "adding line:", currentRootLine)
+
+	linesNew = append([]string{currentRootLine}, linesNew...)
+
+	return strings.Join(linesNew, "\n"), nil
+}
@@ -20,12 +20,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/containers/buildah"
 	humanize "github.com/dustin/go-humanize"
-	digest "github.com/opencontainers/go-digest"
 	"github.com/pterm/pterm"
 	"github.com/vanilla-os/abroot/settings"
 	"github.com/vanilla-os/prometheus"
@@ -33,10 +31,16 @@ import (
 	"go.podman.io/storage"
 )
 
-type NotEnoughSpaceError struct{}
+type NotEnoughSpaceError struct {
+	// Report is the result of the space check, if one was performed
+	Report *SpaceReport
+}
 
 func (v *NotEnoughSpaceError) Error() string {
-	return "not enough space in disk"
+	if v.Report == nil {
+		return "not enough space in disk"
+	}
+	return "not enough space in disk:\n" + v.Report.String()
 }
 
 var Progressbar = pterm.ProgressbarPrinter{
@@ -63,8 +67,9 @@ func padString(str string, size int) string {
 	}
 }
 
-// OciExportRootFs pulls an image from a registry
-func OciPullImage(imageName string) error {
+// OciPullImage pulls an image from a registry, downloading at no more than
+// rateLimit bytes per second (0 means no limit)
+func OciPullImage(imageName string, rateLimit uint64) error {
 	pt, err := prometheus.NewPrometheus(
 		"/var/lib/abroot/storage",
 		"overlay",
@@ -79,7 +84,7 @@ func OciPullImage(imageName string) error {
 		return nil
 	}
 
-	err = pullImageWithProgressbar(pt, "remoteimage", imageName)
+	err = pullImageWithProgressbar(pt, "remoteimage", imageName, rateLimit)
 	if err != nil {
 		PrintVerboseErr("OciPullImage", 1, err)
 		return err
@@ -160,13 +165,72 @@ func OciExportRootFs(buildImageName string, imageRecipe *ImageRecipe, transDir s
 		return err
 	}
 
-	// copy mount dir contents to dest
-	err = rsyncCmd(mountDir+"/", dest, []string{"--delete", "--delete-before", "--checksum"}, false)
+	oldLayers, err := ReadRootLayers(dest)
 	if err != nil {
-		PrintVerboseErr("OciExportRootFs", 9, err)
+		PrintVerboseWarn("OciExportRootFs", 8.6, "ignoring unreadable layers record:", err)
+		oldLayers = nil
+	}
+
+	// the record is only valid once the sync is complete, an interrupted
+	// sync must be followed by a full one
+	err = os.Remove(filepath.Join(dest, layersRecordFile))
+	if err != nil && !os.IsNotExist(err) {
+		PrintVerboseErr("OciExportRootFs", 8.7, err)
 		return err
 	}
 
+	newLayers, err := getImageLayers(pt.Store, imageBuild.TopLayer)
+	if err != nil {
+		PrintVerboseWarn("OciExportRootFs", 8.8, "could not read image layers, falling back to a full sync:", err)
+		newLayers = nil
+	}
+
+	common, changedPaths, opaqueDirs := DiffRootLayers(oldLayers, newLayers)
+	incremental := settings.Cnf.IncrementalDeploy && common > 0
+	syncs := ReadIncrementalSyncs(dest)
+	if incremental && settings.Cnf.IncrementalDeployFullSyncEvery > 0 && syncs >= int(settings.Cnf.IncrementalDeployFullSyncEvery) {
+		// only a full sync removes the files belonging to no layer
+		PrintVerboseInfo("OciExportRootFs", "forcing a full sync after", syncs, "incremental ones")
+		incremental = false
+	}
+	if incremental {
+		// only sync what the differing layers touch
+		PrintVerboseInfo("OciExportRootFs", "reusing", common, "layers, syncing the remaining", len(newLayers)-common)
+		err = syncChangedPaths(mountDir, dest, changedPaths, opaqueDirs, filepath.Join(transDir, "changed-paths"))
+		if err != nil {
+			PrintVerboseErr("OciExportRootFs", 9, err)
+			return err
+		}
+	} else {
+		// copy mount dir contents to dest
+		err = rsyncCmd(mountDir+"/", dest, []string{"--delete", "--delete-before", "--checksum"}, false)
+		if err != nil {
+			PrintVerboseErr("OciExportRootFs", 9.1, err)
+			return err
+		}
+	}
+
+	if newLayers != nil {
+		err = WriteRootLayers(dest, newLayers)
+		if err != nil {
+			PrintVerboseErr("OciExportRootFs", 9.2, err)
+			return err
+		}
+	}
+
+	if settings.Cnf.IncrementalDeploy {
+		if incremental {
+			syncs++
+		} else {
+			syncs = 0
+		}
+		err = WriteIncrementalSyncs(dest, syncs)
+		if err != nil {
+			PrintVerboseErr("OciExportRootFs", 9.3, err)
+			return err
+		}
+	}
+
 	// unmount image
 	_, err = pt.UnMountImage(imageBuild.TopLayer, true)
 	if err != nil {
@@ -198,16 +262,16 @@ func checkImageSize(imageDir string, filesystemMount string) error {
 		imageDirSize = imageDirStat.Size()
 	}
 
-	var stat syscall.Statfs_t
-	err = syscall.Statfs(filesystemMount, &stat)
+	backend, err := NewRootBackend()
 	if err != nil {
 		PrintVerboseErr("OciExportRootFs", 8.3, err)
 		return err
 	}
 
-	availableSpace := stat.Blocks * uint64(stat.Bsize)
-	if settings.Cnf.ThinProvisioning {
-		availableSpace /= 2
+	availableSpace, err := backend.AvailableSpace(filesystemMount)
+	if err != nil {
+		PrintVerboseErr("OciExportRootFs", 8.35, err)
+		return err
 	}
 
 	if uint64(imageDirSize) > availableSpace {
@@ -222,19 +286,20 @@ func checkImageSize(imageDir string, filesystemMount string) error {
 // pullImageWithProgressbar pulls the image specified in the provided recipe
 // and reports the download progress using pterm progressbars. Each blob has
 // its own bar, similar to how docker and podman report downloads in their
-// respective CLIs
-func pullImageWithProgressbar(pt *prometheus.Prometheus, name string, imageName string) error {
+// respective CLIs. Blobs resumed from a previous pull show the offset they
+// were resumed from.
+func pullImageWithProgressbar(pt *prometheus.Prometheus, name string, imageName string, rateLimit uint64) error {
 	PrintVerboseInfo("pullImageWithProgressbar", "running...")
 
 	progressCh := make(chan types.ProgressProperties)
-	manifestCh := make(chan prometheus.OciManifest)
+	doneCh := make(chan struct{})
 	errorCh := make(chan error)
 
 	defer close(progressCh)
-	defer close(manifestCh)
+	defer close(doneCh)
 	defer close(errorCh)
 
-	err := pt.PullImageAsync(imageName, name, progressCh, manifestCh, errorCh)
+	err := pullImageAsync(pt.Store, imageName, name, rateLimit, progressCh, doneCh, errorCh)
 	if err != nil {
 		PrintVerboseErr("pullImageWithProgressbar", 0, err)
 		return err
@@ -242,37 +307,49 @@ func pullImageWithProgressbar(pt *prometheus.Prometheus, name string, imageName
 
 	multi := pterm.DefaultMultiPrinter
 	bars := map[string]*pterm.ProgressbarPrinter{}
+	resumed := map[string]string{}
 
 	multi.Start()
 
 	barFmt := "%s [%s/%s]"
+	resumedBarFmt := "%s [%s/%s, resumed at %s]"
+	barTitle := func(digest string, offset uint64, total int64) string {
+		progressBytes := humanize.Bytes(offset)
+		totalBytes := humanize.Bytes(uint64(max(total, 0)))
+		if resumedAt, ok := resumed[digest]; ok {
+			return padString(fmt.Sprintf(resumedBarFmt, digest[:12], progressBytes, totalBytes, resumedAt), 28)
+		}
+		return padString(fmt.Sprintf(barFmt, digest[:12], progressBytes, totalBytes), 28)
+	}
+
 	for {
 		select {
 		case report := <-progressCh:
 			digest := report.Artifact.Digest.Encoded()
 			if pb, ok := bars[digest]; ok {
-				progressBytes := humanize.Bytes(uint64(report.Offset))
-				totalBytes := humanize.Bytes(uint64(report.Artifact.Size))
-
 				pb.Add(int(report.Offset) - pb.Current)
-
-				title := fmt.Sprintf(barFmt, digest[:12], progressBytes, totalBytes)
-				pb.UpdateTitle(padString(title, 28))
+				pb.UpdateTitle(barTitle(digest, report.Offset, report.Artifact.Size))
 			} else {
-				totalBytes := humanize.Bytes(uint64(report.Artifact.Size))
+				if report.Offset > 0 && report.Event == types.ProgressEventNewArtifact {
+					resumed[digest] = humanize.Bytes(report.Offset)
+				}
 
-				title := fmt.Sprintf(barFmt, digest[:12], "0", totalBytes)
-				newPb, err := Progressbar.WithTotal(int(report.Artifact.Size)).WithWriter(multi.NewWriter()).Start(padString(title, 28))
+				newPb, err := Progressbar.WithTotal(int(report.Artifact.Size)).WithWriter(multi.NewWriter()).Start(barTitle(digest, report.Offset, report.Artifact.Size))
 				if err != nil {
 					PrintVerboseErr("pullImageWithProgressbar", 1, err)
 					return err
 				}
+				newPb.Add(int(report.Offset))
 
 				bars[digest] = newPb
 			}
-		case <-manifestCh:
+		case <-doneCh:
 			multi.Stop()
 			return nil
+		case err := <-errorCh:
+			multi.Stop()
+			PrintVerboseErr("pullImageWithProgressbar", 2, err)
+			return err
 		}
 	}
 }
@@ -374,34 +451,27 @@ func DeleteAllButLatestImage() error {
 }
 
 // HasUpdate checks if the image/tag from the registry has a different digest
-// it returns the new digest and a boolean indicating if an update is available
-func HasUpdate(oldDigest digest.Digest) (digest.Digest, bool, error) {
+// for this platform than the current image. The digest of the manifest list
+// is ignored, since it changes whenever any of the platforms is rebuilt.
+// It returns the new platform image and a boolean indicating if an update is
+// available
+func HasUpdate(current *ABImage) (PlatformImage, bool, error) {
 	PrintVerboseInfo("OCI.HasUpdate", "Checking for updates ...")
 
-	pt, err := prometheus.NewPrometheus(
-		"/var/lib/abroot/storage",
-		"overlay",
-		settings.Cnf.MaxParallelDownloads,
-	)
-	if err != nil {
-		PrintVerboseErr("OCI.HasUpdate", 0, err)
-		return "", false, err
-	}
-
 	imageName := fmt.Sprintf("%s/%s:%s", settings.Cnf.Registry, settings.Cnf.Name, settings.Cnf.Tag)
 	PrintVerboseInfo("OCI.HasUpdate", "checking image: ", imageName)
 
-	_, newDigest, err := pt.PullManifestOnly(imageName)
+	_, newImage, err := PullManifest(imageName)
 	if err != nil {
 		PrintVerboseErr("OCI.HasUpdate", 1, err)
-		return "", false, err
+		return PlatformImage{}, false, err
 	}
 
-	if newDigest == oldDigest {
+	if current.IsSameImage(newImage) {
 		PrintVerboseInfo("OCI.HasUpdate", "no update available")
-		return "", false, nil
+		return PlatformImage{}, false, nil
 	}
 
-	PrintVerboseInfo("OCI.HasUpdate", "update available. Old digest: ", oldDigest, ", new digest: ", newDigest)
-	return newDigest, true, nil
+	PrintVerboseInfo("OCI.HasUpdate", "update available. Old digest: ", current.Digest, ", new digest: ", newImage.Digest, ", platform: ", newImage.Platform)
+	return newImage, true, nil
 }
@@ -27,15 +27,23 @@ import (
 )
 
 // BaseImagePackageDiff retrieves the added, removed, upgraded and downgraded
-// base packages (the ones bundled with the image).
-func BaseImagePackageDiff(currentDigest, newDigest digest.Digest) (
+// base packages (the ones bundled with the image) between two versions of
+// an image. The image names are given explicitly, since a rebase changes the
+// configured one before the diff is computed, and they must name the same
+// image, since the differ only compares the versions of one image.
+func BaseImagePackageDiff(currentImage string, currentDigest digest.Digest, newImage string, newDigest digest.Digest) (
 	added, upgraded, downgraded, removed []diff.PackageDiff,
 	err error,
 ) {
 	PrintVerboseInfo("PackageDiff.BaseImagePackageDiff", "running...")
 
-	imageComponents := strings.Split(settings.Cnf.Name, "/")
-	imageName := imageComponents[len(imageComponents)-1]
+	imageName := differImageName(newImage)
+	if differImageName(currentImage) != imageName {
+		err = fmt.Errorf("no package diff between different images: %s and %s", currentImage, newImage)
+		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 0, err)
+		return
+	}
+
 	reqUrl := fmt.Sprintf("%s/images/%s/diff", settings.Cnf.DifferURL, imageName)
 	body := fmt.Sprintf("{\"old_digest\": \"%s\", \"new_digest\": \"%s\"}", currentDigest, newDigest)
 
@@ -43,26 +51,26 @@ func BaseImagePackageDiff(currentDigest, newDigest digest.Digest) (
 
 	request, err := http.NewRequest(http.MethodGet, reqUrl, strings.NewReader(body))
 	if err != nil {
-		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 0, err)
+		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 1, err)
 		return
 	}
 	defer request.Body.Close()
 
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
-		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 1, err)
+		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 2, err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 2, fmt.Errorf("received non-OK status %s", resp.Status))
+		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 3, fmt.Errorf("received non-OK status %s", resp.Status))
 		return
 	}
 
 	contents, err := io.ReadAll(resp.Body)
 	if err != nil {
-		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 3, err)
+		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 4, err)
 		return
 	}
 
@@ -71,7 +79,7 @@ func BaseImagePackageDiff(currentDigest, newDigest digest.Digest) (
 	}{}
 	err = json.Unmarshal(contents, &pkgDiff)
 	if err != nil {
-		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 4, err)
+		PrintVerboseErr("PackageDiff.BaseImagePackageDiff", 5, err)
 		return
 	}
 
@@ -83,6 +91,15 @@ func BaseImagePackageDiff(currentDigest, newDigest digest.Digest) (
 	return
 }
 
+// differImageName returns the name the differ knows an image by: the last
+// component of its name, without the registry, the tag or the digest
+func differImageName(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	components := strings.Split(image, "/")
+	name, _, _ := strings.Cut(components[len(components)-1], ":")
+	return name
+}
+
 // OverlayPackageDiff retrieves the added, removed, upgraded and downgraded
 // overlay packages (the ones added manually via `abroot pkg add`).
 func OverlayPackageDiff() (
@@ -253,6 +253,14 @@ func (p *PackageManager) GetAddPackages() ([]string, error) {
 	return p.getPackages(PackagesAddFile)
 }
 
+// RestoreAddPackages writes back a list of packages read with
+// GetAddPackages, to undo removals when the operation they were made for
+// fails
+func (p *PackageManager) RestoreAddPackages(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.RestoreAddPackages", "running...")
+	return p.writeAddPackages(pkgs)
+}
+
 // GetRemovePackages returns the packages in the packages.remove file
 func (p *PackageManager) GetRemovePackages() ([]string, error) {
 	PrintVerboseInfo("PackageManager.GetRemovePackages", "running...")
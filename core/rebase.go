@@ -0,0 +1,228 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// ImageIncompatibleError is returned when the image a rebase points to
+// cannot be used by this system
+type ImageIncompatibleError struct {
+	Image  string
+	Reason string
+}
+
+func (e *ImageIncompatibleError) Error() string {
+	return fmt.Sprintf("image %s is not compatible with this system: %s", e.Image, e.Reason)
+}
+
+// RebaseTarget represents the image a rebase points to
+type RebaseTarget struct {
+	Registry string
+	Name     string
+	Tag      string
+
+	// Image is filled once the target has been inspected
+	Image *ImageInfo
+}
+
+// FullName returns the name of the target image, including its tag
+func (t *RebaseTarget) FullName() string {
+	return fmt.Sprintf("%s/%s:%s", t.Registry, t.Name, t.Tag)
+}
+
+// ParseRebaseTarget parses an image name given to rebase. The registry and
+// the tag can be omitted, in which case the configured ones are kept. The
+// first component is only considered a registry if it looks like a host,
+// so that names like vanilla-os/desktop keep working.
+func ParseRebaseTarget(name string) (*RebaseTarget, error) {
+	if name == "" {
+		return nil, fmt.Errorf("no image provided")
+	}
+
+	if strings.Contains(name, "@") {
+		return nil, fmt.Errorf("images can only be referenced by tag, not by digest: %s", name)
+	}
+
+	target := &RebaseTarget{
+		Registry: settings.Cnf.Registry,
+		Tag:      settings.Cnf.Tag,
+	}
+
+	ref := name
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		target.Registry = parts[0]
+		ref = parts[1]
+	}
+
+	// the tag is what follows the last colon of the last component
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		target.Tag = ref[i+1:]
+		ref = ref[:i]
+	}
+	target.Name = ref
+
+	if target.Name == "" || target.Tag == "" {
+		return nil, fmt.Errorf("invalid image name: %s", name)
+	}
+
+	return target, nil
+}
+
+// CheckImageCompatibility verifies that an image is built for this OS and
+// architecture and has all the labels listed in requiredImageLabels
+func CheckImageCompatibility(imageName string, info *ImageInfo) error {
+	if info.OS != "" && info.OS != runtime.GOOS {
+		return &ImageIncompatibleError{imageName, fmt.Sprintf("built for %s, not %s", info.OS, runtime.GOOS)}
+	}
+
+	if info.Architecture != runtime.GOARCH {
+		return &ImageIncompatibleError{imageName, fmt.Sprintf("built for the %s architecture, not %s", info.Architecture, runtime.GOARCH)}
+	}
+
+	for _, required := range settings.Cnf.RequiredImageLabels {
+		key, value, hasValue := strings.Cut(required, "=")
+		label, ok := info.Labels[key]
+		if !ok {
+			return &ImageIncompatibleError{imageName, fmt.Sprintf("missing label %s", key)}
+		}
+		if hasValue && label != value {
+			return &ImageIncompatibleError{imageName, fmt.Sprintf("label %s is %q, %q is required", key, label, value)}
+		}
+	}
+
+	return nil
+}
+
+// Rebase points the system to a new image. The image is inspected first, so
+// that a missing or incompatible one is rejected before anything changes.
+// The configuration is only updated in memory, so that the next operation
+// deploys the new image and writes it to the administrator configuration
+// before syncing /etc. CommitRebase must be called if no operation follows
+// or if there was no update to deploy.
+func (s *ABSystem) Rebase(name string) (target *RebaseTarget, err error) {
+	PrintVerboseInfo("ABSystem.Rebase", "running...")
+
+	// a rejected rebase is recorded here, since no operation follows it
+	defer func() {
+		if err != nil {
+			entry := NewHistoryEntry(HISTORY_REBASE)
+			entry.Image = name
+			entry.OldDigest = s.CurImage.Digest.String()
+			entry.Finish(err)
+		}
+	}()
+
+	target, err = ParseRebaseTarget(name)
+	if err != nil {
+		PrintVerboseErr("ABSystem.Rebase", 0, err)
+		return nil, err
+	}
+
+	target.Image, err = InspectImage(target.FullName())
+	if err != nil {
+		PrintVerboseErr("ABSystem.Rebase", 1, err)
+		return nil, err
+	}
+
+	err = CheckImageCompatibility(target.FullName(), target.Image)
+	if err != nil {
+		PrintVerboseErr("ABSystem.Rebase", 2, err)
+		return nil, err
+	}
+
+	settings.Cnf.Registry = target.Registry
+	settings.Cnf.Name = target.Name
+	settings.Cnf.Tag = target.Tag
+	s.rebasePending = true
+
+	s.history = NewHistoryEntry(HISTORY_REBASE)
+	s.history.Image = target.FullName()
+	s.history.OldDigest = s.CurImage.Digest.String()
+	s.history.NewDigest = target.Image.Digest.String()
+
+	PrintVerboseInfo("ABSystem.Rebase", "rebasing to", target.FullName(), "with digest", target.Image.Digest)
+	return target, nil
+}
+
+// FinishRebase records the rebase started by Rebase in the history, with
+// the result of the whole command: the operation deploying it only fills
+// in the entry, since the rebase can still fail afterwards.
+func (s *ABSystem) FinishRebase(dryRun bool, err error) {
+	if s.history == nil {
+		return
+	}
+
+	s.history.DryRun = dryRun
+	s.history.Finish(err)
+	s.history = nil
+}
+
+// CommitRebase writes the image set by Rebase to the administrator
+// configuration, unless the operation deploying it already did.
+func (s *ABSystem) CommitRebase(dryRun bool) (err error) {
+	PrintVerboseInfo("ABSystem.CommitRebase", "running...")
+
+	if dryRun {
+		PrintVerboseInfo("ABSystem.CommitRebase", "dry run, not writing the configuration")
+		return nil
+	}
+
+	if s.rebaseCommitted {
+		PrintVerboseInfo("ABSystem.CommitRebase", "already written by the operation")
+		return nil
+	}
+
+	_, err = s.writeRebaseConfig()
+	if err != nil {
+		PrintVerboseErr("ABSystem.CommitRebase", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// writeRebaseConfig writes the image set by Rebase to the administrator
+// configuration. It returns a function restoring the previous file, for the
+// operation deploying the image to undo the change if it fails.
+func (s *ABSystem) writeRebaseConfig() (func(), error) {
+	previous, readErr := os.ReadFile(settings.CnfPathAdmin)
+
+	err := writeAdminConfig()
+	if err != nil {
+		return nil, err
+	}
+	s.rebaseCommitted = true
+
+	return func() {
+		s.rebaseCommitted = false
+
+		var err error
+		if os.IsNotExist(readErr) {
+			err = os.Remove(settings.CnfPathAdmin)
+		} else if readErr == nil {
+			err = os.WriteFile(settings.CnfPathAdmin, previous, 0o644)
+		}
+		if err != nil {
+			PrintVerboseWarn("ABSystem.writeRebaseConfig", 0, "could not restore the configuration:", err)
+		}
+	}, nil
+}
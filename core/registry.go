@@ -0,0 +1,451 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/abroot/settings"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/signature"
+	istorage "go.podman.io/image/v5/storage"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+	"go.podman.io/storage"
+)
+
+// registryCertsDir is where the CA bundles of the configured registries get
+// copied, in the layout expected by the containers libraries
+var registryCertsDir = filepath.Join("/run", "abroot", "certs.d")
+
+// imagePlatformOS is the operating system ABRoot images are selected for
+// from manifest lists
+const imagePlatformOS = "linux"
+
+// ImageSource is a location an image can be pulled from, along with the
+// context needed to access it
+type ImageSource struct {
+	ImageName     string
+	SystemContext *types.SystemContext
+}
+
+// getRegistryConf returns the configuration of the registry serving the
+// given image, preferring the most specific match, or nil if there is none
+func getRegistryConf(imageName string) *settings.RegistryConf {
+	var match *settings.RegistryConf
+	for i, conf := range settings.Cnf.Registries {
+		prefix := strings.TrimSuffix(conf.Registry, "/")
+		if prefix == "" || !strings.HasPrefix(imageName, prefix) {
+			continue
+		}
+
+		// the prefix must end on a path component
+		rest := imageName[len(prefix):]
+		if rest != "" && !strings.ContainsAny(rest[:1], "/:@") {
+			continue
+		}
+
+		if match == nil || len(prefix) > len(strings.TrimSuffix(match.Registry, "/")) {
+			match = &settings.Cnf.Registries[i]
+		}
+	}
+
+	return match
+}
+
+// GetImageSources returns the sources to try, in order, to pull the given
+// image: the mirrors of its registry first, then the registry itself
+func GetImageSources(imageName string) ([]ImageSource, error) {
+	PrintVerboseInfo("GetImageSources", "running...")
+
+	names := []string{}
+	conf := getRegistryConf(imageName)
+	if conf != nil {
+		prefix := strings.TrimSuffix(conf.Registry, "/")
+		for _, mirror := range conf.Mirrors {
+			names = append(names, strings.TrimSuffix(mirror, "/")+strings.TrimPrefix(imageName, prefix))
+		}
+	}
+	names = append(names, imageName)
+
+	sources := []ImageSource{}
+	for _, name := range names {
+		sys, err := NewRegistrySystemContext(name)
+		if err != nil {
+			PrintVerboseErr("GetImageSources", 0, err)
+			return nil, err
+		}
+
+		sources = append(sources, ImageSource{ImageName: name, SystemContext: sys})
+	}
+
+	return sources, nil
+}
+
+// NewRegistrySystemContext returns the context used to access the registry
+// serving the given image, with the credentials, certificate authorities and
+// TLS policy set in its configuration
+func NewRegistrySystemContext(imageName string) (*types.SystemContext, error) {
+	// manifest lists are always resolved to the entry of this platform
+	sys := &types.SystemContext{
+		OSChoice:           imagePlatformOS,
+		ArchitectureChoice: runtime.GOARCH,
+	}
+
+	conf := getRegistryConf(imageName)
+	if conf == nil {
+		return sys, nil
+	}
+
+	if conf.AuthFile != "" {
+		sys.AuthFilePath = conf.AuthFile
+	}
+
+	if conf.CredentialHelper != "" {
+		host := strings.SplitN(conf.Registry, "/", 2)[0]
+		auth, err := getHelperCredentials(conf.CredentialHelper, host)
+		if err != nil {
+			return nil, err
+		}
+		sys.DockerAuthConfig = auth
+	}
+
+	if conf.CAFile != "" {
+		certDir, err := setupRegistryCA(conf)
+		if err != nil {
+			return nil, err
+		}
+		sys.DockerCertPath = certDir
+	}
+
+	if conf.Insecure {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	return sys, nil
+}
+
+// getHelperCredentials asks a docker credential helper for the credentials
+// of the given registry host
+func getHelperCredentials(helper string, host string) (*types.DockerAuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed for %s: %s: %w", helper, host, strings.TrimSpace(stderr.String()), err)
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal(out, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output from credential helper %s: %w", helper, err)
+	}
+
+	// helpers return identity tokens with this special username
+	if creds.Username == "<token>" {
+		return &types.DockerAuthConfig{IdentityToken: creds.Secret}, nil
+	}
+
+	return &types.DockerAuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// setupRegistryCA copies the CA bundle of a registry into its own
+// certificates directory and returns the latter
+func setupRegistryCA(conf *settings.RegistryConf) (string, error) {
+	data, err := os.ReadFile(conf.CAFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read the CA bundle of %s: %w", conf.Registry, err)
+	}
+
+	certDir := filepath.Join(registryCertsDir, strings.ReplaceAll(conf.Registry, "/", "_"))
+	err = os.MkdirAll(certDir, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(filepath.Join(certDir, "ca.crt"), data, 0o644)
+	if err != nil {
+		return "", err
+	}
+
+	return certDir, nil
+}
+
+// PullManifest fetches the manifest of the given image, picking the
+// instance for the current platform from manifest lists. Sources are tried
+// in the order returned by GetImageSources.
+func PullManifest(imageName string) (manifest.Manifest, PlatformImage, error) {
+	PrintVerboseInfo("PullManifest", "running...")
+
+	sources, err := GetImageSources(imageName)
+	if err != nil {
+		PrintVerboseErr("PullManifest", 0, err)
+		return nil, PlatformImage{}, err
+	}
+
+	errs := []error{}
+	for _, source := range sources {
+		man, platformImage, err := pullManifestFrom(source)
+		if err == nil {
+			return man, platformImage, nil
+		}
+
+		PrintVerboseWarn("PullManifest", 1, "could not fetch manifest from", source.ImageName, err)
+		errs = append(errs, fmt.Errorf("%s: %w", source.ImageName, err))
+	}
+
+	err = errors.Join(errs...)
+	PrintVerboseErr("PullManifest", 2, err)
+	return nil, PlatformImage{}, err
+}
+
+// pullManifestFrom fetches the manifest of an image from a single source
+func pullManifestFrom(source ImageSource) (manifest.Manifest, PlatformImage, error) {
+	ctx := context.Background()
+
+	srcRef, err := alltransports.ParseImageName("docker://" + source.ImageName)
+	if err != nil {
+		return nil, PlatformImage{}, fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	imgSource, err := srcRef.NewImageSource(ctx, source.SystemContext)
+	if err != nil {
+		return nil, PlatformImage{}, fmt.Errorf("failed to create image source: %w", err)
+	}
+	defer imgSource.Close()
+
+	manRaw, manMime, err := imgSource.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, PlatformImage{}, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	var platformImage PlatformImage
+	if manifest.MIMETypeIsMultiImage(manMime) {
+		platformImage.IndexDigest, err = manifest.Digest(manRaw)
+		if err != nil {
+			return nil, PlatformImage{}, fmt.Errorf("failed to fetch digest of manifest list: %w", err)
+		}
+
+		list, err := manifest.ListFromBlob(manRaw, manMime)
+		if err != nil {
+			return nil, PlatformImage{}, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+
+		instanceDigest, err := list.ChooseInstance(source.SystemContext)
+		if err != nil {
+			return nil, PlatformImage{}, fmt.Errorf("failed to select platform instance: %w", err)
+		}
+
+		platformImage.Platform = imagePlatformOS + "/" + runtime.GOARCH
+		instance, err := list.Instance(instanceDigest)
+		if err == nil && instance.ReadOnly.Platform != nil {
+			platformImage.Platform = formatPlatform(instance.ReadOnly.Platform.OS, instance.ReadOnly.Platform.Architecture, instance.ReadOnly.Platform.Variant)
+		}
+
+		manRaw, manMime, err = imgSource.GetManifest(ctx, &instanceDigest)
+		if err != nil {
+			return nil, PlatformImage{}, fmt.Errorf("failed to fetch platform manifest: %w", err)
+		}
+	}
+
+	man, err := manifest.FromBlob(manRaw, manMime)
+	if err != nil {
+		return nil, PlatformImage{}, fmt.Errorf("failed to parse platform specific manifest: %w", err)
+	}
+
+	platformImage.Digest, err = manifest.Digest(manRaw)
+	if err != nil {
+		return nil, PlatformImage{}, fmt.Errorf("failed to fetch digest of manifest: %w", err)
+	}
+
+	return man, platformImage, nil
+}
+
+// formatPlatform returns a platform in the os/arch[/variant] form
+func formatPlatform(platformOS string, arch string, variant string) string {
+	if variant == "" {
+		return platformOS + "/" + arch
+	}
+
+	return platformOS + "/" + arch + "/" + variant
+}
+
+// pullImageAsync pulls an image into the store, under the given name,
+// trying its sources in order. Blobs are first downloaded into
+// downloadsDir at no more than rateLimit bytes per second (0 means no
+// limit), so that an interrupted pull can be resumed, then the image is
+// copied from there. Download progress is reported on progressCh, then
+// either doneCh or errorCh receives the outcome.
+func pullImageAsync(store storage.Store, imageName string, dstName string, rateLimit uint64, progressCh chan types.ProgressProperties, doneCh chan struct{}, errorCh chan error) error {
+	PrintVerboseInfo("pullImageAsync", "running...")
+
+	sources, err := GetImageSources(imageName)
+	if err != nil {
+		PrintVerboseErr("pullImageAsync", 0, err)
+		return err
+	}
+
+	destRef, err := istorage.Transport.ParseStoreReference(store, dstName)
+	if err != nil {
+		PrintVerboseErr("pullImageAsync", 1, err)
+		return err
+	}
+
+	policy, err := signature.DefaultPolicy(&types.SystemContext{})
+	if err != nil {
+		PrintVerboseErr("pullImageAsync", 2, err)
+		return err
+	}
+
+	policyCtx, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		PrintVerboseErr("pullImageAsync", 3, err)
+		return err
+	}
+
+	limiter := newRateLimiter(rateLimit)
+	peers := GetPeerCaches()
+
+	go func() {
+		defer policyCtx.Destroy()
+
+		ctx := context.Background()
+		errs := []error{}
+		for _, source := range sources {
+			srcRef, err := downloadImage(ctx, store, source, peers, progressCh, limiter)
+			if err == nil {
+				_, err = copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
+					MaxParallelDownloads: settings.Cnf.MaxParallelDownloads,
+				})
+			}
+			if err == nil {
+				// the blobs are kept to be served to peers if asked to
+				if !settings.Cnf.CacheBlobs {
+					err = clearDownloadsDir()
+					if err != nil {
+						PrintVerboseWarn("pullImageAsync", 4, "could not clear downloaded blobs", err)
+					}
+				}
+
+				doneCh <- struct{}{}
+				return
+			}
+
+			PrintVerboseWarn("pullImageAsync", 5, "could not pull from", source.ImageName, err)
+			errs = append(errs, fmt.Errorf("%s: %w", source.ImageName, err))
+		}
+
+		errorCh <- errors.Join(errs...)
+	}()
+
+	return nil
+}
+
+// ImageInfo holds what is known about a remote image before pulling it
+type ImageInfo struct {
+	Digest       digest.Digest     `json:"digest"`
+	Architecture string            `json:"architecture"`
+	OS           string            `json:"os"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// InspectImage fetches the manifest and configuration of the given image,
+// for the current platform, without pulling its layers. Sources are tried in
+// the order returned by GetImageSources.
+func InspectImage(imageName string) (*ImageInfo, error) {
+	PrintVerboseInfo("InspectImage", "running...")
+
+	sources, err := GetImageSources(imageName)
+	if err != nil {
+		PrintVerboseErr("InspectImage", 0, err)
+		return nil, err
+	}
+
+	errs := []error{}
+	for _, source := range sources {
+		info, err := inspectImageFrom(source)
+		if err == nil {
+			return info, nil
+		}
+
+		PrintVerboseWarn("InspectImage", 1, "could not inspect image from", source.ImageName, err)
+		errs = append(errs, fmt.Errorf("%s: %w", source.ImageName, err))
+	}
+
+	err = errors.Join(errs...)
+	PrintVerboseErr("InspectImage", 2, err)
+	return nil, err
+}
+
+// inspectImageFrom fetches the manifest and configuration of an image from a
+// single source
+func inspectImageFrom(source ImageSource) (*ImageInfo, error) {
+	ctx := context.Background()
+
+	srcRef, err := alltransports.ParseImageName("docker://" + source.ImageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	// manifest lists are resolved to the instance of the current platform
+	img, err := srcRef.NewImage(ctx, source.SystemContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer img.Close()
+
+	manRaw, _, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	manDigest, err := manifest.Digest(manRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch digest of manifest: %w", err)
+	}
+
+	config, err := img.OCIConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image configuration: %w", err)
+	}
+
+	info := &ImageInfo{
+		Digest:       manDigest,
+		Architecture: config.Architecture,
+		OS:           config.OS,
+		Labels:       config.Config.Labels,
+	}
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+
+	return info, nil
+}
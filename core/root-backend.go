@@ -0,0 +1,313 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// Supported storage backends, set via the storageBackend configuration entry
+const (
+	// STORAGE_PARTITIONS stores each root in its own partition (or LVM
+	// volume), labelled partLabelA and partLabelB
+	STORAGE_PARTITIONS = "partitions"
+
+	// STORAGE_BTRFS_SUBVOLUMES stores each root in a subvolume, named after
+	// partLabelA and partLabelB, of a single btrfs filesystem
+	STORAGE_BTRFS_SUBVOLUMES = "btrfs-subvolumes"
+
+	// STORAGE_LVM_THIN stores each root in a thin volume, labelled
+	// partLabelA and partLabelB, with ABRoot managing the thin pool
+	STORAGE_LVM_THIN = "lvm-thin"
+)
+
+// btrfsPoolMount is where the top level of the btrfs pool gets mounted
+// while managing its subvolumes
+var btrfsPoolMount = filepath.Join("/run", "abroot", "btrfs-pool")
+
+// RootBackend abstracts how the ABRoot roots are stored on disk, so that the
+// ABRootManager can expose them as present and future roots regardless of
+// their layout
+type RootBackend interface {
+	// Name returns the name of the backend, as used in the configuration
+	Name() string
+
+	// GetRoots returns the roots managed by the backend, already identified
+	// as present and future
+	GetRoots() ([]ABRootPartition, error)
+
+	// PrepareFuture prepares the future root before the new system gets
+	// synced into it. It must be called while the future root is unmounted.
+	PrepareFuture(present ABRootPartition, future ABRootPartition) error
+
+	// AvailableSpace returns the space which can be used to deploy a new
+	// system in the root mounted at the given path
+	AvailableSpace(rootMount string) (uint64, error)
+}
+
+// NewRootBackend returns the RootBackend selected in the configuration
+func NewRootBackend() (RootBackend, error) {
+	switch settings.Cnf.StorageBackend {
+	case "", STORAGE_PARTITIONS:
+		return &PartitionsBackend{}, nil
+	case STORAGE_BTRFS_SUBVOLUMES:
+		if settings.Cnf.ThinProvisioning {
+			return nil, errors.New("the btrfs-subvolumes storage backend can't be used with thin provisioning")
+		}
+		if settings.Cnf.BtrfsPoolLabel == "" {
+			return nil, errors.New("btrfsPoolLabel must be set to use the btrfs-subvolumes storage backend")
+		}
+		return &BtrfsSubvolumesBackend{PoolLabel: settings.Cnf.BtrfsPoolLabel}, nil
+	case STORAGE_LVM_THIN:
+		if !settings.Cnf.ThinProvisioning {
+			return nil, errors.New("thinProvisioning must be enabled to use the lvm-thin storage backend")
+		}
+		return &LvmThinBackend{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage backend %s", settings.Cnf.StorageBackend)
+}
+
+// PartitionsBackend is the classic ABRoot layout, with two partitions (or
+// LVM volumes) of fixed size
+type PartitionsBackend struct{}
+
+// Name returns the name of the backend
+func (b *PartitionsBackend) Name() string {
+	return STORAGE_PARTITIONS
+}
+
+// GetRoots returns the partitions labelled partLabelA and partLabelB, the
+// present one being the partition mounted at /
+func (b *PartitionsBackend) GetRoots() ([]ABRootPartition, error) {
+	PrintVerboseInfo("PartitionsBackend.GetRoots", "running...")
+
+	diskM := NewDiskManager()
+	roots := []ABRootPartition{}
+	for _, label := range []string{settings.Cnf.PartLabelA, settings.Cnf.PartLabelB} {
+		partition, err := diskM.GetPartitionByLabel(label)
+		if err != nil {
+			PrintVerboseErr("PartitionsBackend.GetRoots", 0, err)
+			return nil, err
+		}
+
+		identifier := "future"
+		if partition.MountPoint == "/" {
+			identifier = "present"
+		}
+
+		roots = append(roots, ABRootPartition{
+			Label:        partition.Label,
+			IdentifiedAs: identifier,
+			Partition:    partition,
+			MountPoint:   partition.MountPoint,
+			MountOptions: partition.MountOptions,
+			Uuid:         partition.Uuid,
+			FsType:       partition.FsType,
+			Current:      partition.MountPoint == "/",
+		})
+	}
+
+	return roots, nil
+}
+
+// PrepareFuture does nothing, since the future partition gets synced in
+// place
+func (b *PartitionsBackend) PrepareFuture(present ABRootPartition, future ABRootPartition) error {
+	return nil
+}
+
+// AvailableSpace returns the free space of the filesystem mounted at
+// rootMount, plus the space used in it, since the files already there get
+// replaced by the new system. With thin provisioning, it is capped by the
+// free space of the thin pool.
+func (b *PartitionsBackend) AvailableSpace(rootMount string) (uint64, error) {
+	free, used, err := filesystemSpace(rootMount)
+	if err != nil {
+		PrintVerboseErr("PartitionsBackend.AvailableSpace", 0, err)
+		return 0, err
+	}
+
+	availableSpace := free + used
+	if settings.Cnf.ThinProvisioning {
+		usage, err := GetThinPoolUsage()
+		if err != nil {
+			PrintVerboseErr("PartitionsBackend.AvailableSpace", 1, err)
+			return 0, err
+		}
+
+		availableSpace = min(availableSpace, usage.Free())
+	}
+
+	return availableSpace, nil
+}
+
+// BtrfsSubvolumesBackend stores both roots as subvolumes of a single btrfs
+// filesystem (the pool), so that they share its free space. The future root
+// is created as a snapshot of the present one, so unchanged files share
+// their extents.
+type BtrfsSubvolumesBackend struct {
+	// PoolLabel is the label of the btrfs filesystem holding the subvolumes
+	PoolLabel string
+}
+
+// Name returns the name of the backend
+func (b *BtrfsSubvolumesBackend) Name() string {
+	return STORAGE_BTRFS_SUBVOLUMES
+}
+
+// GetRoots returns the subvolumes named partLabelA and partLabelB, the
+// present one being the subvolume mounted at /
+func (b *BtrfsSubvolumesBackend) GetRoots() ([]ABRootPartition, error) {
+	PrintVerboseInfo("BtrfsSubvolumesBackend.GetRoots", "running...")
+
+	pool, err := NewDiskManager().GetPartitionByLabel(b.PoolLabel)
+	if err != nil {
+		PrintVerboseErr("BtrfsSubvolumesBackend.GetRoots", 0, err)
+		return nil, err
+	}
+
+	if pool.FsType != "btrfs" {
+		err := fmt.Errorf("the storage pool %s is not a btrfs filesystem", b.PoolLabel)
+		PrintVerboseErr("BtrfsSubvolumesBackend.GetRoots", 1, err)
+		return nil, err
+	}
+
+	currentSubvol, err := getMountedSubvolume("/")
+	if err != nil {
+		PrintVerboseErr("BtrfsSubvolumesBackend.GetRoots", 2, err)
+		return nil, err
+	}
+
+	roots := []ABRootPartition{}
+	for _, label := range []string{settings.Cnf.PartLabelA, settings.Cnf.PartLabelB} {
+		partition := pool
+		partition.Label = label
+		partition.MountOptions = "subvol=" + label
+
+		identifier := "future"
+		partition.MountPoint = ""
+		if currentSubvol == label {
+			identifier = "present"
+			partition.MountPoint = "/"
+		}
+
+		roots = append(roots, ABRootPartition{
+			Label:        label,
+			IdentifiedAs: identifier,
+			Partition:    partition,
+			MountPoint:   partition.MountPoint,
+			MountOptions: partition.MountOptions,
+			Uuid:         partition.Uuid,
+			FsType:       partition.FsType,
+			Current:      identifier == "present",
+		})
+	}
+
+	return roots, nil
+}
+
+// PrepareFuture replaces the future subvolume with a fresh snapshot of the
+// present one
+func (b *BtrfsSubvolumesBackend) PrepareFuture(present ABRootPartition, future ABRootPartition) error {
+	PrintVerboseInfo("BtrfsSubvolumesBackend.PrepareFuture", "running...")
+
+	pool := present.Partition
+	pool.MountOptions = "subvolid=5"
+	err := pool.Mount(btrfsPoolMount)
+	if err != nil {
+		PrintVerboseErr("BtrfsSubvolumesBackend.PrepareFuture", 0, err)
+		return err
+	}
+	defer pool.Unmount()
+
+	presentSubvol := filepath.Join(btrfsPoolMount, present.Label)
+	futureSubvol := filepath.Join(btrfsPoolMount, future.Label)
+
+	if _, err := os.Stat(futureSubvol); err == nil {
+		PrintVerboseInfo("BtrfsSubvolumesBackend.PrepareFuture", "deleting old future subvolume", futureSubvol)
+		out, err := exec.Command("btrfs", "subvolume", "delete", futureSubvol).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("could not delete subvolume %s: %s: %w", futureSubvol, strings.TrimSpace(string(out)), err)
+			PrintVerboseErr("BtrfsSubvolumesBackend.PrepareFuture", 1, err)
+			return err
+		}
+	}
+
+	PrintVerboseInfo("BtrfsSubvolumesBackend.PrepareFuture", "snapshotting", presentSubvol, "to", futureSubvol)
+	out, err := exec.Command("btrfs", "subvolume", "snapshot", presentSubvol, futureSubvol).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("could not snapshot %s: %s: %w", presentSubvol, strings.TrimSpace(string(out)), err)
+		PrintVerboseErr("BtrfsSubvolumesBackend.PrepareFuture", 2, err)
+		return err
+	}
+
+	return nil
+}
+
+// AvailableSpace returns the free space of the whole pool. The data the
+// future root shares with the present one can't be told apart from the
+// rest of the pool without walking the root, so it is not counted and the
+// estimate errs on the safe side.
+func (b *BtrfsSubvolumesBackend) AvailableSpace(rootMount string) (uint64, error) {
+	free, _, err := filesystemSpace(rootMount)
+	if err != nil {
+		PrintVerboseErr("BtrfsSubvolumesBackend.AvailableSpace", 0, err)
+		return 0, err
+	}
+
+	return free, nil
+}
+
+// getMountedSubvolume returns the btrfs subvolume mounted at the given path,
+// by reading its root from /proc/self/mountinfo
+func getMountedSubvolume(mountPoint string) (string, error) {
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer mountinfo.Close()
+
+	subvol := ""
+	found := false
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != mountPoint {
+			continue
+		}
+
+		// later entries shadow earlier ones on the same mount point, the
+		// system may also be mounted from a directory of the subvolume
+		subvol = strings.SplitN(strings.Trim(fields[3], "/"), "/", 2)[0]
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if !found {
+		return "", fmt.Errorf("nothing is mounted at %s", mountPoint)
+	}
+
+	return subvol, nil
+}
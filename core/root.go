@@ -31,6 +31,9 @@ type ABRootManager struct {
 
 	// VarPartition is the partition where /var is mounted
 	VarPartition Partition
+
+	// Backend is the storage backend holding the roots, see RootBackend
+	Backend RootBackend
 }
 
 // ABRootPartition represents a partition managed by ABRoot
@@ -55,38 +58,26 @@ func NewABRootManager() *ABRootManager {
 	return a
 }
 
-// GetPartitions gets the root partitions from the current device
+// GetPartitions gets the root partitions from the configured storage backend
+// and the /var partition from the current device
 func (a *ABRootManager) GetPartitions() error {
 	PrintVerboseInfo("ABRootManager.GetRootPartitions", "running...")
 
-	diskM := NewDiskManager()
-	rootLabels := []string{settings.Cnf.PartLabelA, settings.Cnf.PartLabelB}
-	for _, label := range rootLabels {
-		partition, err := diskM.GetPartitionByLabel(label)
-		if err != nil {
-			PrintVerboseErr("ABRootManager.GetRootPartitions", 0, err)
-			return err
-		}
-
-		identifier, err := a.IdentifyPartition(partition)
-		if err != nil {
-			PrintVerboseErr("ABRootManager.GetRootPartitions", 1, err)
-			return err
-		}
+	backend, err := NewRootBackend()
+	if err != nil {
+		PrintVerboseErr("ABRootManager.GetRootPartitions", 0, err)
+		return err
+	}
+	a.Backend = backend
 
-		isCurrent := a.IsCurrent(partition)
-		a.Partitions = append(a.Partitions, ABRootPartition{
-			Label:        partition.Label,
-			IdentifiedAs: identifier,
-			Partition:    partition,
-			MountPoint:   partition.MountPoint,
-			MountOptions: partition.MountOptions,
-			Uuid:         partition.Uuid,
-			FsType:       partition.FsType,
-			Current:      isCurrent,
-		})
+	roots, err := backend.GetRoots()
+	if err != nil {
+		PrintVerboseErr("ABRootManager.GetRootPartitions", 1, err)
+		return err
 	}
+	a.Partitions = roots
 
+	diskM := NewDiskManager()
 	partition, err := diskM.GetPartitionByLabel(settings.Cnf.PartLabelVar)
 	if err != nil {
 		PrintVerboseErr("ABRootManager.GetRootPartitions", 2, err)
@@ -182,6 +173,43 @@ func (a *ABRootManager) GetOther() (partition ABRootPartition, err error) {
 	return a.GetPartition(settings.Cnf.PartLabelA)
 }
 
+// GetNextBoot gets the partition booted by default on the next boot, read
+// from the grub configuration of the boot partition
+func (a *ABRootManager) GetNextBoot() (partition ABRootPartition, err error) {
+	PrintVerboseInfo("ABRootManager.GetNextBoot", "running...")
+
+	partBoot, err := a.GetBoot()
+	if err != nil {
+		PrintVerboseErr("ABRootManager.GetNextBoot", 0, err)
+		return ABRootPartition{}, err
+	}
+
+	tmpBootMount := "/run/abroot/tmp-boot-mount-next-boot/"
+	err = partBoot.Mount(tmpBootMount)
+	if err != nil {
+		PrintVerboseErr("ABRootManager.GetNextBoot", 1, err)
+		return ABRootPartition{}, err
+	}
+	defer partBoot.Unmount()
+
+	grub, err := NewGrub(partBoot)
+	if err != nil {
+		PrintVerboseErr("ABRootManager.GetNextBoot", 2, err)
+		return ABRootPartition{}, err
+	}
+
+	isPresent, err := grub.IsBootedIntoPresentRoot()
+	if err != nil {
+		PrintVerboseErr("ABRootManager.GetNextBoot", 3, err)
+		return ABRootPartition{}, err
+	}
+
+	if isPresent {
+		return a.GetPresent()
+	}
+	return a.GetFuture()
+}
+
 // GetPartition gets a partition by label
 func (a *ABRootManager) GetPartition(label string) (partition ABRootPartition, err error) {
 	PrintVerboseInfo("ABRootManager.GetPartition", "running...")
@@ -0,0 +1,264 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/vanilla-os/abroot/settings"
+	"github.com/vanilla-os/prometheus"
+	"go.podman.io/storage"
+)
+
+// layerCompressionRatio is used to estimate the uncompressed size of the
+// layers which are not in the local storage yet, since registries only
+// report their compressed size
+const layerCompressionRatio = 3
+
+// packageSizeEstimate is the space each added package is estimated to take
+// in the packages layer, which is only built once the image is pulled
+const packageSizeEstimate = 50 * 1024 * 1024
+
+// abrootStorageDir is where ABRoot keeps the OCI images
+const abrootStorageDir = "/var/lib/abroot/storage"
+
+// SpaceRequirement represents the space needed in a location to deploy an
+// image, compared with the space available there
+type SpaceRequirement struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Required  uint64 `json:"required"`
+	Available uint64 `json:"available"`
+}
+
+// Satisfied reports whether the location has enough space
+func (r SpaceRequirement) Satisfied() bool {
+	return r.Required <= r.Available
+}
+
+// SpaceReport is the result of the space check performed before pulling an
+// image
+type SpaceReport struct {
+	Image        string             `json:"image"`
+	Requirements []SpaceRequirement `json:"requirements"`
+}
+
+// Satisfied reports whether all the locations have enough space
+func (r *SpaceReport) Satisfied() bool {
+	for _, req := range r.Requirements {
+		if !req.Satisfied() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns a human readable version of the report, with a line for
+// each location
+func (r *SpaceReport) String() string {
+	lines := []string{}
+	for _, req := range r.Requirements {
+		mark := "ok"
+		if !req.Satisfied() {
+			mark = fmt.Sprintf("missing %s", humanize.Bytes(req.Required-req.Available))
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"%s (%s): %s required, %s available, %s",
+			req.Name, req.Path, humanize.Bytes(req.Required), humanize.Bytes(req.Available), mark,
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// filesystemSpace returns the free space of the filesystem mounted at path
+// and the space used in it, from the statistics of the filesystem, so that
+// nothing has to be walked
+func filesystemSpace(path string) (free uint64, used uint64, err error) {
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	free = stat.Bavail * uint64(stat.Bsize)
+	used = (stat.Blocks - stat.Bfree) * uint64(stat.Bsize)
+	return free, used, nil
+}
+
+// imageLayerSizes holds the sizes of an image, as far as they can be known
+// before pulling it
+type imageLayerSizes struct {
+	// Uncompressed is the size of all the layers once extracted
+	Uncompressed uint64
+
+	// Download is the size of the layers missing from the local storage
+	Download uint64
+
+	// DownloadUncompressed is the size of the missing layers once extracted
+	DownloadUncompressed uint64
+}
+
+// CheckImageSpace checks, before pulling the given image, that both the
+// image storage and the future root mounted at futureRoot have enough free
+// space for it and for the packages layer built on top of it, installing
+// the given number of packages. Layers already in the local storage are
+// reused, while the size of the missing ones is estimated from their
+// compressed size, and the one of the packages layer from the number of
+// packages.
+// It returns a NotEnoughSpaceError, along with the report, if any location
+// is too small.
+func CheckImageSpace(imageName string, futureRoot string, packages int) (*SpaceReport, error) {
+	PrintVerboseInfo("CheckImageSpace", "running...")
+
+	sizes, err := getImageSizes(imageName)
+	if err != nil {
+		PrintVerboseErr("CheckImageSpace", 0, err)
+		return nil, err
+	}
+
+	// the packages layer is kept in the storage and synced to the root
+	packagesSize := uint64(max(packages, 0)) * packageSizeEstimate
+	sizes.Uncompressed += packagesSize
+	sizes.DownloadUncompressed += packagesSize
+
+	backend, err := NewRootBackend()
+	if err != nil {
+		PrintVerboseErr("CheckImageSpace", 1, err)
+		return nil, err
+	}
+
+	rootAvailable, err := backend.AvailableSpace(futureRoot)
+	if err != nil {
+		PrintVerboseErr("CheckImageSpace", 2, err)
+		return nil, err
+	}
+
+	var storageStat, rootStat syscall.Statfs_t
+	err = syscall.Statfs(abrootStorageDir, &storageStat)
+	if err != nil {
+		PrintVerboseErr("CheckImageSpace", 3, err)
+		return nil, err
+	}
+	err = syscall.Statfs(futureRoot, &rootStat)
+	if err != nil {
+		PrintVerboseErr("CheckImageSpace", 4, err)
+		return nil, err
+	}
+
+	storageRequired := sizes.Download + sizes.DownloadUncompressed
+	report := &SpaceReport{Image: imageName}
+
+	if storageStat.Fsid == rootStat.Fsid {
+		report.Requirements = []SpaceRequirement{{
+			Name:      "storage and future root",
+			Path:      futureRoot,
+			Required:  storageRequired + sizes.Uncompressed,
+			Available: rootAvailable,
+		}}
+	} else {
+		report.Requirements = []SpaceRequirement{
+			{
+				Name:      "storage",
+				Path:      abrootStorageDir,
+				Required:  storageRequired,
+				Available: storageStat.Bavail * uint64(storageStat.Bsize),
+			},
+			{
+				Name:      "future root",
+				Path:      futureRoot,
+				Required:  sizes.Uncompressed,
+				Available: rootAvailable,
+			},
+		}
+	}
+
+	if !report.Satisfied() {
+		err := &NotEnoughSpaceError{Report: report}
+		PrintVerboseErr("CheckImageSpace", 5, err)
+		return report, err
+	}
+
+	return report, nil
+}
+
+// getImageSizes returns the sizes of the given image, from the local
+// storage for local images and from the manifest otherwise
+func getImageSizes(imageName string) (imageLayerSizes, error) {
+	pt, err := prometheus.NewPrometheus(
+		abrootStorageDir,
+		"overlay",
+		settings.Cnf.MaxParallelDownloads,
+	)
+	if err != nil {
+		return imageLayerSizes{}, err
+	}
+
+	if strings.HasPrefix(imageName, "localhost/") {
+		return getLocalImageSizes(pt.Store, imageName)
+	}
+	return getRemoteImageSizes(pt.Store, imageName)
+}
+
+// getRemoteImageSizes returns the sizes of an image from its manifest,
+// using the actual uncompressed size of the layers already in the storage
+func getRemoteImageSizes(store storage.Store, imageName string) (imageLayerSizes, error) {
+	manifest, _, err := PullManifest(imageName)
+	if err != nil {
+		return imageLayerSizes{}, err
+	}
+
+	var sizes imageLayerSizes
+	for _, layerInfo := range manifest.LayerInfos() {
+		layers, err := store.LayersByCompressedDigest(layerInfo.Digest)
+		if err == nil && len(layers) > 0 && layers[0].UncompressedSize > 0 {
+			sizes.Uncompressed += uint64(layers[0].UncompressedSize)
+			continue
+		}
+
+		compressed := uint64(max(layerInfo.Size, 0))
+		sizes.Uncompressed += compressed * layerCompressionRatio
+		sizes.Download += compressed
+		sizes.DownloadUncompressed += compressed * layerCompressionRatio
+	}
+
+	return sizes, nil
+}
+
+// getLocalImageSizes returns the sizes of an image which is already in the
+// storage, so nothing needs to be downloaded
+func getLocalImageSizes(store storage.Store, imageName string) (imageLayerSizes, error) {
+	image, err := store.Image(imageName)
+	if err != nil {
+		return imageLayerSizes{}, err
+	}
+
+	var sizes imageLayerSizes
+	for id := image.TopLayer; id != ""; {
+		layer, err := store.Layer(id)
+		if err != nil {
+			return imageLayerSizes{}, err
+		}
+
+		sizes.Uncompressed += uint64(max(layer.UncompressedSize, 0))
+		id = layer.Parent
+	}
+
+	return sizes, nil
+}
@@ -0,0 +1,194 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// StatusSchemaVersion is the version of the schema of the output of
+// `abroot status --json`. It is increased whenever a field is removed or
+// changes meaning, while new fields can be added within the same version.
+const StatusSchemaVersion = 1
+
+// OperationState tells whether an operation is running or waiting for a
+// reboot
+type OperationState struct {
+	// Locked is true while an operation is running
+	Locked bool `json:"locked"`
+
+	// Finalizing is true while an operation is applying its last changes
+	Finalizing bool `json:"finalizing"`
+
+	// Finished is true once an operation completed, until the next boot
+	Finished bool `json:"finished"`
+
+	// UserStopRequested is true if the user asked for operations to stop
+	UserStopRequested bool `json:"userStopRequested"`
+}
+
+// GetOperationState returns the state of the operations, from the lock,
+// finalizing and finished files
+func (s *ABSystem) GetOperationState() OperationState {
+	PrintVerboseInfo("ABSystem.GetOperationState", "running...")
+
+	return OperationState{
+		Locked:            s.isLockfilePidActive(),
+		Finalizing:        fileExists(finalizingFile),
+		Finished:          s.finishedFileExists(),
+		UserStopRequested: UserStopRequested(),
+	}
+}
+
+// EtcOverlayState describes the overlay holding the changes made by the user
+// to /etc
+type EtcOverlayState struct {
+	// Mounted is true if /etc is an overlay
+	Mounted bool `json:"mounted"`
+
+	// UpperDir is the directory holding the changes
+	UpperDir string `json:"upperDir,omitempty"`
+
+	// ChangedFiles is the number of files changed by the user, which
+	// includes the ones removed
+	ChangedFiles int `json:"changedFiles"`
+}
+
+// GetEtcOverlayState returns the state of the /etc overlay
+func GetEtcOverlayState() (EtcOverlayState, error) {
+	PrintVerboseInfo("GetEtcOverlayState", "running...")
+
+	state := EtcOverlayState{}
+
+	fsType, options, err := getMountOptions("/proc/self/mountinfo", "/etc")
+	if err != nil {
+		PrintVerboseErr("GetEtcOverlayState", 0, err)
+		return state, err
+	}
+	if fsType != "overlay" {
+		return state, nil
+	}
+	state.Mounted = true
+
+	for _, option := range strings.Split(options, ",") {
+		if upperDir, found := strings.CutPrefix(option, "upperdir="); found {
+			state.UpperDir = upperDir
+		}
+	}
+	if state.UpperDir == "" {
+		return state, nil
+	}
+
+	err = filepath.WalkDir(state.UpperDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			state.ChangedFiles++
+		}
+		return nil
+	})
+	if err != nil {
+		PrintVerboseErr("GetEtcOverlayState", 1, err)
+		return state, err
+	}
+
+	return state, nil
+}
+
+// getMountOptions returns the filesystem type and the superblock options
+// of the topmost mount at the given path, as listed in a mountinfo file.
+// Both are empty if nothing is mounted there.
+func getMountOptions(mountinfoPath string, mountPoint string) (fsType string, options string, err error) {
+	mountinfo, err := os.Open(mountinfoPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer mountinfo.Close()
+
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != mountPoint {
+			continue
+		}
+
+		// the optional fields end with a single "-", followed by the
+		// filesystem type, the source and the superblock options
+		for i := 6; i < len(fields)-3; i++ {
+			if fields[i] == "-" {
+				// later entries shadow earlier ones on the same mount point
+				fsType = fields[i+1]
+				options = fields[i+3]
+				break
+			}
+		}
+	}
+
+	return fsType, options, scanner.Err()
+}
+
+// VarEncryptionState tells whether the /var partition is encrypted
+type VarEncryptionState struct {
+	Encrypted bool `json:"encrypted"`
+
+	// Unlocked is true if the encrypted device has been opened
+	Unlocked bool `json:"unlocked"`
+
+	// Device is the encrypted device
+	Device string `json:"device,omitempty"`
+}
+
+// GetVarEncryptionState returns the encryption state of the given /var
+// partition. An empty partition means it was not found, which happens
+// when the encrypted device configured in PartCryptVar is still locked.
+func GetVarEncryptionState(varPart Partition) VarEncryptionState {
+	PrintVerboseInfo("GetVarEncryptionState", "running...")
+
+	for parent := varPart.Parent; parent != nil; parent = parent.Parent {
+		if parent.IsEncrypted() {
+			device := "/dev/" + parent.Device
+			if parent.IsDevMapper() {
+				device = "/dev/mapper/" + parent.Device
+			}
+			return VarEncryptionState{Encrypted: true, Unlocked: true, Device: device}
+		}
+	}
+
+	if varPart.Device == "" && settings.Cnf.PartCryptVar != "" {
+		return VarEncryptionState{Encrypted: true, Device: settings.Cnf.PartCryptVar}
+	}
+
+	return VarEncryptionState{}
+}
+
+// GetLastOperation returns the most recent entry of the history, or nil if
+// no operation was recorded
+func GetLastOperation() (*HistoryEntry, error) {
+	entries, err := ReadHistory(HistoryFilter{Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	return &entries[0], nil
+}
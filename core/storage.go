@@ -0,0 +1,604 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+const (
+	gib = 1024 * 1024 * 1024
+
+	// rootHeadroomPercent is the space proposed for a root on top of the
+	// projected size of the image, for the images to come
+	rootHeadroomPercent = 25
+
+	// varMinFree is the minimum free space kept on /var when shrinking it
+	varMinFree = 5 * gib
+
+	// sectorSize is the unit of the start and size of partitions in sysfs
+	sectorSize = 512
+
+	// gptBackupSectors are kept free at the end of a disk for the backup
+	// GPT, rounded up to 1 MiB
+	gptBackupSectors = 2048
+
+	STORAGE_VOLUME_PARTITION = "partition"
+	STORAGE_VOLUME_LVM       = "lvm"
+)
+
+// StorageVolume is a root or the /var partition, with the size proposed
+// for it by a StoragePlan
+type StorageVolume struct {
+	Label string `json:"label"`
+
+	// Role is present, future or var
+	Role   string `json:"role"`
+	Device string `json:"device"`
+	FsType string `json:"fsType"`
+
+	// Kind is STORAGE_VOLUME_PARTITION or STORAGE_VOLUME_LVM
+	Kind string `json:"kind"`
+
+	// Group is the disk holding a partition, or the volume group of a
+	// logical volume
+	Group string `json:"group"`
+
+	// Start is the offset of a partition on its disk
+	Start uint64 `json:"start,omitempty"`
+
+	Size uint64 `json:"size"`
+	Used uint64 `json:"used"`
+
+	// Available is the space the volume can grow into without moving
+	// anything: the unallocated space right after a partition, or the free
+	// space of the volume group
+	Available uint64 `json:"available"`
+
+	Proposed uint64 `json:"proposed"`
+
+	// Note explains why the proposed size can't be reached, if so, or
+	// that /var is shrunk during the next boot
+	Note string `json:"note,omitempty"`
+}
+
+// StoragePlan compares the sizes of the roots with the projected size of
+// the image and proposes new sizes for the roots and /var
+type StoragePlan struct {
+	Image     string `json:"image"`
+	ImageSize uint64 `json:"imageSize"`
+
+	// RootSize is the size proposed for each root
+	RootSize uint64 `json:"rootSize"`
+
+	Volumes []StorageVolume `json:"volumes"`
+
+	// Feasible tells whether all the proposed sizes can be reached
+	Feasible bool `json:"feasible"`
+}
+
+// Volume returns the volume with the given role, or nil
+func (p *StoragePlan) Volume(role string) *StorageVolume {
+	for i := range p.Volumes {
+		if p.Volumes[i].Role == role {
+			return &p.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// NeedsResize tells whether any volume has to be resized
+func (p *StoragePlan) NeedsResize() bool {
+	for _, volume := range p.Volumes {
+		if volume.Proposed != volume.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a human readable version of the plan, with a line for
+// each volume
+func (p *StoragePlan) String() string {
+	lines := []string{}
+	for _, v := range p.Volumes {
+		line := fmt.Sprintf("%s (%s, %s): %s", v.Label, v.Role, v.Device, humanize.IBytes(v.Size))
+		if v.Used > 0 {
+			line += ", " + humanize.IBytes(v.Used) + " used"
+		}
+		switch {
+		case v.Proposed > v.Size:
+			line += ", grow to " + humanize.IBytes(v.Proposed)
+		case v.Proposed < v.Size:
+			line += ", shrink to " + humanize.IBytes(v.Proposed)
+		default:
+			line += ", ok"
+		}
+		if v.Note != "" {
+			line += " (" + v.Note + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// roundUpGiB rounds a size up to the next GiB
+func roundUpGiB(size uint64) uint64 {
+	return (size + gib - 1) / gib * gib
+}
+
+// varShrinkable returns how much /var can be shrunk, keeping its used
+// space plus some room
+func varShrinkable(varVolume *StorageVolume) uint64 {
+	minVar := roundUpGiB(varVolume.Used + max(varVolume.Used/5, varMinFree))
+	if varVolume.Size <= minVar {
+		return 0
+	}
+	return varVolume.Size - minVar
+}
+
+// varShrinksOffline tells whether /var has to be unmounted to be shrunk as
+// proposed, which is done during the next boot
+func varShrinksOffline(varVolume *StorageVolume) bool {
+	return varVolume.Kind == STORAGE_VOLUME_PARTITION || varVolume.FsType != "btrfs"
+}
+
+// ProposeStorage fills the proposed size of the volumes of a plan: each
+// root gets RootSize if it is smaller, taking the space it needs from the
+// unallocated space after it or from its volume group. /var is shrunk to
+// make up for what is missing if it is a logical volume of the same group,
+// or the partition right after the root, and keeps its used space plus some
+// room. A btrfs logical volume is shrunk online, the other cases during the
+// next boot, while /var is unmounted. Partitions are only moved this way,
+// and filesystems other than ext4 and btrfs can't be shrunk, so the other
+// layouts are reported as unsupported.
+func ProposeStorage(plan *StoragePlan) {
+	plan.RootSize = roundUpGiB(plan.ImageSize * (100 + rootHeadroomPercent) / 100)
+	plan.Feasible = true
+
+	varVolume := plan.Volume("var")
+	if varVolume != nil {
+		varVolume.Proposed = varVolume.Size
+		varVolume.Note = ""
+	}
+	varShrinkSupported := varVolume != nil && slices.Contains(varShrinkFsTypes, varVolume.FsType)
+
+	// the space needed from each volume group
+	groupNeeds := map[string]uint64{}
+	for i := range plan.Volumes {
+		root := &plan.Volumes[i]
+		if root.Role == "var" {
+			continue
+		}
+
+		root.Note = ""
+		root.Proposed = max(root.Size, plan.RootSize)
+		growth := root.Proposed - root.Size
+		if growth == 0 {
+			continue
+		}
+
+		if root.Kind == STORAGE_VOLUME_LVM {
+			groupNeeds[root.Group] += growth
+			continue
+		}
+		if growth <= root.Available {
+			continue
+		}
+
+		// an encrypted /var has no group, since its partition is hidden
+		// behind its mapping
+		missing := growth - root.Available
+		varFollows := varVolume != nil && varVolume.Kind == STORAGE_VOLUME_PARTITION && varVolume.Group != "" &&
+			varVolume.Group == root.Group && varVolume.Start == root.Start+root.Size+root.Available
+		if varFollows && varShrinkSupported {
+			shrinkable := varShrinkable(varVolume)
+			varVolume.Proposed = varVolume.Size - roundUpGiB(min(missing, shrinkable))
+			if shrinkable >= missing {
+				continue
+			}
+			root.Note = fmt.Sprintf("%s missing after the partition, once /var is shrunk", humanize.IBytes(missing-shrinkable))
+			plan.Feasible = false
+			continue
+		}
+
+		root.Note = fmt.Sprintf("unsupported layout: needs %s of unallocated space right after the partition, %s available, and only an ext4 or btrfs /var partition right after it can be moved",
+			humanize.IBytes(growth), humanize.IBytes(root.Available))
+		plan.Feasible = false
+	}
+
+	for i := range plan.Volumes {
+		root := &plan.Volumes[i]
+		need, ok := groupNeeds[root.Group]
+		if root.Role == "var" || !ok || need <= root.Available {
+			continue
+		}
+
+		missing := need - root.Available
+		sharesGroup := varVolume != nil && varVolume.Kind == STORAGE_VOLUME_LVM && varVolume.Group == root.Group
+		if sharesGroup && !varShrinkSupported {
+			root.Note = fmt.Sprintf("unsupported layout: %s missing in volume group %s, and the %s filesystem of /var can't be shrunk",
+				humanize.IBytes(missing), root.Group, varVolume.FsType)
+			plan.Feasible = false
+			continue
+		}
+		if sharesGroup {
+			shrinkable := varShrinkable(varVolume)
+			varVolume.Proposed = varVolume.Size - roundUpGiB(min(missing, shrinkable))
+			if shrinkable >= missing {
+				// both roots of the group are served by the same shrink
+				groupNeeds[root.Group] = root.Available
+				continue
+			}
+			missing -= shrinkable
+		}
+
+		root.Note = fmt.Sprintf("%s missing in volume group %s", humanize.IBytes(missing), root.Group)
+		plan.Feasible = false
+	}
+
+	if varVolume != nil && varVolume.Proposed < varVolume.Size && varShrinksOffline(varVolume) {
+		varVolume.Note = "shrunk during the next boot, while unmounted"
+	}
+}
+
+// PlanStorage returns the plan for the roots of the given manager to fit
+// the given image, with the current sizes of the roots and /var
+func PlanStorage(rootM *ABRootManager, imageName string) (*StoragePlan, error) {
+	PrintVerboseInfo("PlanStorage", "running...")
+
+	if backend := settings.Cnf.StorageBackend; backend != "" && backend != STORAGE_PARTITIONS {
+		err := fmt.Errorf("the roots share their space with the %s storage backend and can't be resized", backend)
+		PrintVerboseErr("PlanStorage", 0, err)
+		return nil, err
+	}
+
+	sizes, err := getImageSizes(imageName)
+	if err != nil {
+		PrintVerboseErr("PlanStorage", 1, err)
+		return nil, err
+	}
+
+	plan := &StoragePlan{Image: imageName, ImageSize: sizes.Uncompressed}
+
+	for _, root := range rootM.Partitions {
+		volume, err := getStorageVolume(root.Partition, root.Label, root.IdentifiedAs)
+		if err != nil {
+			PrintVerboseErr("PlanStorage", 2, err)
+			return nil, err
+		}
+		plan.Volumes = append(plan.Volumes, volume)
+	}
+
+	if rootM.VarPartition.Device != "" {
+		volume, err := getStorageVolume(rootM.VarPartition, rootM.VarPartition.Label, "var")
+		if err != nil {
+			PrintVerboseErr("PlanStorage", 3, err)
+			return nil, err
+		}
+		plan.Volumes = append(plan.Volumes, volume)
+	}
+
+	ProposeStorage(plan)
+
+	return plan, nil
+}
+
+// getStorageVolume returns the details of a partition or logical volume
+func getStorageVolume(part Partition, label string, role string) (StorageVolume, error) {
+	volume := StorageVolume{
+		Label:  label,
+		Role:   role,
+		Device: "/dev/" + part.Device,
+		FsType: part.FsType,
+		Kind:   STORAGE_VOLUME_PARTITION,
+	}
+
+	lv, err := getLogicalVolume(part)
+	if err == nil {
+		volume.Device = lv.DmPath
+		volume.Kind = STORAGE_VOLUME_LVM
+		volume.Group = lv.VgName
+		volume.Size = lv.Size
+		volume.Available, err = getVolumeGroupFree(lv.VgName)
+		if err != nil {
+			return volume, err
+		}
+	} else if part.IsDevMapper() {
+		// an encrypted partition: the space around it is not reported,
+		// since it can't be resized through its mapping
+		volume.Device = "/dev/mapper/" + part.Device
+		size, err := blockDeviceSize(volume.Device)
+		if err != nil {
+			return volume, err
+		}
+		volume.Size = uint64(size)
+	} else {
+		volume.Size, err = getSysfsSize("/sys/class/block", part.Device)
+		if err != nil {
+			return volume, err
+		}
+		start, err := readSysfsUint(filepath.Join("/sys/class/block", part.Device, "start"))
+		if err != nil {
+			return volume, err
+		}
+		volume.Start = start * sectorSize
+		volume.Group, volume.Available, err = GetPartitionGap("/sys/block", part.Device)
+		if err != nil {
+			return volume, err
+		}
+	}
+
+	// the used space only matters for /var, which is always mounted
+	usage, err := part.Usage()
+	if err != nil && !errors.Is(err, ErrUsageUnknown) {
+		return volume, err
+	}
+	volume.Used = usage.Used
+
+	return volume, nil
+}
+
+// getVolumeGroupFree returns the free space of a volume group
+func getVolumeGroupFree(vgName string) (uint64, error) {
+	out, err := exec.Command("vgs", "--noheadings", "--units", "b", "--nosuffix", "-o", "vg_free", vgName).Output()
+	if err != nil {
+		return 0, fmt.Errorf("could not get the free space of %s: %w", vgName, err)
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// readSysfsUint reads a number from a sysfs file
+func readSysfsUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// getSysfsSize returns the size in bytes of a block device from sysfs
+func getSysfsSize(sysClassBlock string, device string) (uint64, error) {
+	sectors, err := readSysfsUint(filepath.Join(sysClassBlock, device, "size"))
+	if err != nil {
+		return 0, err
+	}
+	return sectors * sectorSize, nil
+}
+
+// GetPartitionGap returns the disk holding the given partition and the
+// unallocated space, in bytes, between the end of the partition and the
+// next one, or the end of the disk, from a /sys/block directory
+func GetPartitionGap(sysBlock string, partition string) (string, uint64, error) {
+	disks, err := os.ReadDir(sysBlock)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, disk := range disks {
+		diskDir := filepath.Join(sysBlock, disk.Name())
+		start, err := readSysfsUint(filepath.Join(diskDir, partition, "start"))
+		if err != nil {
+			continue
+		}
+		size, err := readSysfsUint(filepath.Join(diskDir, partition, "size"))
+		if err != nil {
+			return "", 0, err
+		}
+		diskSize, err := readSysfsUint(filepath.Join(diskDir, "size"))
+		if err != nil {
+			return "", 0, err
+		}
+
+		end := start + size
+		next := diskSize - min(diskSize, gptBackupSectors)
+
+		entries, err := os.ReadDir(diskDir)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, entry := range entries {
+			otherStart, err := readSysfsUint(filepath.Join(diskDir, entry.Name(), "start"))
+			if err != nil || entry.Name() == partition {
+				continue
+			}
+			if otherStart >= end && otherStart < next {
+				next = otherStart
+			}
+		}
+
+		if next <= end {
+			return disk.Name(), 0, nil
+		}
+		return disk.Name(), (next - end) * sectorSize, nil
+	}
+
+	return "", 0, fmt.Errorf("partition %s not found in %s", partition, sysBlock)
+}
+
+// growPartition makes a partition size bytes long, by moving its end
+func growPartition(disk string, partition string, size uint64) error {
+	number, err := readSysfsUint(filepath.Join("/sys/block", disk, partition, "partition"))
+	if err != nil {
+		return err
+	}
+
+	// sfdisk keeps the start of the partition and changes its size
+	cmd := exec.Command("sfdisk", "--no-reread", "-N", strconv.FormatUint(number, 10), "/dev/"+disk)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf(", %d\n", size/sectorSize))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sfdisk failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+
+	// the disk is in use, so only the partition table entry is updated
+	return runCmds("could not update the partition table of "+disk, [][]string{
+		{"partx", "--update", "--nr", strconv.FormatUint(number, 10), "/dev/" + disk},
+	})
+}
+
+// growFilesystemCmds returns the commands growing the filesystem of device,
+// mounted at mountPoint, to the size of the device
+func growFilesystemCmds(fsType string, device string, mountPoint string) [][]string {
+	switch fsType {
+	case "btrfs":
+		return [][]string{{"btrfs", "filesystem", "resize", "max", mountPoint}}
+	case "xfs":
+		return [][]string{{"xfs_growfs", mountPoint}}
+	}
+
+	return [][]string{{"resize2fs", device}}
+}
+
+// shrinkVar shrinks the /var logical volume, mounted at /var, to the
+// proposed size. Only btrfs can be shrunk while mounted, which the plan
+// already checked.
+func shrinkVar(volume *StorageVolume) error {
+	if volume.FsType != "btrfs" {
+		return fmt.Errorf("%s can't be shrunk while /var is mounted", volume.FsType)
+	}
+
+	// the filesystem is shrunk below the target first, then grown back to
+	// fill the logical volume, to be sure it fits
+	return runCmds("could not shrink /var", [][]string{
+		{"btrfs", "filesystem", "resize", strconv.FormatUint(volume.Proposed-gib, 10), "/var"},
+		{"lvreduce", "-y", "-L", strconv.FormatUint(volume.Proposed, 10) + "b", volume.Device},
+		{"btrfs", "filesystem", "resize", "max", "/var"},
+	})
+}
+
+// ResizeFutureRoot grows the future root to the size proposed by the plan,
+// shrinking /var first if the plan takes space from it. If /var can only be
+// shrunk unmounted, the shrink is scheduled for the next boot instead and
+// ErrVarShrinkScheduled is returned, the future root being grown by running
+// it again after rebooting. The present root is never touched: it is
+// resized after rebooting, once it is the future one.
+func (s *ABSystem) ResizeFutureRoot(plan *StoragePlan, dryRun bool) error {
+	PrintVerboseInfo("ABSystem.ResizeFutureRoot", "running...")
+
+	future := plan.Volume("future")
+	if future == nil {
+		err := fmt.Errorf("the future root was not found")
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 0, err)
+		return err
+	}
+	if future.Proposed <= future.Size {
+		PrintVerboseInfo("ABSystem.ResizeFutureRoot", "the future root is large enough")
+		return nil
+	}
+	if future.Note != "" {
+		err := fmt.Errorf("the future root can't be grown: %s", future.Note)
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 1, err)
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	err := s.LockOperation()
+	if err != nil {
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 2, err)
+		return err
+	}
+	defer s.UnlockOperation()
+
+	// /var gives the future root the space it lacks if it shares its volume
+	// group, or if it is the partition right after it
+	varVolume := plan.Volume("var")
+	givesSpace := false
+	if varVolume != nil && varVolume.Proposed < varVolume.Size && varVolume.Group == future.Group {
+		givesSpace = future.Kind == STORAGE_VOLUME_LVM ||
+			varVolume.Start == future.Start+future.Size+future.Available
+	}
+	if givesSpace {
+		available := future.Available
+		if future.Kind == STORAGE_VOLUME_LVM {
+			available, err = getVolumeGroupFree(future.Group)
+			if err != nil {
+				PrintVerboseErr("ABSystem.ResizeFutureRoot", 3, err)
+				return err
+			}
+		}
+		if available < future.Proposed-future.Size && varShrinksOffline(varVolume) {
+			err = ScheduleVarShrink(varVolume)
+			if err != nil {
+				PrintVerboseErr("ABSystem.ResizeFutureRoot", 3.1, err)
+				return err
+			}
+			return ErrVarShrinkScheduled
+		}
+		if available < future.Proposed-future.Size {
+			err = shrinkVar(varVolume)
+			if err != nil {
+				PrintVerboseErr("ABSystem.ResizeFutureRoot", 4, err)
+				return err
+			}
+		}
+	}
+
+	futurePart, err := s.RootM.GetFuture()
+	if err != nil {
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 5, err)
+		return err
+	}
+
+	if future.Kind == STORAGE_VOLUME_LVM {
+		err = runCmds("could not extend "+future.Device, [][]string{
+			{"lvextend", "-L", strconv.FormatUint(future.Proposed, 10) + "b", future.Device},
+		})
+	} else {
+		err = growPartition(future.Group, futurePart.Partition.Device, future.Proposed)
+	}
+	if err != nil {
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 6, err)
+		return err
+	}
+
+	// btrfs and xfs can only be grown while mounted
+	mountPoint := filepath.Join("/run/abroot/resize", future.Label)
+	part := futurePart.Partition
+	err = part.Mount(mountPoint)
+	if err != nil {
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 7, err)
+		return err
+	}
+	defer part.Unmount()
+
+	err = runCmds("could not grow the filesystem of "+future.Label, growFilesystemCmds(future.FsType, future.Device, mountPoint))
+	if err != nil {
+		PrintVerboseErr("ABSystem.ResizeFutureRoot", 8, err)
+		return err
+	}
+
+	PrintVerboseInfo("ABSystem.ResizeFutureRoot", "future root grown to", future.Proposed)
+	return nil
+}
+
+// MarshalStoragePlan returns the plan in JSON
+func MarshalStoragePlan(plan *StoragePlan) ([]byte, error) {
+	return json.MarshalIndent(plan, "", "  ")
+}
@@ -23,7 +23,6 @@ import (
 
 	"github.com/google/uuid"
 	EtcBuilder "github.com/linux-immutability-tools/EtcBuilder/cmd"
-	digest "github.com/opencontainers/go-digest"
 	"github.com/vanilla-os/abroot/settings"
 	"github.com/vanilla-os/sdk/pkg/v1/goodies"
 )
@@ -43,6 +42,28 @@ type ABSystem struct {
 	// CurImage contains an instance of ABImage which represents the current
 	// image used by the system (abimage.abr).
 	CurImage *ABImage
+
+	// DownloadRateLimit overrides the downloadRateLimit option for the
+	// operations of this instance, e.g. 2MB, or 0 for no limit.
+	DownloadRateLimit string
+
+	// Trigger, if set, is recorded in the history as the type of the
+	// operations of this instance in place of the ABSystemOperation, e.g.
+	// HISTORY_REBASE for the upgrade deploying a rebase.
+	Trigger string
+
+	// history, if set, is filled in by RunOperation instead of recording an
+	// entry of its own, for the commands made of several steps to record
+	// them as a whole, see Rebase
+	history *HistoryEntry
+
+	// rebasePending is set by Rebase, for RunOperation to write the new
+	// image to the administrator configuration before syncing /etc
+	rebasePending bool
+
+	// rebaseCommitted is set once the new image is written to the
+	// administrator configuration
+	rebaseCommitted bool
 }
 
 // Supported ABSystemOperation types
@@ -124,46 +145,9 @@ func (s *ABSystem) CheckAll() error {
 }
 
 // CheckUpdate checks if there is an update available
-func (s *ABSystem) CheckUpdate() (digest.Digest, bool, error) {
+func (s *ABSystem) CheckUpdate() (PlatformImage, bool, error) {
 	PrintVerboseInfo("ABSystem.CheckUpdate", "running...")
-	return HasUpdate(s.CurImage.Digest)
-}
-
-func (s *ABSystem) Rebase(name string, dryRun bool) error {
-
-	if name == "" {
-		return fmt.Errorf("no image provided")
-	}
-
-	if strings.Contains(name, ".") {
-		registrySplit := strings.SplitN(name, "/", 2)
-		settings.Cnf.Registry = registrySplit[0]
-		name = registrySplit[1]
-	}
-	nameTagSplit := strings.Split(name, ":")
-	name = nameTagSplit[0]
-	if len(nameTagSplit) < 1 {
-		fmt.Errorf("No tag provided")
-	}
-	settings.Cnf.Tag = nameTagSplit[1]
-	if name != "" {
-		settings.Cnf.Name = name
-	}
-
-	_, _, err := s.CheckUpdate()
-	if err != nil {
-		return err
-	}
-
-	if !dryRun {
-		err := settings.WriteConfigToFile(settings.CnfPathAdmin)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-
+	return HasUpdate(s.CurImage)
 }
 
 // RunOperation executes a root-switching operation from the options below:
@@ -176,9 +160,32 @@ func (s *ABSystem) Rebase(name string, dryRun bool) error {
 //		Applies package changes, and updates the system if an update is available.
 //	INITRAMFS:
 //		Updates the initramfs for the future root, but doesn't update the system.
-func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bool, dryRun bool) error {
+func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bool, dryRun bool) (err error) {
 	PrintVerboseInfo("ABSystem.RunOperation", "starting", operation)
 
+	historyOperation := string(operation)
+	if s.Trigger != "" {
+		historyOperation = s.Trigger
+	}
+
+	_, err = StartOperationLog(historyOperation)
+	if err != nil {
+		PrintVerboseWarn("ABSystem.RunOperation", 0.05, "could not start the operation log:", err)
+	}
+
+	entry := s.history
+	if entry != nil {
+		entry.ID = CurrentOperationID()
+	} else {
+		entry = NewHistoryEntry(historyOperation)
+		defer func() {
+			entry.Finish(err)
+		}()
+	}
+	entry.DryRun = dryRun
+	entry.Image = settings.GetFullImageNameWithTag()
+	entry.OldDigest = s.CurImage.Digest.String()
+
 	cq := goodies.NewCleanupQueue()
 	defer cq.Run()
 
@@ -191,7 +198,7 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		return errors.New("another operation finished successfully, a reboot is required")
 	}
 
-	err := s.LockOperation()
+	err = s.LockOperation()
 	if err != nil {
 		PrintVerboseErr("ABSystem.RunOperation", 0.1, "could not create lock file:", err)
 		return fmt.Errorf("could not create lock file: %w", err)
@@ -218,10 +225,10 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		return err
 	}
 
-	var imageDigest digest.Digest
+	var platformImage PlatformImage
 	if operation != INITRAMFS {
 		var res bool
-		imageDigest, res, err = s.CheckUpdate()
+		platformImage, res, err = s.CheckUpdate()
 		if err != nil {
 			PrintVerboseErr("ABSystem.RunOperation", 1, err)
 			return err
@@ -231,14 +238,15 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 				PrintVerboseErr("ABSystem.RunOperation", 1.1, err)
 				return ErrNoUpdate
 			}
-			imageDigest = s.CurImage.Digest
+			platformImage = s.CurImage.PlatformImage()
 			if operation == FORCE_UPGRADE {
 				PrintVerboseWarn("ABSystem.RunOperation", 1.2, "No update available but --force is set. Proceeding...")
 			}
 		}
 	} else {
-		imageDigest = s.CurImage.Digest
+		platformImage = s.CurImage.PlatformImage()
 	}
+	entry.NewDigest = platformImage.Digest.String()
 
 	// Stage 2: Get the present root, future root and boot partitions,
 	// 			mount future to /part-future and clean up
@@ -286,6 +294,22 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		return partFuture.Partition.Unmount()
 	}, nil, 90, &goodies.NoErrorHandler{}, false)
 
+	hookEnv := &HookEnv{
+		Operation:    string(operation),
+		PresentLabel: partPresent.Label,
+		FutureLabel:  partFuture.Label,
+		OldDigest:    s.CurImage.Digest.String(),
+		NewDigest:    platformImage.Digest.String(),
+		FutureRoot:   futureRoot,
+		DryRun:       dryRun,
+	}
+
+	err = RunHooks(HOOK_PRE_UPGRADE, hookEnv)
+	if err != nil {
+		PrintVerboseErr("ABSystem.RunOperation", 2.35, err)
+		return err
+	}
+
 	// Stage 3: Make a imageRecipe with user packages
 	//         	then download the image
 	// ------------------------------------------------
@@ -317,6 +341,11 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		return err
 	}
 
+	entry.PackagesAdded, entry.PackagesRemoved, err = pkgM.GetUnstagedPackages("/")
+	if err != nil {
+		PrintVerboseWarn("ABSystem.RunOperation", 3.25, "could not list the package changes:", err)
+	}
+
 	pkgsFinal, err := pkgM.GetFinalCmd()
 	if err != nil {
 		PrintVerboseErr("ABSystem.RunOperation", 3.3, err)
@@ -341,8 +370,8 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		}
 	default:
 		imageName = settings.GetFullImageName()
-		imageName += "@" + imageDigest.String()
-		labels["ABRoot.BaseImageDigest"] = imageDigest.String()
+		imageName += "@" + platformImage.Digest.String()
+		labels["ABRoot.BaseImageDigest"] = platformImage.Digest.String()
 	}
 
 	imageRecipe := NewImageRecipe(
@@ -352,9 +381,32 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		content,
 	)
 
-	// Stage 3.2: Download image
+	// Stage 3.2: Check the available space, then download image
+	rateLimit, err := GetDownloadRateLimit(s.DownloadRateLimit)
+	if err != nil {
+		PrintVerboseErr("ABSystem.RunOperation", 3.44, err)
+		return err
+	}
+
+	// the packages layer installs all the added packages, not only the
+	// unstaged ones
+	addedPackages := []string{}
+	if pkgsFinal != "true" {
+		addedPackages, err = pkgM.GetAddPackages()
+		if err != nil {
+			PrintVerboseWarn("ABSystem.RunOperation", 3.445, "could not list the added packages, leaving them out of the space check:", err)
+		}
+	}
+
+	spaceReport, err := CheckImageSpace(imageName, futureRoot, len(addedPackages))
+	if err != nil {
+		PrintVerboseErr("ABSystem.RunOperation", 3.45, err)
+		return err
+	}
+	PrintVerboseInfo("ABSystem.RunOperation", "space check passed:\n"+spaceReport.String())
+
 	if !dryRun {
-		err = OciPullImage(imageName)
+		err = OciPullImage(imageName, rateLimit)
 		if err != nil {
 			PrintVerboseErr("ABSystem.RunOperation", 3.5, err)
 			return err
@@ -371,6 +423,56 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		return err
 	}
 
+	if settings.Cnf.StorageBackend == STORAGE_LVM_THIN {
+		usage, err := GetThinPoolUsage()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.05, err)
+			return err
+		}
+
+		err = usage.Check()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.06, err)
+			return err
+		}
+	}
+
+	// the future root is the one to roll back to until now, so the backend
+	// only replaces it once the hooks, the space check and the pull passed
+	if !dryRun {
+		err = partFuture.Partition.Unmount()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.07, err)
+			return err
+		}
+
+		err = s.RootM.Backend.PrepareFuture(partPresent, partFuture)
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.08, err)
+			return err
+		}
+
+		// the backend may have recreated the future root, e.g. with a new
+		// filesystem UUID, so it must be looked up again
+		err = s.RootM.GetPartitions()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.09, err)
+			return err
+		}
+
+		partFuture, err = s.RootM.GetFuture()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.091, err)
+			return err
+		}
+
+		err = partFuture.Partition.Mount(futureRoot)
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.092, err)
+			return err
+		}
+	}
+
 	err = s.createFinalizingFile()
 	if err != nil {
 		PrintVerboseErr("ABSystem.RunOperation", 5.3, err)
@@ -390,6 +492,12 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 
 	abrootTrans := filepath.Join(futureRoot, "abroot-trans")
 	if !dryRun {
+		err = removeRootManifest(futureRoot, partFuture.Label)
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.1, err)
+			return err
+		}
+
 		err = OciExportRootFs(
 			"abroot-"+uuid.New().String(),
 			imageRecipe,
@@ -424,7 +532,7 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 	// ------------------------------------------------
 	PrintVerboseSimple("[Stage 5] -------- ABSystemRunOperation")
 
-	abimage, err := NewABImage(imageDigest, settings.GetFullImageNameWithTag())
+	abimage, err := NewABImage(platformImage, settings.GetFullImageNameWithTag())
 	if err != nil {
 		PrintVerboseErr("ABSystem.RunOperation", 5.1, err)
 		return err
@@ -610,6 +718,22 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 	// ------------------------------------------------
 	PrintVerboseSimple("[Stage 7] -------- ABSystemRunOperation")
 
+	// the administrator configuration is part of /etc, so a rebase must be
+	// written to it before it is synced, and undone if the operation fails
+	if s.rebasePending && !dryRun {
+		var restoreConfig func()
+		restoreConfig, err = s.writeRebaseConfig()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 7.99, err)
+			return err
+		}
+		defer func() {
+			if err != nil {
+				restoreConfig()
+			}
+		}()
+	}
+
 	oldEtc := "/sysconf" // The current etc WITHOUT anything overlayed
 	oldUpperEtc := fmt.Sprintf("/var/lib/abroot/etc/%s", partPresent.Label)
 	newUpperEtc := fmt.Sprintf("/var/lib/abroot/etc/%s", partFuture.Label)
@@ -627,6 +751,11 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		}
 	}
 
+	err = RunHooks(HOOK_POST_DEPLOY, hookEnv)
+	if err != nil {
+		PrintVerboseWarn("ABSystem.RunOperation", 8.1, err)
+	}
+
 	// Stage 8: Mount boot partition
 	// ------------------------------------------------
 	PrintVerboseSimple("[Stage 8] -------- ABSystemRunOperation")
@@ -648,6 +777,49 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		return partBoot.Unmount()
 	}, nil, 100, &goodies.NoErrorHandler{}, false)
 
+	// Stage 8.1: Check that the future root can boot
+	// ------------------------------------------------
+	PrintVerboseSimple("[Stage 8.1] -------- ABSystemRunOperation")
+
+	if !dryRun {
+		bootDir := filepath.Join(futureRoot, "boot")
+		if settings.Cnf.ThinProvisioning {
+			bootDir = filepath.Join(initMountpoint, partFuture.Label)
+		}
+
+		// a chroot which can't be set up fails the checks running in it,
+		// rather than the operation with a bare error
+		chroot, err := NewChroot(
+			futureRoot,
+			partFuture.Partition.Uuid,
+			partFuture.Partition.Device,
+			true,
+			newUpperEtc,
+		)
+		var run HealthCheckRunner
+		if err != nil {
+			PrintVerboseWarn("ABSystem.RunOperation", 10, "could not set up the chroot:", err)
+			run = chrootSetupFailed(err)
+		} else {
+			run = chroot.ExecuteOutput
+		}
+
+		_, healthErr := CheckRootHealth(futureRoot, bootDir, HealthChecksDir, run)
+
+		if chroot != nil {
+			err = chroot.Close()
+			if err != nil {
+				PrintVerboseErr("ABSystem.RunOperation", 10.1, err)
+				return err
+			}
+		}
+
+		if healthErr != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 10.2, healthErr)
+			return healthErr
+		}
+	}
+
 	// Stage 9: Atomic swap the bootloader
 	// ------------------------------------------------
 	PrintVerboseSimple("[Stage 9] -------- ABSystemRunOperation")
@@ -664,6 +836,26 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		PrintVerboseErr("ABSystem.RunOperation", 11.1, err)
 		return err
 	}
+	err = RunHooks(HOOK_PRE_REBOOT, hookEnv)
+	if err != nil {
+		PrintVerboseErr("ABSystem.RunOperation", 11.15, err)
+		return err
+	}
+
+	// records what was deployed, for abroot verify, once nothing else
+	// writes to the future root
+	if !dryRun {
+		err = createBindDirs(futureRoot)
+		if err != nil {
+			PrintVerboseWarn("ABSystem.RunOperation", 11.17, "could not create the bind mount directories:", err)
+		}
+
+		err = WriteRootManifest(futureRoot, partFuture.Label)
+		if err != nil {
+			PrintVerboseWarn("ABSystem.RunOperation", 11.18, "could not write the manifest of the future root:", err)
+		}
+	}
+
 	if !dryRun && isPresent {
 		grubCfgCurrent := filepath.Join(tmpBootMount, "grub/grub.cfg")
 		grubCfgFuture := filepath.Join(tmpBootMount, "grub/grub.cfg.future")
@@ -703,6 +895,15 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation, deleteBeforeCopy bo
 		}
 	}
 
+	// the kernel and the initrd change, so the PCRs measuring them will too
+	if !dryRun {
+		err = s.resealVarTPM2ForNextBoot()
+		if err != nil {
+			// the passphrase can still unlock /var
+			PrintVerboseWarn("ABSystem.RunOperation", 11.35, "could not seal the /var key for the next boot:", err)
+		}
+	}
+
 	if !dryRun {
 		err = s.createFinishedFile()
 		if err != nil {
@@ -722,6 +923,23 @@ func (s *ABSystem) Rollback(checkOnly bool) (response ABRollbackResponse, err er
 	cq := goodies.NewCleanupQueue()
 	defer cq.Run()
 
+	if !checkOnly {
+		_, err = StartOperationLog(HISTORY_ROLLBACK)
+		if err != nil {
+			PrintVerboseWarn("ABSystem.Rollback", 0.1, "could not start the operation log:", err)
+		}
+
+		entry := NewHistoryEntry(HISTORY_ROLLBACK)
+		entry.OldDigest = s.CurImage.Digest.String()
+		defer func() {
+			if response == ROLLBACK_UNNECESSARY {
+				entry.Finish(errNothingToDo)
+				return
+			}
+			entry.Finish(err)
+		}()
+	}
+
 	if s.finishedFileExists() {
 		if checkOnly {
 			return ROLLBACK_RES_NO, nil
@@ -825,6 +1043,30 @@ func (s *ABSystem) Rollback(checkOnly bool) (response ABRollbackResponse, err er
 		return ROLLBACK_FAILED, err
 	}
 
+	err = s.resealVarTPM2ForNextBoot()
+	if err != nil {
+		// the passphrase can still unlock /var
+		PrintVerboseWarn("ABSystem.Rollback", 7.1, "could not seal the /var key for the next boot:", err)
+	}
+
+	hookEnv := &HookEnv{
+		Operation: "rollback",
+		OldDigest: s.CurImage.Digest.String(),
+	}
+	partPresent, err := s.RootM.GetPresent()
+	if err == nil {
+		hookEnv.PresentLabel = partPresent.Label
+	}
+	partFuture, err := s.RootM.GetFuture()
+	if err == nil {
+		hookEnv.FutureLabel = partFuture.Label
+	}
+
+	err = RunHooks(HOOK_POST_ROLLBACK, hookEnv)
+	if err != nil {
+		PrintVerboseWarn("ABSystem.Rollback", 8, err)
+	}
+
 	// allow upgrades after rolling back
 	err = s.UnlockOperation()
 	if err != nil {
@@ -0,0 +1,404 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// testFutureDir is where the throwaway copy of the future root is assembled
+const testFutureDir = "/run/abroot/test-future"
+
+// testFutureMachine is the name of the container the future root runs in
+const testFutureMachine = "abroot-test-future"
+
+// testFutureBootTimeout is how long the future root is given to finish
+// booting in the container
+const testFutureBootTimeout = 3 * time.Minute
+
+// testFutureStopTimeout is how long the container is given to power off
+// before it is terminated
+const testFutureStopTimeout = 30 * time.Second
+
+// bootFinishedStates are the states reported by systemctl is-system-running
+// once the startup is over
+var bootFinishedStates = []string{"running", "degraded", "maintenance", "stopping", "offline"}
+
+// ErrNspawnUnavailable is returned when booting the future root is requested
+// but systemd-nspawn is not installed
+var ErrNspawnUnavailable = errors.New("systemd-nspawn is required to boot the future root")
+
+// FutureTestEnv is a throwaway copy of the future root, assembled with
+// overlays on a tmpfs, so that all the changes made in it are discarded by
+// Close. The /etc of the future root includes the user changes, as it does
+// at boot time.
+type FutureTestEnv struct {
+	// Root is where the copy of the future root is mounted
+	Root string
+
+	system     *ABSystem
+	partFuture ABRootPartition
+	mounts     []string
+}
+
+// FutureBootReport is the result of booting the future root in a container
+type FutureBootReport struct {
+	// State is the state reported by systemctl is-system-running
+	State string
+
+	// DefaultTargetReached is true if the default target became active
+	DefaultTargetReached bool
+
+	// FailedUnits lists the units which failed during the boot
+	FailedUnits []string
+}
+
+// NewFutureTestEnv mounts the future root and assembles a throwaway copy of
+// it. The operation is locked until Close is called, so that the future
+// root does not change in the meantime.
+func (s *ABSystem) NewFutureTestEnv() (*FutureTestEnv, error) {
+	PrintVerboseInfo("ABSystem.NewFutureTestEnv", "running...")
+
+	err := s.LockOperation()
+	if err != nil {
+		PrintVerboseErr("ABSystem.NewFutureTestEnv", 0, err)
+		return nil, err
+	}
+
+	partFuture, err := s.RootM.GetFuture()
+	if err != nil {
+		PrintVerboseErr("ABSystem.NewFutureTestEnv", 1, err)
+		s.UnlockOperation()
+		return nil, err
+	}
+
+	partFuture.Partition.Unmount() // just in case
+	futureRoot := "/part-future"
+	err = partFuture.Partition.Mount(futureRoot)
+	if err != nil {
+		PrintVerboseErr("ABSystem.NewFutureTestEnv", 2, err)
+		s.UnlockOperation()
+		return nil, err
+	}
+
+	userEtc := filepath.Join(AbrootVarDir, "etc", partFuture.Label)
+	if _, err := os.Stat(userEtc); err != nil {
+		userEtc = ""
+	}
+
+	env, err := AssembleFutureTestEnv(testFutureDir, futureRoot, userEtc)
+	if err != nil {
+		PrintVerboseErr("ABSystem.NewFutureTestEnv", 3, err)
+		partFuture.Partition.Unmount()
+		s.UnlockOperation()
+		return nil, err
+	}
+	env.system = s
+	env.partFuture = partFuture
+
+	PrintVerboseInfo("ABSystem.NewFutureTestEnv", "future root assembled in", env.Root)
+	return env, nil
+}
+
+// AssembleFutureTestEnv assembles in dir a throwaway copy of the root
+// mounted at futureRoot, with overlays whose upper directories are on a
+// tmpfs. userEtc, if not empty, holds the user changes to /etc. Everything
+// mounted so far is undone if a step fails.
+func AssembleFutureTestEnv(dir string, futureRoot string, userEtc string) (*FutureTestEnv, error) {
+	env := &FutureTestEnv{Root: filepath.Join(dir, "root")}
+
+	err := env.assemble(dir, futureRoot, userEtc)
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// assemble mounts a tmpfs holding the upper directories of the overlays the
+// copy is made of, then the overlays
+func (e *FutureTestEnv) assemble(dir string, futureRoot string, userEtc string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	err = e.mount("tmpfs", dir, "tmpfs", "mode=0755")
+	if err != nil {
+		return err
+	}
+
+	for _, subdir := range []string{"root", "upper", "work", "etc-upper", "etc-work"} {
+		err = os.MkdirAll(filepath.Join(dir, subdir), 0o755)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootOverlay := OverlayMount{
+		LowerDirs: []string{futureRoot},
+		UpperDir:  filepath.Join(dir, "upper"),
+		WorkDir:   filepath.Join(dir, "work"),
+	}
+	err = e.mount("overlay", e.Root, "overlay", rootOverlay.Options())
+	if err != nil {
+		return err
+	}
+
+	// the user changes to /etc are kept read-only in a lower directory, like
+	// the root /etc, so they are not touched either
+	etcOverlay := OverlayMount{
+		LowerDirs: []string{filepath.Join(futureRoot, "etc")},
+		UpperDir:  filepath.Join(dir, "etc-upper"),
+		WorkDir:   filepath.Join(dir, "etc-work"),
+	}
+	if userEtc != "" {
+		etcOverlay.LowerDirs = append([]string{userEtc}, etcOverlay.LowerDirs...)
+	}
+	err = e.mount("overlay", filepath.Join(e.Root, "etc"), "overlay", etcOverlay.Options())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// mount performs a mount and records it, so that Close can undo it
+func (e *FutureTestEnv) mount(source string, target string, fstype string, options string) error {
+	PrintVerboseInfo("FutureTestEnv.mount", "mounting", target)
+
+	err := syscall.Mount(source, target, fstype, 0, options)
+	if err != nil {
+		return fmt.Errorf("could not mount %s: %w", target, err)
+	}
+
+	e.mounts = append(e.mounts, target)
+	return nil
+}
+
+// Close discards the copy of the future root, then unmounts the future root
+// and unlocks the operation if NewFutureTestEnv did so
+func (e *FutureTestEnv) Close() error {
+	PrintVerboseInfo("FutureTestEnv.Close", "running...")
+
+	var closeErr error
+	for i := len(e.mounts) - 1; i >= 0; i-- {
+		err := syscall.Unmount(e.mounts[i], 0)
+		if err != nil {
+			PrintVerboseErr("FutureTestEnv.Close", 0, e.mounts[i], err)
+			closeErr = errors.Join(closeErr, err)
+		}
+	}
+	e.mounts = nil
+
+	if e.partFuture.Partition.MountPoint != "" {
+		err := e.partFuture.Partition.Unmount()
+		if err != nil {
+			PrintVerboseErr("FutureTestEnv.Close", 1, err)
+			closeErr = errors.Join(closeErr, err)
+		}
+	}
+
+	if e.system != nil {
+		err := e.system.UnlockOperation()
+		if err != nil {
+			PrintVerboseErr("FutureTestEnv.Close", 2, err)
+			closeErr = errors.Join(closeErr, err)
+		}
+	}
+
+	return closeErr
+}
+
+// Run runs a command in the copy of the future root, in a container if
+// systemd-nspawn is available, in a chroot otherwise
+func (e *FutureTestEnv) Run(cmd string) error {
+	PrintVerboseInfo("FutureTestEnv.Run", "running command:", cmd)
+
+	if _, err := exec.LookPath("systemd-nspawn"); err == nil {
+		return e.nspawn("/bin/sh", "-c", cmd)
+	}
+
+	PrintVerboseWarn("FutureTestEnv.Run", 0, "systemd-nspawn not found, using a chroot")
+	chroot, err := NewChroot(e.Root, e.partFuture.Partition.Uuid, e.partFuture.Partition.Device, false, "")
+	if err != nil {
+		PrintVerboseErr("FutureTestEnv.Run", 1, err)
+		return err
+	}
+
+	runErr := chroot.Execute(cmd)
+
+	err = chroot.Close()
+	if err != nil {
+		PrintVerboseErr("FutureTestEnv.Run", 2, err)
+		return errors.Join(runErr, err)
+	}
+
+	return runErr
+}
+
+// Shell opens an interactive shell in the copy of the future root
+func (e *FutureTestEnv) Shell() error {
+	PrintVerboseInfo("FutureTestEnv.Shell", "running...")
+
+	if _, err := exec.LookPath("systemd-nspawn"); err == nil {
+		// with no command, systemd-nspawn runs the shell of root
+		return e.nspawn()
+	}
+
+	return e.Run(`exec "${SHELL:-/bin/sh}"`)
+}
+
+// FutureNspawnArgs returns the arguments of systemd-nspawn to run the given
+// command in the copy of the future root at root, or to boot it if boot is
+// true. Booting runs systemd itself rather than /sbin/init, which performs
+// the early boot mounts of a real boot, and gives the container its own
+// network, so that its services do not act on the one of the host.
+func FutureNspawnArgs(root string, boot bool, args ...string) []string {
+	nspawnArgs := []string{"--quiet", "--directory=" + root, "--machine=" + testFutureMachine}
+	if boot {
+		nspawnArgs = append(nspawnArgs,
+			"--private-network", "--console=passive", "--kill-signal=SIGRTMIN+3",
+			"--", SystemdPath,
+		)
+		return nspawnArgs
+	}
+
+	if len(args) > 0 {
+		nspawnArgs = append(append(nspawnArgs, "--"), args...)
+	}
+	return nspawnArgs
+}
+
+// nspawn runs systemd-nspawn on the copy of the future root, attached to
+// the terminal
+func (e *FutureTestEnv) nspawn(args ...string) error {
+	cmd := exec.Command("systemd-nspawn", FutureNspawnArgs(e.Root, false, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		PrintVerboseErr("FutureTestEnv.nspawn", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// Boot boots the copy of the future root in a container, waits for the boot
+// to finish and reports whether the default target was reached and which
+// units failed. The container is powered off afterwards.
+func (e *FutureTestEnv) Boot() (*FutureBootReport, error) {
+	PrintVerboseInfo("FutureTestEnv.Boot", "running...")
+
+	if _, err := exec.LookPath("systemd-nspawn"); err != nil {
+		PrintVerboseErr("FutureTestEnv.Boot", 0, ErrNspawnUnavailable)
+		return nil, ErrNspawnUnavailable
+	}
+
+	container := exec.Command("systemd-nspawn", FutureNspawnArgs(e.Root, true)...)
+	err := container.Start()
+	if err != nil {
+		PrintVerboseErr("FutureTestEnv.Boot", 1, err)
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- container.Wait()
+	}()
+	defer stopFutureContainer(container, exited)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testFutureBootTimeout)
+	defer cancel()
+
+	report := &FutureBootReport{}
+
+	// the machine is only reachable once registered, so keep asking until
+	// the startup is over
+	for {
+		out, _ := exec.CommandContext(ctx, "systemctl", "--machine="+testFutureMachine, "is-system-running", "--wait").Output()
+		report.State = lastLine(string(out))
+		if slices.Contains(bootFinishedStates, report.State) {
+			break
+		}
+
+		select {
+		case err := <-exited:
+			exited <- err
+			err = fmt.Errorf("the container exited before finishing to boot: %v", err)
+			PrintVerboseErr("FutureTestEnv.Boot", 2, err)
+			return nil, err
+		case <-ctx.Done():
+			err := fmt.Errorf("the boot did not finish within %s", testFutureBootTimeout)
+			PrintVerboseErr("FutureTestEnv.Boot", 3, err)
+			return nil, err
+		case <-time.After(time.Second):
+		}
+	}
+
+	out, _ := exec.Command("systemctl", "--machine="+testFutureMachine, "is-active", "default.target").Output()
+	report.DefaultTargetReached = lastLine(string(out)) == "active"
+
+	out, err = exec.Command("systemctl", "--machine="+testFutureMachine, "list-units", "--failed", "--plain", "--no-legend").Output()
+	if err != nil {
+		PrintVerboseErr("FutureTestEnv.Boot", 4, err)
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			report.FailedUnits = append(report.FailedUnits, fields[0])
+		}
+	}
+
+	PrintVerboseInfo("FutureTestEnv.Boot", "boot finished in state", report.State, "with", len(report.FailedUnits), "failed units")
+	return report, nil
+}
+
+// stopFutureContainer powers off the container the future root was booted
+// in, terminating it if it does not stop in time
+func stopFutureContainer(container *exec.Cmd, exited chan error) {
+	err := exec.Command("machinectl", "poweroff", testFutureMachine).Run()
+	if err != nil {
+		PrintVerboseWarn("stopFutureContainer", 0, "could not power off the container:", err)
+	}
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(testFutureStopTimeout):
+	}
+
+	PrintVerboseWarn("stopFutureContainer", 1, "the container did not power off, terminating it")
+	exec.Command("machinectl", "terminate", testFutureMachine).Run()
+	container.Process.Kill()
+	<-exited
+}
+
+// lastLine returns the last non-empty line of the output of a command
+func lastLine(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
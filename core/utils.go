@@ -21,6 +21,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"slices"
+	"strings"
 	"syscall"
 )
 
@@ -154,6 +155,21 @@ func isDeviceLUKSEncrypted(devicePath string) (bool, error) {
 	return true, nil
 }
 
+// runCmds runs the given commands in order, stopping at the first failure,
+// whose error starts with what was being done and holds the output of the
+// command
+func runCmds(what string, cmds [][]string) error {
+	for _, args := range cmds {
+		PrintVerboseInfo("runCmds", "running", strings.Join(args, " "))
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s failed: %s: %w", what, args[0], strings.TrimSpace(string(out)), err)
+		}
+	}
+
+	return nil
+}
+
 // getDirSize calculates the total size of a directory recursively.
 func getDirSize(path string) (int64, error) {
 	ds, err := os.Stat(path)
@@ -0,0 +1,364 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+const (
+	cryptsetupPath       = "/usr/sbin/cryptsetup"
+	systemdCryptsetup    = "/usr/lib/systemd/systemd-cryptsetup"
+	systemdCryptenroll   = "/usr/bin/systemd-cryptenroll"
+	tpm2TokenType        = "systemd-tpm2"
+	fido2TokenType       = "systemd-fido2"
+	recoveryTokenType    = "systemd-recovery"
+	KEYSLOT_PASSPHRASE   = "passphrase"
+	KEYSLOT_TPM2         = "tpm2"
+	KEYSLOT_FIDO2        = "fido2"
+	KEYSLOT_RECOVERY_KEY = "recovery"
+)
+
+// bootChainPcrs are the PCRs measuring the boot loader, its configuration,
+// the kernel and the initrd, whose values change with every deployed image
+var bootChainPcrs = []int{4, 8, 9, 11}
+
+// LuksKeyslot is a keyslot of a LUKS2 device
+type LuksKeyslot struct {
+	Slot int `json:"slot"`
+
+	// Type is how the keyslot is unlocked, one of the KEYSLOT_* values
+	Type string `json:"type"`
+
+	// Pcrs are the PCRs a TPM2 keyslot is sealed against
+	Pcrs []int `json:"pcrs,omitempty"`
+}
+
+// luksMetadata is the part of the LUKS2 metadata describing the keyslots
+// and the tokens used to unlock them
+type luksMetadata struct {
+	Keyslots map[string]struct {
+		Type string `json:"type"`
+	} `json:"keyslots"`
+	Tokens map[string]struct {
+		Type     string   `json:"type"`
+		Keyslots []string `json:"keyslots"`
+		Pcrs     []int    `json:"tpm2-pcrs"`
+	} `json:"tokens"`
+}
+
+// ParseLuksKeyslots returns the keyslots described by the JSON metadata of
+// a LUKS2 device, as printed by `cryptsetup luksDump --dump-json-metadata`.
+// Keyslots without a token are unlocked with a passphrase.
+func ParseLuksKeyslots(metadata []byte) ([]LuksKeyslot, error) {
+	var m luksMetadata
+	err := json.Unmarshal(metadata, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	keyslots := []LuksKeyslot{}
+	for id, k := range m.Keyslots {
+		// holds the progress of an encryption, not a key
+		if k.Type == "reencrypt" {
+			continue
+		}
+
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot %q: %w", id, err)
+		}
+		keyslot := LuksKeyslot{Slot: slot, Type: KEYSLOT_PASSPHRASE}
+
+		for _, token := range m.Tokens {
+			if !slices.Contains(token.Keyslots, id) {
+				continue
+			}
+			switch token.Type {
+			case tpm2TokenType:
+				keyslot.Type = KEYSLOT_TPM2
+				keyslot.Pcrs = token.Pcrs
+			case fido2TokenType:
+				keyslot.Type = KEYSLOT_FIDO2
+			case recoveryTokenType:
+				keyslot.Type = KEYSLOT_RECOVERY_KEY
+			}
+		}
+
+		keyslots = append(keyslots, keyslot)
+	}
+
+	sort.Slice(keyslots, func(i, j int) bool {
+		return keyslots[i].Slot < keyslots[j].Slot
+	})
+
+	return keyslots, nil
+}
+
+// ListVarKeyslots returns the keyslots of the encrypted /var device
+func ListVarKeyslots(device string) ([]LuksKeyslot, error) {
+	PrintVerboseInfo("ListVarKeyslots", "running...")
+
+	out, err := exec.Command(cryptsetupPath, "luksDump", "--dump-json-metadata", device).Output()
+	if err != nil {
+		err = fmt.Errorf("could not read the LUKS metadata of %s: %w", device, err)
+		PrintVerboseErr("ListVarKeyslots", 0, err)
+		return nil, err
+	}
+
+	keyslots, err := ParseLuksKeyslots(out)
+	if err != nil {
+		PrintVerboseErr("ListVarKeyslots", 1, err)
+		return nil, err
+	}
+
+	return keyslots, nil
+}
+
+// FormatPcrs returns the PCRs in the format used by systemd, e.g. 7+9
+func FormatPcrs(pcrs []int) string {
+	formatted := make([]string, 0, len(pcrs))
+	for _, pcr := range pcrs {
+		formatted = append(formatted, strconv.Itoa(pcr))
+	}
+	return strings.Join(formatted, "+")
+}
+
+// ParsePcrs parses PCRs in the format used by systemd, e.g. 7+9 or 7,9
+func ParsePcrs(pcrs string) ([]int, error) {
+	parsed := []int{}
+	for _, field := range strings.FieldsFunc(pcrs, func(r rune) bool { return r == '+' || r == ',' }) {
+		pcr, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || pcr < 0 || pcr > 23 {
+			return nil, fmt.Errorf("invalid PCR %q", field)
+		}
+		parsed = append(parsed, pcr)
+	}
+	return parsed, nil
+}
+
+// StablePcrs returns the given PCRs without the ones measuring the boot
+// chain, which change when a new image is deployed
+func StablePcrs(pcrs []int) []int {
+	stable := []int{}
+	for _, pcr := range pcrs {
+		if !slices.Contains(bootChainPcrs, pcr) {
+			stable = append(stable, pcr)
+		}
+	}
+	return stable
+}
+
+// samePcrs tells whether two lists hold the same PCRs, in any order
+func samePcrs(a []int, b []int) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// runCryptenroll runs systemd-cryptenroll on the terminal, since it may
+// ask for a passphrase or for the user to touch a security key
+func runCryptenroll(args ...string) error {
+	cmd := exec.Command(systemdCryptenroll, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// EnrollVarTPM2 seals a key of the encrypted /var device in the TPM2,
+// against the given PCRs, replacing any other TPM2 keyslot. The passphrase
+// of the device is asked on the terminal.
+func EnrollVarTPM2(device string, pcrs []int) error {
+	PrintVerboseInfo("EnrollVarTPM2", "running...")
+
+	err := runCryptenroll("--tpm2-device=auto", "--tpm2-pcrs="+FormatPcrs(pcrs), "--wipe-slot=tpm2", device)
+	if err != nil {
+		err = fmt.Errorf("could not enroll the TPM2 in %s: %w", device, err)
+		PrintVerboseErr("EnrollVarTPM2", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// EnrollVarFIDO2 adds a keyslot of the encrypted /var device unlocked with
+// a FIDO2 security key. The passphrase of the device is asked on the
+// terminal.
+func EnrollVarFIDO2(device string) error {
+	PrintVerboseInfo("EnrollVarFIDO2", "running...")
+
+	err := runCryptenroll("--fido2-device=auto", device)
+	if err != nil {
+		err = fmt.Errorf("could not enroll the FIDO2 key in %s: %w", device, err)
+		PrintVerboseErr("EnrollVarFIDO2", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// UnlockVarTPM2 opens the encrypted /var device as name, with the key
+// sealed in the TPM2. Nothing is asked on the terminal, so that the caller
+// can fall back to the passphrase.
+func UnlockVarTPM2(device string, name string) error {
+	PrintVerboseInfo("UnlockVarTPM2", "running...")
+
+	cmd := exec.Command(systemdCryptsetup, "attach", name, device, "-", "tpm2-device=auto,headless=true")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("could not unlock %s with the TPM2: %w", device, err)
+		PrintVerboseErr("UnlockVarTPM2", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// varFido2TokenTimeout is how long the FIDO2 security key is waited for
+// before falling back to the passphrase
+const varFido2TokenTimeout = "30s"
+
+// UnlockVarFIDO2 opens the encrypted /var device as name, with an enrolled
+// FIDO2 security key. Its PIN, if any, is asked on the terminal and the key
+// is waited for up to varFido2TokenTimeout.
+func UnlockVarFIDO2(device string, name string) error {
+	PrintVerboseInfo("UnlockVarFIDO2", "running...")
+
+	cmd := exec.Command(systemdCryptsetup, "attach", name, device, "-", "fido2-device=auto,token-timeout="+varFido2TokenTimeout)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("could not unlock %s with the FIDO2 key: %w", device, err)
+		PrintVerboseErr("UnlockVarFIDO2", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// HasVarKeyslot tells whether the encrypted /var device has a keyslot of
+// the given type
+func HasVarKeyslot(device string, keyslotType string) (bool, error) {
+	keyslots, err := ListVarKeyslots(device)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(keyslots, func(k LuksKeyslot) bool { return k.Type == keyslotType }), nil
+}
+
+// ResealVarTPM2 seals the key of the TPM2 keyslot of the encrypted /var
+// device again, against the given PCRs and their current values. The
+// present TPM2 keyslot authorizes the change, so no passphrase is needed.
+// Nothing is done if the device has no TPM2 keyslot or if it is already
+// sealed against the given PCRs.
+func ResealVarTPM2(device string, pcrs []int) error {
+	PrintVerboseInfo("ResealVarTPM2", "running...")
+
+	keyslots, err := ListVarKeyslots(device)
+	if err != nil {
+		PrintVerboseErr("ResealVarTPM2", 0, err)
+		return err
+	}
+
+	tpm2Index := slices.IndexFunc(keyslots, func(k LuksKeyslot) bool { return k.Type == KEYSLOT_TPM2 })
+	if tpm2Index < 0 {
+		PrintVerboseInfo("ResealVarTPM2", "no TPM2 keyslot, nothing to do")
+		return nil
+	}
+	if samePcrs(keyslots[tpm2Index].Pcrs, pcrs) {
+		PrintVerboseInfo("ResealVarTPM2", "already sealed against PCRs", FormatPcrs(pcrs))
+		return nil
+	}
+
+	out, err := exec.Command(systemdCryptenroll,
+		"--unlock-tpm2-device=auto",
+		"--tpm2-device=auto", "--tpm2-pcrs="+FormatPcrs(pcrs),
+		"--wipe-slot=tpm2", device,
+	).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("could not seal the key of %s again: %w: %s", device, err, strings.TrimSpace(string(out)))
+		PrintVerboseErr("ResealVarTPM2", 1, err)
+		return err
+	}
+
+	PrintVerboseInfo("ResealVarTPM2", "sealed against PCRs", FormatPcrs(pcrs))
+	return nil
+}
+
+// ErrNoStablePcrs is returned when all the PCRs the /var key is sealed
+// against change with the deployed image, so it can't be sealed for the
+// next boot
+var ErrNoStablePcrs = errors.New("all the configured PCRs measure the boot chain")
+
+// resealVarTPM2ForNextBoot prepares the TPM2 keyslot of the encrypted /var
+// partition for the boot into a new kernel and initrd. Their PCR values
+// can't be predicted, so the key is sealed against the other configured
+// PCRs only, until the early boot seals it against all of them again once
+// the new boot chain has been measured.
+func (s *ABSystem) resealVarTPM2ForNextBoot() error {
+	state := GetVarEncryptionState(s.RootM.VarPartition)
+	if !state.Encrypted || !state.Unlocked {
+		return nil
+	}
+
+	pcrs := settings.Cnf.VarTpm2Pcrs
+	stable := StablePcrs(pcrs)
+	if len(stable) == len(pcrs) {
+		// nothing measured by the boot chain, the values won't change
+		return nil
+	}
+	if len(stable) == 0 {
+		return ErrNoStablePcrs
+	}
+
+	return ResealVarTPM2(state.Device, stable)
+}
+
+// resealVarTPM2 seals the key of the encrypted /var against all the
+// configured PCRs again, once the boot chain of the deployed image has been
+// measured, after an upgrade sealed it against the stable ones only. A
+// failure is only reported, since /var has already been unlocked.
+func (b *EarlyBoot) resealVarTPM2() error {
+	device := settings.Cnf.PartCryptVar
+	if device == "" || b.encryptedVar != nil {
+		return nil
+	}
+	if b.DryRun {
+		b.Log.Info("would seal the key of %s against PCRs %s", device, FormatPcrs(settings.Cnf.VarTpm2Pcrs))
+		return nil
+	}
+
+	err := ResealVarTPM2(device, settings.Cnf.VarTpm2Pcrs)
+	if err != nil {
+		b.Log.Warn("%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,575 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// VarEncryptionHeaderSize is the space freed at the end of the filesystem
+// of /var before encrypting it, where its data is shifted to make room for
+// the LUKS2 header
+const VarEncryptionHeaderSize int64 = 32 * 1024 * 1024
+
+// varPassphraseTimeout is how long the early boot waits for the passphrase
+// of a scheduled encryption of /var
+const varPassphraseTimeout = 2 * time.Minute
+
+// errPassphraseTimeout is returned when no passphrase was entered in time
+var errPassphraseTimeout = errors.New("no passphrase was entered in time, the encryption was postponed")
+
+// VarEncryptionScheduleFile schedules the encryption of /var for the next
+// boot, since the partition can't be in use while it is prepared
+const VarEncryptionScheduleFile = "/var/lib/abroot/var-encryption.json"
+
+// varEncryptionFsTypes are the filesystems which can be shrunk to make room
+// for the LUKS2 header
+var varEncryptionFsTypes = []string{"ext4", "btrfs"}
+
+// ErrVarAlreadyEncrypted is returned when encrypting a /var partition which
+// is already encrypted
+var ErrVarAlreadyEncrypted = errors.New("the /var partition is already encrypted")
+
+// VarEncryptionPlan describes how the /var partition is encrypted in place
+type VarEncryptionPlan struct {
+	// Device is the partition holding /var, which becomes the LUKS2 device
+	Device string `json:"device"`
+
+	// Uuid is the UUID of the filesystem, which it keeps once encrypted
+	Uuid   string `json:"uuid"`
+	FsType string `json:"fsType"`
+
+	// LuksUuid is the UUID given to the LUKS2 device, which must differ
+	// from the one of the filesystem so that each is found by its UUID
+	LuksUuid string `json:"luksUuid"`
+
+	DeviceSize int64 `json:"deviceSize"`
+
+	// FsSize is the size the filesystem is shrunk to
+	FsSize int64 `json:"fsSize"`
+
+	// MapperName is the name of the opened LUKS2 device, luks-<LuksUuid>
+	// like unlock-var names it
+	MapperName string `json:"mapperName"`
+}
+
+// PlanVarEncryption checks that the given /var partition can be encrypted
+// in place and returns the plan to do it
+func PlanVarEncryption(varPart Partition) (*VarEncryptionPlan, error) {
+	PrintVerboseInfo("PlanVarEncryption", "running...")
+
+	if varPart.Device == "" {
+		err := fmt.Errorf("partition %s not found", settings.Cnf.PartLabelVar)
+		PrintVerboseErr("PlanVarEncryption", 0, err)
+		return nil, err
+	}
+	if GetVarEncryptionState(varPart).Encrypted {
+		PrintVerboseErr("PlanVarEncryption", 1, ErrVarAlreadyEncrypted)
+		return nil, ErrVarAlreadyEncrypted
+	}
+
+	supported := false
+	for _, fsType := range varEncryptionFsTypes {
+		if varPart.FsType == fsType {
+			supported = true
+		}
+	}
+	if !supported {
+		err := fmt.Errorf("%s can't be shrunk to make room for the encryption header, only %s are supported",
+			varPart.FsType, strings.Join(varEncryptionFsTypes, " and "))
+		PrintVerboseErr("PlanVarEncryption", 2, err)
+		return nil, err
+	}
+
+	device := "/dev/" + varPart.Device
+	if varPart.IsDevMapper() {
+		device = "/dev/mapper/" + varPart.Device
+	}
+
+	deviceSize, err := blockDeviceSize(device)
+	if err != nil {
+		PrintVerboseErr("PlanVarEncryption", 3, err)
+		return nil, err
+	}
+
+	usage, err := varPart.Usage()
+	if err != nil {
+		PrintVerboseErr("PlanVarEncryption", 4, err)
+		return nil, err
+	}
+	// keep some room for the filesystem to be shrunk
+	if int64(usage.Free) < 2*VarEncryptionHeaderSize {
+		err := fmt.Errorf("at least %d MiB must be free on /var to encrypt it", 2*VarEncryptionHeaderSize/1024/1024)
+		PrintVerboseErr("PlanVarEncryption", 5, err)
+		return nil, err
+	}
+
+	// a multiple of 1 MiB, which suits the block size of any filesystem
+	fsSize := (deviceSize - VarEncryptionHeaderSize) / (1024 * 1024) * (1024 * 1024)
+	luksUuid := uuid.New().String()
+
+	return &VarEncryptionPlan{
+		Device:     device,
+		Uuid:       varPart.Uuid,
+		FsType:     varPart.FsType,
+		LuksUuid:   luksUuid,
+		DeviceSize: deviceSize,
+		FsSize:     fsSize,
+		MapperName: "luks-" + luksUuid,
+	}, nil
+}
+
+// blockDeviceSize returns the size of a block device in bytes
+func blockDeviceSize(device string) (int64, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return file.Seek(0, io.SeekEnd)
+}
+
+// ScheduleVarEncryption schedules the encryption of /var for the next boot
+// and records the encrypted device as PartCryptVar in the configuration of
+// the administrator
+func ScheduleVarEncryption(plan *VarEncryptionPlan) error {
+	PrintVerboseInfo("ScheduleVarEncryption", "running...")
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		PrintVerboseErr("ScheduleVarEncryption", 0, err)
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(VarEncryptionScheduleFile), 0o755)
+	if err != nil {
+		PrintVerboseErr("ScheduleVarEncryption", 1, err)
+		return err
+	}
+	err = os.WriteFile(VarEncryptionScheduleFile, data, 0o600)
+	if err != nil {
+		PrintVerboseErr("ScheduleVarEncryption", 2, err)
+		return err
+	}
+
+	settings.Cnf.PartCryptVar = plan.Device
+	err = writeAdminConfig()
+	if err != nil {
+		PrintVerboseErr("ScheduleVarEncryption", 3, err)
+		return err
+	}
+
+	return nil
+}
+
+// writeAdminConfig writes the configuration to the file of the
+// administrator, creating it if needed
+func writeAdminConfig() error {
+	if _, err := os.Stat(settings.CnfPathAdmin); os.IsNotExist(err) {
+		err := os.MkdirAll(filepath.Dir(settings.CnfPathAdmin), 0o755)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(settings.CnfPathAdmin, os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+
+	return settings.WriteConfigToFile(settings.CnfPathAdmin)
+}
+
+// ReadVarEncryptionSchedule reads the plan of a scheduled encryption
+func ReadVarEncryptionSchedule(path string) (*VarEncryptionPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan VarEncryptionPlan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %s: %w", path, err)
+	}
+	if plan.Device == "" || plan.Uuid == "" || plan.FsSize <= 0 {
+		return nil, fmt.Errorf("invalid schedule %s: missing device details", path)
+	}
+	// older schedules reused the UUID of the filesystem for the LUKS2 device
+	if plan.LuksUuid == "" || plan.LuksUuid == plan.Uuid {
+		plan.LuksUuid = uuid.New().String()
+		plan.MapperName = "luks-" + plan.LuksUuid
+	}
+
+	return &plan, nil
+}
+
+// LuksReencryptionInProgress tells whether the JSON metadata of a LUKS2
+// device, as printed by `cryptsetup luksDump --dump-json-metadata`, records
+// an unfinished encryption
+func LuksReencryptionInProgress(metadata []byte) (bool, error) {
+	var m struct {
+		Keyslots map[string]struct {
+			Type string `json:"type"`
+		} `json:"keyslots"`
+	}
+	err := json.Unmarshal(metadata, &m)
+	if err != nil {
+		return false, err
+	}
+
+	for _, keyslot := range m.Keyslots {
+		if keyslot.Type == "reencrypt" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// VarReencryptionInProgress tells whether the encryption of the given
+// LUKS2 device was started but not finished
+func VarReencryptionInProgress(device string) (bool, error) {
+	PrintVerboseInfo("VarReencryptionInProgress", "running...")
+
+	out, err := exec.Command(cryptsetupPath, "luksDump", "--dump-json-metadata", device).Output()
+	if err != nil {
+		err = fmt.Errorf("could not read the LUKS metadata of %s: %w", device, err)
+		PrintVerboseErr("VarReencryptionInProgress", 0, err)
+		return false, err
+	}
+
+	return LuksReencryptionInProgress(out)
+}
+
+// ResumeVarEncryption finishes an interrupted encryption of the given
+// device, asking for its passphrase on the terminal
+func ResumeVarEncryption(device string) error {
+	PrintVerboseInfo("ResumeVarEncryption", "running...")
+
+	cmd := exec.Command(cryptsetupPath, "reencrypt", "--resume-only", "--progress-frequency", "5", device)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("could not resume the encryption of %s: %w", device, err)
+		PrintVerboseErr("ResumeVarEncryption", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// shrinkFilesystem shrinks the filesystem of device to size bytes, e.g.
+// to leave room for the LUKS2 header of /var. The size is absolute, so that
+// shrinking again after an interruption has no effect. btrfs is shrunk
+// while mounted on mountPoint, ext4 once unmounted.
+func shrinkFilesystem(fsType string, device string, size int64, mountPoint string) error {
+	var commands [][]string
+	switch fsType {
+	case "btrfs":
+		commands = [][]string{{"btrfs", "filesystem", "resize", strconv.FormatInt(size, 10), mountPoint}}
+	case "ext4":
+		commands = [][]string{
+			{"e2fsck", "-f", "-p", device},
+			{"resize2fs", device, strconv.FormatInt(size/1024, 10) + "K"},
+		}
+	default:
+		return fmt.Errorf("%s can't be shrunk", fsType)
+	}
+
+	for _, command := range commands {
+		out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+		// e2fsck exits with 1 when it fixed the filesystem
+		var exitErr *exec.ExitError
+		if command[0] == "e2fsck" && errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s failed: %w: %s", command[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+// readNewPassphrase asks for a new passphrase twice on the terminal,
+// without echoing it. The encryption is postponed if nothing is entered
+// within varPassphraseTimeout, so that an unattended boot goes on.
+func readNewPassphrase(terminal *os.File, log *BootLogger) (string, error) {
+	fd := int(terminal.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to ask for the passphrase: %w", err)
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	err = unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho)
+	if err != nil {
+		return "", err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+
+	reader := bufio.NewReader(terminal)
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(log.Console, prompt)
+		if reader.Buffered() == 0 {
+			// the terminal is in canonical mode, so it is only readable
+			// once a whole line was entered
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+			n, err := unix.Poll(fds, int(varPassphraseTimeout.Milliseconds()))
+			if err != nil {
+				return "", err
+			}
+			if n == 0 {
+				fmt.Fprintln(log.Console)
+				return "", errPassphraseTimeout
+			}
+		}
+		line, err := reader.ReadString('\n')
+		fmt.Fprintln(log.Console)
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	for {
+		passphrase, err := read("New passphrase for /var, empty to postpone: ")
+		if err == errPassphraseTimeout {
+			return "", err
+		}
+		if err != nil || passphrase == "" {
+			return "", errors.New("the encryption was postponed")
+		}
+		confirmation, err := read("Repeat the passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if passphrase == confirmation {
+			return passphrase, nil
+		}
+		log.Warn("the passphrases don't match")
+	}
+}
+
+// runCryptsetupWithKey runs cryptsetup reading the passphrase from its
+// standard input. With wait false it is left running.
+func runCryptsetupWithKey(passphrase string, wait bool, args ...string) error {
+	cmd := exec.Command(cryptsetupPath, append(args, "--key-file", "-")...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if wait {
+		return cmd.Run()
+	}
+
+	// keep going once the init replaces this process
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// encryptVarIfScheduled encrypts /var in place if it was scheduled with
+// `abroot var-encryption enable`. /var must be mounted from the plain
+// device, and is mounted again from the encrypted one.
+//
+// Only the LUKS2 header is written during the boot, then the data are
+// encrypted in the background, by `cryptsetup reencrypt`, while the system
+// is used. If this is interrupted, the LUKS2 header records how far it
+// went, so `abroot var-encryption enable` can resume it. A failure before
+// the header is written leaves /var unencrypted and usable.
+func (b *EarlyBoot) encryptVarIfScheduled() error {
+	if b.DryRun {
+		return nil
+	}
+
+	schedule := b.path(VarEncryptionScheduleFile)
+	plan, err := ReadVarEncryptionSchedule(schedule)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		b.Log.Warn("%v", err)
+		return nil
+	}
+
+	encrypted, err := isDeviceLUKSEncrypted(plan.Device)
+	if err != nil {
+		b.Log.Warn("%v", err)
+		return nil
+	}
+	if encrypted {
+		// the header was written on a previous boot, and the device was
+		// unlocked to mount /var
+		os.Remove(schedule)
+		return nil
+	}
+	if b.VarDevice != plan.Device {
+		b.Log.Warn("the encryption was scheduled for %s, but /var is on %s", plan.Device, b.VarDevice)
+		return nil
+	}
+
+	b.Log.Info("encrypting %s, the data will be encrypted in the background", plan.Device)
+	passphrase, err := readNewPassphrase(os.Stdin, b.Log)
+	if err != nil {
+		b.Log.Warn("%v", err)
+		return nil
+	}
+
+	varMount := b.path("/var")
+	mountPlain := func() error {
+		return b.mount(plan.Device, varMount, b.VarFsType, 0, b.VarOptions)
+	}
+
+	if plan.FsType == "btrfs" {
+		err = shrinkFilesystem(plan.FsType, plan.Device, plan.FsSize, varMount)
+		if err != nil {
+			b.Log.Warn("%v", err)
+			return nil
+		}
+	}
+	err = syscall.Unmount(varMount, 0)
+	if err != nil {
+		b.Log.Warn("could not unmount /var to encrypt it: %v", err)
+		return nil
+	}
+	if plan.FsType == "ext4" {
+		err = shrinkFilesystem(plan.FsType, plan.Device, plan.FsSize, varMount)
+		if err != nil {
+			b.Log.Warn("%v", err)
+			return mountPlain()
+		}
+	}
+
+	b.Log.Info("writing the encryption header")
+	err = runCryptsetupWithKey(passphrase, true,
+		"reencrypt", "--encrypt", "--type", "luks2", "--init-only",
+		"--reduce-device-size", strconv.FormatInt(VarEncryptionHeaderSize/1024/1024, 10)+"M",
+		"--uuid", plan.LuksUuid, plan.Device, plan.MapperName,
+	)
+	if err != nil {
+		b.Log.Error("could not encrypt %s, run `abroot var-encryption enable` again: %v", plan.Device, err)
+		err = mountPlain()
+		if err == nil {
+			os.Remove(schedule)
+		}
+		return err
+	}
+
+	b.VarDevice = "/dev/mapper/" + plan.MapperName
+	err = b.mount(b.VarDevice, varMount, b.VarFsType, 0, b.VarOptions)
+	if err != nil {
+		return err
+	}
+	b.encryptedVar = plan
+	err = os.Remove(schedule)
+	if err != nil {
+		b.Log.Warn("%v", err)
+	}
+
+	err = runCryptsetupWithKey(passphrase, false, "reencrypt", "--resume-only", plan.Device)
+	if err != nil {
+		b.Log.Warn("could not start encrypting the data, run `abroot var-encryption enable` to resume: %v", err)
+	}
+
+	return nil
+}
+
+// recordEncryptedVar adds the encrypted /var to the crypttab and points the
+// fstab entries using its plain device to the opened one, once it was
+// encrypted during this boot. The files are edited in the /etc of the
+// user, so that they are carried to the next roots. A failure is only
+// reported, since /var is already mounted.
+func (b *EarlyBoot) recordEncryptedVar() error {
+	if b.encryptedVar == nil || b.DryRun {
+		return nil
+	}
+
+	for _, file := range []struct {
+		path   string
+		update func(string, *VarEncryptionPlan) string
+	}{
+		{b.path("/etc/crypttab"), UpdateCrypttabForEncryptedVar},
+		{b.path("/etc/fstab"), UpdateFstabForEncryptedVar},
+	} {
+		contents, err := os.ReadFile(file.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			b.Log.Warn("could not record the encrypted /var in %s: %v", file.path, err)
+			continue
+		}
+		err = os.WriteFile(file.path+".new", []byte(file.update(string(contents), b.encryptedVar)), 0o644)
+		if err == nil {
+			err = os.Rename(file.path+".new", file.path)
+		}
+		if err != nil {
+			b.Log.Warn("could not record the encrypted /var in %s: %v", file.path, err)
+		}
+	}
+
+	return nil
+}
+
+// UpdateCrypttabForEncryptedVar returns the given crypttab contents with an
+// entry for the encrypted /var, replacing any entry for its device. It is
+// marked noauto since unlock-var opens it before systemd starts.
+func UpdateCrypttabForEncryptedVar(contents string, plan *VarEncryptionPlan) string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(contents, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") &&
+			(fields[0] == plan.MapperName || fields[1] == plan.Device ||
+				fields[1] == "UUID="+plan.Uuid || fields[1] == "UUID="+plan.LuksUuid) {
+			continue
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	lines = append(lines, plan.MapperName+" UUID="+plan.LuksUuid+" none luks,noauto")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// UpdateFstabForEncryptedVar returns the given fstab contents with the
+// entries mounting the plain device of /var mounting the opened one. The
+// entries using the UUID of the filesystem are kept, since it is unchanged.
+func UpdateFstabForEncryptedVar(contents string, plan *VarEncryptionPlan) string {
+	lines := strings.Split(contents, "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == plan.Device {
+			lines[i] = strings.Replace(line, plan.Device, "/dev/mapper/"+plan.MapperName, 1)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
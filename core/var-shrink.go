@@ -0,0 +1,265 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// VarShrinkScheduleFile schedules the shrink of /var for the next boot,
+// since only btrfs logical volumes can be shrunk while mounted
+const VarShrinkScheduleFile = "/var/lib/abroot/var-shrink.json"
+
+// varShrinkMoveLog is where sfdisk records the progress of moving the data
+// of a /var partition, in the root, so that an interrupted move can be
+// recovered with `sfdisk --move-data`
+const varShrinkMoveLog = "/abroot-var-shrink.move"
+
+// varShrinkFsTypes are the filesystems /var can be shrunk from
+var varShrinkFsTypes = []string{"ext4", "btrfs"}
+
+// ErrVarShrinkScheduled is returned when the space for the future root is
+// only available once /var is shrunk during the next boot
+var ErrVarShrinkScheduled = errors.New("the shrink of /var was scheduled for the next boot")
+
+// VarShrinkPlan describes how /var is shrunk during the next boot
+type VarShrinkPlan struct {
+	// Device is the partition or logical volume holding /var
+	Device string `json:"device"`
+	FsType string `json:"fsType"`
+
+	// Kind is STORAGE_VOLUME_PARTITION or STORAGE_VOLUME_LVM
+	Kind string `json:"kind"`
+
+	// Disk and Partition locate a /var partition, which is shrunk by
+	// moving its start towards its end, so that the space is freed right
+	// after the root before it
+	Disk      string `json:"disk,omitempty"`
+	Partition uint64 `json:"partition,omitempty"`
+
+	// Start and Size are the offset and the size /var ends up with, in
+	// bytes. Start is only used for a partition.
+	Start uint64 `json:"start,omitempty"`
+	Size  uint64 `json:"size"`
+}
+
+// ScheduleVarShrink schedules the shrink of the given /var volume to its
+// proposed size for the next boot
+func ScheduleVarShrink(volume *StorageVolume) error {
+	PrintVerboseInfo("ScheduleVarShrink", "running...")
+
+	plan := &VarShrinkPlan{
+		Device: volume.Device,
+		FsType: volume.FsType,
+		Kind:   volume.Kind,
+		Size:   volume.Proposed,
+	}
+	if volume.Kind == STORAGE_VOLUME_PARTITION {
+		number, err := readSysfsUint(filepath.Join("/sys/class/block", filepath.Base(volume.Device), "partition"))
+		if err != nil {
+			PrintVerboseErr("ScheduleVarShrink", 0, err)
+			return err
+		}
+		plan.Disk = volume.Group
+		plan.Partition = number
+		plan.Start = volume.Start + volume.Size - volume.Proposed
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		PrintVerboseErr("ScheduleVarShrink", 1, err)
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(VarShrinkScheduleFile), 0o755)
+	if err != nil {
+		PrintVerboseErr("ScheduleVarShrink", 2, err)
+		return err
+	}
+	err = os.WriteFile(VarShrinkScheduleFile, data, 0o600)
+	if err != nil {
+		PrintVerboseErr("ScheduleVarShrink", 3, err)
+		return err
+	}
+
+	return nil
+}
+
+// ReadVarShrinkSchedule reads the plan of a scheduled shrink
+func ReadVarShrinkSchedule(path string) (*VarShrinkPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan VarShrinkPlan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %s: %w", path, err)
+	}
+	if plan.Device == "" || plan.Size <= gib {
+		return nil, fmt.Errorf("invalid schedule %s: missing device details", path)
+	}
+	if plan.Kind == STORAGE_VOLUME_PARTITION && (plan.Disk == "" || plan.Partition == 0 || plan.Start == 0) {
+		return nil, fmt.Errorf("invalid schedule %s: missing partition details", path)
+	}
+
+	return &plan, nil
+}
+
+// varShrinkDone tells whether the device of /var already has the start and
+// size of the plan, e.g. when the boot was interrupted after shrinking it
+func varShrinkDone(plan *VarShrinkPlan) (bool, error) {
+	if plan.Kind == STORAGE_VOLUME_PARTITION {
+		start, err := readSysfsUint(filepath.Join("/sys/class/block", filepath.Base(plan.Device), "start"))
+		if err != nil {
+			return false, err
+		}
+		return start*sectorSize >= plan.Start, nil
+	}
+
+	size, err := blockDeviceSize(plan.Device)
+	if err != nil {
+		return false, err
+	}
+	return uint64(size) <= plan.Size, nil
+}
+
+// shrinkVarDevice shrinks the logical volume of /var, or moves the start of
+// its partition with its data, once its filesystem was shrunk
+func shrinkVarDevice(plan *VarShrinkPlan, moveLog string) error {
+	if plan.Kind == STORAGE_VOLUME_LVM {
+		return runCmds("could not shrink "+plan.Device, [][]string{
+			{"lvreduce", "-y", "-L", strconv.FormatUint(plan.Size, 10) + "b", plan.Device},
+		})
+	}
+
+	number := strconv.FormatUint(plan.Partition, 10)
+	cmd := exec.Command("sfdisk", "--no-reread", "--move-data="+moveLog, "-N", number, "/dev/"+plan.Disk)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("%d, %d\n", plan.Start/sectorSize, plan.Size/sectorSize))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sfdisk failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+
+	// the disk holds the root, so only the partition table entry is updated
+	return runCmds("could not update the partition table of "+plan.Disk, [][]string{
+		{"partx", "--update", "--nr", number, "/dev/" + plan.Disk},
+	})
+}
+
+// shrinkVarIfScheduled shrinks /var if it was scheduled by
+// `abroot storage resize`. /var must be mounted, and is mounted again once
+// shrunk.
+//
+// The filesystem is shrunk 1 GiB below the target, then the logical volume
+// is reduced or the partition is moved, and the filesystem is grown back to
+// fill it. A failure before the device is changed leaves /var usable, only
+// with a smaller filesystem. Moving a partition rewrites all the data of
+// /var: if it is interrupted, /var can only be recovered from the log of
+// sfdisk, kept at varShrinkMoveLog in the root.
+func (b *EarlyBoot) shrinkVarIfScheduled() error {
+	if b.DryRun {
+		return nil
+	}
+
+	schedule := b.path(VarShrinkScheduleFile)
+	plan, err := ReadVarShrinkSchedule(schedule)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		b.Log.Warn("%v", err)
+		return nil
+	}
+
+	if b.VarDevice != plan.Device {
+		b.Log.Warn("the shrink was scheduled for %s, but /var is on %s", plan.Device, b.VarDevice)
+		return nil
+	}
+	done, err := varShrinkDone(plan)
+	if err != nil {
+		b.Log.Warn("%v", err)
+		return nil
+	}
+	if done {
+		os.Remove(schedule)
+		return nil
+	}
+
+	b.Log.Info("shrinking %s to %s, do not power off the system", plan.Device, humanize.IBytes(plan.Size))
+
+	varMount := b.path("/var")
+	fsSize := int64(plan.Size - gib)
+	mountVar := func() error {
+		return b.mount(plan.Device, varMount, b.VarFsType, 0, b.VarOptions)
+	}
+
+	if plan.FsType == "btrfs" {
+		err = shrinkFilesystem(plan.FsType, plan.Device, fsSize, varMount)
+		if err != nil {
+			b.Log.Warn("%v", err)
+			return nil
+		}
+	}
+	err = syscall.Unmount(varMount, 0)
+	if err != nil {
+		b.Log.Warn("could not unmount /var to shrink it: %v", err)
+		return nil
+	}
+	if plan.FsType == "ext4" {
+		err = shrinkFilesystem(plan.FsType, plan.Device, fsSize, varMount)
+		if err != nil {
+			b.Log.Warn("%v", err)
+			return mountVar()
+		}
+	}
+
+	moveLog := b.path(varShrinkMoveLog)
+	err = shrinkVarDevice(plan, moveLog)
+	if err != nil && plan.Kind == STORAGE_VOLUME_LVM {
+		b.Log.Warn("%v", err)
+		return mountVar()
+	}
+	if err != nil {
+		return fmt.Errorf("could not move %s, its data may be recovered with the log in %s: %w", plan.Device, moveLog, err)
+	}
+	os.Remove(moveLog)
+
+	err = mountVar()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(schedule)
+	if err != nil {
+		b.Log.Warn("%v", err)
+	}
+
+	err = runCmds("could not grow the filesystem of /var", growFilesystemCmds(plan.FsType, plan.Device, varMount))
+	if err != nil {
+		b.Log.Warn("%v", err)
+	}
+
+	b.Log.Info("/var shrunk, run `abroot storage resize` to grow the root")
+	return nil
+}
@@ -0,0 +1,599 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/vanilla-os/abroot/settings"
+	"github.com/vanilla-os/prometheus"
+	"go.podman.io/storage"
+)
+
+// rootManifestFile is the file, relative to a root, where older versions
+// kept its manifest, which is now ignored since whoever tampers with the
+// root can rewrite it
+const rootManifestFile = "abroot-manifest.abr"
+
+// rootManifestsDir is where the manifests of the roots, listing the hashes
+// of the files deployed in them, are kept, out of the roots themselves
+var rootManifestsDir = filepath.Join(AbrootVarDir, "manifests")
+
+// verifyDir is where the roots are mounted to be verified
+var verifyDir = filepath.Join("/run", "abroot", "verify")
+
+// verifyExcluded are the paths, relative to a root, which are not part of
+// what was deployed
+var verifyExcluded = []string{rootManifestFile, layersRecordFile, incrementalSyncsFile, "abroot-trans"}
+
+// ErrNoRootManifest is returned when repairing a root deployed without a
+// manifest: its image lacks the files written at deploy time, e.g. the
+// initramfs, so it can't tell how to restore them
+var ErrNoRootManifest = errors.New("the root has no manifest, it can only be repaired once deployed again")
+
+// ManifestEntry describes a file of a root
+type ManifestEntry struct {
+	Path string `json:"path"`
+
+	// Mode holds the type and the permissions of the file
+	Mode uint32 `json:"mode"`
+	Uid  uint32 `json:"uid"`
+	Gid  uint32 `json:"gid"`
+
+	Sha256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// VerifyReport lists the differences between a root and what was deployed
+// in it
+type VerifyReport struct {
+	Root string `json:"root"`
+
+	// Source is what the root was compared with, the manifest or the image
+	Source string `json:"source"`
+
+	Modified []string `json:"modified"`
+	Missing  []string `json:"missing"`
+	Extra    []string `json:"extra"`
+
+	// Unrepairable are the modified and missing paths the image has a
+	// different version of, so they could not be restored
+	Unrepairable []string `json:"unrepairable,omitempty"`
+
+	// KeptExtra are the extra paths which were not removed by the repair,
+	// see RepairOptions
+	KeptExtra []string `json:"keptExtra,omitempty"`
+}
+
+// RepairOptions tells RepairRoot what to do with the extra files
+type RepairOptions struct {
+	// RemoveExtra removes the extra files, which are kept otherwise
+	RemoveExtra bool
+
+	// MountPoints are the paths, relative to the root, something is
+	// mounted on once booted. The extra ones, and the ones holding them,
+	// are always kept.
+	MountPoints []string
+}
+
+// holdsMountPoint tells whether path is one of the mount points or one of
+// their parents
+func (o RepairOptions) holdsMountPoint(path string) bool {
+	for _, mountPoint := range o.MountPoints {
+		if mountPoint == path || strings.HasPrefix(mountPoint, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Clean tells whether the root matches what was deployed
+func (r *VerifyReport) Clean() bool {
+	return len(r.Modified) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// newManifestEntry returns the entry for the file at path, relative to root
+func newManifestEntry(root string, path string) (ManifestEntry, error) {
+	fullPath := filepath.Join(root, path)
+
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	entry := ManifestEntry{Path: path, Mode: uint32(info.Mode())}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Uid = stat.Uid
+		entry.Gid = stat.Gid
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return entry, err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		if err != nil {
+			return entry, err
+		}
+		entry.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	case info.Mode()&fs.ModeSymlink != 0:
+		entry.Target, err = os.Readlink(fullPath)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	return entry, nil
+}
+
+// GenerateRootManifest returns the entries of all the files of the root at
+// the given path, sorted by path. Like the sync of the root, it does not
+// descend into other filesystems.
+func GenerateRootManifest(root string) ([]ManifestEntry, error) {
+	PrintVerboseInfo("GenerateRootManifest", "running...")
+
+	var rootStat syscall.Stat_t
+	err := syscall.Stat(root, &rootStat)
+	if err != nil {
+		PrintVerboseErr("GenerateRootManifest", 0, err)
+		return nil, err
+	}
+
+	entries := []ManifestEntry{}
+	err = filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		path, err := filepath.Rel(root, fullPath)
+		if err != nil || path == "." {
+			return err
+		}
+		if slices.Contains(verifyExcluded, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entry, err := newManifestEntry(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+
+		// the mount point is part of the root, not what is mounted on it
+		if d.IsDir() {
+			var stat syscall.Stat_t
+			err = syscall.Lstat(fullPath, &stat)
+			if err != nil {
+				return err
+			}
+			if stat.Dev != rootStat.Dev {
+				return filepath.SkipDir
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		PrintVerboseErr("GenerateRootManifest", 1, err)
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ReadRootManifest returns the manifest of the root with the given label. A
+// nil slice is returned if the root has no manifest, e.g. if it was
+// deployed by an older ABRoot.
+func ReadRootManifest(label string) ([]ManifestEntry, error) {
+	PrintVerboseInfo("ReadRootManifest", "running...")
+
+	data, err := os.ReadFile(filepath.Join(rootManifestsDir, label))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		PrintVerboseErr("ReadRootManifest", 0, err)
+		return nil, err
+	}
+
+	var entries []ManifestEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		PrintVerboseErr("ReadRootManifest", 1, err)
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// WriteRootManifest writes the manifest of the given root, labelled label,
+// in rootManifestsDir, so that it can't be rewritten along with the files
+// of the root. The root is bind mounted without what is mounted on it, e.g.
+// the init partition, so that the directories below the mount points are
+// recorded. The whole root is read and hashed on every deployment, which
+// takes a while on large roots.
+func WriteRootManifest(root string, label string) error {
+	PrintVerboseInfo("WriteRootManifest", "running...")
+
+	bindRoot := filepath.Join(verifyDir, "deploy")
+	err := os.MkdirAll(bindRoot, 0o755)
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 0, err)
+		return err
+	}
+
+	err = os.MkdirAll(rootManifestsDir, 0o755)
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 0.1, err)
+		return err
+	}
+
+	err = syscall.Mount(root, bindRoot, "", syscall.MS_BIND, "")
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 1, err)
+		return err
+	}
+	defer syscall.Unmount(bindRoot, 0)
+
+	entries, err := GenerateRootManifest(bindRoot)
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 2, err)
+		return err
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 3, err)
+		return err
+	}
+
+	manifestPath := filepath.Join(rootManifestsDir, label)
+	err = os.WriteFile(manifestPath+".new", data, 0o644)
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 4, err)
+		return err
+	}
+	err = os.Rename(manifestPath+".new", manifestPath)
+	if err != nil {
+		PrintVerboseErr("WriteRootManifest", 5, err)
+		return err
+	}
+
+	return nil
+}
+
+// removeRootManifest removes the manifest of a root about to be deployed
+// again, since it won't match the root until the deployment is complete,
+// along with the one older versions kept in the root
+func removeRootManifest(root string, label string) error {
+	for _, path := range []string{filepath.Join(rootManifestsDir, label), filepath.Join(root, rootManifestFile)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompareRootManifests returns the paths which are modified, missing or
+// extra in the actual entries of a root, compared with the expected ones
+func CompareRootManifests(expected []ManifestEntry, actual []ManifestEntry) *VerifyReport {
+	report := &VerifyReport{Modified: []string{}, Missing: []string{}, Extra: []string{}}
+
+	actualByPath := make(map[string]ManifestEntry, len(actual))
+	for _, entry := range actual {
+		actualByPath[entry.Path] = entry
+	}
+
+	expectedPaths := make(map[string]bool, len(expected))
+	for _, entry := range expected {
+		expectedPaths[entry.Path] = true
+
+		actualEntry, ok := actualByPath[entry.Path]
+		if !ok {
+			report.Missing = append(report.Missing, entry.Path)
+		} else if actualEntry != entry {
+			report.Modified = append(report.Modified, entry.Path)
+		}
+	}
+
+	for _, entry := range actual {
+		if !expectedPaths[entry.Path] {
+			report.Extra = append(report.Extra, entry.Path)
+		}
+	}
+
+	slices.Sort(report.Modified)
+	slices.Sort(report.Missing)
+	slices.Sort(report.Extra)
+
+	return report
+}
+
+// RepairRoot restores the modified and missing files of the report from
+// the image mounted at imageDir, and removes the extra ones as allowed by
+// opts. Files whose version in the image differs from the expected one,
+// e.g. because they were written at deploy time, are listed as
+// unrepairable.
+func RepairRoot(root string, imageDir string, expected []ManifestEntry, report *VerifyReport, opts RepairOptions) error {
+	PrintVerboseInfo("RepairRoot", "running...")
+
+	expectedByPath := make(map[string]ManifestEntry, len(expected))
+	for _, entry := range expected {
+		expectedByPath[entry.Path] = entry
+	}
+
+	restore := []string{}
+	for _, path := range append(slices.Clone(report.Modified), report.Missing...) {
+		imageEntry, err := newManifestEntry(imageDir, path)
+		if err != nil || imageEntry != expectedByPath[path] {
+			report.Unrepairable = append(report.Unrepairable, path)
+			continue
+		}
+		restore = append(restore, path)
+	}
+	slices.Sort(report.Unrepairable)
+
+	for _, path := range report.Extra {
+		if !opts.RemoveExtra || opts.holdsMountPoint(path) {
+			report.KeptExtra = append(report.KeptExtra, path)
+			continue
+		}
+
+		err := os.RemoveAll(filepath.Join(root, path))
+		if err != nil {
+			PrintVerboseErr("RepairRoot", 0, err)
+			return err
+		}
+	}
+
+	if len(restore) == 0 {
+		return nil
+	}
+
+	slices.Sort(restore)
+	listFile := filepath.Join(verifyDir, "restore-list")
+	err := os.WriteFile(listFile, []byte(strings.Join(restore, "\n")+"\n"), 0o644)
+	if err != nil {
+		PrintVerboseErr("RepairRoot", 1, err)
+		return err
+	}
+	defer os.Remove(listFile)
+
+	err = rsyncCmd(imageDir+"/", root, []string{"--files-from=" + listFile, "--force", "--checksum"}, true)
+	if err != nil {
+		PrintVerboseErr("RepairRoot", 2, err)
+		return err
+	}
+
+	return nil
+}
+
+// findRootImageLayer returns the top layer, in the storage, of the image
+// whose layers are the given ones
+func findRootImageLayer(store storage.Store, layers []RootLayer) (string, error) {
+	if len(layers) == 0 {
+		return "", errors.New("the layers of the root are not recorded")
+	}
+
+	candidates, err := store.LayersByUncompressedDigest(layers[len(layers)-1].Digest)
+	if err != nil && !errors.Is(err, storage.ErrLayerUnknown) {
+		return "", err
+	}
+
+	for _, candidate := range candidates {
+		id := candidate.ID
+		i := len(layers) - 1
+		for ; i >= 0 && id != ""; i-- {
+			layer, err := store.Layer(id)
+			if err != nil || layer.UncompressedDigest != layers[i].Digest {
+				break
+			}
+			id = layer.Parent
+		}
+		if i < 0 && id == "" {
+			return candidate.ID, nil
+		}
+	}
+
+	return "", errors.New("the image of the root is no longer in the storage")
+}
+
+// mountRoot mounts the root with the given identifier, present or future,
+// in the given directory, returning its path and a function unmounting it.
+// The present root is bind mounted from /, without what is mounted on it,
+// since its device is busy.
+func (s *ABSystem) mountRoot(identifier string, dir string) (string, func(), error) {
+	root := filepath.Join(dir, identifier)
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if identifier == "present" {
+		err = syscall.Mount("/", root, "", syscall.MS_BIND, "")
+		if err != nil {
+			return "", nil, fmt.Errorf("could not mount the present root: %w", err)
+		}
+		return root, func() { syscall.Unmount(root, 0) }, nil
+	}
+
+	partFuture, err := s.RootM.GetFuture()
+	if err != nil {
+		return "", nil, err
+	}
+
+	partFuture.Partition.Unmount() // just in case
+	err = partFuture.Partition.Mount(root)
+	if err != nil {
+		return "", nil, err
+	}
+	return root, func() { partFuture.Partition.Unmount() }, nil
+}
+
+// getMountPoints returns the mount points listed in a mountinfo file,
+// relative to /
+func getMountPoints(mountinfoPath string) ([]string, error) {
+	mountinfo, err := os.Open(mountinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer mountinfo.Close()
+
+	mountPoints := []string{}
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] == "/" {
+			continue
+		}
+		mountPoints = append(mountPoints, strings.TrimPrefix(fields[4], "/"))
+	}
+
+	return mountPoints, scanner.Err()
+}
+
+// VerifyRoot compares the files of the root with the given identifier,
+// present or future, with the manifest written when it was deployed, or
+// with its image if it has none. If repair is true, the differences are
+// then undone from the image. The extra files of the booted root are only
+// removed if removeExtra is true, and the mount points never are.
+func (s *ABSystem) VerifyRoot(identifier string, repair bool, removeExtra bool) (*VerifyReport, error) {
+	PrintVerboseInfo("ABSystem.VerifyRoot", "running...")
+
+	err := s.LockOperation()
+	if err != nil {
+		PrintVerboseErr("ABSystem.VerifyRoot", 0, err)
+		return nil, err
+	}
+	defer s.UnlockOperation()
+
+	rootPart, err := s.RootM.GetPresent()
+	if identifier == "future" {
+		rootPart, err = s.RootM.GetFuture()
+	}
+	if err != nil {
+		PrintVerboseErr("ABSystem.VerifyRoot", 0.1, err)
+		return nil, err
+	}
+
+	root, unmountRoot, err := s.mountRoot(identifier, verifyDir)
+	if err != nil {
+		PrintVerboseErr("ABSystem.VerifyRoot", 1, err)
+		return nil, err
+	}
+	defer unmountRoot()
+
+	expected, err := ReadRootManifest(rootPart.Label)
+	if err != nil {
+		PrintVerboseErr("ABSystem.VerifyRoot", 2, err)
+		return nil, err
+	}
+	if expected == nil && repair {
+		PrintVerboseErr("ABSystem.VerifyRoot", 3, ErrNoRootManifest)
+		return nil, ErrNoRootManifest
+	}
+
+	var imageDir string
+	if expected == nil || repair {
+		pt, err := prometheus.NewPrometheus(
+			abrootStorageDir,
+			"overlay",
+			settings.Cnf.MaxParallelDownloads,
+		)
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 4, err)
+			return nil, err
+		}
+
+		layers, err := ReadRootLayers(root)
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 5, err)
+			return nil, err
+		}
+
+		topLayer, err := findRootImageLayer(pt.Store, layers)
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 6, err)
+			return nil, err
+		}
+
+		imageDir, err = pt.MountImage(topLayer)
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 7, err)
+			return nil, err
+		}
+		defer pt.UnMountImage(topLayer, true)
+	}
+
+	source := "manifest"
+	if expected == nil {
+		source = "image"
+		expected, err = GenerateRootManifest(imageDir)
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 8, err)
+			return nil, err
+		}
+	}
+
+	actual, err := GenerateRootManifest(root)
+	if err != nil {
+		PrintVerboseErr("ABSystem.VerifyRoot", 9, err)
+		return nil, err
+	}
+
+	report := CompareRootManifests(expected, actual)
+	report.Root = identifier
+	report.Source = source
+
+	if repair && !report.Clean() {
+		// both roots have the same mount points once booted
+		mountPoints, err := getMountPoints("/proc/self/mountinfo")
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 10, err)
+			return report, err
+		}
+
+		err = RepairRoot(root, imageDir, expected, report, RepairOptions{
+			RemoveExtra: identifier != "present" || removeExtra,
+			MountPoints: mountPoints,
+		})
+		if err != nil {
+			PrintVerboseErr("ABSystem.VerifyRoot", 11, err)
+			return report, err
+		}
+	}
+
+	return report, nil
+}
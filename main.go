@@ -15,6 +15,8 @@ package main
 
 import (
 	"embed"
+	"os"
+	"path/filepath"
 
 	"go.podman.io/storage/pkg/reexec"
 	"github.com/vanilla-os/abroot/cmd"
@@ -33,6 +35,13 @@ func main() {
 		return
 	}
 
+	// when /sbin/init links to abroot, perform the early boot mounts and
+	// start systemd with the arguments given by the kernel. Being PID 1 is
+	// not enough, e.g. abroot may be the command of a container.
+	if os.Getpid() == 1 && filepath.Base(os.Args[0]) == "init" {
+		os.Args = append([]string{os.Args[0], "mount-sys", "--init", "--"}, os.Args[1:]...)
+	}
+
 	abroot = cmd.New(Version, fs)
 
 	// root command
@@ -74,18 +83,45 @@ func main() {
 	updateInitramfs := cmd.NewUpdateInitfsCommand()
 	root.AddCommand(updateInitramfs)
 
+	gc := cmd.NewGCCommand()
+	root.AddCommand(gc)
+
+	cache := cmd.NewCacheCommand()
+	root.AddCommand(cache)
+
+	logs := cmd.NewLogsCommand()
+	root.AddCommand(logs)
+
+	history := cmd.NewHistoryCommand()
+	root.AddCommand(history)
+
+	metrics := cmd.NewMetricsCommand()
+	root.AddCommand(metrics)
+
 	cnf := cmd.NewConfCommand()
 	root.AddCommand(cnf)
 
 	unlockVar := cmd.NewUnlockVarCommand()
 	root.AddCommand(unlockVar)
 
+	varEncryption := cmd.NewVarEncryptionCommand()
+	root.AddCommand(varEncryption)
+
+	storage := cmd.NewStorageCommand()
+	root.AddCommand(storage)
+
+	verify := cmd.NewVerifyCommand()
+	root.AddCommand(verify)
+
 	mntSys := cmd.NewMountSysCommand()
 	root.AddCommand(mntSys)
 
 	rebase := cmd.NewRebaseCommand()
 	root.AddCommand(rebase)
 
+	testFuture := cmd.NewTestFutureCommand()
+	root.AddCommand(testFuture)
+
 	// run the app
 	err := abroot.Run()
 	if err != nil {
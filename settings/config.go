@@ -26,6 +26,25 @@ type Config struct {
 	// Common
 	MaxParallelDownloads uint `json:"maxParallelDownloads"`
 
+	// DownloadRateLimit caps the download rate of images, e.g. 2MB for two
+	// megabytes per second, empty or 0 for no limit
+	DownloadRateLimit string `json:"downloadRateLimit"`
+
+	// LogMaxSize is the size, e.g. 10MB, above which the log of an
+	// operation is rotated
+	LogMaxSize string `json:"logMaxSize"`
+
+	// LogMaxFiles is the maximum number of log files kept, 0 for no limit
+	LogMaxFiles uint `json:"logMaxFiles"`
+
+	// LogRetentionDays is the number of days log files are kept for, 0 for
+	// no limit
+	LogRetentionDays uint `json:"logRetentionDays"`
+
+	// DumpRedact are the kinds of data redacted from the bundle written by
+	// `abroot status --dump`: uuids, hostnames and usernames
+	DumpRedact []string `json:"dumpRedact"`
+
 	// Registry
 	Registry           string `json:"registry"`
 	RegistryAPIVersion string `json:"registryAPIVersion"`
@@ -33,6 +52,29 @@ type Config struct {
 	Name               string `json:"name"`
 	Tag                string `json:"tag"`
 
+	// Per-registry mirrors, authentication and TLS configuration
+	Registries []RegistryConf `json:"registries"`
+
+	// PeerCaches are the addresses (host:port) of the caches served by
+	// other systems with `abroot cache serve`, tried before the registry
+	PeerCaches []string `json:"peerCaches"`
+
+	// PeerCacheDiscovery looks for peer caches on the local network
+	// through mDNS, in addition to PeerCaches
+	PeerCacheDiscovery bool `json:"peerCacheDiscovery"`
+
+	// CacheBlobs keeps the blobs of the last pulled image, so that they can
+	// be served to peers
+	CacheBlobs bool `json:"cacheBlobs"`
+
+	// CacheAllowedNetworks are the networks, in CIDR notation, of the
+	// clients served by `abroot cache serve`, any client if empty
+	CacheAllowedNetworks []string `json:"cacheAllowedNetworks"`
+
+	// RequiredImageLabels are the labels an image must have to be used by
+	// rebase, either as "key" or as "key=value"
+	RequiredImageLabels []string `json:"requiredImageLabels"`
+
 	// Package manager
 	IPkgMngPre    string `json:"iPkgMngPre"`
 	IPkgMngPost   string `json:"iPkgMngPost"`
@@ -56,9 +98,81 @@ type Config struct {
 	PartLabelEfi  string `json:"partLabelEfivar"`
 	PartCryptVar  string `json:"PartCryptVar"`
 
+	// VarTpm2Pcrs are the PCRs the key of the encrypted /var partition is
+	// sealed against when enrolled in the TPM2
+	VarTpm2Pcrs []int `json:"varTpm2Pcrs"`
+
 	// Structure
 	ThinProvisioning bool   `json:"thinProvisioning"`
 	ThinInitVolume   string `json:"thinInitVolume"`
+	StorageBackend   string `json:"storageBackend"`
+	BtrfsPoolLabel   string `json:"btrfsPoolLabel"`
+
+	// ThinPoolMinFreePercent is the minimum free data and metadata space,
+	// in percent, the thin pool must have to deploy a new root
+	ThinPoolMinFreePercent uint `json:"thinPoolMinFreePercent"`
+
+	// IncrementalDeploy makes transactions only sync the paths touched by
+	// the image layers which differ from the ones recorded in the future
+	// root. Files belonging to no layer, e.g. created in the root outside of
+	// ABRoot, are left in place, so a full sync is still performed every
+	// IncrementalDeployFullSyncEvery transactions.
+	IncrementalDeploy bool `json:"incrementalDeploy"`
+
+	// IncrementalDeployFullSyncEvery is how many incremental syncs a root
+	// gets before a full one, 0 meaning never
+	IncrementalDeployFullSyncEvery uint `json:"incrementalDeployFullSyncEvery"`
+
+	// System mounts
+	ExtraOverlayMounts []OverlayMountConf `json:"extraOverlayMounts"`
+	ExtraBindMounts    []BindMountConf    `json:"extraBindMounts"`
+}
+
+// OverlayMountConf describes an additional writable overlay which mount-sys
+// mounts on top of a read-only directory of the root, like it does for /etc
+type OverlayMountConf struct {
+	// Destination is the absolute path of the directory to overlay
+	Destination string `json:"destination"`
+
+	// Location is the directory, relative to /var/lib/abroot, holding the
+	// upper and work directories of the overlay
+	Location string `json:"location"`
+
+	// Shared makes both roots use the same upper directory, otherwise each
+	// root gets its own, named after its label
+	Shared bool `json:"shared"`
+}
+
+// RegistryConf describes how to reach a registry, or a namespace of it,
+// when pulling images
+type RegistryConf struct {
+	// Registry is the registry host, optionally followed by a namespace,
+	// the configuration applies to, e.g. ghcr.io or ghcr.io/vanilla-os
+	Registry string `json:"registry"`
+
+	// Mirrors are tried in order before the registry itself, each one
+	// replacing the Registry prefix of the image name
+	Mirrors []string `json:"mirrors"`
+
+	// AuthFile is a containers auth.json holding the credentials
+	AuthFile string `json:"authFile"`
+
+	// CredentialHelper is the name of a docker credential helper, e.g.
+	// secretservice for docker-credential-secretservice
+	CredentialHelper string `json:"credentialHelper"`
+
+	// CAFile is a PEM bundle of the certificate authorities to trust
+	CAFile string `json:"caFile"`
+
+	// Insecure allows plain HTTP and unverified TLS connections
+	Insecure bool `json:"insecure"`
+}
+
+// BindMountConf describes an additional bind mount performed by mount-sys
+type BindMountConf struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly"`
 }
 
 var Cnf *Config
@@ -113,10 +227,24 @@ func init() {
 	// VanillaOS specific defaults for backwards compatibility
 	viper.SetDefault("updateInitramfsCmd", "lpkg --unlock && /usr/sbin/update-initramfs -u && lpkg --lock")
 	viper.SetDefault("updateGrubCmd", "/usr/sbin/grub-mkconfig -o '%s'")
+	viper.SetDefault("storageBackend", "partitions")
+	viper.SetDefault("thinPoolMinFreePercent", 10)
+	viper.SetDefault("incrementalDeploy", false)
+	viper.SetDefault("incrementalDeployFullSyncEvery", 10)
+	viper.SetDefault("logMaxSize", "10MB")
+	viper.SetDefault("logMaxFiles", 20)
+	viper.SetDefault("logRetentionDays", 30)
+	viper.SetDefault("dumpRedact", []string{"uuids", "hostnames", "usernames"})
+	viper.SetDefault("varTpm2Pcrs", []int{7})
 
 	Cnf = &Config{
 		// Common
 		MaxParallelDownloads: viper.GetUint("maxParallelDownloads"),
+		DownloadRateLimit:    viper.GetString("downloadRateLimit"),
+		LogMaxSize:           viper.GetString("logMaxSize"),
+		LogMaxFiles:          viper.GetUint("logMaxFiles"),
+		LogRetentionDays:     viper.GetUint("logRetentionDays"),
+		DumpRedact:           viper.GetStringSlice("dumpRedact"),
 
 		// Registry
 		Registry:           viper.GetString("registry"),
@@ -125,6 +253,13 @@ func init() {
 		Name:               viper.GetString("name"),
 		Tag:                viper.GetString("tag"),
 
+		PeerCaches:           viper.GetStringSlice("peerCaches"),
+		PeerCacheDiscovery:   viper.GetBool("peerCacheDiscovery"),
+		CacheBlobs:           viper.GetBool("cacheBlobs"),
+		CacheAllowedNetworks: viper.GetStringSlice("cacheAllowedNetworks"),
+
+		RequiredImageLabels: viper.GetStringSlice("requiredImageLabels"),
+
 		// Package manager
 		IPkgMngPre:    viper.GetString("iPkgMngPre"),
 		IPkgMngPost:   viper.GetString("iPkgMngPost"),
@@ -147,10 +282,33 @@ func init() {
 		PartLabelBoot: viper.GetString("partLabelBoot"),
 		PartLabelEfi:  viper.GetString("partLabelEfi"),
 		PartCryptVar:  viper.GetString("PartCryptVar"),
+		VarTpm2Pcrs:   viper.GetIntSlice("varTpm2Pcrs"),
 
 		// Structure
 		ThinProvisioning: viper.GetBool("thinProvisioning"),
 		ThinInitVolume:   viper.GetString("thinInitVolume"),
+		StorageBackend:   viper.GetString("storageBackend"),
+		BtrfsPoolLabel:   viper.GetString("btrfsPoolLabel"),
+
+		ThinPoolMinFreePercent:         viper.GetUint("thinPoolMinFreePercent"),
+		IncrementalDeploy:              viper.GetBool("incrementalDeploy"),
+		IncrementalDeployFullSyncEvery: viper.GetUint("incrementalDeployFullSyncEvery"),
+	}
+
+	// Registries
+	err = viper.UnmarshalKey("registries", &Cnf.Registries)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not parse registries", err)
+	}
+
+	// System mounts
+	err = viper.UnmarshalKey("extraOverlayMounts", &Cnf.ExtraOverlayMounts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not parse extraOverlayMounts", err)
+	}
+	err = viper.UnmarshalKey("extraBindMounts", &Cnf.ExtraBindMounts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not parse extraBindMounts", err)
 	}
 }
 
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestCacheHandler tests the NewCacheHandler function by querying the
+// served endpoint like a registry client would.
+func TestCacheHandler(t *testing.T) {
+	server := httptest.NewServer(core.NewCacheHandler(nil))
+	defer server.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/v2/", http.StatusOK},
+		{http.MethodGet, "/v2/vanilla-os/desktop/blobs/sha256:" + strings.Repeat("0", 64), http.StatusNotFound},
+		{http.MethodGet, "/v2/vanilla-os/desktop/blobs/invalid", http.StatusBadRequest},
+		{http.MethodGet, "/v2/vanilla-os/desktop/manifests/main", http.StatusNotFound},
+		{http.MethodPut, "/v2/vanilla-os/desktop/blobs/uploads/", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, server.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.status, resp.StatusCode)
+		}
+	}
+
+	t.Log("TestCacheHandler: done")
+}
+
+// TestCacheHandlerAllowedNetworks tests that the clients outside of the
+// allowed networks are refused.
+func TestCacheHandlerAllowedNetworks(t *testing.T) {
+	_, err := core.ParseAllowedNetworks([]string{"192.168.1.0/33"})
+	if err == nil {
+		t.Fatal("expected an invalid network to be rejected")
+	}
+
+	cases := []struct {
+		networks []string
+		status   int
+	}{
+		{nil, http.StatusOK},
+		{[]string{"127.0.0.0/8"}, http.StatusOK},
+		{[]string{"192.168.1.0/24", "127.0.0.1"}, http.StatusOK},
+		{[]string{"192.168.1.0/24"}, http.StatusForbidden},
+		{[]string{"10.0.0.1"}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		allowed, err := core.ParseAllowedNetworks(c.networks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := httptest.NewServer(core.NewCacheHandler(allowed))
+		resp, err := http.Get(server.URL + "/v2/")
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Fatalf("%v: expected %d, got %d", c.networks, c.status, resp.StatusCode)
+		}
+	}
+
+	t.Log("TestCacheHandlerAllowedNetworks: done")
+}
+
+// TestServeCacheAddress tests that the cache is not served on all the
+// interfaces unless asked to.
+func TestServeCacheAddress(t *testing.T) {
+	for _, address := range []string{"", ":5000", "5000"} {
+		err := core.ServeCache(address, false)
+		if err == nil || !strings.Contains(err.Error(), "interface to listen on") {
+			t.Fatalf("%q: expected the address to be rejected, got %v", address, err)
+		}
+	}
+
+	t.Log("TestServeCacheAddress: done")
+}
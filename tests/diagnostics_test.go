@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestRedactor tests the Redactor by redacting a kernel command line and
+// checking that the same values get the same placeholders.
+func TestRedactor(t *testing.T) {
+	_, err := core.NewRedactor([]string{"passwords"}, nil, nil)
+	if err == nil {
+		t.Fatal("expected an unknown kind to be rejected")
+	}
+
+	r, err := core.NewRedactor(
+		[]string{core.REDACT_UUIDS, core.REDACT_HOSTNAMES, core.REDACT_USERNAMES},
+		[]string{"vanilla-pc", "localhost"},
+		[]string{"john", "john.doe"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "root=UUID=0A1B2C3D-1111-2222-3333-444455556666 efi=UUID=ABCD-1234 " +
+		"resume=UUID=0a1b2c3d-1111-2222-3333-444455556666 host=vanilla-pc " +
+		"home=/home/john.doe owner=john johnny localhost"
+	expected := "root=UUID=<uuid-1> efi=UUID=<uuid-2> " +
+		"resume=UUID=<uuid-1> host=<hostname-1> " +
+		"home=/home/<user-1> owner=<user-2> johnny localhost"
+
+	redacted := string(r.Redact([]byte(input)))
+	if redacted != expected {
+		t.Fatalf("expected %q, got %q", expected, redacted)
+	}
+
+	// placeholders are kept across calls
+	redacted = string(r.Redact([]byte("vanilla-pc")))
+	if redacted != "<hostname-1>" {
+		t.Fatalf("expected the same placeholder, got %q", redacted)
+	}
+
+	r, err = core.NewRedactor([]string{core.REDACT_HOSTNAMES}, []string{"vanilla-pc"}, []string{"john"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted = string(r.Redact([]byte(input)))
+	if !strings.Contains(redacted, "0A1B2C3D") || !strings.Contains(redacted, "john") {
+		t.Fatalf("expected only hostnames to be redacted, got %q", redacted)
+	}
+
+	t.Log("TestRedactor: done")
+}
+
+// TestDiagnosticBundle tests the DiagnosticBundle by adding files to it and
+// checking that the archive holds them, redacted, along with a manifest
+// listing the missing ones.
+func TestDiagnosticBundle(t *testing.T) {
+	dir := t.TempDir()
+	fstab := filepath.Join(dir, "fstab")
+	err := os.WriteFile(fstab, []byte("UUID=0a1b2c3d-1111-2222-3333-444455556666 / btrfs defaults 0 0\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := core.NewRedactor([]string{core.REDACT_UUIDS}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundlePath := filepath.Join(dir, "bundle.tar.gz")
+	bundle, err := core.NewDiagnosticBundle(bundlePath, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bundle.AddFile("etc/fstab", fstab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bundle.AddFile("etc/missing", filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bundle.AddCommand("echo.txt", "echo", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bundle.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a deferred Close runs once the bundle was closed
+	err = bundle.Close()
+	if err != nil {
+		t.Fatal("expected closing the bundle again to do nothing:", err)
+	}
+
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(content)
+	}
+
+	if files["etc/fstab"] != "UUID=<uuid-1> / btrfs defaults 0 0\n" {
+		t.Fatalf("expected a redacted fstab, got %q", files["etc/fstab"])
+	}
+	if files["echo.txt"] != "hello\n" {
+		t.Fatalf("expected the output of the command, got %q", files["echo.txt"])
+	}
+	if _, ok := files["etc/missing"]; ok {
+		t.Fatal("expected the missing file not to be in the bundle")
+	}
+
+	var manifest core.DiagnosticManifest
+	err = json.Unmarshal([]byte(files[core.DiagnosticManifestName]), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Items) != 3 || len(manifest.Redacted) != 1 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	if manifest.Items[0].Source != fstab || manifest.Items[0].Error != "" {
+		t.Fatalf("unexpected manifest item: %+v", manifest.Items[0])
+	}
+	if manifest.Items[1].Name != "etc/missing" || manifest.Items[1].Error == "" {
+		t.Fatalf("expected the missing file to be recorded with an error, got %+v", manifest.Items[1])
+	}
+
+	t.Log("TestDiagnosticBundle: done")
+}
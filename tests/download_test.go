@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// TestGetDownloadRateLimit tests the GetDownloadRateLimit function by
+// parsing the configured limit and a per-operation override.
+func TestGetDownloadRateLimit(t *testing.T) {
+	oldLimit := settings.Cnf.DownloadRateLimit
+	settings.Cnf.DownloadRateLimit = "2MB"
+	defer func() { settings.Cnf.DownloadRateLimit = oldLimit }()
+
+	cases := map[string]uint64{
+		"":       2000000,
+		"500KiB": 512000,
+		"0":      0,
+	}
+	for override, expected := range cases {
+		rate, err := core.GetDownloadRateLimit(override)
+		if err != nil {
+			t.Fatalf("%q: %v", override, err)
+		}
+		if rate != expected {
+			t.Fatalf("%q: expected %d, got %d", override, expected, rate)
+		}
+	}
+
+	_, err := core.GetDownloadRateLimit("fast")
+	if err == nil {
+		t.Fatal("expected an error for an invalid limit")
+	}
+
+	t.Log("TestGetDownloadRateLimit: done")
+}
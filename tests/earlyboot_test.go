@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// TestEarlyBoot tests the EarlyBoot sequence against a fake root, in a
+// private mount namespace, with a tmpfs as the /var partition.
+func TestEarlyBoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	// the namespace belongs to this thread, which is dropped when the test
+	// ends since it is never unlocked
+	runtime.LockOSThread()
+	err := syscall.Unshare(syscall.CLONE_NEWNS)
+	if err != nil {
+		t.Skip("mount namespaces are not available:", err)
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		t.Skip("mount namespaces are not available:", err)
+	}
+
+	oldBindMounts := settings.Cnf.ExtraBindMounts
+	oldOverlayMounts := settings.Cnf.ExtraOverlayMounts
+	defer func() {
+		settings.Cnf.ExtraBindMounts = oldBindMounts
+		settings.Cnf.ExtraOverlayMounts = oldOverlayMounts
+	}()
+	settings.Cnf.ExtraBindMounts = []settings.BindMountConf{{Source: "/var/data", Destination: "/data"}}
+	settings.Cnf.ExtraOverlayMounts = nil
+
+	root := t.TempDir()
+	for _, dir := range []string{"etc", "usr", "var"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fstab := "UUID=old / btrfs defaults 0 0\nUUID=old-var /var btrfs defaults 0 0\nUUID=efi /boot/efi vfat defaults 0 0\n"
+	err = os.WriteFile(filepath.Join(root, "etc/fstab"), []byte(fstab), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake root is a mount point, like the real one
+	err = syscall.Mount(root, root, "", syscall.MS_BIND, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(root, syscall.MNT_DETACH)
+
+	b := &core.EarlyBoot{
+		Root: root,
+		RootPartition: core.ABRootPartition{
+			Label:     "vos-a",
+			Partition: core.Partition{Label: "vos-a", Uuid: "new", FsType: "btrfs"},
+		},
+		VarDevice: "tmpfs",
+		VarFsType: "tmpfs",
+		Log:       &core.BootLogger{Console: io.Discard},
+	}
+	err = b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changes to /etc end up in the upper directory, on /var
+	err = os.WriteFile(filepath.Join(root, "etc/hostname"), []byte("vanilla\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, core.AbrootVarDir, "etc/vos-a/hostname")); err != nil {
+		t.Fatal("expected the change to /etc to be in the overlay:", err)
+	}
+
+	err = os.WriteFile(filepath.Join(root, "data/file"), []byte("data\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "var/data/file")); err != nil {
+		t.Fatal("expected the bind mount to be performed:", err)
+	}
+
+	err = os.WriteFile(filepath.Join(root, "usr/file"), []byte("usr\n"), 0o644)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Fatal("expected /usr to be read-only, got", err)
+	}
+
+	newFstab, err := os.ReadFile(filepath.Join(root, "etc/fstab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(newFstab), "UUID=new / btrfs ro,defaults 0 0\n") ||
+		strings.Contains(string(newFstab), "old") || !strings.Contains(string(newFstab), "/boot/efi") {
+		t.Fatalf("unexpected fstab:\n%s", newFstab)
+	}
+
+	t.Log("TestEarlyBoot: done")
+}
+
+// TestEarlyBootMissingVar tests that the EarlyBoot sequence stops when the
+// /var partition is missing, reporting the encrypted device.
+func TestEarlyBootMissingVar(t *testing.T) {
+	oldCryptVar := settings.Cnf.PartCryptVar
+	defer func() {
+		settings.Cnf.PartCryptVar = oldCryptVar
+	}()
+	settings.Cnf.PartCryptVar = "/dev/mapper/vos--var-var"
+
+	b := &core.EarlyBoot{
+		Root:   t.TempDir(),
+		DryRun: true,
+		Log:    &core.BootLogger{Console: io.Discard},
+	}
+	err := b.Run()
+
+	var bootErr *core.EarlyBootError
+	if !errors.As(err, &bootErr) || bootErr.ExitCode != 5 {
+		t.Fatal("expected mounting /var to fail, got", err)
+	}
+	if !strings.Contains(err.Error(), settings.Cnf.PartCryptVar) {
+		t.Fatal("expected the error to mention the encrypted device, got", err)
+	}
+
+	t.Log("TestEarlyBootMissingVar: done")
+}
+
+// TestFindBootPartitions tests the FindBootPartitions function with a fake
+// /dev/disk and mountinfo.
+func TestFindBootPartitions(t *testing.T) {
+	root := t.TempDir()
+	links := map[string]string{
+		"dev/disk/by-label/" + settings.Cnf.PartLabelA:   "../../vda2",
+		"dev/disk/by-label/" + settings.Cnf.PartLabelB:   "../../vda3",
+		"dev/disk/by-label/" + settings.Cnf.PartLabelVar: "../../dm-0",
+		"dev/disk/by-uuid/1111-aaaa":                     "../../vda2",
+		"dev/disk/by-uuid/2222-bbbb":                     "../../vda3",
+	}
+	for link, target := range links {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(link)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink(target, filepath.Join(root, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, device := range []string{"vda2", "vda3", "dm-0"} {
+		err := os.WriteFile(filepath.Join(root, "dev", device), nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mountinfo := filepath.Join(t.TempDir(), "mountinfo")
+	err := os.WriteFile(mountinfo, []byte(
+		"22 1 0:21 / /proc rw,nosuid shared:12 - proc proc rw\n"+
+			"25 1 252:3 /@ "+root+" ro,relatime shared:1 - btrfs /dev/vda3 ro,space_cache=v2,subvol=/@\n",
+	), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present, varPart, err := core.FindBootPartitions(root, mountinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if present.Label != settings.Cnf.PartLabelB || present.Partition.Uuid != "2222-bbbb" || present.Partition.FsType != "btrfs" {
+		t.Fatalf("unexpected root: %+v", present)
+	}
+	if present.Partition.MountOptions != "subvol=/@" {
+		t.Fatalf("expected the subvolume to be kept, got %q", present.Partition.MountOptions)
+	}
+	if varPart.Device != "dm-0" {
+		t.Fatalf("unexpected /var partition: %+v", varPart)
+	}
+
+	t.Log("TestFindBootPartitions: done")
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// makeFakeRoot creates a minimal root which passes the health checks, with
+// a merged /usr like the images ABRoot deploys
+func makeFakeRoot(t *testing.T) string {
+	root := t.TempDir()
+
+	for _, dir := range []string{"boot", "etc", "usr/lib/modules/6.1.0", "usr/lib/systemd", "usr/sbin"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"boot/vmlinuz-6.1.0":      "kernel",
+		"boot/initrd.img-6.1.0":   "initrd",
+		"usr/lib/systemd/systemd": "#!/bin/sh\n",
+		"etc/fstab":               "# comment\nUUID=1234 / ext4 ro,defaults 0 0\n/dev/sda1 /boot ext4 defaults\n",
+	}
+	for path, content := range files {
+		err := os.WriteFile(filepath.Join(root, path), []byte(content), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"sbin":          "usr/sbin",
+		"usr/sbin/init": "../lib/systemd/systemd",
+	}
+	for path, target := range links {
+		err := os.Symlink(target, filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// TestCheckRootHealth tests the CheckRootHealth function by checking a fake
+// root, then breaking it and making sure the failing checks are reported.
+func TestCheckRootHealth(t *testing.T) {
+	root := makeFakeRoot(t)
+	scriptsDir := t.TempDir()
+
+	executed := []string{}
+	run := func(cmd string) (string, error) {
+		executed = append(executed, cmd)
+
+		// user scripts are copied into the root, so run them from there
+		if strings.HasPrefix(cmd, "/run/") {
+			out, err := exec.Command(filepath.Join(root, cmd)).CombinedOutput()
+			return string(out), err
+		}
+		return "", nil
+	}
+
+	err := os.WriteFile(filepath.Join(scriptsDir, "10-pass"), []byte("#!/bin/sh\nexit 0\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := core.CheckRootHealth(root, filepath.Join(root, "boot"), scriptsDir, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != len(core.HealthCheckCommands)+5 {
+		t.Fatalf("unexpected results:\n%s", report.String())
+	}
+	if executed[len(executed)-1] != "/run/abroot/health-checks/10-pass" {
+		t.Fatalf("user script not executed, executed %v", executed)
+	}
+
+	// break the root
+	err = os.Remove(filepath.Join(root, "boot", "initrd.img-6.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "etc", "fstab"), []byte("/dev/sda1 /boot\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(scriptsDir, "20-fail"), []byte("#!/bin/sh\necho broken\nexit 1\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = core.CheckRootHealth(root, filepath.Join(root, "boot"), scriptsDir, run)
+	var healthErr *core.HealthCheckFailedError
+	if !errors.As(err, &healthErr) {
+		t.Fatalf("expected a HealthCheckFailedError, got %v", err)
+	}
+
+	failed := []string{}
+	for _, result := range report.Results {
+		if !result.Passed {
+			failed = append(failed, result.Name)
+		}
+	}
+	if strings.Join(failed, ",") != "kernel,fstab,script 20-fail" {
+		t.Fatalf("unexpected failures %v:\n%s", failed, report.String())
+	}
+
+	// /sbin/init must resolve inside the root
+	err = os.Remove(filepath.Join(root, "usr", "lib", "systemd", "systemd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ = core.CheckRootHealth(root, filepath.Join(root, "boot"), scriptsDir, run)
+	for _, result := range report.Results {
+		if result.Name == "init" && result.Passed {
+			t.Fatal("expected the init check to fail")
+		}
+	}
+
+	t.Log("TestCheckRootHealth: done")
+}
@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestReadHistory tests the ReadHistory function by recording a few
+// operations and checking that they are returned filtered, from the most
+// recent to the oldest.
+func TestReadHistory(t *testing.T) {
+	oldHistoryFile := core.HistoryFile
+	core.HistoryFile = filepath.Join(t.TempDir(), "history.jsonl")
+	defer func() {
+		core.HistoryFile = oldHistoryFile
+	}()
+
+	// a missing history is empty
+	entries, err := core.ReadHistory(core.HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty history, got %d entries", len(entries))
+	}
+
+	upgrade := core.NewHistoryEntry(core.UPGRADE)
+	upgrade.OldDigest = "sha256:old"
+	upgrade.NewDigest = "sha256:new"
+	upgrade.Started = time.Now().Add(-48 * time.Hour)
+	upgrade.Finish(nil)
+
+	noUpdate := core.NewHistoryEntry(core.UPGRADE)
+	noUpdate.Finish(core.ErrNoUpdate)
+
+	apply := core.NewHistoryEntry(core.APPLY)
+	apply.PackagesAdded = []string{"htop"}
+	apply.Finish(errors.New("build failed"))
+
+	// a line cut by a power loss is skipped
+	file, err := os.OpenFile(core.HistoryFile, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(`{"operation":"rollb` + "\n")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := core.NewHistoryEntry(core.HISTORY_ROLLBACK)
+	rollback.Finish(nil)
+
+	entries, err = core.ReadHistory(core.HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	if entries[0].Operation != core.HISTORY_ROLLBACK || entries[3].NewDigest != "sha256:new" {
+		t.Fatalf("expected the most recent entry first, got %+v", entries)
+	}
+	if entries[1].Result != core.HISTORY_FAILED || entries[1].Error != "build failed" || len(entries[1].PackagesAdded) != 1 {
+		t.Fatalf("unexpected failed entry: %+v", entries[1])
+	}
+	if entries[2].Result != core.HISTORY_NOTHING_TO_DO || entries[2].Error != "" {
+		t.Fatalf("expected ErrNoUpdate to be recorded as nothing to do, got %+v", entries[2])
+	}
+
+	entries, err = core.ReadHistory(core.HistoryFilter{Operation: core.UPGRADE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 upgrades, got %d", len(entries))
+	}
+
+	entries, err = core.ReadHistory(core.HistoryFilter{Result: core.HISTORY_SUCCESS, Since: time.Now().Add(-24 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Operation != core.HISTORY_ROLLBACK {
+		t.Fatalf("expected only the rollback, got %+v", entries)
+	}
+
+	entries, err = core.ReadHistory(core.HistoryFilter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Operation != core.HISTORY_ROLLBACK {
+		t.Fatalf("expected the 2 most recent entries, got %+v", entries)
+	}
+
+	t.Log("TestReadHistory: done")
+}
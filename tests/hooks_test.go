@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// writeHook writes an executable shell script to the directory of a stage
+func writeHook(t *testing.T, hooksDir string, stage core.HookStage, name string, script string) {
+	stageDir := filepath.Join(hooksDir, string(stage)+".d")
+	err := os.MkdirAll(stageDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(stageDir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRunHooks tests the RunHooksFrom function by running hooks which
+// record their environment and checking that only the failing hooks of
+// pre-* stages veto the operation.
+func TestRunHooks(t *testing.T) {
+	hooksDir := t.TempDir()
+	outFile := filepath.Join(t.TempDir(), "out")
+
+	env := &core.HookEnv{
+		Operation:    "upgrade",
+		PresentLabel: "vos-a",
+		FutureLabel:  "vos-b",
+		OldDigest:    "sha256:old",
+		NewDigest:    "sha256:new",
+		FutureRoot:   "/part-future",
+		DryRun:       true,
+	}
+
+	// a missing stage directory is not an error
+	err := core.RunHooksFrom(hooksDir, core.HOOK_PRE_UPGRADE, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeHook(t, hooksDir, core.HOOK_PRE_UPGRADE, "20-second", `echo "second" >> `+outFile)
+	writeHook(t, hooksDir, core.HOOK_PRE_UPGRADE, "10-first",
+		`echo "$ABROOT_HOOK $ABROOT_OPERATION $ABROOT_PRESENT_LABEL $ABROOT_FUTURE_LABEL $ABROOT_OLD_DIGEST $ABROOT_NEW_DIGEST $ABROOT_FUTURE_ROOT $ABROOT_DRY_RUN" >> `+outFile)
+
+	// non-executable files are skipped
+	err = os.WriteFile(filepath.Join(hooksDir, "pre-upgrade.d", "00-disabled"), []byte("#!/bin/sh\nexit 1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = core.RunHooksFrom(hooksDir, core.HOOK_PRE_UPGRADE, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "pre-upgrade upgrade vos-a vos-b sha256:old sha256:new /part-future 1\nsecond\n"
+	if string(out) != expected {
+		t.Fatalf("expected %q, got %q", expected, string(out))
+	}
+
+	// a failing pre-* hook vetoes the operation and stops the next hooks
+	writeHook(t, hooksDir, core.HOOK_PRE_UPGRADE, "15-veto", "echo vetoing; exit 3")
+	os.Remove(outFile)
+
+	err = core.RunHooksFrom(hooksDir, core.HOOK_PRE_UPGRADE, env)
+	var vetoErr *core.HookVetoError
+	if !errors.As(err, &vetoErr) {
+		t.Fatalf("expected a HookVetoError, got %v", err)
+	}
+	if vetoErr.Hook != "15-veto" || vetoErr.ExitCode != 3 {
+		t.Fatalf("unexpected veto: %v", vetoErr)
+	}
+
+	out, _ = os.ReadFile(outFile)
+	if strings.Contains(string(out), "second") {
+		t.Fatal("hooks after the veto were executed")
+	}
+
+	// a failing post-* hook does not
+	writeHook(t, hooksDir, core.HOOK_POST_DEPLOY, "10-fail", "exit 1")
+	err = core.RunHooksFrom(hooksDir, core.HOOK_POST_DEPLOY, env)
+	if err != nil {
+		t.Fatalf("expected post-deploy failures to be ignored, got %v", err)
+	}
+
+	t.Log("TestRunHooks: done")
+}
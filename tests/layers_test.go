@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestDiffRootLayers tests the DiffRootLayers function by comparing a root
+// with an image sharing its base layer but not the upper ones.
+func TestDiffRootLayers(t *testing.T) {
+	oldLayers := []core.RootLayer{
+		{Digest: "sha256:base", Paths: []string{"usr", "usr/bin/sh"}},
+		{Digest: "sha256:old", Paths: []string{"usr/bin/old"}, OpaqueDirs: []string{"opt/app"}},
+	}
+	newLayers := []core.RootLayer{
+		{Digest: "sha256:base", Paths: []string{"usr", "usr/bin/sh"}},
+		{Digest: "sha256:new", Paths: []string{"usr/bin/new", "usr/bin/old"}},
+	}
+
+	common, paths, opaqueDirs := core.DiffRootLayers(oldLayers, newLayers)
+	if common != 1 {
+		t.Fatalf("expected 1 common layer, got %d", common)
+	}
+
+	if !slices.Equal(paths, []string{"usr/bin/new", "usr/bin/old"}) {
+		t.Fatalf("unexpected changed paths: %v", paths)
+	}
+
+	if !slices.Equal(opaqueDirs, []string{"opt/app"}) {
+		t.Fatalf("unexpected opaque dirs: %v", opaqueDirs)
+	}
+
+	common, _, _ = core.DiffRootLayers(nil, newLayers)
+	if common != 0 {
+		t.Fatalf("expected no common layers without a record, got %d", common)
+	}
+
+	t.Log("TestDiffRootLayers: done")
+}
+
+// TestRootLayersRecord tests the WriteRootLayers and ReadRootLayers functions
+// by writing a record to a temporary root and reading it back.
+func TestRootLayersRecord(t *testing.T) {
+	root := t.TempDir()
+
+	layers, err := core.ReadRootLayers(root)
+	if err != nil || layers != nil {
+		t.Fatalf("expected no record, got %v (%v)", layers, err)
+	}
+
+	err = core.WriteRootLayers(root, []core.RootLayer{{Digest: "sha256:base", Paths: []string{"usr"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err = core.ReadRootLayers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 1 || layers[0].Digest != "sha256:base" {
+		t.Fatalf("unexpected record: %+v", layers)
+	}
+
+	t.Log("TestRootLayersRecord: done")
+}
+
+// TestIncrementalSyncs tests the WriteIncrementalSyncs and
+// ReadIncrementalSyncs functions, a root without a count having none.
+func TestIncrementalSyncs(t *testing.T) {
+	root := t.TempDir()
+
+	if syncs := core.ReadIncrementalSyncs(root); syncs != 0 {
+		t.Fatalf("expected no incremental sync, got %d", syncs)
+	}
+
+	err := core.WriteIncrementalSyncs(root, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if syncs := core.ReadIncrementalSyncs(root); syncs != 3 {
+		t.Fatalf("expected 3 incremental syncs, got %d", syncs)
+	}
+
+	t.Log("TestIncrementalSyncs: done")
+}
@@ -1,16 +1,27 @@
 package tests
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
 )
 
-// TestGetLogFile tests the GetLogFile function by getting the log file and
-// checking if it is not nil.
+// TestGetLogFile tests the GetLogFile function by starting an operation log,
+// getting the log file and checking if it is not nil.
 func TestGetLogFile(t *testing.T) {
 	t.Log("TestGetLogFile: running...")
 
+	_, err := core.StartOperationLog("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	logFile := core.GetLogFile()
 	if logFile == nil {
 		t.Fatal("TestGetLogFile: logFile is nil")
@@ -42,3 +53,162 @@ func TestWriteToLog(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestReadOperationLog tests the ReadOperationLog function by logging
+// messages to the log of an operation and reading them back.
+func TestReadOperationLog(t *testing.T) {
+	id, err := core.StartOperationLog("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core.PrintVerboseWarn("TestReadOperationLog", 1.5, "a", "warning")
+	err = core.LogToFile("TestReadOperationLog: %d", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opLog, err := core.GetOperationLog(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []core.LogRecord{}
+	err = core.ReadOperationLog(context.Background(), opLog, false, func(record core.LogRecord) {
+		records = append(records, record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foundWarning, foundMessage := false, false
+	for _, record := range records {
+		if record.Level == "WARN" && record.Prefix == "TestReadOperationLog" && record.Depth == "1.5" && record.Msg == "a warning" {
+			foundWarning = true
+		}
+		if strings.HasSuffix(record.String(), "INFO  TestReadOperationLog: 42") {
+			foundMessage = true
+		}
+	}
+	if !foundWarning || !foundMessage {
+		t.Fatalf("records not found in the log, warning: %t, message: %t", foundWarning, foundMessage)
+	}
+
+	latest, err := core.GetOperationLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID != id {
+		t.Fatalf("expected the latest log to be %s, got %s", id, latest.ID)
+	}
+
+	t.Log("TestReadOperationLog: done")
+}
+
+// TestOperationLogRotation tests that a log is rotated to numbered parts
+// once it exceeds its maximum size.
+func TestOperationLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abroot-20240101-000000-0badc0de.json")
+	w, err := core.NewOperationLogWriter(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := []byte(`{"msg":"` + strings.Repeat("a", 30) + `"}` + "\n")
+	for i := 0; i < 5; i++ {
+		_, err = w.Write(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two records fit in each part
+	for file, records := range map[string]int{
+		path: 1,
+		strings.TrimSuffix(path, ".json") + ".1.json": 2,
+		strings.TrimSuffix(path, ".json") + ".2.json": 2,
+	} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(data), "\n") != records {
+			t.Fatalf("expected %d records in %s, got:\n%s", records, file, data)
+		}
+	}
+
+	t.Log("TestOperationLogRotation: done")
+}
+
+// TestRemoveExpiredLogs tests removing the logs older than the retention
+// and the ones beyond the maximum number of files.
+func TestRemoveExpiredLogs(t *testing.T) {
+	oldRetention := settings.Cnf.LogRetentionDays
+	settings.Cnf.LogRetentionDays = 30
+	defer func() { settings.Cnf.LogRetentionDays = oldRetention }()
+
+	err := os.MkdirAll(core.LogDir, 0o755)
+	if err != nil {
+		t.Skip("the log directory can't be created:", err)
+	}
+
+	// the logs of other runs are newer than these ones
+	old := filepath.Join(core.LogDir, "abroot-20200101-000000-00000001.json")
+	older := filepath.Join(core.LogDir, "abroot-20200102-000000-00000002.json")
+	recent := filepath.Join(core.LogDir, "abroot-20200103-000000-00000003.json")
+	recentPart := filepath.Join(core.LogDir, "abroot-20200103-000000-00000003.1.json")
+	for _, path := range []string{old, older, recent, recentPart} {
+		err := os.WriteFile(path, []byte(`{"msg":"test"}`+"\n"), 0o640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+	}
+	expiredTime := time.Now().Add(-31 * 24 * time.Hour)
+	err = os.Chtimes(old, expiredTime, expiredTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = core.RemoveExpiredLogs(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); err == nil {
+		t.Fatal("expected the log older than the retention to be removed")
+	}
+	if _, err := os.Stat(older); err != nil {
+		t.Fatal("expected a recent log to be kept:", err)
+	}
+
+	// keep the files of the other logs and of the most recent test log
+	logs, err := core.ListOperationLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep := 0
+	for _, opLog := range logs {
+		if opLog.ID != core.CurrentOperationID() && opLog.ID != "00000002" {
+			keep += len(opLog.Files)
+		}
+	}
+
+	err = core.RemoveExpiredLogs(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(older); err == nil {
+		t.Fatal("expected the oldest log beyond the maximum to be removed")
+	}
+	for _, path := range []string{recent, recentPart} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal("expected the most recent logs to be kept:", err)
+		}
+	}
+
+	t.Log("TestRemoveExpiredLogs: done")
+}
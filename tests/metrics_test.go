@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestWriteMetrics tests the WriteMetrics function by writing metrics with
+// and without labels and checking the Prometheus text format.
+func TestWriteMetrics(t *testing.T) {
+	metrics := []core.Metric{
+		{
+			Name: "abroot_image_info",
+			Help: "The image deployed in the present root.",
+			Samples: []core.MetricSample{{
+				Labels: map[string]string{"image": `ghcr.io/vanilla-os/"desktop"`, "digest": "sha256:abc"},
+				Value:  1,
+			}},
+		},
+		{
+			Name: "abroot_root_free_bytes",
+			Help: "Free space of the filesystem of each root.",
+			Samples: []core.MetricSample{
+				{Labels: map[string]string{"root": "vos-a"}, Value: 1.5e10},
+				{Labels: map[string]string{"root": "vos-b"}, Value: 0},
+			},
+		},
+		{
+			Name:    "abroot_up",
+			Help:    "Whether all the metrics could be collected.",
+			Samples: []core.MetricSample{{Value: 1}},
+		},
+	}
+
+	var b strings.Builder
+	err := core.WriteMetrics(&b, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP abroot_image_info The image deployed in the present root.
+# TYPE abroot_image_info gauge
+abroot_image_info{digest="sha256:abc",image="ghcr.io/vanilla-os/\"desktop\""} 1
+# HELP abroot_root_free_bytes Free space of the filesystem of each root.
+# TYPE abroot_root_free_bytes gauge
+abroot_root_free_bytes{root="vos-a"} 1.5e+10
+abroot_root_free_bytes{root="vos-b"} 0
+# HELP abroot_up Whether all the metrics could be collected.
+# TYPE abroot_up gauge
+abroot_up 1
+`
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+
+	t.Log("TestWriteMetrics: done")
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// TestGetOverlayMounts tests the GetOverlayMounts function by configuring a
+// per-root and a shared overlay and checking their upper directories.
+func TestGetOverlayMounts(t *testing.T) {
+	settings.Cnf.ExtraOverlayMounts = []settings.OverlayMountConf{
+		{Destination: "/opt/vendor", Location: "vendor"},
+		{Destination: "/usr/lib/firmware-updates", Location: "firmware", Shared: true},
+	}
+	defer func() { settings.Cnf.ExtraOverlayMounts = nil }()
+
+	overlays, err := core.GetOverlayMounts("vos-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(overlays) != 3 {
+		t.Fatalf("expected 3 overlays, got %d", len(overlays))
+	}
+
+	if overlays[0].Destination != "/etc" || overlays[0].UpperDir != "/var/lib/abroot/etc/vos-a" {
+		t.Fatalf("unexpected /etc overlay: %+v", overlays[0])
+	}
+
+	if overlays[1].UpperDir != "/var/lib/abroot/vendor/vos-a" || overlays[1].WorkDir != "/var/lib/abroot/vendor/vos-a-work" {
+		t.Fatalf("unexpected per-root overlay: %+v", overlays[1])
+	}
+
+	if overlays[2].UpperDir != "/var/lib/abroot/firmware/shared" {
+		t.Fatalf("unexpected shared overlay: %+v", overlays[2])
+	}
+
+	t.Log("TestGetOverlayMounts: done")
+}
+
+// TestGetOverlayMountsInvalid tests that overlays escaping /var/lib/abroot or
+// shadowing a system mount are refused.
+func TestGetOverlayMountsInvalid(t *testing.T) {
+	defer func() { settings.Cnf.ExtraOverlayMounts = nil }()
+
+	for _, conf := range []settings.OverlayMountConf{
+		{Destination: "/opt/vendor", Location: "../../etc"},
+		{Destination: "/opt/vendor", Location: "/srv"},
+		{Destination: "/usr", Location: "usr"},
+	} {
+		settings.Cnf.ExtraOverlayMounts = []settings.OverlayMountConf{conf}
+		_, err := core.GetOverlayMounts("vos-a")
+		if err == nil {
+			t.Fatalf("expected %+v to be refused", conf)
+		}
+	}
+
+	t.Log("TestGetOverlayMountsInvalid: done")
+}
+
+// TestAdjustFstab tests the AdjustFstab function by feeding it an fstab with
+// stale system and configured mounts and checking the result.
+func TestAdjustFstab(t *testing.T) {
+	settings.Cnf.ExtraBindMounts = []settings.BindMountConf{
+		{Source: "/var/vendor", Destination: "/opt/vendor"},
+	}
+	defer func() { settings.Cnf.ExtraBindMounts = nil }()
+
+	fstab := strings.Join([]string{
+		"# comment",
+		"UUID=old / btrfs ro,defaults 0 0",
+		"/var/home /home none defaults,bind 0 0",
+		"/var/vendor /opt/vendor none bind 0 0",
+		"UUID=data /data ext4 defaults 0 2",
+	}, "\n")
+
+	root := core.ABRootPartition{
+		Label:     "vos-a",
+		Partition: core.Partition{Uuid: "new", FsType: "btrfs", MountOptions: "subvol=vos-a"},
+	}
+
+	res, err := core.AdjustFstab(fstab, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"UUID=new / btrfs ro,defaults,subvol=vos-a 0 0",
+		"# comment",
+		"UUID=data /data ext4 defaults 0 2",
+	}, "\n")
+	if res != expected {
+		t.Fatalf("unexpected fstab:\n%s", res)
+	}
+
+	t.Log("TestAdjustFstab: done")
+}
+
+// TestEscapeUnitPath tests the EscapeUnitPath function against the output of
+// systemd-escape --path.
+func TestEscapeUnitPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/":                          "-",
+		"/var":                       "var",
+		"/usr/lib/firmware-updates/": "usr-lib-firmware\\x2dupdates",
+		"/opt/.hidden":               "opt-\\x2ehidden",
+	} {
+		if res := core.EscapeUnitPath(path); res != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, path, res)
+		}
+	}
+
+	t.Log("TestEscapeUnitPath: done")
+}
+
+// TestGenerateMountUnits tests the GenerateMountUnits function by checking
+// that the units carry the real filesystem type of the partitions.
+func TestGenerateMountUnits(t *testing.T) {
+	root := core.ABRootPartition{
+		Label:     "vos-a",
+		Partition: core.Partition{Uuid: "1234", FsType: "xfs", Device: "sda2"},
+	}
+	varPart := core.Partition{Uuid: "5678", FsType: "ext4", Device: "sda4"}
+
+	units, err := core.GenerateMountUnits(root, varPart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if units[0].Name() != "-.mount" || units[0].Type != "xfs" || units[0].What != "/dev/disk/by-uuid/1234" {
+		t.Fatalf("unexpected root unit: %+v", units[0])
+	}
+
+	if units[1].Name() != "var.mount" || units[1].Type != "ext4" {
+		t.Fatalf("unexpected var unit: %+v", units[1])
+	}
+
+	if !strings.Contains(units[2].Contents(), "RequiresMountsFor=/var") {
+		t.Fatalf("etc unit does not require /var:\n%s", units[2].Contents())
+	}
+
+	t.Log("TestGenerateMountUnits: done")
+}
+
+// TestMountGeneratorInstalled tests that the generator is found in any of
+// the directories systemd loads generators from.
+func TestMountGeneratorInstalled(t *testing.T) {
+	root := t.TempDir()
+	if core.MountGeneratorInstalled(root) {
+		t.Fatal("expected no generator to be found in an empty root")
+	}
+
+	dir := filepath.Join(root, "etc/systemd/system-generators")
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "abroot-generator"), []byte("#!/usr/bin/sh\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !core.MountGeneratorInstalled(root) {
+		t.Fatal("expected the generator to be found")
+	}
+
+	t.Log("TestMountGeneratorInstalled: done")
+}
@@ -7,7 +7,6 @@ import (
 
 	digest "github.com/opencontainers/go-digest"
 	"github.com/vanilla-os/abroot/core"
-	"github.com/vanilla-os/abroot/settings"
 )
 
 // TestPackageManager tests the PackageManager functions by adding a package
@@ -64,12 +63,10 @@ func TestPackageManager(t *testing.T) {
 // TestBaseImagePackageDiff tests the BaseImagePackageDiff function by comparing
 // the packages of two different base images.
 func TestBaseImagePackageDiff(t *testing.T) {
-	settings.Cnf.Name = "vanilla-os/core"
-
 	oldDigest := digest.FromString("sha256:eac5693376d75cee2e676a83a67f4ce5db17d21e30bbde6a752480928719c842")
 	newDigest := digest.FromString("sha256:eaa30f5a907f6f7785936a31f94fe291c6ce00943dcd1d3a8a6e40f1fc890346")
 
-	added, upgraded, downgraded, removed, err := core.BaseImagePackageDiff(oldDigest, newDigest)
+	added, upgraded, downgraded, removed, err := core.BaseImagePackageDiff("ghcr.io/vanilla-os/core:main", oldDigest, "ghcr.io/vanilla-os/core:main", newDigest)
 	if err != nil {
 		panic(err)
 	}
@@ -82,6 +79,21 @@ func TestBaseImagePackageDiff(t *testing.T) {
 	t.Log("TestBaseImagePackageDiff: done")
 }
 
+// TestBaseImagePackageDiffImages tests that BaseImagePackageDiff refuses to
+// compare different images, as done when rebasing, before querying the
+// differ.
+func TestBaseImagePackageDiffImages(t *testing.T) {
+	oldDigest := digest.FromString("old")
+	newDigest := digest.FromString("new")
+
+	_, _, _, _, err := core.BaseImagePackageDiff("ghcr.io/vanilla-os/desktop:main", oldDigest, "ghcr.io/vanilla-os/nvidia:main", newDigest)
+	if err == nil || !strings.Contains(err.Error(), "different images") {
+		t.Fatal("expected different images not to be compared, got", err)
+	}
+
+	t.Log("TestBaseImagePackageDiffImages: done")
+}
+
 // TestOverlayPackageDiff tests the OverlayPackageDiff function by obtaining the
 // added, removed, upgraded, and downgraded overlay packages.
 func TestOverlayPackageDiff(t *testing.T) {
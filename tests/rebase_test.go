@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// TestParseRebaseTarget tests the ParseRebaseTarget function by parsing
+// names with and without registry and tag.
+func TestParseRebaseTarget(t *testing.T) {
+	oldRegistry, oldTag := settings.Cnf.Registry, settings.Cnf.Tag
+	settings.Cnf.Registry, settings.Cnf.Tag = "ghcr.io", "main"
+	defer func() { settings.Cnf.Registry, settings.Cnf.Tag = oldRegistry, oldTag }()
+
+	cases := map[string]string{
+		"ghcr.io/vanilla-os/desktop:dev":    "ghcr.io/vanilla-os/desktop:dev",
+		"vanilla-os/nvidia":                 "ghcr.io/vanilla-os/nvidia:main",
+		"localhost:5000/custom/image":       "localhost:5000/custom/image:main",
+		"localhost/custom:test":             "localhost/custom:test",
+		"registry.example.com/os/image:1.0": "registry.example.com/os/image:1.0",
+	}
+	for name, expected := range cases {
+		target, err := core.ParseRebaseTarget(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if target.FullName() != expected {
+			t.Fatalf("%s: expected %s, got %s", name, expected, target.FullName())
+		}
+	}
+
+	for _, name := range []string{"", "ghcr.io/vanilla-os/desktop@sha256:abc", "desktop:"} {
+		_, err := core.ParseRebaseTarget(name)
+		if err == nil {
+			t.Fatalf("%q: expected an error", name)
+		}
+	}
+
+	t.Log("TestParseRebaseTarget: done")
+}
+
+// TestCheckImageCompatibility tests the CheckImageCompatibility function by
+// checking images with a different architecture and missing or mismatching
+// required labels.
+func TestCheckImageCompatibility(t *testing.T) {
+	oldLabels := settings.Cnf.RequiredImageLabels
+	settings.Cnf.RequiredImageLabels = []string{"org.vanillaos.abroot", "org.vanillaos.abroot.compat=2"}
+	defer func() { settings.Cnf.RequiredImageLabels = oldLabels }()
+
+	valid := &core.ImageInfo{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Labels: map[string]string{
+			"org.vanillaos.abroot":        "true",
+			"org.vanillaos.abroot.compat": "2",
+		},
+	}
+	err := core.CheckImageCompatibility("valid", valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherArch := "arm64"
+	if runtime.GOARCH == otherArch {
+		otherArch = "amd64"
+	}
+
+	invalid := []*core.ImageInfo{
+		{OS: runtime.GOOS, Architecture: otherArch, Labels: valid.Labels},
+		{OS: runtime.GOOS, Architecture: runtime.GOARCH, Labels: map[string]string{"org.vanillaos.abroot.compat": "2"}},
+		{OS: runtime.GOOS, Architecture: runtime.GOARCH, Labels: map[string]string{"org.vanillaos.abroot": "true", "org.vanillaos.abroot.compat": "1"}},
+	}
+	for i, info := range invalid {
+		err := core.CheckImageCompatibility("invalid", info)
+		var incompatibleErr *core.ImageIncompatibleError
+		if !errors.As(err, &incompatibleErr) {
+			t.Fatalf("case %d: expected an ImageIncompatibleError, got %v", i, err)
+		}
+	}
+
+	t.Log("TestCheckImageCompatibility: done")
+}
@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+	"go.podman.io/image/v5/types"
+)
+
+// TestGetImageSources tests the GetImageSources function by configuring a
+// mirror for a namespace of a registry and checking the resulting order.
+func TestGetImageSources(t *testing.T) {
+	settings.Cnf.Registries = []settings.RegistryConf{
+		{Registry: "ghcr.io/vanilla-os", Mirrors: []string{"harbor.local/ghcr"}},
+		{Registry: "harbor.local", Insecure: true},
+	}
+	defer func() { settings.Cnf.Registries = nil }()
+
+	sources, err := core.GetImageSources("ghcr.io/vanilla-os/desktop:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 sources, got %d", len(sources))
+	}
+
+	if sources[0].ImageName != "harbor.local/ghcr/desktop:main" || sources[0].SystemContext.DockerInsecureSkipTLSVerify != types.OptionalBoolTrue {
+		t.Fatalf("unexpected mirror source: %+v", sources[0])
+	}
+
+	if sources[1].ImageName != "ghcr.io/vanilla-os/desktop:main" || sources[1].SystemContext.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue {
+		t.Fatalf("unexpected registry source: %+v", sources[1])
+	}
+
+	// other namespaces of the same registry must not use the mirror
+	sources, err = core.GetImageSources("ghcr.io/vanilla-os-extra/desktop:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("expected 1 source, got %d", len(sources))
+	}
+
+	t.Log("TestGetImageSources: done")
+}
+
+// TestPullManifestMirrorFallback tests the PullManifest function against a
+// local registry, reached through an insecure mirror after an unreachable
+// one.
+func TestPullManifestMirrorFallback(t *testing.T) {
+	manifest := `{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+			"size": 2
+		},
+		"layers": []
+	}`
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/vanilla-os/desktop/manifests/main":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(manifest))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+	settings.Cnf.Registries = []settings.RegistryConf{
+		{Registry: "registry.invalid", Mirrors: []string{"127.0.0.1:1", registryHost}},
+		{Registry: "127.0.0.1", Insecure: true},
+	}
+	defer func() { settings.Cnf.Registries = nil }()
+
+	_, platformImage, err := core.PullManifest("registry.invalid/vanilla-os/desktop:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if platformImage.Digest != digest.FromString(manifest) {
+		t.Fatalf("unexpected digest %s", platformImage.Digest)
+	}
+
+	t.Log("TestPullManifestMirrorFallback: done")
+}
+
+// TestPullManifestPlatform tests the PullManifest function against a local
+// registry serving a multi-platform index, then checks that a rebuilt index
+// with the same platform manifest is not considered an update.
+func TestPullManifestPlatform(t *testing.T) {
+	platformManifest := func(arch string) string {
+		return `{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest": "` + digest.FromString(arch).String() + `",
+			"size": 2
+		},
+		"layers": []
+	}`
+	}
+
+	manifests := map[string]string{}
+	index := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [`
+	for i, arch := range []string{"amd64", "arm64"} {
+		m := platformManifest(arch)
+		manifests[digest.FromString(m).String()] = m
+		if i > 0 {
+			index += ","
+		}
+		index += `{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "` + digest.FromString(m).String() + `", "size": ` + strconv.Itoa(len(m)) + `, "platform": {"os": "linux", "architecture": "` + arch + `"}}`
+	}
+	index += `]}`
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimPrefix(r.URL.Path, "/v2/vanilla-os/desktop/manifests/")
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case ref == "main":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Write([]byte(index))
+		case manifests[ref] != "":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(manifests[ref]))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+	settings.Cnf.Registries = []settings.RegistryConf{{Registry: registryHost, Insecure: true}}
+	defer func() { settings.Cnf.Registries = nil }()
+
+	_, platformImage, err := core.PullManifest(registryHost + "/vanilla-os/desktop:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if platformImage.IndexDigest != digest.FromString(index) {
+		t.Fatalf("unexpected index digest %s", platformImage.IndexDigest)
+	}
+	if platformImage.Digest != digest.FromString(platformManifest(runtime.GOARCH)) {
+		t.Fatalf("unexpected platform digest %s", platformImage.Digest)
+	}
+	if platformImage.Platform != "linux/"+runtime.GOARCH {
+		t.Fatalf("unexpected platform %s", platformImage.Platform)
+	}
+
+	// the index was rebuilt, but not the manifest of this platform
+	current := &core.ABImage{Digest: platformImage.Digest, IndexDigest: "sha256:0000"}
+	if !current.IsSameImage(platformImage) {
+		t.Fatal("a new index with the same platform manifest must not be an update")
+	}
+
+	// records written before platform digests were tracked hold the index
+	legacy := &core.ABImage{Digest: platformImage.IndexDigest}
+	if !legacy.IsSameImage(platformImage) {
+		t.Fatal("a legacy record of the same index must not be an update")
+	}
+
+	current = &core.ABImage{Digest: "sha256:0000", IndexDigest: platformImage.IndexDigest}
+	if current.IsSameImage(platformImage) {
+		t.Fatal("a different platform manifest must be an update")
+	}
+
+	t.Log("TestPullManifestPlatform: done")
+}
@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestSpaceReport tests the SpaceReport type by checking a report where the
+// future root is too small.
+func TestSpaceReport(t *testing.T) {
+	report := &core.SpaceReport{
+		Image: "ghcr.io/vanilla-os/desktop:main",
+		Requirements: []core.SpaceRequirement{
+			{Name: "storage", Path: "/var/lib/abroot/storage", Required: 1000, Available: 5000},
+			{Name: "future root", Path: "/part-future", Required: 3000, Available: 2000},
+		},
+	}
+
+	if report.Satisfied() {
+		t.Fatal("expected the report not to be satisfied")
+	}
+
+	if !report.Requirements[0].Satisfied() {
+		t.Fatal("expected the storage requirement to be satisfied")
+	}
+
+	err := &core.NotEnoughSpaceError{Report: report}
+	if !strings.Contains(err.Error(), "future root (/part-future): 3.0 kB required, 2.0 kB available, missing 1.0 kB") {
+		t.Fatalf("unexpected error message: %s", err.Error())
+	}
+
+	t.Log("TestSpaceReport: done")
+}
+
+// TestPartitionsAvailableSpace tests that the space available in a root on
+// a partition counts its free and used space, but not the reserved one.
+func TestPartitionsAvailableSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	available, err := (&core.PartitionsBackend{}).AvailableSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(dir, &stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available < stat.Bavail*uint64(stat.Bsize) || available > stat.Blocks*uint64(stat.Bsize) {
+		t.Fatalf("expected between the free space and the size of the filesystem, got %d", available)
+	}
+
+	t.Log("TestPartitionsAvailableSpace: done")
+}
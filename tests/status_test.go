@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// TestPartitionUsage tests the Usage function by measuring the filesystem
+// of a temporary directory, as if a partition of the first block device
+// with a size was mounted there.
+func TestPartitionUsage(t *testing.T) {
+	device, sectors := "", uint64(0)
+	entries, _ := os.ReadDir("/sys/class/block")
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("/sys/class/block", entry.Name(), "size"))
+		if err != nil {
+			continue
+		}
+		sectors, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if _, err := os.Stat("/dev/" + entry.Name()); err == nil && sectors > 0 {
+			device = entry.Name()
+			break
+		}
+	}
+	if device == "" {
+		t.Skip("no block device to measure")
+	}
+
+	part := core.Partition{
+		Label:      "vos-test",
+		Device:     device,
+		FsType:     "ext4",
+		MountPoint: t.TempDir(),
+	}
+
+	usage, err := part.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Label != "vos-test" || usage.Device != device || usage.FsType != "ext4" {
+		t.Fatalf("unexpected partition details: %+v", usage)
+	}
+	if usage.Size != sectors*512 {
+		t.Fatalf("expected the size of the device, got %+v", usage)
+	}
+	if !usage.Known || usage.Free == 0 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	// a device missing from sysfs has no size to report
+	part.Device = "sdz1"
+	_, err = part.Usage()
+	if err == nil {
+		t.Fatal("expected a missing device to be reported")
+	}
+
+	t.Log("TestPartitionUsage: done")
+}
+
+// TestGetVarEncryptionState tests the GetVarEncryptionState function with
+// a plain, an unlocked and a locked /var partition.
+func TestGetVarEncryptionState(t *testing.T) {
+	oldCryptVar := settings.Cnf.PartCryptVar
+	defer func() {
+		settings.Cnf.PartCryptVar = oldCryptVar
+	}()
+	settings.Cnf.PartCryptVar = "/dev/mapper/vos--var-var"
+
+	state := core.GetVarEncryptionState(core.Partition{Device: "sda3", FsType: "btrfs"})
+	if state.Encrypted {
+		t.Fatalf("expected a plain partition not to be encrypted, got %+v", state)
+	}
+
+	// LVM volume holding a LUKS device holding the filesystem
+	lv := &core.Partition{Device: "vos--var-var", FsType: "crypto_LUKS", Parent: &core.Partition{Device: "sda3", FsType: "LVM2_member"}}
+	state = core.GetVarEncryptionState(core.Partition{Device: "luks-1234", FsType: "btrfs", Parent: lv})
+	if !state.Encrypted || !state.Unlocked || state.Device != "/dev/mapper/vos--var-var" {
+		t.Fatalf("expected an unlocked encrypted partition, got %+v", state)
+	}
+
+	state = core.GetVarEncryptionState(core.Partition{})
+	if !state.Encrypted || state.Unlocked || state.Device != settings.Cnf.PartCryptVar {
+		t.Fatalf("expected a locked encrypted partition, got %+v", state)
+	}
+
+	t.Log("TestGetVarEncryptionState: done")
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+const gib = 1024 * 1024 * 1024
+
+// TestProposeStorage tests the sizes proposed for roots on partitions and
+// on logical volumes sharing their volume group with /var.
+func TestProposeStorage(t *testing.T) {
+	plan := &core.StoragePlan{
+		ImageSize: 8 * gib,
+		Volumes: []core.StorageVolume{
+			{Label: "vos-a", Role: "present", Kind: core.STORAGE_VOLUME_PARTITION, Group: "vda", Size: 12 * gib, Used: 7 * gib},
+			{Label: "vos-b", Role: "future", Kind: core.STORAGE_VOLUME_PARTITION, Group: "vda", Size: 8 * gib, Available: 1 * gib},
+			{Label: "vos-var", Role: "var", Kind: core.STORAGE_VOLUME_PARTITION, Group: "vda", Size: 100 * gib, Used: 10 * gib},
+		},
+	}
+	core.ProposeStorage(plan)
+
+	if plan.RootSize != 10*gib {
+		t.Fatal("expected the roots to be proposed 10 GiB, got", plan.RootSize)
+	}
+	if plan.Volume("present").Proposed != 12*gib {
+		t.Fatal("expected a large enough root to be kept as is")
+	}
+	if plan.Volume("var").Proposed != 100*gib {
+		t.Fatal("expected a /var partition to be kept as is")
+	}
+	future := plan.Volume("future")
+	if future.Proposed != 10*gib || future.Note == "" || plan.Feasible {
+		t.Fatalf("expected the future root to lack unallocated space: %+v", future)
+	}
+
+	plan = &core.StoragePlan{
+		ImageSize: 8 * gib,
+		Volumes: []core.StorageVolume{
+			{Label: "vos-a", Role: "present", Kind: core.STORAGE_VOLUME_LVM, Group: "vos", Size: 8 * gib, Available: 1 * gib},
+			{Label: "vos-b", Role: "future", Kind: core.STORAGE_VOLUME_LVM, Group: "vos", Size: 8 * gib, Available: 1 * gib},
+			{Label: "vos-var", Role: "var", Kind: core.STORAGE_VOLUME_LVM, Group: "vos", FsType: "btrfs", Size: 100 * gib, Used: 10 * gib},
+		},
+	}
+	core.ProposeStorage(plan)
+
+	if !plan.Feasible {
+		t.Fatalf("expected the plan to be feasible: %s", plan)
+	}
+	if plan.Volume("present").Proposed != 10*gib || plan.Volume("future").Proposed != 10*gib {
+		t.Fatalf("expected both roots to be grown: %s", plan)
+	}
+	if plan.Volume("var").Proposed != 97*gib {
+		t.Fatal("expected /var to give the missing 3 GiB, got", plan.Volume("var").Proposed)
+	}
+
+	// /var only has 3 GiB to spare above its used space plus 5 GiB
+	plan.Volumes[2].Size = 18 * gib
+	plan.Volumes[0].Available = 0
+	plan.Volumes[1].Available = 0
+	core.ProposeStorage(plan)
+
+	if plan.Feasible || plan.Volume("var").Proposed != 15*gib {
+		t.Fatalf("expected /var to be shrunk as much as possible and the plan to be unfeasible: %s", plan)
+	}
+
+	// ext4 can only be shrunk unmounted, during the next boot
+	plan.Volumes[2].Size = 100 * gib
+	plan.Volumes[2].FsType = "ext4"
+	core.ProposeStorage(plan)
+
+	if !plan.Feasible || plan.Volume("var").Proposed != 96*gib || plan.Volume("var").Note == "" {
+		t.Fatalf("expected an ext4 /var to be shrunk during the next boot: %s", plan)
+	}
+
+	plan.Volumes[2].FsType = "xfs"
+	core.ProposeStorage(plan)
+
+	if plan.Feasible || plan.Volume("var").Proposed != 100*gib || !strings.Contains(plan.Volume("present").Note, "unsupported layout") {
+		t.Fatalf("expected an xfs /var to be reported as unsupported: %s", plan)
+	}
+
+	// the future root is followed by /var, which is moved to make room
+	plan = &core.StoragePlan{
+		ImageSize: 8 * gib,
+		Volumes: []core.StorageVolume{
+			{Label: "vos-a", Role: "present", Kind: core.STORAGE_VOLUME_PARTITION, Group: "vda", Start: 1 * gib, Size: 12 * gib},
+			{Label: "vos-b", Role: "future", Kind: core.STORAGE_VOLUME_PARTITION, Group: "vda", Start: 13 * gib, Size: 8 * gib},
+			{Label: "vos-var", Role: "var", Kind: core.STORAGE_VOLUME_PARTITION, Group: "vda", FsType: "ext4", Start: 21 * gib, Size: 100 * gib, Used: 10 * gib},
+		},
+	}
+	core.ProposeStorage(plan)
+
+	if !plan.Feasible || plan.Volume("future").Proposed != 10*gib || plan.Volume("var").Proposed != 98*gib {
+		t.Fatalf("expected /var to give 2 GiB to the future root: %s", plan)
+	}
+	if plan.Volume("var").Note == "" {
+		t.Fatal("expected the shrink of a /var partition to be done during the next boot")
+	}
+
+	// the present root is not followed by /var
+	plan.Volumes[0].Size = 8 * gib
+	core.ProposeStorage(plan)
+
+	if plan.Feasible || !strings.Contains(plan.Volume("present").Note, "unsupported layout") {
+		t.Fatalf("expected the present root to lack unallocated space: %s", plan)
+	}
+
+	t.Log("TestProposeStorage: done")
+}
+
+// TestReadVarShrinkSchedule tests the validation of the schedule of an
+// offline shrink of /var.
+func TestReadVarShrinkSchedule(t *testing.T) {
+	schedule := filepath.Join(t.TempDir(), "var-shrink.json")
+
+	_, err := core.ReadVarShrinkSchedule(schedule)
+	if !os.IsNotExist(err) {
+		t.Fatal("expected a missing schedule to be reported as such, got", err)
+	}
+
+	err = os.WriteFile(schedule, []byte(`{"device": "/dev/vda4", "fsType": "ext4", "kind": "partition", "size": 105226698752}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = core.ReadVarShrinkSchedule(schedule)
+	if err == nil {
+		t.Fatal("expected a partition without its disk and start to be refused")
+	}
+
+	err = os.WriteFile(schedule, []byte(`{"device": "/dev/vda4", "fsType": "ext4", "kind": "partition", "disk": "vda", "partition": 4, "start": 24696061952, "size": 105226698752}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := core.ReadVarShrinkSchedule(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Disk != "vda" || plan.Partition != 4 || plan.Size != 98*gib {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+
+	t.Log("TestReadVarShrinkSchedule: done")
+}
+
+// TestGetPartitionGap tests the GetPartitionGap function with a fake
+// /sys/block.
+func TestGetPartitionGap(t *testing.T) {
+	sysBlock := t.TempDir()
+	files := map[string]string{
+		"vda/size":       "40896512",
+		"vda/vda1/start": "2048",
+		"vda/vda1/size":  "1048576",
+		"vda/vda2/start": "1050624",
+		"vda/vda2/size":  "16777216",
+		"vda/vda3/start": "19924992",
+		"vda/vda3/size":  "16777216",
+		"loop0/size":     "1024",
+	}
+	for file, content := range files {
+		err := os.MkdirAll(filepath.Join(sysBlock, filepath.Dir(file)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(sysBlock, file), []byte(content+"\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	disk, gap, err := core.GetPartitionGap(sysBlock, "vda2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk != "vda" || gap != 1*gib {
+		t.Fatalf("expected 1 GiB free after vda2 on vda, got %d on %s", gap, disk)
+	}
+
+	// the last 1 MiB of the disk holds the backup GPT
+	_, gap, err = core.GetPartitionGap(sysBlock, "vda3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gap != 2*gib-1024*1024 {
+		t.Fatal("unexpected space after the last partition:", gap)
+	}
+
+	_, _, err = core.GetPartitionGap(sysBlock, "vdb1")
+	if err == nil {
+		t.Fatal("expected a missing partition to fail")
+	}
+
+	t.Log("TestGetPartitionGap: done")
+}
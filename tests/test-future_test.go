@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestFutureNspawnArgs tests the arguments given to systemd-nspawn to boot
+// the future root and to run a command in it.
+func TestFutureNspawnArgs(t *testing.T) {
+	args := core.FutureNspawnArgs("/run/root", true)
+	if !slices.Contains(args, "--private-network") || !slices.Contains(args, "--directory=/run/root") {
+		t.Fatal("expected the container to have its own network:", args)
+	}
+	if slices.Contains(args, "--boot") || args[len(args)-1] != core.SystemdPath || args[len(args)-2] != "--" {
+		t.Fatal("expected systemd to be run instead of /sbin/init:", args)
+	}
+
+	args = core.FutureNspawnArgs("/run/root", false, "/bin/sh", "-c", "true")
+	if slices.Contains(args, "--private-network") {
+		t.Fatal("expected commands to keep the network:", args)
+	}
+	if !slices.Equal(args[len(args)-4:], []string{"--", "/bin/sh", "-c", "true"}) {
+		t.Fatal("expected the command to follow the options:", args)
+	}
+
+	args = core.FutureNspawnArgs("/run/root", false)
+	if slices.Contains(args, "--") {
+		t.Fatal("expected no command for a shell:", args)
+	}
+
+	t.Log("TestFutureNspawnArgs: done")
+}
+
+// mountsBelow returns the mount points below dir
+func mountsBelow(t *testing.T, dir string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && (fields[4] == dir || strings.HasPrefix(fields[4], dir+"/")) {
+			mounts = append(mounts, fields[4])
+		}
+	}
+	return mounts
+}
+
+// TestAssembleFutureTestEnv tests that the copy of the future root discards
+// the changes made in it, and that everything is unmounted when assembling
+// it fails, in a private mount namespace.
+func TestAssembleFutureTestEnv(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	// the namespace belongs to this thread, which is dropped when the test
+	// ends since it is never unlocked
+	runtime.LockOSThread()
+	err := syscall.Unshare(syscall.CLONE_NEWNS)
+	if err != nil {
+		t.Skip("mount namespaces are not available:", err)
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		t.Skip("mount namespaces are not available:", err)
+	}
+
+	futureRoot := t.TempDir()
+	dir := filepath.Join(t.TempDir(), "test-future")
+
+	// without /etc in the future root, the last overlay can't be mounted
+	_, err = core.AssembleFutureTestEnv(dir, futureRoot, "")
+	if err == nil {
+		t.Fatal("expected assembling a root without /etc to fail")
+	}
+	if mounts := mountsBelow(t, dir); len(mounts) > 0 {
+		t.Fatal("expected the failed assembly to be undone, got", mounts)
+	}
+
+	err = os.MkdirAll(filepath.Join(futureRoot, "etc"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userEtc := t.TempDir()
+	err = os.WriteFile(filepath.Join(userEtc, "hostname"), []byte("vanilla\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := core.AssembleFutureTestEnv(dir, futureRoot, userEtc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(env.Root, "etc/hostname")); err != nil {
+		t.Fatal("expected the user changes to /etc to be applied:", err)
+	}
+	err = os.WriteFile(filepath.Join(env.Root, "etc/hostname"), []byte("changed\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(env.Root, "file"), []byte("file\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounts := mountsBelow(t, dir); len(mounts) > 0 {
+		t.Fatal("expected everything to be unmounted, got", mounts)
+	}
+
+	if _, err := os.Stat(filepath.Join(futureRoot, "file")); err == nil {
+		t.Fatal("expected the future root to be left untouched")
+	}
+	hostname, err := os.ReadFile(filepath.Join(userEtc, "hostname"))
+	if err != nil || string(hostname) != "vanilla\n" {
+		t.Fatal("expected the user changes to /etc to be left untouched:", string(hostname), err)
+	}
+
+	t.Log("TestAssembleFutureTestEnv: done")
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// TestThinPoolUsageCheck tests the ThinPoolUsage.Check function by checking
+// pools with enough and not enough free data and metadata space.
+func TestThinPoolUsageCheck(t *testing.T) {
+	oldMinFree := settings.Cnf.ThinPoolMinFreePercent
+	settings.Cnf.ThinPoolMinFreePercent = 10
+	defer func() { settings.Cnf.ThinPoolMinFreePercent = oldMinFree }()
+
+	usage := core.ThinPoolUsage{VgName: "vos-root", PoolName: "root", DataPercent: 45.5, MetadataPercent: 12}
+	if err := usage.Check(); err != nil {
+		t.Fatalf("expected %+v to be accepted: %v", usage, err)
+	}
+
+	for _, usage := range []core.ThinPoolUsage{
+		{VgName: "vos-root", PoolName: "root", DataPercent: 91, MetadataPercent: 12},
+		{VgName: "vos-root", PoolName: "root", DataPercent: 45.5, MetadataPercent: 90.01},
+	} {
+		err := usage.Check()
+		if _, ok := err.(*core.ThinPoolFullError); !ok {
+			t.Fatalf("expected %+v to be refused, got %v", usage, err)
+		}
+	}
+
+	t.Log("TestThinPoolUsageCheck: done")
+}
+
+// TestParseLvsReport tests the ParseLvsReport function with reports of thin
+// pools, thin volumes and plain volumes.
+func TestParseLvsReport(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		report   string
+		expected []core.LogicalVolume
+		fails    bool
+	}{
+		{
+			name: "pool and thin volume",
+			report: `{"report": [{"lv": [
+				{"vg_name": "vos-root", "lv_name": "root", "lv_dm_path": "/dev/mapper/vos--root-root", "pool_lv": "", "lv_size": "53687091200", "data_percent": "45.50", "metadata_percent": "12.01"},
+				{"vg_name": "vos-root", "lv_name": "vos-a", "lv_dm_path": "/dev/mapper/vos--root-vos--a", "pool_lv": "root", "lv_size": "21474836480", "data_percent": "30.00", "metadata_percent": ""}
+			]}]}`,
+			expected: []core.LogicalVolume{
+				{VgName: "vos-root", LvName: "root", DmPath: "/dev/mapper/vos--root-root", Size: 53687091200, DataPercent: 45.5, MetadataPercent: 12.01},
+				{VgName: "vos-root", LvName: "vos-a", DmPath: "/dev/mapper/vos--root-vos--a", PoolLv: "root", Size: 21474836480, DataPercent: 30},
+			},
+		},
+		{
+			name: "plain volume without usage",
+			report: `{"report": [{"lv": [
+				{"vg_name": "vos", "lv_name": "var", "lv_dm_path": "/dev/mapper/vos-var", "pool_lv": "", "lv_size": "107374182400", "data_percent": "", "metadata_percent": ""}
+			]}]}`,
+			expected: []core.LogicalVolume{
+				{VgName: "vos", LvName: "var", DmPath: "/dev/mapper/vos-var", Size: 107374182400},
+			},
+		},
+		{
+			name:     "no volumes",
+			report:   `{"report": [{"lv": []}]}`,
+			expected: []core.LogicalVolume{},
+		},
+		{
+			name:   "invalid report",
+			report: `lvs: command failed`,
+			fails:  true,
+		},
+	} {
+		lvs, err := core.ParseLvsReport([]byte(test.report))
+		if test.fails {
+			if err == nil {
+				t.Fatalf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !slices.Equal(lvs, test.expected) {
+			t.Fatalf("%s: expected %+v, got %+v", test.name, test.expected, lvs)
+		}
+	}
+
+	t.Log("TestParseLvsReport: done")
+}
+
+// TestRelabelCmds tests the commands changing the label and the UUID of a
+// snapshotted filesystem.
+func TestRelabelCmds(t *testing.T) {
+	for _, test := range []struct {
+		fsType   string
+		expected [][]string
+	}{
+		{"ext4", [][]string{
+			{"e2fsck", "-f", "-y", "/dev/vos/vos-b"},
+			{"tune2fs", "-U", "random", "-L", "vos-b", "/dev/vos/vos-b"},
+		}},
+		{"xfs", [][]string{{"xfs_admin", "-U", "generate", "-L", "vos-b", "/dev/vos/vos-b"}}},
+		{"btrfs", [][]string{
+			{"btrfstune", "-f", "-u", "/dev/vos/vos-b"},
+			{"btrfs", "filesystem", "label", "/dev/vos/vos-b", "vos-b"},
+		}},
+		{"ext3", [][]string{{"e2label", "/dev/vos/vos-b", "vos-b"}}},
+	} {
+		cmds := core.RelabelCmds(test.fsType, "/dev/vos/vos-b", "vos-b")
+		if !slices.EqualFunc(cmds, test.expected, slices.Equal[[]string]) {
+			t.Fatalf("%s: expected %v, got %v", test.fsType, test.expected, cmds)
+		}
+	}
+
+	t.Log("TestRelabelCmds: done")
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// TestParseLuksKeyslots tests the ParseLuksKeyslots function with the
+// metadata of a device having a passphrase, a TPM2 and a FIDO2 keyslot.
+func TestParseLuksKeyslots(t *testing.T) {
+	metadata := `{
+		"keyslots": {
+			"0": {"type": "luks2"},
+			"1": {"type": "luks2"},
+			"2": {"type": "luks2"},
+			"10": {"type": "luks2"}
+		},
+		"tokens": {
+			"0": {"type": "systemd-tpm2", "keyslots": ["1"], "tpm2-pcrs": [7, 9]},
+			"1": {"type": "systemd-fido2", "keyslots": ["2"]},
+			"2": {"type": "systemd-recovery", "keyslots": ["10"]}
+		}
+	}`
+
+	keyslots, err := core.ParseLuksKeyslots([]byte(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []core.LuksKeyslot{
+		{Slot: 0, Type: core.KEYSLOT_PASSPHRASE},
+		{Slot: 1, Type: core.KEYSLOT_TPM2, Pcrs: []int{7, 9}},
+		{Slot: 2, Type: core.KEYSLOT_FIDO2},
+		{Slot: 10, Type: core.KEYSLOT_RECOVERY_KEY},
+	}
+	if len(keyslots) != len(expected) {
+		t.Fatalf("expected %d keyslots, got %+v", len(expected), keyslots)
+	}
+	for i, keyslot := range keyslots {
+		if keyslot.Slot != expected[i].Slot || keyslot.Type != expected[i].Type ||
+			core.FormatPcrs(keyslot.Pcrs) != core.FormatPcrs(expected[i].Pcrs) {
+			t.Fatalf("expected %+v, got %+v", expected[i], keyslot)
+		}
+	}
+
+	t.Log("TestParseLuksKeyslots: done")
+}
+
+// TestPcrs tests parsing PCRs and leaving out the ones measuring the boot
+// chain.
+func TestPcrs(t *testing.T) {
+	pcrs, err := core.ParsePcrs("7+9,11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core.FormatPcrs(pcrs) != "7+9+11" {
+		t.Fatalf("unexpected PCRs: %v", pcrs)
+	}
+
+	if stable := core.FormatPcrs(core.StablePcrs(pcrs)); stable != "7" {
+		t.Fatalf("expected only PCR 7 to be stable, got %s", stable)
+	}
+
+	_, err = core.ParsePcrs("7+24")
+	if err == nil {
+		t.Fatal("expected an invalid PCR to be rejected")
+	}
+
+	t.Log("TestPcrs: done")
+}
+
+// TestLuksReencryptionInProgress tests detecting an unfinished encryption
+// from the metadata of a LUKS2 device, and that its keyslot is not listed.
+func TestLuksReencryptionInProgress(t *testing.T) {
+	metadata := []byte(`{
+		"keyslots": {
+			"0": {"type": "luks2"},
+			"1": {"type": "reencrypt", "mode": "encrypt"}
+		},
+		"tokens": {}
+	}`)
+
+	inProgress, err := core.LuksReencryptionInProgress(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inProgress {
+		t.Fatal("expected the encryption to be in progress")
+	}
+
+	keyslots, err := core.ParseLuksKeyslots(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyslots) != 1 || keyslots[0].Type != core.KEYSLOT_PASSPHRASE {
+		t.Fatalf("expected only the passphrase keyslot, got %+v", keyslots)
+	}
+
+	inProgress, err = core.LuksReencryptionInProgress([]byte(`{"keyslots": {"0": {"type": "luks2"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inProgress {
+		t.Fatal("expected no encryption to be in progress")
+	}
+
+	t.Log("TestLuksReencryptionInProgress: done")
+}
+
+// TestReadVarEncryptionSchedule tests reading a valid and an incomplete
+// encryption schedule.
+func TestReadVarEncryptionSchedule(t *testing.T) {
+	dir := t.TempDir()
+
+	schedule := filepath.Join(dir, "var-encryption.json")
+	err := os.WriteFile(schedule, []byte(`{"device": "/dev/sda3", "uuid": "1234", "fsType": "ext4",
+		"deviceSize": 1073741824, "fsSize": 1040187392, "mapperName": "luks-1234"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := core.ReadVarEncryptionSchedule(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Device != "/dev/sda3" || plan.FsSize != plan.DeviceSize-core.VarEncryptionHeaderSize {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+	// the schedule reused the UUID of the filesystem for the LUKS2 device
+	if plan.LuksUuid == "" || plan.LuksUuid == plan.Uuid || plan.MapperName != "luks-"+plan.LuksUuid {
+		t.Fatalf("expected the LUKS2 device to get its own UUID: %+v", plan)
+	}
+
+	err = os.WriteFile(schedule, []byte(`{"device": "/dev/sda3"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = core.ReadVarEncryptionSchedule(schedule)
+	if err == nil {
+		t.Fatal("expected an incomplete schedule to be rejected")
+	}
+
+	t.Log("TestReadVarEncryptionSchedule: done")
+}
+
+// TestUpdateTabsForEncryptedVar tests recording the encrypted /var in the
+// crypttab and the fstab.
+func TestUpdateTabsForEncryptedVar(t *testing.T) {
+	plan := &core.VarEncryptionPlan{
+		Device:     "/dev/sda3",
+		Uuid:       "1234",
+		LuksUuid:   "5678",
+		MapperName: "luks-5678",
+	}
+
+	crypttab := "# <name> <device> <password> <options>\nswap /dev/sda4 /dev/urandom swap\nluks-1234 UUID=1234 none luks\n"
+	expected := "# <name> <device> <password> <options>\nswap /dev/sda4 /dev/urandom swap\nluks-5678 UUID=5678 none luks,noauto\n"
+	if updated := core.UpdateCrypttabForEncryptedVar(crypttab, plan); updated != expected {
+		t.Fatalf("unexpected crypttab:\n%s", updated)
+	}
+	if updated := core.UpdateCrypttabForEncryptedVar("", plan); updated != "luks-5678 UUID=5678 none luks,noauto\n" {
+		t.Fatalf("expected an entry to be added to an empty crypttab:\n%s", updated)
+	}
+
+	fstab := "UUID=1234 /var/data ext4 subvol=data 0 0\n/dev/sda3 /srv ext4 defaults 0 0\n/dev/sda30 /mnt ext4 defaults 0 0\n"
+	expected = "UUID=1234 /var/data ext4 subvol=data 0 0\n/dev/mapper/luks-5678 /srv ext4 defaults 0 0\n/dev/sda30 /mnt ext4 defaults 0 0\n"
+	if updated := core.UpdateFstabForEncryptedVar(fstab, plan); updated != expected {
+		t.Fatalf("unexpected fstab:\n%s", updated)
+	}
+
+	t.Log("TestUpdateTabsForEncryptedVar: done")
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/vanilla-os/abroot/core"
+)
+
+// writeTestRoot writes a small root with a file, a symlink and a directory
+func writeTestRoot(t *testing.T, root string) {
+	t.Helper()
+
+	for file, content := range map[string]string{
+		"usr/bin/abroot":     "binary",
+		"usr/lib/os-release": "NAME=Vanilla OS\n",
+		"etc/hostname":       "vanilla\n",
+	} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, file), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.Symlink("../usr/lib/os-release", filepath.Join(root, "etc/os-release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestVerifyRootManifest tests that the modified, missing and extra files of
+// a root are reported, and that the records of ABRoot are ignored.
+func TestVerifyRootManifest(t *testing.T) {
+	root := t.TempDir()
+	writeTestRoot(t, root)
+
+	expected, err := core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 8 {
+		t.Fatalf("expected 8 entries, got %+v", expected)
+	}
+
+	actual, err := core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !core.CompareRootManifests(expected, actual).Clean() {
+		t.Fatal("expected an unchanged root to be clean")
+	}
+
+	err = os.WriteFile(filepath.Join(root, "usr/bin/abroot"), []byte("tampered"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(filepath.Join(root, "etc/hostname"), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(root, "etc/os-release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "usr/bin/extra"), []byte("extra"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "abroot-layers.abr"), []byte("[]"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err = core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := core.CompareRootManifests(expected, actual)
+
+	if !slices.Equal(report.Modified, []string{"etc/hostname", "usr/bin/abroot"}) {
+		t.Fatal("unexpected modified files:", report.Modified)
+	}
+	if !slices.Equal(report.Missing, []string{"etc/os-release"}) {
+		t.Fatal("unexpected missing files:", report.Missing)
+	}
+	if !slices.Equal(report.Extra, []string{"usr/bin/extra"}) {
+		t.Fatal("unexpected extra files:", report.Extra)
+	}
+
+	t.Log("TestVerifyRootManifest: done")
+}
+
+// TestRepairRoot tests that a root is restored from its image, except for
+// the files the image has a different version of.
+func TestRepairRoot(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync is required to repair a root")
+	}
+	if err := os.MkdirAll("/run/abroot/verify", 0o755); err != nil {
+		t.Skip("the verify directory can't be created:", err)
+	}
+
+	image := t.TempDir()
+	writeTestRoot(t, image)
+
+	root := t.TempDir()
+	writeTestRoot(t, root)
+
+	// written at deploy time, so it differs from the image
+	err := os.WriteFile(filepath.Join(root, "etc/hostname"), []byte("deployed\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, content := range map[string]string{
+		"usr/bin/abroot": "tampered",
+		"etc/hostname":   "tampered\n",
+		"usr/bin/extra":  "extra",
+	} {
+		err = os.WriteFile(filepath.Join(root, file), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Remove(filepath.Join(root, "usr/lib/os-release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := core.CompareRootManifests(expected, actual)
+
+	err = core.RepairRoot(root, image, expected, report, core.RepairOptions{RemoveExtra: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Unrepairable, []string{"etc/hostname"}) {
+		t.Fatal("unexpected unrepairable files:", report.Unrepairable)
+	}
+
+	actual, err = core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = core.CompareRootManifests(expected, actual)
+	if len(report.Missing) != 0 || len(report.Extra) != 0 || !slices.Equal(report.Modified, []string{"etc/hostname"}) {
+		t.Fatalf("expected the root to be restored but for etc/hostname: %+v", report)
+	}
+
+	t.Log("TestRepairRoot: done")
+}
+
+// TestRepairRootExtra tests that the extra files are only removed when
+// asked to, and that mount points and their parents are always kept.
+func TestRepairRootExtra(t *testing.T) {
+	root := t.TempDir()
+	writeTestRoot(t, root)
+
+	expected, err := core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"mnt/data", "opt/extra"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actual, err := core.GenerateRootManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := core.CompareRootManifests(expected, actual)
+
+	// nothing is restored, so the image is not needed
+	err = core.RepairRoot(root, "", expected, report, core.RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.KeptExtra, report.Extra) {
+		t.Fatal("expected the extra files to be kept:", report.KeptExtra)
+	}
+
+	report = core.CompareRootManifests(expected, actual)
+	err = core.RepairRoot(root, "", expected, report, core.RepairOptions{
+		RemoveExtra: true,
+		MountPoints: []string{"mnt/data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.KeptExtra, []string{"mnt", "mnt/data"}) {
+		t.Fatal("expected the mount point and its parent to be kept:", report.KeptExtra)
+	}
+	if _, err := os.Stat(filepath.Join(root, "opt")); err == nil {
+		t.Fatal("expected the other extra files to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "mnt/data")); err != nil {
+		t.Fatal("expected the mount point to be kept:", err)
+	}
+
+	t.Log("TestRepairRootExtra: done")
+}